@@ -3,10 +3,14 @@ package api
 import (
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"net/url"
 	"os"
+	"slices"
 	"strconv"
+	"strings"
 	"time"
 	"xkeen-panel/internal/geoip"
 	"xkeen-panel/internal/mihomo"
@@ -39,32 +43,146 @@ func (h *Handlers) HandleStatus(w http.ResponseWriter, r *http.Request) {
 // HandleGetSubscription — GET /api/subscription
 func (h *Handlers) HandleGetSubscription(w http.ResponseWriter, r *http.Request) {
 	data := h.subscription.GetData()
+
+	// url is the primary subscription — what the single-URL form edits
+	primary := ""
+	if len(data.Subscriptions) > 0 {
+		primary = data.Subscriptions[0].URL
+	}
+
+	// Every provider's last download accounts for its own servers
+	reports := make(map[string]*models.ParseReport, len(data.Subscriptions))
+	for _, sub := range data.Subscriptions {
+		if sub.Report != nil {
+			reports[sub.Name] = sub.Report
+		}
+	}
+
 	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"url":          data.URL,
-		"last_updated": data.LastUpdated,
-		"server_count": len(data.Servers),
+		"url":           primary,
+		"report":        reports,
+		"last_updated":  data.LastUpdated,
+		"server_count":  len(data.Servers),
+		"subscriptions": subscriptionViews(data),
+		"manual":        data.Manual,
 	})
 }
 
-// HandleUpdateSubscription — POST /api/subscription
-func (h *Handlers) HandleUpdateSubscription(w http.ResponseWriter, r *http.Request) {
-	var req models.UpdateSubscriptionRequest
+// subscriptionView is a subscription as the UI sees it: its settings and state
+// plus how many servers it currently contributes to the catalogue.
+type subscriptionView struct {
+	models.Subscription
+	ServerCount int `json:"server_count"`
+}
+
+func subscriptionViews(data models.SubscriptionData) []subscriptionView {
+	counts := make(map[string]int, len(data.Subscriptions))
+	for _, server := range data.Servers {
+		counts[server.Source]++
+	}
+
+	views := make([]subscriptionView, 0, len(data.Subscriptions))
+	for _, sub := range data.Subscriptions {
+		views = append(views, subscriptionView{Subscription: sub, ServerCount: counts[sub.Name]})
+	}
+	return views
+}
+
+// HandleListSubscriptions — GET /api/subscriptions
+func (h *Handlers) HandleListSubscriptions(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"subscriptions": subscriptionViews(h.subscription.GetData()),
+	})
+}
+
+// HandleAddSubscription — POST /api/subscriptions
+func (h *Handlers) HandleAddSubscription(w http.ResponseWriter, r *http.Request) {
+	var req models.SubscriptionRequest
 	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
 		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "неверный формат запроса"})
 		return
 	}
 
-	if req.URL == "" {
-		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "URL обязателен"})
+	sub := models.Subscription{Name: req.Name, Enabled: true}
+	if req.URL != nil {
+		sub.URL = *req.URL
+	}
+	if req.Enabled != nil {
+		sub.Enabled = *req.Enabled
+	}
+	if req.RefreshInterval != nil {
+		sub.RefreshInterval = *req.RefreshInterval
+	}
+	if req.Fetch != nil {
+		sub.Fetch = *req.Fetch
+	}
+
+	servers, err := h.subscription.AddSubscription(sub)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
 		return
 	}
 
-	servers, err := h.subscription.UpdateURL(req.URL)
+	h.writeCatalogue(w, servers)
+}
+
+// HandleUpdateNamedSubscription — PUT /api/subscriptions/{name}
+func (h *Handlers) HandleUpdateNamedSubscription(w http.ResponseWriter, r *http.Request) {
+	var req models.SubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "неверный формат запроса"})
+		return
+	}
+	req.Name = subscriptionName(r)
+
+	servers, err := h.subscription.UpdateSubscription(req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	h.writeCatalogue(w, servers)
+}
+
+// HandleDeleteSubscription — DELETE /api/subscriptions/{name}
+func (h *Handlers) HandleDeleteSubscription(w http.ResponseWriter, r *http.Request) {
+	servers, err := h.subscription.RemoveSubscription(subscriptionName(r))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+
+	h.writeCatalogue(w, servers)
+}
+
+// HandleRefreshNamedSubscription — POST /api/subscriptions/{name}/refresh
+func (h *Handlers) HandleRefreshNamedSubscription(w http.ResponseWriter, r *http.Request) {
+	servers, err := h.subscription.RefreshSubscriptionByUser(subscriptionName(r))
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		return
 	}
 
+	h.writeCatalogue(w, servers)
+}
+
+// subscriptionName reads the {name} path segment; names may carry spaces and
+// other characters that arrive escaped.
+func subscriptionName(r *http.Request) string {
+	name := chi.URLParam(r, "name")
+	if unescaped, err := url.PathUnescape(name); err == nil {
+		return unescaped
+	}
+	return name
+}
+
+// writeCatalogue answers a subscription change with the merged catalogue and
+// brings the pool in line with it.
+func (h *Handlers) writeCatalogue(w http.ResponseWriter, servers []models.Server) {
+	writeJSON(w, http.StatusOK, h.catalogueResponse(servers))
+}
+
+func (h *Handlers) catalogueResponse(servers []models.Server) map[string]interface{} {
 	resp := map[string]interface{}{
 		"server_count": len(servers),
 		"servers":      servers,
@@ -74,31 +192,239 @@ func (h *Handlers) HandleUpdateSubscription(w http.ResponseWriter, r *http.Reque
 	} else if sync.Changed {
 		resp["pool"] = sync
 	}
+	return resp
+}
 
+// HandleApproveQuarantine — POST /api/subscriptions/{name}/quarantine/approve
+func (h *Handlers) HandleApproveQuarantine(w http.ResponseWriter, r *http.Request) {
+	prevURI := ""
+	if active := h.subscription.GetActiveServer(); active != nil {
+		prevURI = active.RawURI
+	}
+
+	servers, err := h.subscription.ApproveQuarantine(subscriptionName(r))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	resp := h.catalogueResponse(servers)
+	if restarting, err := h.reapplyActive(prevURI); err != nil {
+		resp["apply_error"] = err.Error()
+	} else if restarting {
+		resp["restarting"] = true
+	}
 	writeJSON(w, http.StatusOK, resp)
 }
 
-// HandleRefreshSubscription — POST /api/subscription/refresh
-func (h *Handlers) HandleRefreshSubscription(w http.ResponseWriter, r *http.Request) {
-	servers, err := h.subscription.Refresh()
+// HandleDiscardQuarantine — DELETE /api/subscriptions/{name}/quarantine
+func (h *Handlers) HandleDiscardQuarantine(w http.ResponseWriter, r *http.Request) {
+	if err := h.subscription.DiscardQuarantine(subscriptionName(r)); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// HandleSubscriptionHistory — GET /api/subscriptions/history?name=
+func (h *Handlers) HandleSubscriptionHistory(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"snapshots": h.subscription.History(r.URL.Query().Get("name")),
+	})
+}
+
+// HandleSubscriptionDiff — GET /api/subscriptions/history/diff?from=&to=
+func (h *Handlers) HandleSubscriptionDiff(w http.ResponseWriter, r *http.Request) {
+	from, errFrom := strconv.Atoi(r.URL.Query().Get("from"))
+	to, errTo := strconv.Atoi(r.URL.Query().Get("to"))
+	if errFrom != nil || errTo != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "нужны ID снимков from и to"})
+		return
+	}
+
+	diff, err := h.subscription.DiffSnapshots(from, to)
 	if err != nil {
-		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
 		return
 	}
 
-	resp := map[string]interface{}{
-		"server_count": len(servers),
-		"servers":      servers,
+	writeJSON(w, http.StatusOK, diff)
+}
+
+// HandleSubscriptionRollback — POST /api/subscriptions/history/{id}/rollback
+//
+// Restores a previous server list and brings the core in line with it: the
+// pool is re-synced, or in single-outbound mode the active server is re-applied
+// if the rollback took it away.
+func (h *Handlers) HandleSubscriptionRollback(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "неверный ID снимка"})
+		return
 	}
-	if sync, err := h.refreshPool(servers); err != nil {
-		resp["pool_error"] = err.Error()
-	} else if sync.Changed {
-		resp["pool"] = sync
+
+	prevURI := ""
+	if active := h.subscription.GetActiveServer(); active != nil {
+		prevURI = active.RawURI
+	}
+
+	servers, err := h.subscription.Rollback(id)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	resp := h.catalogueResponse(servers)
+	if restarting, err := h.reapplyActive(prevURI); err != nil {
+		resp["apply_error"] = err.Error()
+	} else if restarting {
+		resp["restarting"] = true
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// reapplyActive writes the active server's outbound after the catalogue was
+// replaced under it, the way the automatic refresh does. Pool mode is left to
+// refreshPool, and nothing happens while the active server is the same one.
+func (h *Handlers) reapplyActive(prevURI string) (bool, error) {
+	active := h.subscription.GetActiveServer()
+	if active == nil || active.RawURI == prevURI {
+		return false, nil
+	}
+	rt := h.detector.Runtime()
+	if rt.Core == xkeen.CoreMihomo {
+		if err := h.syncMihomo(rt); err != nil {
+			return false, err
+		}
+	} else {
+		if h.detector.Topology().Mode == xkeen.TopologyPool {
+			return false, nil
+		}
+		target := h.watchdog.AllowedActiveOrBest()
+		if target == nil {
+			return false, nil
+		}
+		if err := xkeen.ApplyServer(rt, h.config.OutboundsFile, target); err != nil {
+			return false, err
+		}
+	}
+
+	go func() {
+		if _, err := xkeen.Restart(rt.Dispatcher); err != nil {
+			log.Printf("[ROLLBACK] Ошибка рестарта: %v", err)
+		}
+	}()
+	return true, nil
+}
+
+// maxImportSize caps pasted or uploaded subscription content.
+const maxImportSize = 8 << 20
+
+// HandleImportSubscription — POST /api/subscriptions/import
+//
+// Takes the content as JSON ({name, content}) or as a multipart upload (file
+// field "file", optional field "name").
+func (h *Handlers) HandleImportSubscription(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxImportSize)
+
+	var req models.ImportRequest
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		file, _, err := r.FormFile("file")
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "файл не получен"})
+			return
+		}
+		defer file.Close()
+		content, err := io.ReadAll(file)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "ошибка чтения файла"})
+			return
+		}
+		req.Name = r.FormValue("name")
+		req.Content = string(content)
+	} else if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "неверный формат запроса"})
+		return
+	}
+
+	servers, report, err := h.subscription.ImportContent(req.Name, req.Content)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]interface{}{"error": err.Error(), "report": report})
+		return
 	}
 
+	resp := h.catalogueResponse(servers)
+	resp["report"] = report
 	writeJSON(w, http.StatusOK, resp)
 }
 
+// HandleAddManualServer — POST /api/servers/manual
+func (h *Handlers) HandleAddManualServer(w http.ResponseWriter, r *http.Request) {
+	var req models.ManualServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "неверный формат запроса"})
+		return
+	}
+
+	servers, err := h.subscription.AddManual(req.URI)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	h.writeCatalogue(w, servers)
+}
+
+// HandleDeleteManualServer — DELETE /api/servers/manual/{id}
+func (h *Handlers) HandleDeleteManualServer(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "неверный ID"})
+		return
+	}
+
+	servers, err := h.subscription.RemoveManual(id)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+
+	h.writeCatalogue(w, servers)
+}
+
+// HandleUpdateSubscription — POST /api/subscription
+func (h *Handlers) HandleUpdateSubscription(w http.ResponseWriter, r *http.Request) {
+	var req models.UpdateSubscriptionRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "неверный формат запроса"})
+		return
+	}
+
+	if req.URL == "" {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "URL обязателен"})
+		return
+	}
+
+	servers, err := h.subscription.UpdateURL(req.URL)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	h.writeCatalogue(w, servers)
+}
+
+// HandleRefreshSubscription — POST /api/subscription/refresh
+func (h *Handlers) HandleRefreshSubscription(w http.ResponseWriter, r *http.Request) {
+	servers, err := h.subscription.RefreshByUser()
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	h.writeCatalogue(w, servers)
+}
+
 // refreshPool приводит пул к обновлённой подписке. Пул генерируется из URI
 // подписки, поэтому смена сервера у провайдера оставляет в нём мёртвый адрес —
 // и если протухли все ноды, балансировщику не из чего выбирать.
@@ -115,7 +441,7 @@ func (h *Handlers) refreshPool(servers []models.Server) (xkeen.SyncResult, error
 	}
 
 	result, err := xkeen.RefreshPool(h.detector.Runtime(), h.config.OutboundsFile, h.config.XrayAPIAddr, servers, state,
-		xkeen.PoolSelectionFromConfig(h.config, h.geoip))
+		xkeen.PoolSelectionFromConfig(h.config, h.geoip, h.subscription))
 	if err != nil {
 		log.Printf("[POOL] Синхронизация с подпиской не выполнена: %v", err)
 		return result, err
@@ -125,17 +451,222 @@ func (h *Handlers) refreshPool(servers []models.Server) (xkeen.SyncResult, error
 		h.watchdog.Log("[POOL] Пул синхронизирован: +%d, -%d, заменено %d, без перезапуска=%v", len(result.Added), len(result.Removed), len(result.Replaced), result.Live)
 	}
 
+	for _, sync := range xkeen.RefreshNamedPools(h.detector.Runtime(), h.config, h.geoip, h.subscription, h.pool) {
+		switch {
+		case sync.Error != "":
+			h.watchdog.Log("[POOL][%s] Синхронизация с подпиской не выполнена: %s", sync.Pool, sync.Error)
+		case sync.Result.Changed:
+			h.detector.InvalidateTopology()
+			h.watchdog.Log("[POOL][%s] Пул синхронизирован: +%d, -%d, заменено %d", sync.Pool,
+				len(sync.Result.Added), len(sync.Result.Removed), len(sync.Result.Replaced))
+		}
+	}
+
 	return result, nil
 }
 
 // HandleGetServers — GET /api/servers
+//
+// Without parameters it returns the whole list. Filters: protocol, country,
+// tag, source (comma-separated, any of them matches), min_latency/max_latency
+// in ms, pool=true|false, udp=true|false, and filter naming a saved filter the other
+// parameters refine. sort takes a field, "-" in front reverses it; page and
+// per_page cut the result into pages. Duplicates set aside by duplicate_mode
+// are left out unless duplicates=true.
 func (h *Handlers) HandleGetServers(w http.ResponseWriter, r *http.Request) {
-	servers := h.subscription.GetServers()
+	q := r.URL.Query()
+
+	var filter models.ServerFilter
+	if name := q.Get("filter"); name != "" {
+		saved, ok := h.subscription.Filter(name)
+		if !ok {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": fmt.Sprintf("фильтр %q не найден", name)})
+			return
+		}
+		filter = saved
+	}
+	if err := mergeFilterQuery(&filter, q); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	servers := xkeen.FilterServers(h.subscription.GetServers(), filter, h.poolMembership(filter))
+	if showDuplicates, _ := strconv.ParseBool(q.Get("duplicates")); !showDuplicates {
+		servers = slices.DeleteFunc(servers, func(s models.Server) bool { return s.DuplicateOf != nil })
+	}
+
+	sortKey := q.Get("sort")
+	desc := strings.HasPrefix(sortKey, "-")
+	if err := xkeen.SortServers(servers, strings.TrimPrefix(sortKey, "-"), desc); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+
+	total := len(servers)
+	resp := map[string]interface{}{"total": total}
+	if q.Has("page") || q.Has("per_page") {
+		page, perPage, err := pageParams(q)
+		if err != nil {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+			return
+		}
+		// A page past the end is empty; checking before multiplying keeps a huge
+		// page number from overflowing into a negative index
+		from := total
+		if pages := (total + perPage - 1) / perPage; page <= pages {
+			from = (page - 1) * perPage
+		}
+		servers = servers[from:min(from+perPage, total)]
+		resp["page"], resp["per_page"] = page, perPage
+	}
+	resp["servers"] = servers
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// defaultPerPage is the page size when only page is given; maxPerPage caps
+// what a client may ask for.
+const (
+	defaultPerPage = 50
+	maxPerPage     = 500
+)
+
+// mergeFilterQuery adds the query's conditions to a filter; a condition given
+// in the query replaces the saved one.
+func mergeFilterQuery(f *models.ServerFilter, q url.Values) error {
+	list := func(key string) []string {
+		var out []string
+		for _, v := range q[key] {
+			for _, item := range strings.Split(v, ",") {
+				if item = strings.TrimSpace(item); item != "" {
+					out = append(out, item)
+				}
+			}
+		}
+		return out
+	}
+	if v := list("protocol"); v != nil {
+		f.Protocols = v
+	}
+	if v := list("country"); v != nil {
+		f.Countries = v
+	}
+	if v := list("tag"); v != nil {
+		f.Tags = v
+	}
+	if v := list("source"); v != nil {
+		f.Sources = v
+	}
+
+	for key, dst := range map[string]*int{"min_latency": &f.MinLatency, "max_latency": &f.MaxLatency} {
+		if raw := q.Get(key); raw != "" {
+			n, err := strconv.Atoi(raw)
+			if err != nil || n < 0 {
+				return fmt.Errorf("неверное значение %s: %q", key, raw)
+			}
+			*dst = n
+		}
+	}
+	for key, dst := range map[string]**bool{"pool": &f.InPool, "udp": &f.UDP} {
+		if raw := q.Get(key); raw != "" {
+			v, err := strconv.ParseBool(raw)
+			if err != nil {
+				return fmt.Errorf("неверное значение %s: %q", key, raw)
+			}
+			*dst = &v
+		}
+	}
+	return nil
+}
+
+func pageParams(q url.Values) (page, perPage int, err error) {
+	page, perPage = 1, defaultPerPage
+	if raw := q.Get("page"); raw != "" {
+		if page, err = strconv.Atoi(raw); err != nil || page < 1 {
+			return 0, 0, fmt.Errorf("неверный номер страницы: %q", raw)
+		}
+	}
+	if raw := q.Get("per_page"); raw != "" {
+		if perPage, err = strconv.Atoi(raw); err != nil || perPage < 1 {
+			return 0, 0, fmt.Errorf("неверный размер страницы: %q", raw)
+		}
+		perPage = min(perPage, maxPerPage)
+	}
+	return page, perPage, nil
+}
+
+// poolMembership tells which servers the pool holds, read only when the filter
+// asks. Outside pool mode nothing is in a pool.
+func (h *Handlers) poolMembership(f models.ServerFilter) func(models.Server) bool {
+	if f.InPool == nil {
+		return nil
+	}
+	none := func(models.Server) bool { return false }
+
+	top := h.detector.Topology()
+	if top.Mode != xkeen.TopologyPool {
+		return none
+	}
+	selector := xkeen.DefaultPoolSelector
+	if len(top.Selectors) > 0 {
+		selector = top.Selectors[0]
+	}
+	inPool, err := xkeen.PoolMembership(h.config.OutboundsFile, selector)
+	if err != nil {
+		log.Printf("[POOL] Состав пула не прочитан: %v", err)
+		return none
+	}
+	return inPool
+}
+
+// HandleDuplicates — GET /api/servers/duplicates
+//
+// The groups of servers that are the same node, and what duplicate_mode does
+// with them.
+func (h *Handlers) HandleDuplicates(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, h.subscription.DuplicateReport())
+}
+
+// HandleListFilters — GET /api/servers/filters
+func (h *Handlers) HandleListFilters(w http.ResponseWriter, r *http.Request) {
+	filters := h.subscription.Filters()
+	if filters == nil {
+		filters = map[string]models.ServerFilter{}
+	}
 	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"servers": servers,
+		"filters":     filters,
+		"pool_filter": h.config.PoolFilter,
 	})
 }
 
+// HandleSaveFilter — PUT /api/servers/filters/{name}
+func (h *Handlers) HandleSaveFilter(w http.ResponseWriter, r *http.Request) {
+	var f models.ServerFilter
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "неверный формат запроса"})
+		return
+	}
+	if err := h.subscription.SaveFilter(chi.URLParam(r, "name"), f); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
+// HandleDeleteFilter — DELETE /api/servers/filters/{name}
+func (h *Handlers) HandleDeleteFilter(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	// Deleting it would silently widen the pool to every server
+	if name == h.config.PoolFilter {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("фильтр %q задан в pool_filter — сначала уберите его из config.yaml", name)})
+		return
+	}
+	if err := h.subscription.DeleteFilter(name); err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]bool{"success": true})
+}
+
 // HandleSelectServer — POST /api/servers/select
 func (h *Handlers) HandleSelectServer(w http.ResponseWriter, r *http.Request) {
 	var req models.SelectServerRequest
@@ -188,7 +719,7 @@ func (h *Handlers) HandleSelectServer(w http.ResponseWriter, r *http.Request) {
 	// In pool mode the balancer picks the node, so a manual choice is an override
 	// through the core API: instant, no restart
 	if top := h.detector.Topology(); top.Mode == xkeen.TopologyPool {
-		if err := h.pinPoolNode(rt, top, server); err != nil {
+		if err := h.pinPoolNode(rt, top, server, ""); err != nil {
 			log.Printf("[SELECT] Ошибка закрепления ноды: %v", err)
 			writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 			return
@@ -231,8 +762,9 @@ func (h *Handlers) HandleSelectServer(w http.ResponseWriter, r *http.Request) {
 //
 // The node is matched by endpoint, not by position: the pool holds only the best
 // `pool_max_nodes` of the subscription, so a subscription index says nothing
-// about which node — if any — serves that server.
-func (h *Handlers) pinPoolNode(rt xkeen.Runtime, top xkeen.Topology, server *models.Server) error {
+// about which node — if any — serves that server. name is the named pool top
+// describes, "" for the main one.
+func (h *Handlers) pinPoolNode(rt xkeen.Runtime, top xkeen.Topology, server *models.Server, name string) error {
 	selector := xkeen.DefaultPoolSelector
 	if len(top.Selectors) > 0 {
 		selector = top.Selectors[0]
@@ -262,7 +794,7 @@ func (h *Handlers) pinPoolNode(rt xkeen.Runtime, top xkeen.Topology, server *mod
 	// The override lives only in the core's memory — store it to reapply after a
 	// restart, together with the node it means so a moved tag is detectable
 	node := xkeen.NodeKeyForTag(h.config.OutboundsFile, selector, tag)
-	if err := h.pool.SetPinned(tag, node); err != nil {
+	if err := h.pool.SetPinnedIn(name, tag, node); err != nil {
 		log.Printf("[SELECT] Не удалось сохранить закреплённую ноду: %v", err)
 	}
 
@@ -328,14 +860,159 @@ func (h *Handlers) HandleMihomoSync(w http.ResponseWriter, r *http.Request) {
 // HandleCheckServers — POST /api/servers/check
 func (h *Handlers) HandleCheckServers(w http.ResponseWriter, r *http.Request) {
 	servers := h.subscription.GetServers()
-	timeout := time.Duration(h.config.ProbeTimeoutMs) * time.Millisecond
-	checked := xkeen.CheckAllLatencies(servers, timeout, h.config.ProbeConcurrency)
+	checked := xkeen.LatencyProbeFromConfig(h.config, h.detector.Runtime(), h.subscription.LatencyHistory()).Check(servers)
 	h.subscription.UpdateLatencies(checked)
 	writeJSON(w, http.StatusOK, map[string]interface{}{
 		"servers": checked,
 	})
 }
 
+// HandleLatencyStats — GET /api/servers/latency
+// Percentiles, loss and a sparkline of every server's probe history.
+func (h *Handlers) HandleLatencyStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, map[string]interface{}{"servers": h.subscription.LatencyStats()})
+}
+
+// HandleServerScores — GET /api/servers/scores
+// How every server rates at its last measured latency, factor by factor — the
+// same score pool membership, pinning and failover rank by.
+func (h *Handlers) HandleServerScores(w http.ResponseWriter, r *http.Request) {
+	scorer := xkeen.ScorerFromConfig(h.config, h.subscription.LatencyHistory())
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"servers": h.subscription.Scores(scorer),
+		"weights": xkeen.EffectiveScoreWeights(h.config.ScoreWeights),
+	})
+}
+
+// HandleServerLatencyStats — GET /api/servers/{id}/latency
+func (h *Handlers) HandleServerLatencyStats(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "неверный ID сервера"})
+		return
+	}
+	stats, err := h.subscription.ServerLatencyStats(id)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, stats)
+}
+
+// HandleGetServerPrefs — GET /api/servers/{id}/prefs
+func (h *Handlers) HandleGetServerPrefs(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "неверный ID сервера"})
+		return
+	}
+	prefs, err := h.subscription.ServerPrefs(id)
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, prefs)
+}
+
+// HandleSetServerPrefs — PUT /api/servers/{id}/prefs (favourite, exclusion,
+// custom name, priority)
+func (h *Handlers) HandleSetServerPrefs(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(chi.URLParam(r, "id"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "неверный ID сервера"})
+		return
+	}
+	var req models.SetServerPrefsRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "неверный формат запроса"})
+		return
+	}
+
+	prefs, err := h.subscription.SetServerPrefs(id, req)
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, prefs)
+}
+
+// serversFromBody picks the servers a {"ids": [...]} body lists, or all of
+// them for an empty body or list. It answers the request itself on a bad body.
+func (h *Handlers) serversFromBody(w http.ResponseWriter, r *http.Request) ([]models.Server, bool) {
+	var req struct {
+		IDs []int `json:"ids"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+			writeJSON(w, http.StatusBadRequest, map[string]string{"error": "неверный формат запроса"})
+			return nil, false
+		}
+	}
+
+	servers := h.subscription.GetServers()
+	if len(req.IDs) == 0 {
+		return servers, true
+	}
+	wanted := make(map[int]bool, len(req.IDs))
+	for _, id := range req.IDs {
+		wanted[id] = true
+	}
+	var picked []models.Server
+	for _, s := range servers {
+		if wanted[s.ID] {
+			picked = append(picked, s)
+		}
+	}
+	return picked, true
+}
+
+// HandleDiscoverExits — POST /api/servers/exits
+//
+// Finds the exit IP and country of the servers listed in the body ({"ids":
+// [...]}), or of every server when there is no body or the list is empty.
+func (h *Handlers) HandleDiscoverExits(w http.ResponseWriter, r *http.Request) {
+	servers, ok := h.serversFromBody(w, r)
+	if !ok {
+		return
+	}
+
+	results, err := xkeen.ExitDiscoveryFromConfig(h.config, h.detector.Runtime(), h.geoip).Discover(servers)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := h.subscription.UpdateExits(servers, results); err != nil {
+		log.Printf("[EXIT] Результаты не сохранены: %v", err)
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": results})
+}
+
+// HandleCheckUDP — POST /api/servers/udp
+//
+// Sends a DNS query over UDP through the servers listed in the body ({"ids":
+// [...]}), or through every server when there is no body or the list is empty.
+func (h *Handlers) HandleCheckUDP(w http.ResponseWriter, r *http.Request) {
+	servers, ok := h.serversFromBody(w, r)
+	if !ok {
+		return
+	}
+
+	results, err := xkeen.UDPCheckerFromConfig(h.config, h.detector.Runtime()).Check(servers)
+	if err != nil {
+		writeJSON(w, http.StatusServiceUnavailable, map[string]string{"error": err.Error()})
+		return
+	}
+	if err := h.subscription.UpdateUDP(servers, results); err != nil {
+		log.Printf("[UDP] Результаты не сохранены: %v", err)
+	}
+
+	out := make([]map[string]interface{}, len(servers))
+	for i, s := range servers {
+		out[i] = map[string]interface{}{"id": s.ID, "name": s.Name, "udp": results[i]}
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{"results": out})
+}
+
 // HandleSetCountry — POST /api/servers/country (manual country override)
 func (h *Handlers) HandleSetCountry(w http.ResponseWriter, r *http.Request) {
 	var req models.SetCountryRequest
@@ -441,6 +1118,8 @@ func (h *Handlers) HandlePoolStatus(w http.ResponseWriter, r *http.Request) {
 		"pool_tags":    top.PoolTags,
 		"proxy_tags":   top.ProxyTags,
 		"pinned_tag":   state.PinnedTag,
+		"pinned_at":    state.PinnedAt,
+		"pin_policy":   h.config.PoolPin,
 		"core":         rt.Core,
 	}
 
@@ -452,13 +1131,22 @@ func (h *Handlers) HandlePoolStatus(w http.ResponseWriter, r *http.Request) {
 		} else {
 			resp["api_available"] = false
 		}
+
+		// Without the metrics listener the nodes still come, with the panel's
+		// probes only
+		observed, err := xkeen.ObservatoryState(h.config.XrayMetricsAddr)
+		resp["observatory_available"] = err == nil
+		if nodes, err := xkeen.ObservedPoolNodes(h.config.OutboundsFile, top, h.subscription.GetServers(), observed); err == nil {
+			resp["nodes"] = nodes
+		}
 	}
 
 	writeJSON(w, http.StatusOK, resp)
 }
 
 // HandlePoolEnable — POST /api/pool/enable. Builds a pool from the subscription
-// and moves the routing rules onto the balancer.
+// and moves the routing rules onto the balancer. With dry_run=1 it only
+// answers with the plan.
 func (h *Handlers) HandlePoolEnable(w http.ResponseWriter, r *http.Request) {
 	servers := h.subscription.GetServers()
 	if len(servers) == 0 {
@@ -467,10 +1155,18 @@ func (h *Handlers) HandlePoolEnable(w http.ResponseWriter, r *http.Request) {
 	}
 
 	rt := h.detector.Runtime()
-	state, err := xkeen.EnablePool(rt, h.config.OutboundsFile, servers, xkeen.PoolOptions{
-		APIAddr:   h.config.XrayAPIAddr,
-		Selection: xkeen.PoolSelectionFromConfig(h.config, h.geoip),
-	})
+	opts := xkeen.PoolOptions{
+		APIAddr:     h.config.XrayAPIAddr,
+		MetricsAddr: h.config.XrayMetricsAddr,
+		Selection:   xkeen.PoolSelectionFromConfig(h.config, h.geoip, h.subscription),
+	}
+	if isDryRun(r) {
+		plan, err := xkeen.PlanEnablePool(rt, h.config.OutboundsFile, servers, opts)
+		writePlan(w, plan, err)
+		return
+	}
+
+	state, err := xkeen.EnablePool(rt, h.config.OutboundsFile, servers, opts)
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		return
@@ -486,7 +1182,7 @@ func (h *Handlers) HandlePoolEnable(w http.ResponseWriter, r *http.Request) {
 			log.Printf("[POOL] Ошибка рестарта: %v", err)
 			return
 		}
-		h.pinAfterRestart(rt)
+		h.pinAfterRestart(rt, "")
 	}()
 
 	writeJSON(w, http.StatusOK, map[string]interface{}{
@@ -501,8 +1197,9 @@ func (h *Handlers) HandlePoolEnable(w http.ResponseWriter, r *http.Request) {
 // A fresh pool selects an outbound per connection, so the outgoing IP moves
 // between nodes and anything IP-bound — Telegram sessions, CDN anti-abuse —
 // breaks. Pinning right after the restart avoids a window of that behaviour
-// before the watchdog's next tick.
-func (h *Handlers) pinAfterRestart(rt xkeen.Runtime) {
+// before the watchdog's next tick. name is the named pool to pin, "" for the
+// main one.
+func (h *Handlers) pinAfterRestart(rt xkeen.Runtime, name string) {
 	deadline := time.Now().Add(90 * time.Second)
 	for xkeen.IsRestarting() && time.Now().Before(deadline) {
 		time.Sleep(time.Second)
@@ -515,10 +1212,16 @@ func (h *Handlers) pinAfterRestart(rt xkeen.Runtime) {
 	if top.Mode != xkeen.TopologyPool {
 		return
 	}
+	if name != "" {
+		var ok bool
+		if top, ok = top.Balancer(h.pool.GetPool(name).BalancerTag); !ok {
+			return
+		}
+	}
 
 	tag, err := xkeen.PinBestNode(rt, h.config.XrayAPIAddr, h.config.OutboundsFile, top,
-		h.subscription.GetServers(), nil,
-		time.Duration(h.config.ProbeTimeoutMs)*time.Millisecond, h.config.ProbeConcurrency)
+		h.subscription.GetServers(), nil, xkeen.LatencyProbeFromConfig(h.config, rt, h.subscription.LatencyHistory()),
+		xkeen.ScorerFromConfig(h.config, h.subscription.LatencyHistory()))
 	if err != nil {
 		h.watchdog.Log("[PIN] Не удалось закрепить ноду: %v", err)
 		return
@@ -528,7 +1231,7 @@ func (h *Handlers) pinAfterRestart(rt xkeen.Runtime) {
 	if len(top.Selectors) > 0 {
 		selector = top.Selectors[0]
 	}
-	if err := h.pool.SetPinned(tag, xkeen.NodeKeyForTag(h.config.OutboundsFile, selector, tag)); err != nil {
+	if err := h.pool.SetPinnedIn(name, tag, xkeen.NodeKeyForTag(h.config.OutboundsFile, selector, tag)); err != nil {
 		log.Printf("[PIN] Не удалось сохранить закрепление: %v", err)
 	}
 	h.watchdog.Log("[PIN] Трафик закреплён за нодой %s", tag)
@@ -543,6 +1246,13 @@ func (h *Handlers) HandlePoolDisable(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	// Named pools live next to the main one; collapsing it would leave their
+	// rules pointing at a routing table that no longer has it
+	if named := h.pool.EnabledNamed(); len(named) > 0 {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": "сначала выключите пулы: " + strings.Join(named, ", ")})
+		return
+	}
+
 	rt := h.detector.Runtime()
 	if err := xkeen.DisablePool(rt, h.config.OutboundsFile, server, h.pool.Get()); err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
@@ -563,16 +1273,22 @@ func (h *Handlers) HandlePoolDisable(w http.ResponseWriter, r *http.Request) {
 	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "restarting": true})
 }
 
-// HandlePoolSync — POST /api/pool/sync. Brings pool membership in line with the subscription.
+// HandlePoolSync — POST /api/pool/sync. Brings pool membership in line with the
+// subscription. With dry_run=1 it only answers with the plan.
 func (h *Handlers) HandlePoolSync(w http.ResponseWriter, r *http.Request) {
 	rt := h.detector.Runtime()
 	state := h.pool.Get()
 	if state.Selector == "" {
 		state.Selector = xkeen.DefaultPoolSelector
 	}
+	sel := xkeen.PoolSelectionFromConfig(h.config, h.geoip, h.subscription)
+	if isDryRun(r) {
+		plan, err := xkeen.PlanRefreshPool(rt, h.config.OutboundsFile, h.config.XrayAPIAddr, h.subscription.GetServers(), state, sel)
+		writePlan(w, plan, err)
+		return
+	}
 
-	result, err := xkeen.RefreshPool(rt, h.config.OutboundsFile, h.config.XrayAPIAddr, h.subscription.GetServers(), state,
-		xkeen.PoolSelectionFromConfig(h.config, h.geoip))
+	result, err := xkeen.RefreshPool(rt, h.config.OutboundsFile, h.config.XrayAPIAddr, h.subscription.GetServers(), state, sel)
 	if err != nil {
 		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
 		return
@@ -582,16 +1298,262 @@ func (h *Handlers) HandlePoolSync(w http.ResponseWriter, r *http.Request) {
 	}
 
 	writeJSON(w, http.StatusOK, map[string]interface{}{
-		"success":    true,
-		"changed":    result.Changed,
-		"added":      result.Added,
-		"removed":    result.Removed,
-		"replaced":   result.Replaced,
-		"live":       result.Live,
-		"restarting": result.Restarted,
+		"success":          true,
+		"changed":          result.Changed,
+		"added":            result.Added,
+		"removed":          result.Removed,
+		"replaced":         result.Replaced,
+		"live":             result.Live,
+		"restarting":       result.Restarted,
+		"strategy_changed": result.StrategyChanged,
+		"bypass_changed":   result.BypassChanged,
 	})
 }
 
+// HandleListPools — GET /api/pools. The main pool and every pool described in
+// config.yaml, with what is built and pinned for each.
+func (h *Handlers) HandleListPools(w http.ResponseWriter, r *http.Request) {
+	rt := h.detector.Runtime()
+	top := h.detector.Topology()
+	main := h.pool.Get()
+
+	pools := []map[string]interface{}{{
+		"name":         "",
+		"enabled":      top.Mode == xkeen.TopologyPool,
+		"balancer_tag": top.BalancerTag,
+		"pool_tags":    top.PoolTags,
+		"pinned_tag":   main.PinnedTag,
+	}}
+
+	named, err := xkeen.NamedPoolsFromConfig(h.config)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	servers := h.subscription.GetServers()
+	observed, _ := xkeen.ObservatoryState(h.config.XrayMetricsAddr)
+	if top.Mode == xkeen.TopologyPool {
+		if nodes, err := xkeen.ObservedPoolNodes(h.config.OutboundsFile, top, servers, observed); err == nil {
+			pools[0]["nodes"] = nodes
+		}
+	}
+	for _, p := range named {
+		state := h.pool.GetPool(p.Name)
+		entry := map[string]interface{}{
+			"name":         p.Name,
+			"enabled":      state.Enabled,
+			"balancer_tag": p.BalancerTag,
+			"selector":     p.Selector,
+			"pinned_tag":   state.PinnedTag,
+			"pinned_at":    state.PinnedAt,
+			"config":       p.PoolConfig,
+		}
+		if b, ok := top.Balancer(p.BalancerTag); ok {
+			entry["pool_tags"] = b.PoolTags
+			if target, err := xkeen.CurrentBalancerTarget(rt, h.config.XrayAPIAddr, p.BalancerTag); err == nil {
+				entry["current_tag"] = target
+			}
+			if nodes, err := xkeen.ObservedPoolNodes(h.config.OutboundsFile, b, servers, observed); err == nil {
+				entry["nodes"] = nodes
+			}
+		}
+		pools = append(pools, entry)
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"pools": pools})
+}
+
+// isDryRun reports whether the request only asks what would change.
+func isDryRun(r *http.Request) bool {
+	v := r.URL.Query().Get("dry_run")
+	return v == "1" || v == "true"
+}
+
+// writePlan answers a dry run. Nothing was written, so there is nothing to
+// invalidate or restart. plan.estimated tells the client the node list may
+// come out otherwise: the real run probes before it picks.
+func writePlan(w http.ResponseWriter, plan xkeen.PoolPlan, err error) {
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success": true,
+		"dry_run": true,
+		"changed": plan.Changed(),
+		"plan":    plan,
+	})
+}
+
+// namedPool finds the pool named in the URL, answering 404 itself when there is none.
+func (h *Handlers) namedPool(w http.ResponseWriter, r *http.Request) (xkeen.NamedPool, bool) {
+	p, err := xkeen.FindNamedPool(h.config, chi.URLParam(r, "name"))
+	if err != nil {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": err.Error()})
+		return xkeen.NamedPool{}, false
+	}
+	return p, true
+}
+
+// HandleNamedPoolEnable — POST /api/pools/{name}/enable. Builds the pool next
+// to the main one and routes its traffic to it. With dry_run=1 it only
+// answers with the plan.
+func (h *Handlers) HandleNamedPoolEnable(w http.ResponseWriter, r *http.Request) {
+	p, ok := h.namedPool(w, r)
+	if !ok {
+		return
+	}
+	servers := h.subscription.GetServers()
+	if len(servers) == 0 {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "подписка пуста — нечего добавлять в пул"})
+		return
+	}
+
+	rt := h.detector.Runtime()
+	sel := p.Selection(h.config, h.geoip, h.subscription)
+	if isDryRun(r) {
+		plan, err := xkeen.PlanEnableNamedPool(rt, h.config.OutboundsFile, h.detector.Topology(), servers, p, sel)
+		writePlan(w, plan, err)
+		return
+	}
+
+	state, err := xkeen.EnableNamedPool(rt, h.config.OutboundsFile, h.detector.Topology(), servers, p, sel)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if err := h.pool.SetPool(p.Name, state); err != nil {
+		log.Printf("[POOL][%s] Не удалось сохранить состояние пула: %v", p.Name, err)
+	}
+	h.detector.InvalidateTopology()
+
+	go func() {
+		if _, err := xkeen.Restart(rt.Dispatcher); err != nil {
+			log.Printf("[POOL][%s] Ошибка рестарта: %v", p.Name, err)
+			return
+		}
+		h.pinAfterRestart(rt, p.Name)
+	}()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":      true,
+		"balancer_tag": state.BalancerTag,
+		"restarting":   true,
+	})
+}
+
+// HandleNamedPoolDisable — POST /api/pools/{name}/disable. Its traffic goes
+// back to the main pool. A pool already gone from config.yaml can still be
+// taken out by name.
+func (h *Handlers) HandleNamedPoolDisable(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	state := h.pool.GetPool(name)
+	if !state.Enabled {
+		writeJSON(w, http.StatusNotFound, map[string]string{"error": fmt.Sprintf("пул %q не включён", name)})
+		return
+	}
+
+	rt := h.detector.Runtime()
+	if err := xkeen.DisableNamedPool(rt, h.config.OutboundsFile, state); err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+
+	if err := h.pool.SetPool(name, xkeen.PoolState{}); err != nil {
+		log.Printf("[POOL][%s] Не удалось очистить состояние пула: %v", name, err)
+	}
+	h.detector.InvalidateTopology()
+
+	go func() {
+		if _, err := xkeen.Restart(rt.Dispatcher); err != nil {
+			log.Printf("[POOL][%s] Ошибка рестарта: %v", name, err)
+		}
+	}()
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "restarting": true})
+}
+
+// HandleNamedPoolSync — POST /api/pools/{name}/sync. Brings one named pool in
+// line with the subscription by its own rules. With dry_run=1 it only answers
+// with the plan.
+func (h *Handlers) HandleNamedPoolSync(w http.ResponseWriter, r *http.Request) {
+	p, ok := h.namedPool(w, r)
+	if !ok {
+		return
+	}
+	state := h.pool.GetPool(p.Name)
+	if !state.Enabled {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("пул %q не включён", p.Name)})
+		return
+	}
+	// The live path goes through the api block the main pool brought
+	state.APIFile = h.pool.Get().APIFile
+
+	sel := p.Selection(h.config, h.geoip, h.subscription)
+	if isDryRun(r) {
+		plan, err := xkeen.PlanRefreshPool(h.detector.Runtime(), h.config.OutboundsFile, h.config.XrayAPIAddr,
+			h.subscription.GetServers(), state, sel)
+		writePlan(w, plan, err)
+		return
+	}
+
+	result, err := xkeen.RefreshPool(h.detector.Runtime(), h.config.OutboundsFile, h.config.XrayAPIAddr,
+		h.subscription.GetServers(), state, sel)
+	if err != nil {
+		writeJSON(w, http.StatusInternalServerError, map[string]string{"error": err.Error()})
+		return
+	}
+	if result.Changed {
+		h.detector.InvalidateTopology()
+	}
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{
+		"success":          true,
+		"changed":          result.Changed,
+		"added":            result.Added,
+		"removed":          result.Removed,
+		"replaced":         result.Replaced,
+		"live":             result.Live,
+		"restarting":       result.Restarted,
+		"strategy_changed": result.StrategyChanged,
+		"bypass_changed":   result.BypassChanged,
+	})
+}
+
+// HandleNamedPoolPin — POST /api/pools/{name}/pin. Pins the node of one
+// named pool that carries the chosen server; the other pools keep theirs.
+func (h *Handlers) HandleNamedPoolPin(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	var req models.SelectServerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "неверный формат запроса"})
+		return
+	}
+
+	state := h.pool.GetPool(name)
+	top, ok := h.detector.Topology().Balancer(state.BalancerTag)
+	if !state.Enabled || !ok {
+		writeJSON(w, http.StatusConflict, map[string]string{"error": fmt.Sprintf("пул %q не включён", name)})
+		return
+	}
+
+	servers := h.subscription.GetServers()
+	if req.ID < 0 || req.ID >= len(servers) {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": "сервер не найден"})
+		return
+	}
+	server := servers[req.ID]
+
+	if err := h.pinPoolNode(h.detector.Runtime(), top, &server, name); err != nil {
+		writeJSON(w, http.StatusBadRequest, map[string]string{"error": err.Error()})
+		return
+	}
+	h.watchdog.Log("[PIN][%s] Трафик закреплён за сервером %s", name, xkeen.DisplayName(server))
+
+	writeJSON(w, http.StatusOK, map[string]interface{}{"success": true, "pinned_tag": h.pool.GetPool(name).PinnedTag})
+}
+
 // HandleGetSettings — GET /api/xkeen/settings (contents of xkeen.json)
 func (h *Handlers) HandleGetSettings(w http.ResponseWriter, r *http.Request) {
 	rt := h.detector.Runtime()
@@ -121,8 +121,8 @@ func (c *Config) RoutingMark() int {
 	return 0
 }
 
-// SyncProxies replaces the proxies section with one entry per VLESS server and
-// points every proxy-group at the new names.
+// SyncProxies replaces the proxies section with one entry per server and points
+// every proxy-group at the new names.
 //
 // The routing mark already in the config is carried over: XKeen validates it on
 // every proxy when Entware proxying is on, and dropping it disables that feature
@@ -135,11 +135,11 @@ func (c *Config) SyncProxies(servers []models.Server) ([]string, error) {
 	used := map[string]bool{}
 
 	for _, server := range servers {
-		if server.RawURI == "" || (server.Protocol != "" && server.Protocol != "vless") {
+		if server.RawURI == "" {
 			continue
 		}
 
-		params, err := xkeen.ParseVLESS(server.RawURI)
+		params, err := xkeen.ParseProxyURI(server.RawURI)
 		if err != nil {
 			continue
 		}
@@ -155,7 +155,7 @@ func (c *Config) SyncProxies(servers []models.Server) ([]string, error) {
 	}
 
 	if len(proxies) == 0 {
-		return nil, fmt.Errorf("нет VLESS-серверов для конфигурации Mihomo")
+		return nil, fmt.Errorf("нет серверов для конфигурации Mihomo")
 	}
 
 	setMapValue(c.root(), "proxies", &yaml.Node{
@@ -276,3 +276,101 @@ func TestWriteKeepsBackup(t *testing.T) {
 		t.Error("restore did not bring the original back")
 	}
 }
+
+// Mihomo runs the protocols Xray cannot, so every parsed server must reach it
+// in Mihomo's own vocabulary.
+func TestSyncProxiesWritesEveryProtocol(t *testing.T) {
+	path := writeConfig(t, "mixed-port: 7890\n")
+
+	cfg, err := Read(path)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	names, err := cfg.SyncProxies([]models.Server{
+		{Name: "SS", Protocol: "shadowsocks", RawURI: "ss://aes-256-gcm:secret@1.2.3.4:8388#SS"},
+		{Name: "TR", Protocol: "trojan", RawURI: "trojan://pw@t.example:443?sni=t.example#TR"},
+		{Name: "HY", Protocol: "hysteria2", RawURI: "hy2://pw@h.example:443?obfs=salamander&obfs-password=salt#HY"},
+		{Name: "TU", Protocol: "tuic", RawURI: "tuic://id:pw@u.example:443?congestion_control=bbr#TU"},
+		{Name: "WG", Protocol: "wireguard", RawURI: "wireguard://AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE%3D@w.example:2408?publickey=ztBvKOdLsPbfVdzIIy3RuhPrQpUiLGdrfRqPAc9FPmM%3D&address=172.16.0.2/32,fd01::2/128&reserved=1,2,3#WG"},
+		{Name: "bad", Protocol: "socks", RawURI: "socks://x@y:1"},
+	})
+	if err != nil {
+		t.Fatalf("SyncProxies: %v", err)
+	}
+	if len(names) != 5 {
+		t.Fatalf("names = %v, want the five parseable servers", names)
+	}
+	if err := cfg.Write(); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var parsed struct {
+		Proxies []map[string]interface{} `yaml:"proxies"`
+	}
+	body, _ := os.ReadFile(path)
+	if err := yaml.Unmarshal(body, &parsed); err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	byType := map[string]map[string]interface{}{}
+	for _, proxy := range parsed.Proxies {
+		byType[proxy["type"].(string)] = proxy
+	}
+
+	if ss := byType["ss"]; ss["cipher"] != "aes-256-gcm" || ss["password"] != "secret" {
+		t.Errorf("ss = %v", ss)
+	}
+	if tr := byType["trojan"]; tr["password"] != "pw" || tr["sni"] != "t.example" {
+		t.Errorf("trojan = %v", tr)
+	}
+	if hy := byType["hysteria2"]; hy["obfs"] != "salamander" || hy["obfs-password"] != "salt" {
+		t.Errorf("hysteria2 = %v", hy)
+	}
+	if tu := byType["tuic"]; tu["uuid"] != "id" || tu["congestion-controller"] != "bbr" {
+		t.Errorf("tuic = %v", tu)
+	}
+	wg := byType["wireguard"]
+	if wg["ip"] != "172.16.0.2" || wg["ipv6"] != "fd01::2" || wg["public-key"] == nil {
+		t.Errorf("wireguard = %v", wg)
+	}
+	if reserved, _ := wg["reserved"].([]interface{}); len(reserved) != 3 {
+		t.Errorf("wireguard reserved = %v", wg["reserved"])
+	}
+}
+
+// Xray has no SIP003 plugins, Mihomo does: a plugin link reaches the config
+// with the plugin spelled Mihomo's way.
+func TestSyncProxiesWritesShadowsocksPlugin(t *testing.T) {
+	path := writeConfig(t, "mixed-port: 7890\n")
+
+	cfg, err := Read(path)
+	if err != nil {
+		t.Fatalf("Read: %v", err)
+	}
+	names, err := cfg.SyncProxies([]models.Server{
+		{Name: "obfs", Protocol: "shadowsocks", RawURI: "ss://YWVzLTI1Ni1nY206c2VjcmV0@1.2.3.4:8388/?plugin=obfs-local%3Bobfs%3Dhttp%3Bobfs-host%3Dbing.com#obfs"},
+		{Name: "v2ray", Protocol: "shadowsocks", RawURI: "ss://YWVzLTI1Ni1nY206c2VjcmV0@1.2.3.5:443/?plugin=v2ray-plugin%3Btls%3Bhost%3Dcdn.example#v2ray"},
+	})
+	if err != nil || len(names) != 2 {
+		t.Fatalf("SyncProxies = %v, %v", names, err)
+	}
+	if err := cfg.Write(); err != nil {
+		t.Fatalf("Write: %v", err)
+	}
+
+	var parsed struct {
+		Proxies []map[string]interface{} `yaml:"proxies"`
+	}
+	body, _ := os.ReadFile(path)
+	if err := yaml.Unmarshal(body, &parsed); err != nil {
+		t.Fatalf("parse: %v", err)
+	}
+
+	obfs, v2ray := parsed.Proxies[0], parsed.Proxies[1]
+	if opts, _ := obfs["plugin-opts"].(map[string]interface{}); obfs["plugin"] != "obfs" || opts["mode"] != "http" || opts["host"] != "bing.com" {
+		t.Errorf("obfs = %v", obfs)
+	}
+	if opts, _ := v2ray["plugin-opts"].(map[string]interface{}); v2ray["plugin"] != "v2ray-plugin" || opts["mode"] != "websocket" || opts["tls"] != true {
+		t.Errorf("v2ray = %v", v2ray)
+	}
+}
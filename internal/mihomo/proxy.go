@@ -9,25 +9,44 @@ import (
 	"xkeen-panel/internal/xkeen"
 )
 
-// vlessProxy is Mihomo's shape of a VLESS node. Field order here is the order
-// written to the file, so it stays readable when the owner opens it.
-type vlessProxy struct {
-	Name              string       `yaml:"name"`
-	Type              string       `yaml:"type"`
-	Server            string       `yaml:"server"`
-	Port              int          `yaml:"port"`
-	UUID              string       `yaml:"uuid"`
-	Network           string       `yaml:"network,omitempty"`
-	UDP               bool         `yaml:"udp"`
-	TLS               bool         `yaml:"tls,omitempty"`
-	Servername        string       `yaml:"servername,omitempty"`
-	Flow              string       `yaml:"flow,omitempty"`
-	ClientFingerprint string       `yaml:"client-fingerprint,omitempty"`
-	ALPN              []string     `yaml:"alpn,omitempty"`
-	RealityOpts       *realityOpts `yaml:"reality-opts,omitempty"`
-	WSOpts            *wsOpts      `yaml:"ws-opts,omitempty"`
-	GRPCOpts          *grpcOpts    `yaml:"grpc-opts,omitempty"`
-	RoutingMark       int          `yaml:"routing-mark,omitempty"`
+// proxy is Mihomo's shape of a node, for every protocol the panel parses. Field
+// order here is the order written to the file, so it stays readable when the
+// owner opens it; whatever a protocol does not use is omitted.
+type proxy struct {
+	Name              string                 `yaml:"name"`
+	Type              string                 `yaml:"type"`
+	Server            string                 `yaml:"server"`
+	Port              int                    `yaml:"port"`
+	UUID              string                 `yaml:"uuid,omitempty"`
+	Password          string                 `yaml:"password,omitempty"`
+	Cipher            string                 `yaml:"cipher,omitempty"`
+	Plugin            string                 `yaml:"plugin,omitempty"`
+	PluginOpts        map[string]interface{} `yaml:"plugin-opts,omitempty"`
+	AlterID           int                    `yaml:"alterId,omitempty"`
+	PrivateKey        string                 `yaml:"private-key,omitempty"`
+	PublicKey         string                 `yaml:"public-key,omitempty"`
+	PresharedKey      string                 `yaml:"pre-shared-key,omitempty"`
+	IP                string                 `yaml:"ip,omitempty"`
+	IPv6              string                 `yaml:"ipv6,omitempty"`
+	Reserved          []int                  `yaml:"reserved,omitempty,flow"`
+	MTU               int                    `yaml:"mtu,omitempty"`
+	Network           string                 `yaml:"network,omitempty"`
+	UDP               bool                   `yaml:"udp"`
+	TLS               bool                   `yaml:"tls,omitempty"`
+	Servername        string                 `yaml:"servername,omitempty"`
+	SNI               string                 `yaml:"sni,omitempty"`
+	SkipCertVerify    bool                   `yaml:"skip-cert-verify,omitempty"`
+	Flow              string                 `yaml:"flow,omitempty"`
+	ClientFingerprint string                 `yaml:"client-fingerprint,omitempty"`
+	ALPN              []string               `yaml:"alpn,omitempty"`
+	Obfs              string                 `yaml:"obfs,omitempty"`
+	ObfsPassword      string                 `yaml:"obfs-password,omitempty"`
+	CongestionControl string                 `yaml:"congestion-controller,omitempty"`
+	UDPRelayMode      string                 `yaml:"udp-relay-mode,omitempty"`
+	RealityOpts       *realityOpts           `yaml:"reality-opts,omitempty"`
+	WSOpts            *wsOpts                `yaml:"ws-opts,omitempty"`
+	GRPCOpts          *grpcOpts              `yaml:"grpc-opts,omitempty"`
+	RoutingMark       int                    `yaml:"routing-mark,omitempty"`
 }
 
 type realityOpts struct {
@@ -44,54 +63,169 @@ type grpcOpts struct {
 	ServiceName string `yaml:"grpc-service-name,omitempty"`
 }
 
-// proxyNode converts a parsed VLESS URI into a Mihomo proxy entry.
-func proxyNode(name string, p *xkeen.VLESSParams, routingMark int) (*yaml.Node, error) {
-	proxy := vlessProxy{
-		Name:              name,
-		Type:              "vless",
-		Server:            p.Address,
-		Port:              p.Port,
-		UUID:              p.UUID,
-		Network:           mihomoNetwork(p.Network),
-		UDP:               true,
-		Flow:              p.Flow,
-		Servername:        p.SNI,
-		ClientFingerprint: p.Fingerprint,
-		RoutingMark:       routingMark,
+// proxyNode converts a parsed proxy URI into a Mihomo proxy entry.
+func proxyNode(name string, p *xkeen.ProxyParams, routingMark int) (*yaml.Node, error) {
+	entry := proxy{
+		Name:        name,
+		Type:        mihomoType(p.Protocol),
+		Server:      p.Address,
+		Port:        p.Port,
+		UDP:         true,
+		RoutingMark: routingMark,
 	}
 
-	// Mihomo has no separate "reality" security: reality is TLS plus reality-opts
-	switch p.Security {
-	case "tls":
-		proxy.TLS = true
-	case "reality":
-		proxy.TLS = true
-		proxy.RealityOpts = &realityOpts{PublicKey: p.PublicKey, ShortID: p.ShortID}
-	}
+	switch entry.Type {
+	case "ss":
+		entry.Cipher = p.Method
+		entry.Password = p.Password
+		entry.Plugin, entry.PluginOpts = mihomoPlugin(p.Plugin)
 
-	if p.ALPN != "" {
-		proxy.ALPN = strings.Split(p.ALPN, ",")
-	}
+	case "hysteria2":
+		entry.Password = p.Password
+		entry.SNI = p.SNI
+		entry.SkipCertVerify = p.Insecure
+		entry.Obfs = p.Obfs
+		entry.ObfsPassword = p.ObfsPassword
+		entry.ALPN = splitList(p.ALPN)
+
+	case "tuic":
+		entry.UUID = p.UUID
+		entry.Password = p.Password
+		entry.SNI = p.SNI
+		entry.SkipCertVerify = p.Insecure
+		entry.CongestionControl = p.CongestionControl
+		entry.UDPRelayMode = p.UDPRelayMode
+		entry.ALPN = splitList(p.ALPN)
+
+	case "wireguard":
+		entry.PrivateKey = p.PrivateKey
+		entry.PublicKey = p.PublicKey
+		entry.PresharedKey = p.PresharedKey
+		entry.Reserved = p.Reserved
+		entry.MTU = p.MTU
+		// Mihomo wants bare interface addresses, one per family
+		for _, addr := range p.LocalAddress {
+			ip, _, _ := strings.Cut(addr, "/")
+			if strings.Contains(ip, ":") {
+				if entry.IPv6 == "" {
+					entry.IPv6 = ip
+				}
+			} else if entry.IP == "" {
+				entry.IP = ip
+			}
+		}
+
+	default:
+		// vless, vmess, trojan: one credential plus a v2ray-style transport
+		switch entry.Type {
+		case "trojan":
+			entry.Password = p.Password
+			entry.SNI = p.SNI
+		case "vmess":
+			entry.UUID = p.UUID
+			entry.AlterID = p.AlterID
+			entry.Cipher = p.Cipher
+			entry.Servername = p.SNI
+		default:
+			entry.UUID = p.UUID
+			entry.Flow = p.Flow
+			entry.Servername = p.SNI
+		}
+		entry.Network = mihomoNetwork(p.Network)
+		entry.ClientFingerprint = p.Fingerprint
+		entry.SkipCertVerify = p.Insecure
+		entry.ALPN = splitList(p.ALPN)
 
-	switch proxy.Network {
-	case "ws":
-		opts := &wsOpts{Path: p.Path}
-		if p.Host != "" {
-			opts.Headers = map[string]string{"Host": p.Host}
+		// Mihomo has no separate "reality" security: reality is TLS plus reality-opts
+		switch p.Security {
+		case "tls":
+			entry.TLS = true
+		case "reality":
+			entry.TLS = true
+			entry.RealityOpts = &realityOpts{PublicKey: p.PublicKey, ShortID: p.ShortID}
+		}
+		// Trojan is TLS by definition and has no tls switch in Mihomo
+		if entry.Type == "trojan" {
+			entry.TLS = false
+		}
+
+		switch entry.Network {
+		case "ws":
+			opts := &wsOpts{Path: p.Path}
+			if p.Host != "" {
+				opts.Headers = map[string]string{"Host": p.Host}
+			}
+			entry.WSOpts = opts
+		case "grpc":
+			entry.GRPCOpts = &grpcOpts{ServiceName: p.Path}
 		}
-		proxy.WSOpts = opts
-	case "grpc":
-		proxy.GRPCOpts = &grpcOpts{ServiceName: p.Path}
 	}
 
 	var node yaml.Node
-	if err := node.Encode(proxy); err != nil {
+	if err := node.Encode(entry); err != nil {
 		return nil, err
 	}
 
 	return &node, nil
 }
 
+// mihomoPlugin turns a SIP003 plugin, "obfs-local;obfs=http;obfs-host=x",
+// into Mihomo's plugin and plugin-opts. Mihomo calls the simple-obfs client
+// "obfs" and spells its options its own way; a bare word like v2ray-plugin's
+// tls is a flag.
+func mihomoPlugin(sip003 string) (string, map[string]interface{}) {
+	if sip003 == "" {
+		return "", nil
+	}
+	fields := strings.Split(sip003, ";")
+	name := fields[0]
+	opts := make(map[string]interface{}, len(fields)-1)
+	for _, field := range fields[1:] {
+		if key, value, ok := strings.Cut(field, "="); ok {
+			opts[key] = value
+		} else if field != "" {
+			opts[field] = true
+		}
+	}
+
+	switch name {
+	case "obfs-local", "simple-obfs":
+		obfs := map[string]interface{}{}
+		if mode, ok := opts["obfs"]; ok {
+			obfs["mode"] = mode
+		}
+		if host, ok := opts["obfs-host"]; ok {
+			obfs["host"] = host
+		}
+		return "obfs", obfs
+	case "v2ray-plugin":
+		// websocket is the plugin's own default; Mihomo wants it spelled out
+		if _, ok := opts["mode"]; !ok {
+			opts["mode"] = "websocket"
+		}
+	}
+	return name, opts
+}
+
+// mihomoType maps the panel's protocol names onto Mihomo proxy types.
+func mihomoType(protocol string) string {
+	switch protocol {
+	case "", "vless":
+		return "vless"
+	case "shadowsocks":
+		return "ss"
+	default:
+		return protocol
+	}
+}
+
+func splitList(text string) []string {
+	if text == "" {
+		return nil
+	}
+	return strings.Split(text, ",")
+}
+
 // mihomoNetwork maps Xray transport names onto Mihomo's. Xray renamed "tcp" to
 // "raw", but Mihomo still expects "tcp" — and expresses it by omitting the key.
 func mihomoNetwork(network string) string {
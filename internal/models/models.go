@@ -25,6 +25,9 @@ type Config struct {
 	MihomoConfig  string `yaml:"mihomo_config"`
 	XkeenJSON     string `yaml:"xkeen_json"`
 	XrayAPIAddr   string `yaml:"xray_api_addr"`
+	// Where the core publishes its metrics, observatory included; written
+	// next to the api block. Empty = no core-side readout
+	XrayMetricsAddr string `yaml:"xray_metrics_addr"`
 
 	// Autopilot: latency probing and server switching
 	ProbeTimeoutMs     int  `yaml:"probe_timeout_ms"`
@@ -34,12 +37,76 @@ type Config struct {
 	LatencySwitchCount int  `yaml:"latency_switch_count"`
 	BlacklistTTLSec    int  `yaml:"blacklist_ttl_sec"`
 	WatchdogAutoStart  bool `yaml:"watchdog_auto_start"`
+	// How servers are measured: "tcp" connects to the port, "real" fetches
+	// latency_probe_url through the node in a throwaway xray
+	LatencyProbe          string `yaml:"latency_probe"`
+	LatencyProbeURL       string `yaml:"latency_probe_url"`
+	LatencyProbeTimeoutMs int    `yaml:"latency_probe_timeout_ms"`
+	// Background latency sweep of the whole catalogue (minutes, 0 = off, the
+	// default). It backs off its concurrency when the load average per CPU core
+	// passes latency_sweep_max_load, and skips a round at twice that
+	LatencySweepMinutes int     `yaml:"latency_sweep_minutes"`
+	LatencySweepMaxLoad float64 `yaml:"latency_sweep_max_load"`
+	// Probe results kept per server: samples, days, and how often (minutes)
+	// they are written to flash
+	LatencyHistorySize         int `yaml:"latency_history_size"`
+	LatencyHistoryDays         int `yaml:"latency_history_days"`
+	LatencyHistoryFlushMinutes int `yaml:"latency_history_flush_minutes"`
+	// How pool membership, pinning and failover weigh a node
+	ScoreWeights ScoreWeights `yaml:"score_weights"`
 
 	// Automatic subscription refresh
 	SubscriptionRefreshInterval int `yaml:"subscription_refresh_interval"`
+	// Refresh on the provider's profile-update-interval instead of the global
+	// interval when the provider sends one
+	SubscriptionProviderInterval bool `yaml:"subscription_provider_interval"`
+	// Warn when this much of the traffic quota is used, or the subscription
+	// expires within this many days
+	SubscriptionQuotaWarnPercent int `yaml:"subscription_quota_warn_percent"`
+	SubscriptionExpiryWarnDays   int `yaml:"subscription_expiry_warn_days"`
+	// Server lists kept per subscription for diff and rollback
+	SubscriptionHistory int `yaml:"subscription_history"`
+	// Refresh guard: a refresh removing more than this share of a subscription's
+	// servers, or shrinking it below this count, waits for approval (0 = off)
+	SubscriptionMaxRemovedPercent int `yaml:"subscription_max_removed_percent"`
+	SubscriptionMinServers        int `yaml:"subscription_min_servers"`
+
+	// Exit discovery: the trace URL fetched through each node to learn the IP
+	// and country traffic actually leaves from; run for new servers after a
+	// refresh when enabled (off by default: it starts a throwaway core)
+	ExitDiscovery bool   `yaml:"exit_discovery"`
+	ExitTraceURL  string `yaml:"exit_trace_url"`
 
 	// Cap on pool size: every node is probed by observatory separately
 	PoolMaxNodes int `yaml:"pool_max_nodes"`
+	// Servers whose last speed test came out slower stay out of the pool
+	PoolMinSpeedMbps float64 `yaml:"pool_min_speed_mbps"`
+	// Name of a saved server filter the pool is built from ("" = every server)
+	PoolFilter string `yaml:"pool_filter"`
+	// Only servers whose UDP check passed go into the pool
+	PoolRequireUDP bool `yaml:"pool_require_udp"`
+	// How the main pool's balancer picks a node: leastPing, leastLoad, random
+	// or roundRobin
+	PoolStrategy string `yaml:"pool_strategy"`
+	// leastLoad settings, shared by every pool running it
+	PoolLeastLoad LeastLoadConfig `yaml:"pool_least_load"`
+	// How long the main pool's pin holds and which traffic skips it
+	PoolPin PinPolicy `yaml:"pool_pin"`
+	// Named pools running next to the main one, each with its own balancer
+	Pools []PoolConfig `yaml:"pools"`
+	// DNS server the UDP check queries through each node
+	UDPCheckDNS string `yaml:"udp_check_dns"`
+
+	// What happens to duplicate servers: "keep", "hide" or "merge". Same
+	// endpoint is always a duplicate; duplicate_rules adds looser matches
+	// ("host", "uuid")
+	DuplicateMode  string   `yaml:"duplicate_mode"`
+	DuplicateRules []string `yaml:"duplicate_rules"`
+
+	// On-demand speed test: what is downloaded and when it stops
+	SpeedTestURL        string `yaml:"speedtest_url"`
+	SpeedTestMaxMB      int    `yaml:"speedtest_max_mb"`
+	SpeedTestMaxSeconds int    `yaml:"speedtest_max_seconds"`
 
 	// Health probes of real services, used to catch an exit IP a CDN blocks
 	// while plain connectivity still works. One service per round, in rotation.
@@ -76,27 +143,347 @@ type User struct {
 	Credentials []webauthn.Credential `json:"credentials,omitempty"`
 }
 
+// LeastLoadConfig tunes Xray's leastLoad strategy, which ranks nodes by the
+// samples burstObservatory collects rather than by a single ping.
+type LeastLoadConfig struct {
+	Expected  int      `yaml:"expected" json:"expected,omitempty"`   // nodes kept in rotation
+	Baselines []string `yaml:"baselines" json:"baselines,omitempty"` // RTT tiers, e.g. ["300ms", "1s"]
+	Tolerance float64  `yaml:"tolerance" json:"tolerance,omitempty"` // share of failed probes a node may have
+}
+
+// PinPolicy says how long a pool's pin holds and which traffic skips it. The
+// zero value pins forever and covers everything.
+type PinPolicy struct {
+	RotateAt string `yaml:"rotate_at" json:"rotate_at,omitempty"` // "04:00": re-pick the node daily at that local time
+
+	// Traffic that goes through the pool's nodes unpinned, picked by the
+	// balancer per connection — for services that do not care about the exit IP.
+	// BypassDestPorts match the port the traffic goes to, Xray's "port" rule;
+	// traffic arriving on a given inbound port is picked by BypassInboundTags.
+	BypassDomains     []string `yaml:"bypass_domains" json:"bypass_domains,omitempty"`
+	BypassDestPorts   string   `yaml:"bypass_dest_ports" json:"bypass_dest_ports,omitempty"` // "443,50000-60000"
+	BypassInboundTags []string `yaml:"bypass_inbound_tags" json:"bypass_inbound_tags,omitempty"`
+}
+
+// PoolConfig describes a named pool: which servers it is built from and which
+// traffic it carries. Routing conditions of different kinds are separate
+// rules, so traffic matching any of them goes through the pool.
+type PoolConfig struct {
+	Name      string   `yaml:"name" json:"name"`
+	Countries []string `yaml:"countries" json:"countries,omitempty"` // entry or exit country
+	Tags      []string `yaml:"tags" json:"tags,omitempty"`           // server tags
+	Filter    string   `yaml:"filter" json:"filter,omitempty"`       // saved server filter
+	MaxNodes  int      `yaml:"max_nodes" json:"max_nodes,omitempty"`
+	Strategy  string   `yaml:"strategy" json:"strategy,omitempty"` // balancer strategy, leastPing by default; leastLoad takes pool_least_load
+
+	Domains     []string `yaml:"domains" json:"domains,omitempty"` // as in Xray rules: domain:, geosite:, full:
+	IPs         []string `yaml:"ips" json:"ips,omitempty"`
+	Ports       string   `yaml:"ports" json:"ports,omitempty"` // "443,50000-60000"
+	InboundTags []string `yaml:"inbound_tags" json:"inbound_tags,omitempty"`
+
+	Pin PinPolicy `yaml:"pin" json:"pin,omitzero"`
+}
+
 // Server is one entry of the subscription.
 type Server struct {
-	ID              int       `json:"id"`
+	ID              int        `json:"id"`
+	Name            string     `json:"name"`
+	Address         string     `json:"address"`
+	Port            int        `json:"port"`
+	Protocol        string     `json:"protocol"`
+	Active          bool       `json:"active"`
+	Latency         int        `json:"latency_ms"`
+	RawURI          string     `json:"raw_uri,omitempty"`
+	LastChecked     time.Time  `json:"last_checked,omitempty"`
+	Country         string     `json:"country,omitempty"`
+	CountryOverride string     `json:"country_override,omitempty"`
+	Source          string     `json:"source,omitempty"` // name of the subscription the server came from
+	Speed           *SpeedTest `json:"speed,omitempty"`
+
+	// Where traffic leaves the node, as seen from outside; it may be another
+	// country than the entry address
+	ExitIP      string    `json:"exit_ip,omitempty"`
+	ExitCountry string    `json:"exit_country,omitempty"`
+	ExitChecked time.Time `json:"exit_checked,omitempty"` // when the exit was last found
+	ExitTried   time.Time `json:"exit_tried,omitempty"`   // when it was last looked for, found or not
+	// Whether UDP gets through the node: nil until checked
+	UDP *UDPCheck `json:"udp,omitempty"`
+
+	// User attributes, copied from SubscriptionData.Prefs on every rebuild
+	Favorite   bool     `json:"favorite,omitempty"`
+	Excluded   bool     `json:"excluded,omitempty"`
+	CustomName string   `json:"custom_name,omitempty"`
+	Priority   int      `json:"priority,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	ProbeMode  string   `json:"probe_mode,omitempty"` // "tcp", "quic", or "" to go by the protocol
+
+	// Duplicate detection: DuplicateOf is the ID of the server kept in this
+	// one's place (hide and merge modes); Aliases names the servers merged
+	// into this one (merge mode)
+	DuplicateOf *int     `json:"duplicate_of,omitempty"`
+	Aliases     []string `json:"aliases,omitempty"`
+}
+
+// UDPCheck is the result of a DNS query over UDP sent through a node.
+type UDPCheck struct {
+	OK        bool      `json:"ok"`
+	LatencyMs int       `json:"latency_ms,omitempty"`
+	Time      time.Time `json:"time"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// ServerPrefs are what the user set on a server: a favourite is always pooled
+// and tried first on failover, an excluded one is never picked automatically,
+// a higher priority ranks ahead of a better score.
+type ServerPrefs struct {
+	Favorite bool     `json:"favorite,omitempty"`
+	Excluded bool     `json:"excluded,omitempty"`
+	Name     string   `json:"name,omitempty"`
+	Priority int      `json:"priority,omitempty"`
+	Tags     []string `json:"tags,omitempty"`
+	Probe    string   `json:"probe,omitempty"` // transport probe: "tcp", "quic", "" = by protocol
+}
+
+// IsZero reports whether nothing is set.
+func (p ServerPrefs) IsZero() bool {
+	return !p.Favorite && !p.Excluded && p.Name == "" && p.Priority == 0 && len(p.Tags) == 0 && p.Probe == ""
+}
+
+// ServerFilter narrows the server list. Empty fields do not filter; list
+// fields match any of their values. A latency bound keeps only servers that
+// answered their last check.
+type ServerFilter struct {
+	Protocols  []string `json:"protocols,omitempty"`
+	Countries  []string `json:"countries,omitempty"`
+	MinLatency int      `json:"min_latency_ms,omitempty"`
+	MaxLatency int      `json:"max_latency_ms,omitempty"`
+	Tags       []string `json:"tags,omitempty"`
+	Sources    []string `json:"sources,omitempty"`
+	InPool     *bool    `json:"in_pool,omitempty"`
+	UDP        *bool    `json:"udp,omitempty"` // true: UDP proven to work; false: not proven
+}
+
+// LatencyStats sums up the probe history of a server. Percentiles are over the
+// probes that got an answer and are -1 when none did; Loss is the share that
+// did not. Sparkline holds the latest results, oldest first, -1 for a loss.
+type LatencyStats struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Key       string    `json:"key,omitempty"`
+	Kind      string    `json:"kind,omitempty"` // the probe kind summed up: tcp or real
+	Samples   int       `json:"samples"`
+	P50       int       `json:"p50_ms"`
+	P90       int       `json:"p90_ms"`
+	P99       int       `json:"p99_ms"`
+	Loss      float64   `json:"loss"`
+	Last      int       `json:"last_ms"`
+	LastTime  time.Time `json:"last_time,omitempty"`
+	Sparkline []int     `json:"sparkline,omitempty"`
+}
+
+// ScoreWeights price each factor of a node's score in milliseconds: Loss per
+// 100% of probes lost, Health and Blacklist per incident in the last day.
+type ScoreWeights struct {
+	Latency   float64 `yaml:"latency" json:"latency"`
+	Jitter    float64 `yaml:"jitter" json:"jitter"`
+	Loss      float64 `yaml:"loss" json:"loss"`
+	Health    float64 `yaml:"health" json:"health"`
+	Blacklist float64 `yaml:"blacklist" json:"blacklist"`
+}
+
+// NodeScore is how a server was rated, lower being better. Parts holds what
+// each factor added to Score; an unreachable server ranks after every
+// reachable one whatever its score.
+type NodeScore struct {
+	ID             int                `json:"id"`
+	Name           string             `json:"name"`
+	Key            string             `json:"key,omitempty"`
+	Score          float64            `json:"score"`
+	Reachable      bool               `json:"reachable"`
+	Latency        int                `json:"latency_ms"`
+	P50            int                `json:"p50_ms"`
+	P90            int                `json:"p90_ms"`
+	Jitter         int                `json:"jitter_ms"`
+	Loss           float64            `json:"loss"`
+	HealthFailures int                `json:"health_failures"`
+	Blacklists     int                `json:"blacklists"`
+	Parts          map[string]float64 `json:"parts,omitempty"`
+}
+
+// SpeedTest is the outcome of a download through a server. A failed test has
+// Error set and no speed.
+type SpeedTest struct {
+	Mbps       float64   `json:"mbps"`
+	Bytes      int64     `json:"bytes"`
+	DurationMs int64     `json:"duration_ms"`
+	Time       time.Time `json:"time"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// Subscription is one provider feeding the server catalogue.
+type Subscription struct {
 	Name            string    `json:"name"`
-	Address         string    `json:"address"`
-	Port            int       `json:"port"`
-	Protocol        string    `json:"protocol"`
-	Active          bool      `json:"active"`
-	Latency         int       `json:"latency_ms"`
-	RawURI          string    `json:"raw_uri,omitempty"`
-	LastChecked     time.Time `json:"last_checked,omitempty"`
-	Country         string    `json:"country,omitempty"`
-	CountryOverride string    `json:"country_override,omitempty"`
+	URL             string    `json:"url"`
+	Enabled         bool      `json:"enabled"`
+	RefreshInterval int       `json:"refresh_interval,omitempty"` // seconds; 0 = subscription_refresh_interval
+	LastUpdated     time.Time `json:"last_updated,omitempty"`
+	LastAttempt     time.Time `json:"last_attempt,omitempty"`
+	LastError       string    `json:"last_error,omitempty"`
+
+	Fetch FetchOptions `json:"fetch"`
+
+	// Validators of the last response that parsed, sent back so that an
+	// unchanged subscription costs a 304 and nothing else
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+
+	// Report is what the last download yielded, kept even when it yielded
+	// nothing — that is when it is needed most
+	Report *ParseReport `json:"report,omitempty"`
+
+	// Usage is the account state the provider reported with the last download
+	Usage *SubscriptionUsage `json:"usage,omitempty"`
+
+	// Quarantine is a refresh held back for approval
+	Quarantine *Quarantine `json:"quarantine,omitempty"`
+}
+
+// Quarantine is a downloaded server list that failed the refresh guard — too
+// many servers gone at once — and waits for the owner to apply or drop it.
+type Quarantine struct {
+	Time         time.Time `json:"time"`
+	Reason       string    `json:"reason"`
+	Servers      []Server  `json:"servers"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified string    `json:"last_modified,omitempty"`
+}
+
+// FetchOptions is how a subscription is downloaded. The zero value is a plain
+// GET with Go's defaults.
+type FetchOptions struct {
+	UserAgent string            `json:"user_agent,omitempty"`
+	Headers   map[string]string `json:"headers,omitempty"`
+	// Proxy is an http://, https:// or socks5:// URL — e.g. the core's own
+	// inbound, for a provider that is blocked outside the tunnel
+	Proxy    string `json:"proxy,omitempty"`
+	Insecure bool   `json:"insecure,omitempty"` // skip TLS certificate verification
+}
+
+// SubscriptionUsage is what a provider says about the account behind a
+// subscription, read from the subscription-userinfo, profile-update-interval
+// and profile-title response headers.
+type SubscriptionUsage struct {
+	Title          string    `json:"title,omitempty"`
+	Upload         int64     `json:"upload"`                    // bytes
+	Download       int64     `json:"download"`                  // bytes
+	Total          int64     `json:"total"`                     // bytes; 0 = unlimited
+	Expire         time.Time `json:"expire,omitempty"`          // zero = never
+	UpdateInterval int       `json:"update_interval,omitempty"` // seconds
+}
+
+// ParseReport accounts for every entry of a downloaded subscription: how many
+// the provider sent, how many became servers, and why each of the rest was
+// dropped. Rejected entries are redacted — a report is meant to be shown to
+// the provider, and the credentials in it are the owner's.
+type ParseReport struct {
+	Format   string         `json:"format"` // links, clash, sing-box
+	Total    int            `json:"total_lines"`
+	Accepted int            `json:"accepted"`
+	Rejected []RejectedLine `json:"rejected,omitempty"`
+	Omitted  int            `json:"omitted,omitempty"` // rejections beyond the stored limit
+}
+
+// RejectedLine is one subscription entry that did not become a server.
+type RejectedLine struct {
+	Line   int    `json:"line"` // 1-based line, or entry number in a document
+	Scheme string `json:"scheme,omitempty"`
+	Error  string `json:"error"`
+	Text   string `json:"text"` // the entry with secrets masked
 }
 
 // SubscriptionData is the stored subscription (data/subscription.json).
+//
+// Servers is the merged catalogue of every enabled subscription, in the order
+// the subscriptions are listed; ActiveID indexes into it.
 type SubscriptionData struct {
-	URL         string    `json:"url"`
-	LastUpdated time.Time `json:"last_updated"`
-	Servers     []Server  `json:"servers"`
-	ActiveID    int       `json:"active_id"`
+	URL           string         `json:"url,omitempty"` // deprecated: a single-provider file, migrated on load
+	Subscriptions []Subscription `json:"subscriptions,omitempty"`
+	LastUpdated   time.Time      `json:"last_updated"`
+	Servers       []Server       `json:"servers"`
+	ActiveID      int            `json:"active_id"`
+
+	// Manual holds share links added by hand; they follow the subscriptions
+	// in Servers and no refresh touches them
+	Manual []string `json:"manual,omitempty"`
+
+	// Prefs holds the user's attributes by endpoint key, so they survive
+	// refreshes that renumber or rename servers
+	Prefs map[string]ServerPrefs `json:"prefs,omitempty"`
+
+	// Filters are the saved server filters by name
+	Filters map[string]ServerFilter `json:"filters,omitempty"`
+}
+
+// DuplicateReport lists the groups of servers found to be the same node.
+type DuplicateReport struct {
+	Mode   string           `json:"mode"`
+	Rules  []string         `json:"rules"`
+	Groups []DuplicateGroup `json:"groups"`
+	Hidden int              `json:"hidden"` // servers set aside in place of their group's kept one
+}
+
+// DuplicateGroup is one set of duplicates. Keep is the server that stands for
+// the group; Reasons are the rules that joined it ("endpoint", "host", "uuid").
+type DuplicateGroup struct {
+	Keep    int               `json:"keep"`
+	Reasons []string          `json:"reasons"`
+	Members []DuplicateMember `json:"members"`
+}
+
+// DuplicateMember is one server of a duplicate group.
+type DuplicateMember struct {
+	ID       int    `json:"id"`
+	Name     string `json:"name"`
+	Source   string `json:"source,omitempty"`
+	Endpoint string `json:"endpoint"`
+}
+
+// SubscriptionSnapshot is one server list as a subscription delivered it
+// (data/subscription_history.json).
+type SubscriptionSnapshot struct {
+	ID           int       `json:"id"`
+	Subscription string    `json:"subscription"`
+	Time         time.Time `json:"time"`
+	ServerCount  int       `json:"server_count"`
+	Servers      []Server  `json:"servers,omitempty"`
+	RestoredFrom int       `json:"restored_from,omitempty"` // a rollback to this snapshot ID
+}
+
+// SnapshotDiff is what changed between two snapshots, matched by endpoint.
+type SnapshotDiff struct {
+	From    int          `json:"from"`
+	To      int          `json:"to"`
+	Added   []DiffEntry  `json:"added"`
+	Removed []DiffEntry  `json:"removed"`
+	Changed []DiffChange `json:"changed"`
+}
+
+// DiffEntry is a server in a diff, keyed by its endpoint.
+type DiffEntry struct {
+	Key      string `json:"key"`
+	Name     string `json:"name"`
+	Protocol string `json:"protocol"`
+	Address  string `json:"address"`
+	Port     int    `json:"port"`
+}
+
+// DiffChange is an endpoint present on both sides that is no longer described
+// the same way. Fields lists what differs: name, protocol, params.
+type DiffChange struct {
+	Key    string    `json:"key"`
+	Before DiffEntry `json:"before"`
+	After  DiffEntry `json:"after"`
+	Fields []string  `json:"fields"`
 }
 
 // Status is the connection status reported to the UI.
@@ -117,6 +504,17 @@ type Status struct {
 	Mode         string `json:"mode"`
 	XKeenVersion string `json:"xkeen_version"`
 	Generation   int    `json:"generation"`
+
+	// Quota and expiry of the subscriptions whose provider reports them
+	Subscriptions []SubscriptionStatus `json:"subscriptions,omitempty"`
+}
+
+// SubscriptionStatus is a subscription's account state with what in it needs
+// attention.
+type SubscriptionStatus struct {
+	Name     string            `json:"name"`
+	Usage    SubscriptionUsage `json:"usage"`
+	Warnings []string          `json:"warnings,omitempty"`
 }
 
 // SetupRequest starts the initial account setup.
@@ -148,7 +546,63 @@ type SetCountryRequest struct {
 	Country string `json:"country"`
 }
 
+// SweepSummary describes one background latency sweep. A skipped sweep
+// carries the reason and no results.
+type SweepSummary struct {
+	Time        time.Time `json:"time"`
+	DurationMs  int64     `json:"duration_ms"`
+	Servers     int       `json:"servers"`
+	Reachable   int       `json:"reachable"`
+	Failed      int       `json:"failed"`
+	Concurrency int       `json:"concurrency"`
+	Load        float64   `json:"load"` // load average per CPU core, -1 when unknown
+	Skipped     bool      `json:"skipped,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+}
+
+// ExitResult is the outcome of exit discovery for one server.
+type ExitResult struct {
+	ID      int    `json:"id"`
+	Name    string `json:"name"`
+	IP      string `json:"exit_ip,omitempty"`
+	Country string `json:"exit_country,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// SetServerPrefsRequest changes a server's user attributes; fields left out
+// stay as they are.
+type SetServerPrefsRequest struct {
+	Favorite *bool     `json:"favorite,omitempty"`
+	Excluded *bool     `json:"excluded,omitempty"`
+	Name     *string   `json:"name,omitempty"`
+	Priority *int      `json:"priority,omitempty"`
+	Tags     *[]string `json:"tags,omitempty"`
+	Probe    *string   `json:"probe,omitempty"`
+}
+
 // UpdateSubscriptionRequest sets the subscription URL.
 type UpdateSubscriptionRequest struct {
 	URL string `json:"url"`
 }
+
+// ImportRequest is subscription content pasted into the UI.
+type ImportRequest struct {
+	Name    string `json:"name"` // empty: the primary subscription
+	Content string `json:"content"`
+}
+
+// ManualServerRequest adds a hand-written share link.
+type ManualServerRequest struct {
+	URI string `json:"uri"`
+}
+
+// SubscriptionRequest adds or edits a named subscription. Nil fields are left
+// as they are on edit.
+type SubscriptionRequest struct {
+	Name            string  `json:"name"`
+	URL             *string `json:"url"`
+	Enabled         *bool   `json:"enabled"`
+	RefreshInterval *int    `json:"refresh_interval"`
+	// Fetch replaces the fetch options as a whole
+	Fetch *FetchOptions `json:"fetch"`
+}
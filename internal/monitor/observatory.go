@@ -0,0 +1,95 @@
+package monitor
+
+import (
+	"context"
+	"time"
+
+	"xkeen-panel/internal/models"
+	"xkeen-panel/internal/sse"
+	"xkeen-panel/internal/xkeen"
+)
+
+// observatoryPollInterval is how often the core's observatory is read. It is a
+// local HTTP request, cheap next to the probes the observatory itself runs.
+const observatoryPollInterval = 15 * time.Second
+
+// ObservatoryWatcher pushes the core's view of the pool nodes over SSE, so the
+// UI sees a node the balancer gave up on without polling the panel.
+type ObservatoryWatcher struct {
+	config       *models.Config
+	subscription *xkeen.SubscriptionManager
+	detector     *xkeen.Detector
+	eventBus     *sse.EventBus
+
+	last map[string][]xkeen.PoolNodeStatus // by balancer tag
+}
+
+func NewObservatoryWatcher(cfg *models.Config, sub *xkeen.SubscriptionManager, det *xkeen.Detector) *ObservatoryWatcher {
+	return &ObservatoryWatcher{
+		config:       cfg,
+		subscription: sub,
+		detector:     det,
+		last:         make(map[string][]xkeen.PoolNodeStatus),
+	}
+}
+
+// SetEventBus wires the SSE event bus the readouts go out on.
+func (o *ObservatoryWatcher) SetEventBus(bus *sse.EventBus) {
+	o.eventBus = bus
+}
+
+// Start polls until ctx is cancelled. Without a metrics address there is
+// nothing to read.
+func (o *ObservatoryWatcher) Start(ctx context.Context) {
+	if o.config.XrayMetricsAddr == "" {
+		return
+	}
+
+	ticker := time.NewTicker(observatoryPollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			o.Poll()
+		}
+	}
+}
+
+// Poll reads the observatory once and publishes every pool whose readout
+// changed since the last one.
+func (o *ObservatoryWatcher) Poll() {
+	top := o.detector.Topology()
+	if top.Mode != xkeen.TopologyPool {
+		clear(o.last)
+		return
+	}
+	state, err := xkeen.ObservatoryState(o.config.XrayMetricsAddr)
+	if err != nil {
+		return
+	}
+
+	servers := o.subscription.GetServers()
+	for _, b := range top.Balancers {
+		// A twin shares its pool's nodes, so its readout would be a copy
+		if xkeen.IsBypassBalancerTag(b.Tag) {
+			continue
+		}
+		pool, _ := top.Balancer(b.Tag)
+		nodes, err := xkeen.ObservedPoolNodes(o.config.OutboundsFile, pool, servers, state)
+		if err != nil {
+			continue
+		}
+		if prev, seen := o.last[b.Tag]; seen && xkeen.SameObservations(prev, nodes) {
+			continue
+		}
+		o.last[b.Tag] = nodes
+		if o.eventBus != nil {
+			o.eventBus.Publish(sse.Event{
+				Type: "pool_observatory",
+				Data: map[string]interface{}{"balancer_tag": b.Tag, "nodes": nodes},
+			})
+		}
+	}
+}
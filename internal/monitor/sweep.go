@@ -0,0 +1,205 @@
+package monitor
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"xkeen-panel/internal/models"
+	"xkeen-panel/internal/sse"
+	"xkeen-panel/internal/xkeen"
+)
+
+const (
+	// sweepStartDelay lets the panel and the core settle before the first sweep.
+	sweepStartDelay = time.Minute
+
+	// A sweep where more than this share of the servers failed backs off: the
+	// probes may be what is choking the uplink.
+	sweepMaxFailureRate = 0.5
+
+	// sweepConcurrencyStep is how much concurrency a calm sweep wins back.
+	sweepConcurrencyStep = 2
+)
+
+// Sweeper probes the whole catalogue in the background, so latencies are
+// current without anyone opening the UI.
+//
+// The router carries the tunnel; a sweep must never starve it. Concurrency
+// starts at probe_concurrency, halves when the load average or the sweep's own
+// failure rate is high, and creeps back up while things stay calm.
+type Sweeper struct {
+	config       *models.Config
+	subscription *xkeen.SubscriptionManager
+	detector     *xkeen.Detector
+	eventBus     *sse.EventBus
+	logf         func(format string, args ...interface{})
+	loadAvg      func() (float64, error) // load average per CPU core
+
+	mu          sync.Mutex
+	concurrency int
+}
+
+func NewSweeper(cfg *models.Config, sub *xkeen.SubscriptionManager, det *xkeen.Detector) *Sweeper {
+	return &Sweeper{
+		config:       cfg,
+		subscription: sub,
+		detector:     det,
+		logf:         log.Printf,
+		loadAvg:      readLoadPerCore,
+		concurrency:  maxSweepConcurrency(cfg),
+	}
+}
+
+// SetEventBus wires the SSE event bus the summaries go out on.
+func (s *Sweeper) SetEventBus(bus *sse.EventBus) {
+	s.eventBus = bus
+}
+
+// SetLogger sends the sweeper's messages to the panel log.
+func (s *Sweeper) SetLogger(logf func(format string, args ...interface{})) {
+	s.logf = logf
+}
+
+// Start sweeps every latency_sweep_minutes until ctx is cancelled.
+func (s *Sweeper) Start(ctx context.Context) {
+	interval := time.Duration(s.config.LatencySweepMinutes) * time.Minute
+	if interval <= 0 {
+		return
+	}
+
+	select {
+	case <-ctx.Done():
+		return
+	case <-time.After(sweepStartDelay):
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		s.Sweep()
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Sweep probes every server the panel can render once — set-aside duplicates
+// excepted — stores the results and publishes a summary.
+func (s *Sweeper) Sweep() models.SweepSummary {
+	start := time.Now()
+	summary := models.SweepSummary{Time: start, Load: -1}
+
+	maxLoad := s.config.LatencySweepMaxLoad
+	if load, err := s.loadAvg(); err == nil {
+		summary.Load = load
+		switch {
+		case maxLoad > 0 && load > 2*maxLoad:
+			s.backOff()
+			summary.Skipped = true
+			summary.Reason = fmt.Sprintf("нагрузка %.2f на ядро", load)
+		case maxLoad > 0 && load > maxLoad:
+			s.backOff()
+		}
+	}
+
+	var servers []models.Server
+	for _, server := range s.subscription.GetServers() {
+		if server.RawURI != "" && server.DuplicateOf == nil && xkeen.OutboundSupported(server) {
+			servers = append(servers, server)
+		}
+	}
+	if !summary.Skipped && len(servers) == 0 {
+		summary.Skipped = true
+		summary.Reason = "нет серверов"
+	}
+
+	s.mu.Lock()
+	summary.Concurrency = s.concurrency
+	s.mu.Unlock()
+
+	if summary.Skipped {
+		s.logf("[SWEEP] Проверка пропущена: %s", summary.Reason)
+		s.publish(summary)
+		return summary
+	}
+
+	probe := xkeen.LatencyProbeFromConfig(s.config, s.detector.Runtime(), s.subscription.LatencyHistory())
+	probe.Concurrency = summary.Concurrency
+	checked := probe.Check(servers)
+	s.subscription.UpdateLatencies(checked)
+
+	summary.Servers = len(checked)
+	for _, c := range checked {
+		if c.Latency >= 0 {
+			summary.Reachable++
+		} else {
+			summary.Failed++
+		}
+	}
+	summary.DurationMs = time.Since(start).Milliseconds()
+
+	// The load was checked before the sweep; the failure rate is the sweep's own verdict
+	if float64(summary.Failed) > sweepMaxFailureRate*float64(summary.Servers) {
+		s.backOff()
+	} else if summary.Load < 0 || maxLoad <= 0 || summary.Load <= maxLoad {
+		s.speedUp()
+	}
+
+	s.logf("[SWEEP] Проверено %d серверов за %.1fс: отвечают %d, параллельно %d",
+		summary.Servers, float64(summary.DurationMs)/1000, summary.Reachable, summary.Concurrency)
+	s.publish(summary)
+	return summary
+}
+
+func (s *Sweeper) publish(summary models.SweepSummary) {
+	if s.eventBus != nil {
+		s.eventBus.Publish(sse.Event{Type: "latency_sweep", Data: summary})
+	}
+}
+
+// backOff halves the concurrency, down to one probe at a time.
+func (s *Sweeper) backOff() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.concurrency = max(1, s.concurrency/2)
+}
+
+// speedUp wins concurrency back a step at a time, up to probe_concurrency.
+func (s *Sweeper) speedUp() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.concurrency = min(maxSweepConcurrency(s.config), s.concurrency+sweepConcurrencyStep)
+}
+
+func maxSweepConcurrency(cfg *models.Config) int {
+	if cfg.ProbeConcurrency > 0 {
+		return cfg.ProbeConcurrency
+	}
+	return 20
+}
+
+// readLoadPerCore reads the one-minute load average and divides it by the
+// number of cores: 1.0 means every core is busy.
+func readLoadPerCore() (float64, error) {
+	data, err := os.ReadFile("/proc/loadavg")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return 0, fmt.Errorf("пустой /proc/loadavg")
+	}
+	load, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return 0, err
+	}
+	return load / float64(runtime.NumCPU()), nil
+}
@@ -0,0 +1,83 @@
+package monitor
+
+import (
+	"fmt"
+	"net"
+	"testing"
+
+	"xkeen-panel/internal/models"
+	"xkeen-panel/internal/xkeen"
+)
+
+func newSweeper(t *testing.T, cfg *models.Config, load float64, uris ...string) *Sweeper {
+	t.Helper()
+	sub := xkeen.NewSubscriptionManager(t.TempDir())
+	for _, uri := range uris {
+		if _, err := sub.AddManual(uri); err != nil {
+			t.Fatalf("AddManual: %v", err)
+		}
+	}
+	s := NewSweeper(cfg, sub, xkeen.NewDetector(t.TempDir(), "", "", "", "", "", ""))
+	s.loadAvg = func() (float64, error) { return load, nil }
+	s.logf = func(string, ...interface{}) {}
+	return s
+}
+
+func listeningURI(t *testing.T, name string) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+	port := l.Addr().(*net.TCPAddr).Port
+	return fmt.Sprintf("vless://11111111-2222-3333-4444-555555555555@127.0.0.1:%d?type=tcp#%s", port, name)
+}
+
+func TestSweepStoresLatencies(t *testing.T) {
+	cfg := &models.Config{ProbeTimeoutMs: 500, ProbeConcurrency: 8, LatencySweepMaxLoad: 1}
+	s := newSweeper(t, cfg, 0.2, listeningURI(t, "up"), "vless://id@127.0.0.1:1?type=tcp#down")
+
+	summary := s.Sweep()
+	if summary.Skipped || summary.Servers != 2 || summary.Reachable != 1 || summary.Failed != 1 {
+		t.Fatalf("summary = %+v, want two servers, one answering", summary)
+	}
+	for _, server := range s.subscription.GetServers() {
+		if server.LastChecked.IsZero() {
+			t.Errorf("%s: latency not stored", server.Name)
+		}
+	}
+}
+
+func TestSweepBacksOffUnderLoad(t *testing.T) {
+	cfg := &models.Config{ProbeTimeoutMs: 500, ProbeConcurrency: 8, LatencySweepMaxLoad: 1}
+
+	busy := newSweeper(t, cfg, 1.5, listeningURI(t, "up"))
+	if summary := busy.Sweep(); summary.Skipped || summary.Concurrency != 4 {
+		t.Errorf("busy router: summary = %+v, want the sweep run at half concurrency", summary)
+	}
+
+	overloaded := newSweeper(t, cfg, 2.5, listeningURI(t, "up"))
+	if summary := overloaded.Sweep(); !summary.Skipped || summary.Servers != 0 {
+		t.Errorf("overloaded router: summary = %+v, want the sweep skipped", summary)
+	}
+}
+
+// Mass failure halves the concurrency; calm sweeps win it back up to the cap.
+func TestSweepAdaptsToFailureRate(t *testing.T) {
+	cfg := &models.Config{ProbeTimeoutMs: 300, ProbeConcurrency: 8, LatencySweepMaxLoad: 1}
+	s := newSweeper(t, cfg, 0.1, "vless://id@127.0.0.1:1?type=tcp#down")
+
+	s.Sweep()
+	if s.concurrency != 4 {
+		t.Fatalf("concurrency after a failed sweep = %d, want 4", s.concurrency)
+	}
+
+	s.subscription = newSweeper(t, cfg, 0.1, listeningURI(t, "up")).subscription
+	for range 5 {
+		s.Sweep()
+	}
+	if s.concurrency != 8 {
+		t.Errorf("concurrency after calm sweeps = %d, want back at the cap of 8", s.concurrency)
+	}
+}
@@ -208,7 +208,8 @@ func (w *Watchdog) superviseExit() {
 	rt := w.detector.Runtime()
 
 	if w.poolStore != nil {
-		w.superviseP(rt, top)
+		w.superviseP(rt, top, "")
+		w.superviseNamedPools(rt, top)
 	}
 
 	w.ticks++
@@ -220,9 +221,18 @@ func (w *Watchdog) superviseExit() {
 		return
 	}
 
+	failed := 0
 	for _, verdict := range w.health.Probe(healthProbeTimeout) {
 		if !verdict.OK {
 			w.writeLog("[HEALTH] %s", verdict)
+			failed++
+		}
+	}
+	// One failing service is weak evidence against the exit, but it is
+	// evidence; the score weighs it, the quorum below decides on rotation
+	if failed > 0 && w.poolStore != nil {
+		if node := w.poolStore.Get().PinnedNode; node != "" {
+			w.subscription.LatencyHistory().RecordIncident(node, xkeen.IncidentHealth, time.Now())
 		}
 	}
 
@@ -253,46 +263,110 @@ func (w *Watchdog) superviseExit() {
 //     the stored pin now means something else, so re-pin from scratch
 //   - the core restarted and dropped the override — re-apply it
 //   - nothing is pinned yet — pin the best node
-func (w *Watchdog) superviseP(rt xkeen.Runtime, top xkeen.Topology) {
-	state := w.poolStore.Get()
+//
+// On top of that the pool's pin policy may ask for a scheduled rotation: once
+// rotate_at comes up, the pin moves to the best node other than the current
+// one. Traffic the policy lets bypass the pin is routing, kept by the refresh.
+//
+// name is the named pool top describes, "" for the main one.
+func (w *Watchdog) superviseP(rt xkeen.Runtime, top xkeen.Topology, name string) {
+	state := w.poolStore.GetPool(name)
+	policy := w.pinPolicy(name)
 
 	if state.PinnedTag == "" {
-		tag, err := w.pinBest(rt, top)
+		tag, err := w.pinBest(rt, top, name, "")
 		if err != nil {
-			w.writeLog("[PIN] Не удалось закрепить ноду: %v", err)
+			w.writeLog("[PIN]%s Не удалось закрепить ноду: %v", poolLabel(name), err)
 			return
 		}
-		w.writeLog("[PIN] Трафик закреплён за нодой %s", tag)
+		w.writeLog("[PIN]%s Трафик закреплён за нодой %s", poolLabel(name), tag)
 		return
 	}
 
 	if xkeen.PinDrifted(w.config.OutboundsFile, w.selector(top), state.PinnedTag, state.PinnedNode) {
-		w.writeLog("[PIN] %s больше не ведёт на закреплённый сервер — выбираю заново", state.PinnedTag)
-		tag, err := w.pinBest(rt, top)
+		w.writeLog("[PIN]%s %s больше не ведёт на закреплённый сервер — выбираю заново", poolLabel(name), state.PinnedTag)
+		tag, err := w.pinBest(rt, top, name, "")
+		if err != nil {
+			w.writeLog("[PIN]%s Не удалось перезакрепить: %v", poolLabel(name), err)
+			return
+		}
+		w.writeLog("[PIN]%s Трафик закреплён за нодой %s", poolLabel(name), tag)
+		return
+	}
+
+	// A pin from before the schedule has no time to count from; it starts now
+	if policy.RotateAt != "" && state.PinnedAt.IsZero() {
+		if err := w.poolStore.SetPinnedIn(name, state.PinnedTag, state.PinnedNode); err != nil {
+			w.writeLog("[PIN] Не удалось сохранить закрепление: %v", err)
+		}
+	}
+	if xkeen.PinRotationDue(policy, state.PinnedAt, time.Now()) {
+		tag, err := w.pinBest(rt, top, name, state.PinnedTag)
 		if err != nil {
-			w.writeLog("[PIN] Не удалось перезакрепить: %v", err)
+			w.writeLog("[PIN]%s Плановая смена ноды не удалась: %v", poolLabel(name), err)
 			return
 		}
-		w.writeLog("[PIN] Трафик закреплён за нодой %s", tag)
+		w.writeLog("[PIN]%s Плановая смена ноды (%s): %s → %s", poolLabel(name), policy.RotateAt, state.PinnedTag, tag)
 		return
 	}
 
 	restored, err := xkeen.EnsurePinned(rt, w.config.XrayAPIAddr, top, state.PinnedTag)
 	if err != nil {
-		w.writeLog("[PIN] Не удалось проверить закрепление: %v", err)
+		w.writeLog("[PIN]%s Не удалось проверить закрепление: %v", poolLabel(name), err)
 		return
 	}
 	if restored {
-		w.writeLog("[PIN] Закрепление восстановлено после перезапуска ядра: %s", state.PinnedTag)
+		w.writeLog("[PIN]%s Закрепление восстановлено после перезапуска ядра: %s", poolLabel(name), state.PinnedTag)
 	}
 }
 
+// superviseNamedPools keeps the pin of every named pool, each on its own:
+// one pool losing its pin or its node says nothing about the others. The
+// health rounds go through the main pool — that is where unrouted probes
+// land — so exit rotation stays with it.
+func (w *Watchdog) superviseNamedPools(rt xkeen.Runtime, top xkeen.Topology) {
+	for _, name := range w.poolStore.EnabledNamed() {
+		state := w.poolStore.GetPool(name)
+		poolTop, ok := top.Balancer(state.BalancerTag)
+		if !ok {
+			w.writeLog("[PIN]%s Балансировщика %s нет в конфиге — пул не проверяю", poolLabel(name), state.BalancerTag)
+			continue
+		}
+		w.superviseP(rt, poolTop, name)
+	}
+}
+
+// pinPolicy is the pin policy of a named pool, "" for the main one. A pool
+// gone from config.yaml pins forever.
+func (w *Watchdog) pinPolicy(name string) models.PinPolicy {
+	if name == "" {
+		return w.config.PoolPin
+	}
+	p, err := xkeen.FindNamedPool(w.config, name)
+	if err != nil {
+		return models.PinPolicy{}
+	}
+	return p.Pin
+}
+
+// poolLabel marks log lines of a named pool.
+func poolLabel(name string) string {
+	if name == "" {
+		return ""
+	}
+	return "[" + name + "]"
+}
+
 // rotateExit condemns the current node and pins the next best one.
 func (w *Watchdog) rotateExit(rt xkeen.Runtime, top xkeen.Topology) {
 	if w.poolStore == nil {
 		return
 	}
 
+	if state := w.poolStore.Get(); state.PinnedNode != "" {
+		w.subscription.LatencyHistory().RecordIncident(state.PinnedNode, xkeen.IncidentBlacklist, time.Now())
+	}
+
 	if current := w.poolStore.Get().PinnedTag; current != "" {
 		ttl := time.Duration(w.config.BlacklistTTLSec) * time.Second
 		if ttl <= 0 {
@@ -303,7 +377,7 @@ func (w *Watchdog) rotateExit(rt xkeen.Runtime, top xkeen.Topology) {
 		w.mu.Unlock()
 	}
 
-	tag, err := w.pinBest(rt, top)
+	tag, err := w.pinBest(rt, top, "", "")
 	if err != nil {
 		w.writeLog("[HEALTH] Не удалось сменить ноду: %v", err)
 		return
@@ -317,18 +391,24 @@ func (w *Watchdog) rotateExit(rt xkeen.Runtime, top xkeen.Topology) {
 	w.writeLog("[HEALTH] Выход переключён на %s", tag)
 }
 
-// pinBest picks the fastest node that is not currently condemned and pins it.
-func (w *Watchdog) pinBest(rt xkeen.Runtime, top xkeen.Topology) (string, error) {
+// pinBest picks the fastest node that is not currently condemned and pins it
+// in the named pool top describes ("" for the main one). skip is a tag passed
+// over this once without condemning it, "" for none.
+func (w *Watchdog) pinBest(rt xkeen.Runtime, top xkeen.Topology, name, skip string) (string, error) {
+	excluded := w.excludedNodes()
+	if skip != "" {
+		excluded[skip] = true
+	}
 	tag, err := xkeen.PinBestNode(rt, w.config.XrayAPIAddr, w.config.OutboundsFile, top,
-		w.subscription.GetServers(), w.excludedNodes(),
-		time.Duration(w.config.ProbeTimeoutMs)*time.Millisecond, w.config.ProbeConcurrency)
+		w.subscription.GetServers(), excluded, xkeen.LatencyProbeFromConfig(w.config, rt, w.subscription.LatencyHistory()),
+		xkeen.ScorerFromConfig(w.config, w.subscription.LatencyHistory()))
 	if err != nil {
 		return "", err
 	}
 
 	if w.poolStore != nil {
 		node := xkeen.NodeKeyForTag(w.config.OutboundsFile, w.selector(top), tag)
-		if err := w.poolStore.SetPinned(tag, node); err != nil {
+		if err := w.poolStore.SetPinnedIn(name, tag, node); err != nil {
 			w.writeLog("[PIN] Не удалось сохранить закрепление: %v", err)
 		}
 	}
@@ -370,7 +450,7 @@ func (w *Watchdog) handleFailover(reason string) {
 		return
 	}
 
-	// In pool mode the core's balancer (leastPing + observatory) picks the node
+	// In pool mode the core's balancer (with its observatory) picks the node
 	// without a restart. The watchdog owns pool membership, not the choice.
 	if top := w.detector.Topology(); top.Mode == xkeen.TopologyPool {
 		w.handlePoolFailover(reason, top)
@@ -387,7 +467,9 @@ func (w *Watchdog) handleFailover(reason string) {
 		prevURI = prev.RawURI
 	}
 
-	// Refresh the subscription (the active server is matched by RawURI)
+	// Refresh the subscription (the active server is matched by RawURI). It is
+	// guarded like a scheduled one: a list that shrank is quarantined and the
+	// failover goes on with the servers already known.
 	if _, err := w.subscription.Refresh(); err != nil {
 		w.writeLog("[WARN] Не удалось обновить подписку: %v", err)
 	}
@@ -428,6 +510,7 @@ func (w *Watchdog) handleFailover(reason string) {
 func (w *Watchdog) handlePoolFailover(reason string, top xkeen.Topology) {
 	w.writeLog("[POOL] %s — выбор ноды за балансировщиком %q, проверяю состав пула", reason, top.BalancerTag)
 
+	// Guarded, as in failover: a shrunk list waits in quarantine
 	if _, err := w.subscription.Refresh(); err != nil {
 		w.writeLog("[WARN] Не удалось обновить подписку: %v", err)
 	}
@@ -441,11 +524,14 @@ func (w *Watchdog) handlePoolFailover(reason string, top xkeen.Topology) {
 	state := xkeen.PoolState{BalancerTag: top.BalancerTag, Selector: selector}
 
 	result, err := xkeen.RefreshPool(w.detector.Runtime(), w.config.OutboundsFile, w.config.XrayAPIAddr, servers, state,
-		xkeen.PoolSelectionFromConfig(w.config, w.geoip))
+		xkeen.PoolSelectionFromConfig(w.config, w.geoip, w.subscription))
 	if err != nil {
 		w.writeLog("[ERROR] Пул не синхронизирован: %v", err)
 		return
 	}
+	if w.poolStore != nil {
+		w.refreshNamedPools()
+	}
 	if !result.Changed {
 		w.writeLog("[POOL] Пул совпадает с подпиской — конфиг не трогаем")
 		return
@@ -465,8 +551,26 @@ func (w *Watchdog) handlePoolFailover(reason string, top xkeen.Topology) {
 	w.writeLog("[POOL] Пул приведён к подписке: +%d, -%d, заменено %d (%s)", len(result.Added), len(result.Removed), len(result.Replaced), how)
 }
 
-// selectBest picks the lowest-latency live server, skipping the current one,
-// blacklisted ones, non-VLESS entries and servers in avoided countries.
+// refreshNamedPools brings the named pools in line with the subscription and
+// logs what changed.
+func (w *Watchdog) refreshNamedPools() {
+	rt := w.detector.Runtime()
+	for _, sync := range xkeen.RefreshNamedPools(rt, w.config, w.geoip, w.subscription, w.poolStore) {
+		switch {
+		case sync.Error != "":
+			w.writeLog("[POOL][%s] Пул не синхронизирован: %s", sync.Pool, sync.Error)
+		case sync.Result.Changed:
+			w.detector.InvalidateTopology()
+			w.writeLog("[POOL][%s] Пул приведён к подписке: +%d, -%d, заменено %d", sync.Pool,
+				len(sync.Result.Added), len(sync.Result.Removed), len(sync.Result.Replaced))
+		}
+	}
+}
+
+// selectBest picks the best-scoring live server, skipping the current one,
+// blacklisted ones, ones the user excluded, protocols the panel cannot render
+// and servers in avoided countries. A live favourite goes before any score,
+// and a higher priority before a better score.
 func (w *Watchdog) selectBest() (*models.Server, error) {
 	data := w.subscription.GetData()
 	if len(data.Servers) == 0 {
@@ -480,10 +584,11 @@ func (w *Watchdog) selectBest() (*models.Server, error) {
 		if s.ID == currentID {
 			continue
 		}
-		if w.isBlacklisted(s.RawURI) {
+		// A set-aside duplicate is the kept server again, or a lookalike of it
+		if s.Excluded || s.DuplicateOf != nil || w.isBlacklisted(s.RawURI) {
 			continue
 		}
-		if s.Protocol != "" && s.Protocol != "vless" {
+		if !xkeen.OutboundSupported(s) {
 			continue
 		}
 		if !w.isServerAllowed(s) {
@@ -501,41 +606,59 @@ func (w *Watchdog) selectBest() (*models.Server, error) {
 		return nil, fmt.Errorf("нет разрешённых серверов для авто-переключения")
 	}
 
-	timeout := time.Duration(w.config.ProbeTimeoutMs) * time.Millisecond
-	checked := xkeen.CheckAllLatencies(candidates, timeout, w.config.ProbeConcurrency)
+	checked := xkeen.LatencyProbeFromConfig(w.config, w.detector.Runtime(), w.subscription.LatencyHistory()).Check(candidates)
 	w.subscription.UpdateLatencies(checked)
 
-	best := -1
-	bestLat := int(^uint(0) >> 1)
-	for i := range checked {
-		if checked[i].Latency >= 0 && checked[i].Latency < bestLat {
-			bestLat = checked[i].Latency
-			best = i
+	ranked, scores := xkeen.RankServers(checked, xkeen.ScorerFromConfig(w.config, w.subscription.LatencyHistory()))
+	if !scores[0].Reachable {
+		return nil, fmt.Errorf("ни один разрешённый сервер не ответил")
+	}
+
+	var best models.Server
+	for _, s := range xkeen.OrderByPreference(ranked) {
+		if s.Latency >= 0 {
+			best = s
+			break
 		}
 	}
-	if best < 0 {
-		return nil, fmt.Errorf("ни один разрешённый сервер не ответил")
+	for i := range ranked {
+		if ranked[i].RawURI != best.RawURI {
+			continue
+		}
+		switch {
+		case best.Favorite:
+			w.writeLog("[FAILOVER] Выбран избранный %s, оценка %.0f", xkeen.DisplayName(best), scores[i].Score)
+		case i > 0:
+			w.writeLog("[FAILOVER] Выбран %s по приоритету %d, оценка %.0f", xkeen.DisplayName(best), best.Priority, scores[i].Score)
+		default:
+			w.writeLog("[FAILOVER] Лучшая оценка у %s: %.0f", xkeen.DisplayName(best), scores[i].Score)
+		}
+		break
 	}
 
 	// By RawURI, not index: a Refresh may have run between snapshot and activation
-	return w.subscription.SetActiveByRawURI(checked[best].RawURI)
+	return w.subscription.SetActiveByRawURI(best.RawURI)
 }
 
 // AllowedActiveOrBest returns the server whose outbound to apply after an
 // automatic subscription refresh. If the active one ended up in an avoided
-// country (the refresh may have replaced it with an RU/BY servers[0]), it picks
-// an allowed replacement. With no replacement it keeps the current one —
-// connectivity wins — and logs that.
+// country (the refresh may have replaced it with an RU/BY servers[0]) or is one
+// the user excluded, it picks an allowed replacement. With no replacement it
+// keeps the current one — connectivity wins — and logs that.
 func (w *Watchdog) AllowedActiveOrBest() *models.Server {
 	active := w.subscription.GetActiveServer()
 	if active == nil {
 		return nil
 	}
-	if w.isServerAllowed(*active) {
+	switch {
+	case active.Excluded:
+		w.writeLog("[AUTO-UPDATE] активный сервер исключён пользователем — подбор замены")
+	case !w.isServerAllowed(*active):
+		w.writeLog("[AUTO-UPDATE] активный сервер в избегаемой стране — подбор замены")
+	default:
 		return active
 	}
 
-	w.writeLog("[AUTO-UPDATE] активный сервер в избегаемой стране — подбор замены")
 	best, err := w.selectBest()
 	if err != nil {
 		w.writeLog("[AUTO-UPDATE] разрешённой замены нет (%v) — оставляю текущий", err)
@@ -544,15 +667,24 @@ func (w *Watchdog) AllowedActiveOrBest() *models.Server {
 	return best
 }
 
-// isServerAllowed decides whether automatic switching may use a server. GeoIP is
-// the primary signal (it proves the server is not in a blocked country); the
-// name is the fallback.
+// isServerAllowed decides whether automatic switching may use a server. A
+// manual country override decides first, then the discovered exit country;
+// otherwise GeoIP of the entry is the primary signal (it proves the server is
+// not in a blocked country) and the name the fallback.
 func (w *Watchdog) isServerAllowed(s models.Server) bool {
-	// Manual override or name-derived country: an avoided one is an immediate no
-	effCountry := s.CountryOverride
-	if effCountry == "" {
-		effCountry = s.Country
+	// The override is the owner's explicit decision: no measurement overrules it
+	if s.CountryOverride != "" {
+		return !w.isAvoidedCountry(s.CountryOverride)
 	}
+
+	// The exit is where traffic really leaves: it outranks everything said about
+	// the entry address
+	if s.ExitCountry != "" {
+		return !w.isAvoidedCountry(s.ExitCountry)
+	}
+
+	// Name-derived country: an avoided one is an immediate no
+	effCountry := s.Country
 	if effCountry != "" && w.isAvoidedCountry(effCountry) {
 		return false
 	}
@@ -589,6 +721,11 @@ func (w *Watchdog) blacklistServer(uri string) {
 	w.mu.Lock()
 	w.blacklist[uri] = time.Now().Add(ttl)
 	w.mu.Unlock()
+
+	// The blacklist expires; the incident keeps counting against the score
+	if key, ok := xkeen.EndpointKey(models.Server{RawURI: uri}); ok {
+		w.subscription.LatencyHistory().RecordIncident(key, xkeen.IncidentBlacklist, time.Now())
+	}
 }
 
 func (w *Watchdog) isBlacklisted(uri string) bool {
@@ -715,6 +852,8 @@ func (w *Watchdog) GetStatus() models.Status {
 		status.Protocol = server.Protocol
 	}
 
+	status.Subscriptions = w.subscription.UsageStatus(w.config.SubscriptionQuotaWarnPercent, w.config.SubscriptionExpiryWarnDays, time.Now())
+
 	return status
 }
 
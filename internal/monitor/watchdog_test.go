@@ -123,6 +123,10 @@ func TestIsServerAllowedWithGeoIP(t *testing.T) {
 		{"ip in RU range", models.Server{Address: "1.2.3.5"}, false},
 		{"ip resolved not avoided", models.Server{Address: "8.8.8.8"}, true},
 		{"geoip authoritative over name", models.Server{Address: "1.2.3.5", Country: "NL"}, false},
+		{"exit outranks an RU entry", models.Server{Address: "1.2.3.5", ExitCountry: "FI"}, true},
+		{"exit outranks a clean entry", models.Server{Address: "8.8.8.8", Country: "NL", ExitCountry: "RU"}, false},
+		{"override outranks the exit", models.Server{Address: "8.8.8.8", ExitCountry: "FI", CountryOverride: "RU"}, false},
+		{"override clears an RU exit", models.Server{Address: "1.2.3.5", ExitCountry: "RU", CountryOverride: "NL"}, true},
 	}
 	for _, c := range cases {
 		if got := w.isServerAllowed(c.s); got != c.want {
@@ -229,3 +233,16 @@ func buildGeoIP(t *testing.T) string {
 	}
 	return path
 }
+
+// A blacklisting outlives its TTL in the node's score.
+func TestBlacklistRecordsIncident(t *testing.T) {
+	w := newWatchdog(t, &models.Config{BlacklistTTLSec: 300})
+	uri := "vless://11111111-2222-3333-4444-555555555555@1.2.3.4:443?type=tcp"
+
+	w.blacklistServer(uri)
+
+	key, _ := xkeen.EndpointKey(models.Server{RawURI: uri})
+	if got := w.subscription.LatencyHistory().Incidents(key, time.Now().Add(-time.Minute)); got[xkeen.IncidentBlacklist] != 1 {
+		t.Errorf("incidents = %v, want one blacklisting", got)
+	}
+}
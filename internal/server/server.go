@@ -77,7 +77,18 @@ func (s *Server) Handler() http.Handler {
 			r.Use(api.AuthMiddleware(s.userManager))
 
 			r.Get("/events", sse.HandleEvents(s.eventBus, s.watchdog))
-			r.Get("/servers/check", sse.HandleStreamLatency(s.subscription, s.config.ProbeConcurrency, time.Duration(s.config.ProbeTimeoutMs)*time.Millisecond))
+			r.Get("/servers/check", sse.HandleStreamLatency(s.subscription, s.config, s.detector))
+			r.Get("/servers/{id}/speedtest", sse.HandleSpeedTest(s.subscription, s.config, s.detector))
+		})
+
+		// Catalogue-wide probes: JWT required, no timeout. Every node goes
+		// through a throwaway core, which takes minutes on a real subscription
+		r.Group(func(r chi.Router) {
+			r.Use(api.AuthMiddleware(s.userManager))
+
+			r.Post("/servers/check", handlers.HandleCheckServers)
+			r.Post("/servers/exits", handlers.HandleDiscoverExits)
+			r.Post("/servers/udp", handlers.HandleCheckUDP)
 		})
 
 		// Protected REST routes: JWT and a timeout
@@ -91,10 +102,32 @@ func (s *Server) Handler() http.Handler {
 			r.Post("/subscription", handlers.HandleUpdateSubscription)
 			r.Post("/subscription/refresh", handlers.HandleRefreshSubscription)
 
+			r.Get("/subscriptions", handlers.HandleListSubscriptions)
+			r.Post("/subscriptions", handlers.HandleAddSubscription)
+			r.Put("/subscriptions/{name}", handlers.HandleUpdateNamedSubscription)
+			r.Delete("/subscriptions/{name}", handlers.HandleDeleteSubscription)
+			r.Post("/subscriptions/{name}/refresh", handlers.HandleRefreshNamedSubscription)
+			r.Post("/subscriptions/{name}/quarantine/approve", handlers.HandleApproveQuarantine)
+			r.Delete("/subscriptions/{name}/quarantine", handlers.HandleDiscardQuarantine)
+			r.Post("/subscriptions/import", handlers.HandleImportSubscription)
+			r.Get("/subscriptions/history", handlers.HandleSubscriptionHistory)
+			r.Get("/subscriptions/history/diff", handlers.HandleSubscriptionDiff)
+			r.Post("/subscriptions/history/{id}/rollback", handlers.HandleSubscriptionRollback)
+
 			r.Get("/servers", handlers.HandleGetServers)
 			r.Post("/servers/select", handlers.HandleSelectServer)
-			r.Post("/servers/check", handlers.HandleCheckServers)
+			r.Get("/servers/latency", handlers.HandleLatencyStats)
+			r.Get("/servers/scores", handlers.HandleServerScores)
+			r.Get("/servers/duplicates", handlers.HandleDuplicates)
+			r.Get("/servers/{id}/latency", handlers.HandleServerLatencyStats)
 			r.Post("/servers/country", handlers.HandleSetCountry)
+			r.Get("/servers/{id}/prefs", handlers.HandleGetServerPrefs)
+			r.Put("/servers/{id}/prefs", handlers.HandleSetServerPrefs)
+			r.Get("/servers/filters", handlers.HandleListFilters)
+			r.Put("/servers/filters/{name}", handlers.HandleSaveFilter)
+			r.Delete("/servers/filters/{name}", handlers.HandleDeleteFilter)
+			r.Post("/servers/manual", handlers.HandleAddManualServer)
+			r.Delete("/servers/manual/{id}", handlers.HandleDeleteManualServer)
 
 			// Passkey management
 			r.Post("/account/passkey/register/begin", webAuthnHandler.HandleRegisterBegin)
@@ -118,6 +151,11 @@ func (s *Server) Handler() http.Handler {
 			r.Post("/pool/enable", handlers.HandlePoolEnable)
 			r.Post("/pool/disable", handlers.HandlePoolDisable)
 			r.Post("/pool/sync", handlers.HandlePoolSync)
+			r.Get("/pools", handlers.HandleListPools)
+			r.Post("/pools/{name}/enable", handlers.HandleNamedPoolEnable)
+			r.Post("/pools/{name}/disable", handlers.HandleNamedPoolDisable)
+			r.Post("/pools/{name}/sync", handlers.HandleNamedPoolSync)
+			r.Post("/pools/{name}/pin", handlers.HandleNamedPoolPin)
 
 			r.Get("/logs", handlers.HandleLogs)
 
@@ -4,10 +4,12 @@ import (
 	"fmt"
 	"log"
 	"net/http"
-	"sync"
+	"strconv"
 	"time"
 	"xkeen-panel/internal/models"
 	"xkeen-panel/internal/xkeen"
+
+	"github.com/go-chi/chi/v5"
 )
 
 // StatusProvider supplies the current status (implemented by the watchdog).
@@ -66,11 +68,10 @@ func HandleEvents(bus *EventBus, sp StatusProvider) http.HandlerFunc {
 	}
 }
 
-// HandleStreamLatency streams per-server latency results over SSE.
-func HandleStreamLatency(sub *xkeen.SubscriptionManager, concurrency int, timeout time.Duration) http.HandlerFunc {
-	if concurrency <= 0 {
-		concurrency = 20
-	}
+// HandleStreamLatency streams per-server latency results over SSE. The probe
+// follows latency_probe from the config; ?mode=tcp or ?mode=real overrides it
+// for one run.
+func HandleStreamLatency(sub *xkeen.SubscriptionManager, cfg *models.Config, det *xkeen.Detector) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		flusher, ok := w.(http.Flusher)
 		if !ok {
@@ -98,24 +99,21 @@ func HandleStreamLatency(sub *xkeen.SubscriptionManager, concurrency int, timeou
 			Latency int `json:"latency_ms"`
 		}
 
-		results := make(chan result, len(servers))
-		sem := make(chan struct{}, concurrency)
-		var wg sync.WaitGroup
-
-		for _, s := range servers {
-			wg.Add(1)
-			sem <- struct{}{}
-			go func(srv models.Server) {
-				defer wg.Done()
-				defer func() { <-sem }()
-				latency := xkeen.CheckLatency(srv.Address, srv.Port, timeout)
-				results <- result{ID: srv.ID, Latency: latency}
-			}(s)
+		probe := xkeen.LatencyProbeFromConfig(cfg, det.Runtime(), sub.LatencyHistory())
+		switch r.URL.Query().Get("mode") {
+		case xkeen.ProbeModeReal:
+			probe.Real = true
+		case xkeen.ProbeModeTCP:
+			probe.Real = false
 		}
 
-		// Close the channel once every goroutine is done
+		results := make(chan result, len(servers))
+
+		// Close the channel once every server is measured
 		go func() {
-			wg.Wait()
+			probe.Each(servers, func(idx, latency int) {
+				results <- result{ID: servers[idx].ID, Latency: latency}
+			})
 			close(results)
 		}()
 
@@ -162,3 +160,70 @@ func HandleStreamLatency(sub *xkeen.SubscriptionManager, concurrency int, timeou
 		flusher.Flush()
 	}
 }
+
+// HandleSpeedTest runs a speed test through one server and streams its
+// progress over SSE: "speed_progress" while it downloads, then "speed" with
+// the result, which is also stored on the server when the test got as far as
+// the node.
+func HandleSpeedTest(sub *xkeen.SubscriptionManager, cfg *models.Config, det *xkeen.Detector) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			http.Error(w, "streaming not supported", http.StatusInternalServerError)
+			return
+		}
+
+		id, err := strconv.Atoi(chi.URLParam(r, "id"))
+		if err != nil {
+			http.Error(w, `{"error":"неверный id"}`, http.StatusBadRequest)
+			return
+		}
+		var server *models.Server
+		for _, s := range sub.GetServers() {
+			if s.ID == id {
+				server = &s
+				break
+			}
+		}
+		if server == nil {
+			http.Error(w, `{"error":"сервер не найден"}`, http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.Header().Set("Cache-Control", "no-cache")
+		w.Header().Set("Connection", "keep-alive")
+		w.Header().Set("X-Accel-Buffering", "no")
+
+		send := func(evt Event) {
+			if data, err := FormatSSE(evt); err == nil {
+				w.Write(data)
+				flusher.Flush()
+			}
+		}
+
+		type progress struct {
+			ID int `json:"id"`
+			xkeen.SpeedProgress
+		}
+		result, err := xkeen.SpeedTest(r.Context(), det.Runtime(), cfg.OutboundsFile, *server,
+			xkeen.SpeedTestOptionsFromConfig(cfg), func(p xkeen.SpeedProgress) {
+				send(Event{Type: "speed_progress", Data: progress{ID: id, SpeedProgress: p}})
+			})
+		if r.Context().Err() != nil {
+			return
+		}
+		if err != nil {
+			// The test never reached the node, so there is nothing to hold
+			// against it: reported, not stored
+			result = models.SpeedTest{Time: time.Now(), Error: err.Error()}
+		} else if err := sub.UpdateSpeed(server.RawURI, result); err != nil {
+			log.Printf("[SPEED] Результат теста не сохранён: %v", err)
+		}
+
+		send(Event{Type: "speed", Data: map[string]interface{}{"id": id, "speed": result}})
+
+		fmt.Fprint(w, "event: close\ndata: {}\n\n")
+		flusher.Flush()
+	}
+}
@@ -1,7 +1,6 @@
 package xkeen
 
 import (
-	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"net/url"
@@ -98,10 +97,14 @@ func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
 	return os.Rename(tmpName, path)
 }
 
-// VLESSParams holds every parameter of a VLESS URI. Exported because the Mihomo
-// config generator builds its proxies from the same fields.
-type VLESSParams struct {
+// ProxyParams holds every parameter of a proxy URI, whatever the protocol.
+// Exported because the Mihomo config generator builds its proxies from the same
+// fields. The credential is UUID for VLESS/VMess/TUIC, Password for Trojan,
+// Shadowsocks and Hysteria2, and PrivateKey for WireGuard.
+type ProxyParams struct {
+	Protocol    string // vless, vmess, trojan, shadowsocks, hysteria2, tuic, wireguard
 	UUID        string
+	Password    string
 	Address     string
 	Port        int
 	Security    string // reality, tls, none
@@ -118,6 +121,42 @@ type VLESSParams struct {
 	ALPN        string
 	Encryption  string
 	Extra       string // JSON from the extra parameter (xhttp: downloadSettings, xmux, …)
+	Method      string // shadowsocks cipher
+	Plugin      string // shadowsocks SIP003 plugin with its options: obfs-local;obfs=http
+	Cipher      string // vmess security: auto, aes-128-gcm, chacha20-poly1305, none
+	AlterID     int    // vmess alterId, 0 for AEAD
+	HeaderType  string // tcp header obfuscation: none, http
+	Insecure    bool   // allowInsecure
+
+	// Hysteria2
+	Obfs         string // salamander
+	ObfsPassword string
+
+	// TUIC
+	CongestionControl string // bbr, cubic, new_reno
+	UDPRelayMode      string // native, quic
+
+	// WireGuard: PublicKey above is the peer's key
+	PrivateKey   string
+	PresharedKey string
+	LocalAddress []string // interface addresses, CIDR
+	Reserved     []int
+	MTU          int
+}
+
+// VLESSParams is the name the parameter model had while only VLESS was
+// rendered; kept so existing callers read naturally.
+type VLESSParams = ProxyParams
+
+// Credential returns whatever identifies the user to the server.
+func (p *ProxyParams) Credential() string {
+	switch {
+	case p.UUID != "":
+		return p.UUID
+	case p.Password != "":
+		return p.Password
+	}
+	return p.PrivateKey
 }
 
 // ParseVLESS parses a VLESS URI in full.
@@ -137,7 +176,13 @@ func ParseVLESS(uri string) (*VLESSParams, error) {
 	}
 
 	q := u.Query()
+	path := q.Get("path")
+	if q.Get("type") == "grpc" && path == "" {
+		path = q.Get("serviceName")
+	}
+
 	return &VLESSParams{
+		Protocol:    "vless",
 		UUID:        u.User.Username(),
 		Address:     u.Hostname(),
 		Port:        port,
@@ -149,20 +194,32 @@ func ParseVLESS(uri string) (*VLESSParams, error) {
 		ShortID:     q.Get("sid"),
 		SpiderX:     q.Get("spx"),
 		Host:        q.Get("host"),
-		Path:        q.Get("path"),
+		Path:        path,
 		Mode:        q.Get("mode"),
 		Flow:        q.Get("flow"),
 		ALPN:        q.Get("alpn"),
 		Encryption:  q.Get("encryption"),
 		Extra:       q.Get("extra"),
+		HeaderType:  q.Get("headerType"),
+		Insecure:    isTruthy(q.Get("allowInsecure")),
 	}, nil
 }
 
-// buildOutboundFromURI renders a complete outbound from a VLESS URI. The tag
-// comes from the existing config so routing keeps matching, and the format is
-// whichever credential shape that config already uses.
-func buildOutboundFromURI(p *VLESSParams, tag string, format outboundFormat) map[string]interface{} {
-	settings := buildVLESSSettings(p, format)
+// buildOutboundFromURI renders a complete outbound from a parsed proxy URI. The
+// tag comes from the existing config so routing keeps matching, and the format
+// is whichever credential shape that config already uses.
+func buildOutboundFromURI(p *ProxyParams, tag string, format outboundFormat) map[string]interface{} {
+	settings := buildProxySettings(p, format)
+
+	// WireGuard is its own transport: no stream settings beyond the sockopt
+	// that mergeOutbound carries over
+	if p.xrayProtocol() == "wireguard" {
+		return map[string]interface{}{
+			"protocol": "wireguard",
+			"settings": settings,
+			"tag":      tag,
+		}
+	}
 
 	// StreamSettings
 	streamSettings := map[string]interface{}{}
@@ -212,11 +269,31 @@ func buildOutboundFromURI(p *VLESSParams, tag string, format outboundFormat) map
 		if p.ALPN != "" {
 			ts["alpn"] = strings.Split(p.ALPN, ",")
 		}
+		if p.Insecure {
+			ts["allowInsecure"] = true
+		}
 		streamSettings["tlsSettings"] = ts
 	}
 
 	// Transport-specific settings
 	switch network {
+	case "tcp", "raw":
+		// vmess links carry an HTTP header disguise as type=http
+		if p.HeaderType == "http" {
+			header := map[string]interface{}{"type": "http"}
+			if p.Host != "" || p.Path != "" {
+				request := map[string]interface{}{}
+				if p.Path != "" {
+					request["path"] = strings.Split(p.Path, ",")
+				}
+				if p.Host != "" {
+					request["headers"] = map[string]interface{}{"Host": strings.Split(p.Host, ",")}
+				}
+				header["request"] = request
+			}
+			streamSettings["tcpSettings"] = map[string]interface{}{"header": header}
+		}
+
 	case "ws":
 		ws := map[string]interface{}{}
 		if p.Path != "" {
@@ -261,6 +338,16 @@ func buildOutboundFromURI(p *VLESSParams, tag string, format outboundFormat) map
 		}
 		streamSettings["xhttpSettings"] = xs
 
+	case "httpupgrade":
+		hu := map[string]interface{}{}
+		if p.Path != "" {
+			hu["path"] = p.Path
+		}
+		if p.Host != "" {
+			hu["host"] = p.Host
+		}
+		streamSettings["httpupgradeSettings"] = hu
+
 	case "h2":
 		h2 := map[string]interface{}{}
 		if p.Path != "" {
@@ -273,7 +360,7 @@ func buildOutboundFromURI(p *VLESSParams, tag string, format outboundFormat) map
 	}
 
 	outbound := map[string]interface{}{
-		"protocol":       "vless",
+		"protocol":       p.xrayProtocol(),
 		"settings":       settings,
 		"streamSettings": streamSettings,
 		"tag":            tag,
@@ -294,16 +381,22 @@ func UpdateOutbound(outboundsPath string, server *models.Server) error {
 		return fmt.Errorf("outbounds не найдены в конфиге")
 	}
 
-	// Parse the VLESS URI
+	// Parse the server URI
 	if server.RawURI == "" {
 		return fmt.Errorf("RawURI пуст — невозможно сгенерировать конфиг. Обновите подписку")
 	}
 
-	if server.Protocol != "" && server.Protocol != "vless" {
-		return fmt.Errorf("автоконфигурация поддерживает только VLESS, протокол %q пока не поддержан", server.Protocol)
+	if !OutboundSupported(*server) {
+		if MihomoOnly(server.Protocol) {
+			return fmt.Errorf("в Xray нет клиента %s — такой сервер работает только с ядром Mihomo", server.Protocol)
+		}
+		if plugin := ssPlugin(server.RawURI); plugin != "" {
+			return fmt.Errorf("в Xray нет плагинов Shadowsocks (%s) — такой сервер работает только с ядром Mihomo", plugin)
+		}
+		return fmt.Errorf("автоконфигурация не поддерживает протокол %q", server.Protocol)
 	}
 
-	params, err := ParseVLESS(server.RawURI)
+	params, err := ParseProxyURI(server.RawURI)
 	if err != nil {
 		return fmt.Errorf("ошибка парсинга URI: %w", err)
 	}
@@ -362,64 +455,3 @@ func GetCurrentOutbound(outboundsPath string) (address string, port int, uuid st
 
 	return "", 0, "", fmt.Errorf("proxy outbound не найден")
 }
-
-// extractUserInfo pulls the userinfo part out of a URI.
-func extractUserInfo(uri string) string {
-	idx := strings.Index(uri, "://")
-	if idx == -1 {
-		return ""
-	}
-	rest := uri[idx+3:]
-	atIdx := strings.IndexByte(rest, '@')
-	if atIdx == -1 {
-		return ""
-	}
-	return rest[:atIdx]
-}
-
-// extractVMessUUID pulls the uuid out of a vmess URI (base64 JSON).
-func extractVMessUUID(uri string) string {
-	encoded := strings.TrimPrefix(uri, "vmess://")
-	decoded, err := base64.StdEncoding.DecodeString(encoded)
-	if err != nil {
-		decoded, _ = base64.RawStdEncoding.DecodeString(encoded)
-	}
-
-	var config map[string]interface{}
-	if err := json.Unmarshal(decoded, &config); err != nil {
-		return ""
-	}
-
-	id, _ := config["id"].(string)
-	return id
-}
-
-// extractSSCredentials pulls method and password out of an ss URI.
-func extractSSCredentials(uri string) (method, password string) {
-	raw := strings.TrimPrefix(uri, "ss://")
-	if idx := strings.LastIndex(raw, "#"); idx != -1 {
-		raw = raw[:idx]
-	}
-
-	atIdx := strings.LastIndex(raw, "@")
-	var encoded string
-	if atIdx != -1 {
-		encoded = raw[:atIdx]
-	} else {
-		encoded = raw
-	}
-
-	decoded, err := base64.URLEncoding.DecodeString(encoded)
-	if err != nil {
-		decoded, err = base64.RawURLEncoding.DecodeString(encoded)
-		if err != nil {
-			decoded, _ = base64.StdEncoding.DecodeString(encoded)
-		}
-	}
-
-	parts := strings.SplitN(string(decoded), ":", 2)
-	if len(parts) == 2 {
-		return parts[0], parts[1]
-	}
-	return "", ""
-}
@@ -146,14 +146,44 @@ func TestUpdateOutboundGuards(t *testing.T) {
 		t.Fatalf("WriteFile: %v", err)
 	}
 
+	if err := UpdateOutbound(path, &models.Server{Protocol: "socks", RawURI: "socks://abc"}); err == nil {
+		t.Error("ожидалась ошибка для протокола socks")
+	}
 	if err := UpdateOutbound(path, &models.Server{Protocol: "vmess", RawURI: "vmess://abc"}); err == nil {
-		t.Error("ожидалась ошибка для протокола vmess")
+		t.Error("ожидалась ошибка для битой vmess-ссылки")
 	}
 	if err := UpdateOutbound(path, &models.Server{Protocol: "vless", RawURI: ""}); err == nil {
 		t.Error("ожидалась ошибка при пустом RawURI")
 	}
 }
 
+// A Trojan server replaces the VLESS outbound in place: the tag stays, the
+// protocol and credential shape follow the server.
+func TestUpdateOutboundTrojan(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "04_outbounds.json")
+	initial := `{"outbounds":[{"protocol":"vless","tag":"vless-reality","settings":{"vnext":[]}},{"protocol":"freedom","tag":"direct"}]}`
+	if err := os.WriteFile(path, []byte(initial), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+
+	if err := UpdateOutbound(path, &models.Server{Protocol: "trojan", RawURI: trojanURI}); err != nil {
+		t.Fatalf("UpdateOutbound: %v", err)
+	}
+
+	cfg, err := ReadOutboundsConfig(path)
+	if err != nil {
+		t.Fatalf("ReadOutboundsConfig: %v", err)
+	}
+	ob0 := cfg["outbounds"].([]interface{})[0].(map[string]interface{})
+	if ob0["protocol"] != "trojan" || ob0["tag"] != "vless-reality" {
+		t.Errorf("outbounds[0] = %v/%v, want trojan under the old tag", ob0["protocol"], ob0["tag"])
+	}
+	address, port, password, ok := readProxyEndpoint(ob0)
+	if !ok || address != "t.example.com" || port != 8443 || password != "p@ss" {
+		t.Errorf("endpoint = %s:%d/%s, want t.example.com:8443/p@ss", address, port, password)
+	}
+}
+
 func TestOutboundsConfigRoundtrip(t *testing.T) {
 	path := filepath.Join(t.TempDir(), "rt.json")
 	cfg := map[string]interface{}{
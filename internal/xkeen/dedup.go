@@ -0,0 +1,250 @@
+package xkeen
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"xkeen-panel/internal/models"
+)
+
+// What happens to the servers found to duplicate another.
+const (
+	DuplicatesKeep  = "keep"  // listed, pooled and probed like any other
+	DuplicatesHide  = "hide"  // set aside: off the list, out of the pool and failover
+	DuplicatesMerge = "merge" // set aside, and the kept server carries their names
+)
+
+// Looser duplicate rules on top of the same endpoint.
+const (
+	DuplicateRuleHost = "host" // same address, any port
+	DuplicateRuleUUID = "uuid" // same uuid or password, any address
+)
+
+// duplicateReasonEndpoint marks servers joined for having the same endpoint.
+const duplicateReasonEndpoint = "endpoint"
+
+// SetDuplicatePolicy sets what happens to duplicate servers and which looser
+// rules, besides the same endpoint, make two servers duplicates.
+func (sm *SubscriptionManager) SetDuplicatePolicy(mode string, rules []string) error {
+	mode = strings.ToLower(strings.TrimSpace(mode))
+	switch mode {
+	case "":
+		mode = DuplicatesKeep
+	case DuplicatesKeep, DuplicatesHide, DuplicatesMerge:
+	default:
+		return fmt.Errorf("неизвестный режим дубликатов %q: keep, hide или merge", mode)
+	}
+	var normalized []string
+	for _, rule := range rules {
+		rule = strings.ToLower(strings.TrimSpace(rule))
+		if rule != DuplicateRuleHost && rule != DuplicateRuleUUID {
+			return fmt.Errorf("неизвестное правило дубликатов %q: host или uuid", rule)
+		}
+		if !slices.Contains(normalized, rule) {
+			normalized = append(normalized, rule)
+		}
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.duplicateMode = mode
+	sm.duplicateRules = normalized
+	sm.markDuplicatesLocked()
+	return nil
+}
+
+// DuplicateReport lists the duplicate groups in the catalogue and what the
+// current mode does with them.
+func (sm *SubscriptionManager) DuplicateReport() models.DuplicateReport {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	report := models.DuplicateReport{
+		Mode:   sm.duplicateMode,
+		Rules:  append([]string{}, sm.duplicateRules...),
+		Groups: duplicateGroups(sm.data.Servers, sm.duplicateRules),
+	}
+	if report.Mode == "" {
+		report.Mode = DuplicatesKeep
+	}
+	if report.Groups == nil {
+		report.Groups = []models.DuplicateGroup{}
+	}
+	for _, s := range sm.data.Servers {
+		if s.DuplicateOf != nil {
+			report.Hidden++
+		}
+	}
+	return report
+}
+
+// markDuplicatesLocked sets DuplicateOf and Aliases by the current mode. The
+// kept server depends on the prefs, so this runs after they are applied. Call
+// with sm.mu held.
+func (sm *SubscriptionManager) markDuplicatesLocked() {
+	servers := sm.data.Servers
+	for i := range servers {
+		servers[i].DuplicateOf = nil
+		servers[i].Aliases = nil
+	}
+	if sm.duplicateMode != DuplicatesHide && sm.duplicateMode != DuplicatesMerge {
+		return
+	}
+
+	for _, group := range duplicateGroups(servers, sm.duplicateRules) {
+		kept := &servers[group.Keep]
+		keptKey, _ := EndpointKey(*kept)
+		for _, m := range group.Members {
+			if m.ID == group.Keep {
+				continue
+			}
+			keep := group.Keep
+			servers[m.ID].DuplicateOf = &keep
+			if sm.duplicateMode != DuplicatesMerge {
+				continue
+			}
+			kept.Aliases = append(kept.Aliases, DisplayName(servers[m.ID]))
+			// Measurements of the very same node count for the kept entry;
+			// a looser match is another node, its results are its own
+			if m.Endpoint == keptKey {
+				mergeMeasurements(kept, servers[m.ID])
+			}
+		}
+	}
+}
+
+// mergeMeasurements fills in what the kept server lacks from a duplicate of
+// the same endpoint: a speed test, a UDP check, a discovered exit.
+func mergeMeasurements(kept *models.Server, dup models.Server) {
+	if kept.Speed == nil {
+		kept.Speed = dup.Speed
+	}
+	if kept.UDP == nil {
+		kept.UDP = dup.UDP
+	}
+	if kept.ExitChecked.IsZero() && !dup.ExitChecked.IsZero() {
+		kept.ExitIP, kept.ExitCountry, kept.ExitChecked = dup.ExitIP, dup.ExitCountry, dup.ExitChecked
+		kept.ExitTried = dup.ExitTried
+	}
+}
+
+// duplicateGroups finds the servers that are the same node: the same
+// endpoint always, and by the given rules the same host or the same
+// credential. Matches chain — A and B on one host, B and C on one uuid make a
+// group of three. Servers without a recognised endpoint are never duplicates.
+func duplicateGroups(servers []models.Server, rules []string) []models.DuplicateGroup {
+	parent := make([]int, len(servers))
+	for i := range parent {
+		parent[i] = i
+	}
+	var find func(int) int
+	find = func(i int) int {
+		if parent[i] != i {
+			parent[i] = find(parent[i])
+		}
+		return parent[i]
+	}
+
+	type link struct {
+		a, b   int
+		reason string
+	}
+	var links []link
+	keys := make([]string, len(servers))
+	firstByKey := map[string]int{}
+	firstByHost := map[string]int{}
+	firstByCredential := map[string]int{}
+
+	for i, s := range servers {
+		key, ok := EndpointKey(s)
+		if !ok {
+			continue
+		}
+		keys[i] = key
+		if first, seen := firstByKey[key]; seen {
+			links = append(links, link{first, i, duplicateReasonEndpoint})
+			continue
+		}
+		firstByKey[key] = i
+
+		params, err := ParseProxyURI(s.RawURI)
+		if err != nil {
+			continue
+		}
+		if slices.Contains(rules, DuplicateRuleHost) && params.Address != "" {
+			host := strings.ToLower(params.Address)
+			if first, seen := firstByHost[host]; seen {
+				links = append(links, link{first, i, DuplicateRuleHost})
+			} else {
+				firstByHost[host] = i
+			}
+		}
+		if cred := params.Credential(); slices.Contains(rules, DuplicateRuleUUID) && cred != "" {
+			if first, seen := firstByCredential[cred]; seen {
+				links = append(links, link{first, i, DuplicateRuleUUID})
+			} else {
+				firstByCredential[cred] = i
+			}
+		}
+	}
+	if len(links) == 0 {
+		return nil
+	}
+
+	for _, l := range links {
+		parent[find(l.b)] = find(l.a)
+	}
+	members := map[int][]int{}
+	reasons := map[int][]string{}
+	for i := range servers {
+		if keys[i] != "" {
+			root := find(i)
+			members[root] = append(members[root], i)
+		}
+	}
+	for _, l := range links {
+		root := find(l.a)
+		if !slices.Contains(reasons[root], l.reason) {
+			reasons[root] = append(reasons[root], l.reason)
+		}
+	}
+
+	var groups []models.DuplicateGroup
+	for root, ids := range members {
+		if len(ids) < 2 {
+			continue
+		}
+		group := models.DuplicateGroup{Keep: keptDuplicate(servers, ids), Reasons: reasons[root]}
+		sort.Strings(group.Reasons)
+		for _, id := range ids {
+			group.Members = append(group.Members, models.DuplicateMember{
+				ID:       id,
+				Name:     DisplayName(servers[id]),
+				Source:   servers[id].Source,
+				Endpoint: keys[id],
+			})
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool { return groups[i].Keep < groups[j].Keep })
+	return groups
+}
+
+// keptDuplicate picks the server that stands for a group: a favourite, else
+// one the user did not exclude, else the first listed. Going by list order
+// rather than latency keeps the choice — and so the pool — steady.
+func keptDuplicate(servers []models.Server, ids []int) int {
+	for _, id := range ids {
+		if servers[id].Favorite {
+			return id
+		}
+	}
+	for _, id := range ids {
+		if !servers[id].Excluded {
+			return id
+		}
+	}
+	return ids[0]
+}
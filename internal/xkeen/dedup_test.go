@@ -0,0 +1,116 @@
+package xkeen
+
+import (
+	"testing"
+
+	"xkeen-panel/internal/models"
+)
+
+const (
+	dupA     = "vless://aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa@dup.example:443?type=tcp&security=tls#NL-1"
+	dupACopy = "vless://aaaaaaaa-aaaa-aaaa-aaaa-aaaaaaaaaaaa@dup.example:443?type=tcp&security=tls#Netherlands%20Premium"
+	dupAPort = "vless://bbbbbbbb-bbbb-bbbb-bbbb-bbbbbbbbbbbb@dup.example:8443?type=tcp&security=tls#NL-2"
+)
+
+func dupManager(t *testing.T, uris ...string) *SubscriptionManager {
+	t.Helper()
+	sm := NewSubscriptionManager(t.TempDir())
+	for _, uri := range uris {
+		if _, err := sm.AddManual(uri); err != nil {
+			t.Fatalf("AddManual: %v", err)
+		}
+	}
+	return sm
+}
+
+func TestDuplicateReportKeepsEverything(t *testing.T) {
+	sm := dupManager(t, dupA, dupACopy, dupAPort)
+
+	report := sm.DuplicateReport()
+	if report.Mode != DuplicatesKeep || report.Hidden != 0 {
+		t.Errorf("report = %+v, want keep mode with nothing hidden", report)
+	}
+	if len(report.Groups) != 1 || len(report.Groups[0].Members) != 2 || report.Groups[0].Reasons[0] != "endpoint" {
+		t.Fatalf("groups = %+v, want the two copies of one endpoint", report.Groups)
+	}
+	for _, s := range sm.GetServers() {
+		if s.DuplicateOf != nil {
+			t.Errorf("%s set aside in keep mode", s.Name)
+		}
+	}
+}
+
+func TestHiddenDuplicatesStayOutOfThePool(t *testing.T) {
+	sm := dupManager(t, dupA, dupACopy, realityURI)
+	if err := sm.SetDuplicatePolicy(DuplicatesHide, nil); err != nil {
+		t.Fatalf("SetDuplicatePolicy: %v", err)
+	}
+
+	servers := sm.GetServers()
+	if servers[1].DuplicateOf == nil || *servers[1].DuplicateOf != 0 {
+		t.Fatalf("copy duplicate_of = %v, want 0", servers[1].DuplicateOf)
+	}
+	if got := SelectPoolServers(servers, PoolSelection{}); len(got) != 2 {
+		t.Errorf("pool = %d servers, want the copy left out", len(got))
+	}
+}
+
+func TestDuplicateRulesAreOptIn(t *testing.T) {
+	sm := dupManager(t, dupA, dupAPort)
+	if groups := sm.DuplicateReport().Groups; len(groups) != 0 {
+		t.Fatalf("groups = %+v, want none without rules", groups)
+	}
+
+	if err := sm.SetDuplicatePolicy(DuplicatesHide, []string{"Host"}); err != nil {
+		t.Fatalf("SetDuplicatePolicy: %v", err)
+	}
+	groups := sm.DuplicateReport().Groups
+	if len(groups) != 1 || groups[0].Reasons[0] != DuplicateRuleHost {
+		t.Errorf("groups = %+v, want one joined by host", groups)
+	}
+}
+
+// Merging lists the copies on the kept server and gives it their measurements.
+func TestMergeListsCopies(t *testing.T) {
+	sm := dupManager(t, dupA, dupACopy)
+	speed := &models.SpeedTest{Mbps: 80}
+	sm.data.Servers[1].Speed = speed
+	if err := sm.SetDuplicatePolicy(DuplicatesMerge, nil); err != nil {
+		t.Fatalf("SetDuplicatePolicy: %v", err)
+	}
+
+	kept := sm.GetServers()[0]
+	if len(kept.Aliases) != 1 || kept.Aliases[0] != "Netherlands Premium" {
+		t.Errorf("aliases = %v, want the copy's name", kept.Aliases)
+	}
+	if kept.Speed != speed {
+		t.Error("the copy's speed test was not merged onto the kept server")
+	}
+}
+
+// A favourite stands for its group, even when it is listed later.
+func TestFavouriteIsKept(t *testing.T) {
+	sm := dupManager(t, dupA, dupAPort)
+	if err := sm.SetDuplicatePolicy(DuplicatesHide, []string{DuplicateRuleHost}); err != nil {
+		t.Fatalf("SetDuplicatePolicy: %v", err)
+	}
+	fav := true
+	if _, err := sm.SetServerPrefs(1, models.SetServerPrefsRequest{Favorite: &fav}); err != nil {
+		t.Fatalf("SetServerPrefs: %v", err)
+	}
+
+	servers := sm.GetServers()
+	if servers[1].DuplicateOf != nil || servers[0].DuplicateOf == nil || *servers[0].DuplicateOf != 1 {
+		t.Errorf("duplicate_of = %v, %v, want the favourite kept", servers[0].DuplicateOf, servers[1].DuplicateOf)
+	}
+}
+
+func TestSetDuplicatePolicyRejectsUnknown(t *testing.T) {
+	sm := NewSubscriptionManager(t.TempDir())
+	if err := sm.SetDuplicatePolicy("drop", nil); err == nil {
+		t.Error("unknown mode accepted")
+	}
+	if err := sm.SetDuplicatePolicy(DuplicatesHide, []string{"name"}); err == nil {
+		t.Error("unknown rule accepted")
+	}
+}
@@ -9,7 +9,8 @@ import (
 )
 
 // endpoint identifies an upstream. Two subscription entries with the same
-// address, port and uuid are the same node however the list happens to order
+// address, port and credential (uuid, or password for Trojan and Shadowsocks)
+// are the same node however the list happens to order
 // them — which is what makes pool membership comparable across refreshes.
 type endpoint struct {
 	Address string
@@ -18,16 +19,16 @@ type endpoint struct {
 }
 
 func endpointOfServer(server models.Server) (endpoint, bool) {
-	if server.RawURI == "" || (server.Protocol != "" && server.Protocol != "vless") {
+	if server.RawURI == "" || !OutboundSupported(server) {
 		return endpoint{}, false
 	}
 
-	params, err := ParseVLESS(server.RawURI)
+	params, err := ParseProxyURI(server.RawURI)
 	if err != nil {
 		return endpoint{}, false
 	}
 
-	return endpoint{Address: params.Address, Port: params.Port, UUID: params.UUID}, true
+	return endpoint{Address: params.Address, Port: params.Port, UUID: params.Credential()}, true
 }
 
 func endpointOfOutbound(ob map[string]interface{}) (endpoint, bool) {
@@ -0,0 +1,257 @@
+package xkeen
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"xkeen-panel/internal/geoip"
+	"xkeen-panel/internal/models"
+)
+
+// DefaultExitTraceURL answers with the IP a request came from and the country
+// Cloudflare places it in, as plain key=value lines.
+const DefaultExitTraceURL = "https://www.cloudflare.com/cdn-cgi/trace"
+
+// ExitDiscovery learns where traffic leaves each node.
+//
+// The entry address says little: many providers take connections in one
+// country and send them out of another, so a server is judged by its exit. The
+// trace is fetched through the node in a throwaway core, the way the real
+// delay probe reaches it.
+type ExitDiscovery struct {
+	Runtime       Runtime
+	OutboundsPath string
+	URL           string
+	Timeout       time.Duration // one request through a node
+	Concurrency   int
+	GeoIP         *geoip.Matcher
+}
+
+// ExitDiscoveryFromConfig builds the discovery the config describes.
+func ExitDiscoveryFromConfig(cfg *models.Config, rt Runtime, matcher *geoip.Matcher) ExitDiscovery {
+	return ExitDiscovery{
+		Runtime:       rt,
+		OutboundsPath: cfg.OutboundsFile,
+		URL:           cfg.ExitTraceURL,
+		Timeout:       time.Duration(cfg.LatencyProbeTimeoutMs) * time.Millisecond,
+		Concurrency:   cfg.ProbeConcurrency,
+		GeoIP:         matcher,
+	}
+}
+
+// Discover fetches the trace through every server; results[i] belongs to
+// servers[i]. A node that does not answer gets an error in its result; the
+// error returned means no node could be asked at all.
+func (d ExitDiscovery) Discover(servers []models.Server) ([]models.ExitResult, error) {
+	results := make([]models.ExitResult, len(servers))
+	for i, s := range servers {
+		results[i] = models.ExitResult{ID: s.ID, Name: s.Name}
+	}
+	if len(servers) == 0 {
+		return results, nil
+	}
+	if err := checkProbeCore(d.Runtime); err != nil {
+		return nil, err
+	}
+
+	var nodes []int
+	var outbounds []map[string]interface{}
+	template := probeTemplate(d.OutboundsPath)
+	for i, s := range servers {
+		ob, ok := probeOutbound(s, template)
+		if !ok {
+			results[i].Error = fmt.Sprintf("протокол %s не поддерживается xray", s.Protocol)
+			continue
+		}
+		nodes = append(nodes, i)
+		outbounds = append(outbounds, ob)
+	}
+	if len(nodes) == 0 {
+		return results, nil
+	}
+
+	ports, err := freePorts(len(nodes))
+	if err != nil {
+		return nil, err
+	}
+	stop, err := startProbeCore(d.Runtime.CoreBin, realDelayConfig(outbounds, ports), ports[0])
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+
+	target := d.URL
+	if target == "" {
+		target = DefaultExitTraceURL
+	}
+	timeout := d.Timeout
+	if timeout <= 0 {
+		timeout = DefaultRealDelayTimeout
+	}
+
+	positions := make([]int, len(nodes))
+	for i := range positions {
+		positions[i] = i
+	}
+	parallel(positions, d.Concurrency, func(n int) {
+		proxy := &url.URL{Scheme: "socks5", Host: fmt.Sprintf("127.0.0.1:%d", ports[n])}
+		result := &results[nodes[n]]
+		ip, loc, err := fetchTrace(proxy, target, timeout)
+		if err != nil {
+			result.Error = err.Error()
+			return
+		}
+		result.IP = ip
+		result.Country = exitCountry(ip, loc, d.GeoIP)
+	})
+	return results, nil
+}
+
+// exitCountry places the exit IP. geoip.dat is authoritative for the avoided
+// countries, the only ones it is loaded with; any other country comes from the
+// trace itself. Cloudflare says XX when it does not know and T1 for Tor.
+func exitCountry(ip, loc string, matcher *geoip.Matcher) string {
+	if parsed := net.ParseIP(ip); parsed != nil && matcher != nil {
+		if cc, ok := matcher.Match(parsed); ok {
+			return cc
+		}
+	}
+	loc = strings.ToUpper(strings.TrimSpace(loc))
+	if loc == "XX" || loc == "T1" {
+		return ""
+	}
+	return loc
+}
+
+// fetchTrace reads the ip and loc lines of a trace through the proxy.
+func fetchTrace(proxy *url.URL, target string, timeout time.Duration) (ip, loc string, err error) {
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:             http.ProxyURL(proxy),
+			DisableKeepAlives: true,
+		},
+	}
+	resp, err := client.Get(target)
+	if err != nil {
+		return "", "", fmt.Errorf("запрос через сервер: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return "", "", fmt.Errorf("%s ответил %d", target, resp.StatusCode)
+	}
+
+	scanner := bufio.NewScanner(io.LimitReader(resp.Body, 8<<10))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(scanner.Text(), "=")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "ip":
+			ip = strings.TrimSpace(value)
+		case "loc":
+			loc = value
+		}
+	}
+	if net.ParseIP(ip) == nil {
+		return "", "", fmt.Errorf("в ответе %s нет IP выхода", target)
+	}
+	return ip, loc, nil
+}
+
+// UpdateExits stores discovered exits back into the catalogue by RawURI;
+// results[i] belongs to servers[i]. Every attempt is stamped; a failed one
+// keeps what was known.
+func (sm *SubscriptionManager) UpdateExits(servers []models.Server, results []models.ExitResult) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	byURI := make(map[string]models.ExitResult, len(results))
+	for i, r := range results {
+		if i < len(servers) && servers[i].RawURI != "" {
+			byURI[servers[i].RawURI] = r
+		}
+	}
+	if len(byURI) == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	for i := range sm.data.Servers {
+		s := &sm.data.Servers[i]
+		r, ok := byURI[s.RawURI]
+		if !ok {
+			continue
+		}
+		s.ExitTried = now
+		if r.Error == "" && r.IP != "" {
+			s.ExitIP, s.ExitCountry, s.ExitChecked = r.IP, r.Country, now
+		}
+	}
+	return sm.writeLocked()
+}
+
+// How long an exit counts before it is looked for again. A found exit outranks
+// the name and GeoIP, so it must not be trusted forever — providers move
+// their exits; a node that did not answer is asked again sooner.
+const (
+	ExitRecheckAge = 7 * 24 * time.Hour
+	exitRetryAge   = 24 * time.Hour
+)
+
+// exitDue reports whether the server's exit should be looked for: never
+// looked for, or the last attempt is too old.
+func exitDue(s models.Server, now time.Time) bool {
+	last := s.ExitTried
+	if last.IsZero() {
+		last = s.ExitChecked
+	}
+	if last.IsZero() {
+		return true
+	}
+	age := exitRetryAge
+	if s.ExitIP != "" {
+		age = ExitRecheckAge
+	}
+	return now.Sub(last) >= age
+}
+
+// DiscoverMissingExits runs discovery for the servers whose exit is due — the
+// new ones after a refresh, and those last looked for too long ago — and
+// returns how many were found. With another core than xray there is nothing
+// to run it with, and nothing is done.
+func (sm *SubscriptionManager) DiscoverMissingExits(d ExitDiscovery) (int, error) {
+	if d.Runtime.Core != CoreXray {
+		return 0, nil
+	}
+
+	now := time.Now()
+	var missing []models.Server
+	for _, s := range sm.GetServers() {
+		if exitDue(s, now) && OutboundSupported(s) {
+			missing = append(missing, s)
+		}
+	}
+	if len(missing) == 0 {
+		return 0, nil
+	}
+
+	results, err := d.Discover(missing)
+	if err != nil {
+		return 0, err
+	}
+	found := 0
+	for _, r := range results {
+		if r.Error == "" {
+			found++
+		}
+	}
+	return found, sm.UpdateExits(missing, results)
+}
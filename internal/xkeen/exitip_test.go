@@ -0,0 +1,128 @@
+package xkeen
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+func TestFetchTrace(t *testing.T) {
+	proxy := downloadStub(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("fl=12f\nh=www.cloudflare.com\nip=203.0.113.7\nts=1700000000.1\nloc=DE\ntls=TLSv1.3\n"))
+	})
+
+	ip, loc, err := fetchTrace(proxy, "http://trace.example/cdn-cgi/trace", time.Second)
+	if err != nil {
+		t.Fatalf("fetchTrace: %v", err)
+	}
+	if ip != "203.0.113.7" || loc != "DE" {
+		t.Errorf("ip, loc = %q, %q, want 203.0.113.7, DE", ip, loc)
+	}
+}
+
+// A captive page or a block page through the node is no exit.
+func TestFetchTraceRejectsPageWithoutIP(t *testing.T) {
+	proxy := downloadStub(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("<html>Доступ ограничен</html>"))
+	})
+	if _, _, err := fetchTrace(proxy, "http://trace.example/cdn-cgi/trace", time.Second); err == nil {
+		t.Error("a page without ip= must be an error")
+	}
+}
+
+func TestExitCountryFromTrace(t *testing.T) {
+	if got := exitCountry("203.0.113.7", "nl", nil); got != "NL" {
+		t.Errorf("country = %q, want NL", got)
+	}
+	if got := exitCountry("203.0.113.7", "XX", nil); got != "" {
+		t.Errorf("unknown location = %q, want empty", got)
+	}
+}
+
+// The exit decides: an NL entry that leaves through RU stays out of the pool,
+// an RU-named entry that leaves through FI goes in.
+func TestPoolSelectionJudgesByExit(t *testing.T) {
+	servers := []models.Server{
+		{Protocol: "vless", RawURI: realityURI, Country: "NL", ExitCountry: "RU"},
+		{Protocol: "vless", RawURI: wsURI, Country: "RU", ExitCountry: "FI"},
+	}
+	got := SelectPoolServers(servers, PoolSelection{AvoidCountries: []string{"RU"}})
+	if len(got) != 1 || got[0].RawURI != wsURI {
+		t.Errorf("pool = %v, want only the server exiting through FI", got)
+	}
+}
+
+// A manual override is the owner's call, measured exit or not.
+func TestPoolSelectionOverrideOutranksExit(t *testing.T) {
+	servers := []models.Server{
+		{Protocol: "vless", RawURI: realityURI, ExitCountry: "FI", CountryOverride: "RU"},
+		{Protocol: "vless", RawURI: wsURI, ExitCountry: "RU", CountryOverride: "NL"},
+	}
+	got := SelectPoolServers(servers, PoolSelection{AvoidCountries: []string{"RU"}})
+	if len(got) != 1 || got[0].RawURI != wsURI {
+		t.Errorf("pool = %v, want only the server overridden to NL", got)
+	}
+}
+
+func TestExitSurvivesRefresh(t *testing.T) {
+	srv, _ := subServer(t, sampleSub())
+	sm := NewSubscriptionManager(t.TempDir())
+	servers, err := sm.UpdateURL(srv.URL)
+	if err != nil {
+		t.Fatalf("UpdateURL: %v", err)
+	}
+
+	results := []models.ExitResult{{IP: "203.0.113.7", Country: "DE"}, {Error: "timeout"}}
+	if err := sm.UpdateExits(servers[:2], results); err != nil {
+		t.Fatalf("UpdateExits: %v", err)
+	}
+	if _, err := sm.Refresh(); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	got := sm.GetServers()
+	if got[0].ExitCountry != "DE" || got[0].ExitChecked.IsZero() {
+		t.Errorf("exit after refresh = %q at %v, want DE kept", got[0].ExitCountry, got[0].ExitChecked)
+	}
+	// A failed attempt is stamped, so the next refresh does not ask again at once
+	if !got[1].ExitChecked.IsZero() || got[1].ExitTried.IsZero() {
+		t.Errorf("failed discovery: checked %v, tried %v, want only the attempt stamped",
+			got[1].ExitChecked, got[1].ExitTried)
+	}
+}
+
+func TestExitDue(t *testing.T) {
+	now := time.Now()
+	cases := []struct {
+		name   string
+		server models.Server
+		want   bool
+	}{
+		{"never looked for", models.Server{}, true},
+		{"failed today", models.Server{ExitTried: now.Add(-time.Hour)}, false},
+		{"failed yesterday", models.Server{ExitTried: now.Add(-25 * time.Hour)}, true},
+		{"found this week", models.Server{ExitIP: "203.0.113.7", ExitChecked: now.Add(-48 * time.Hour), ExitTried: now.Add(-48 * time.Hour)}, false},
+		{"found long ago", models.Server{ExitIP: "203.0.113.7", ExitChecked: now.Add(-8 * 24 * time.Hour)}, true},
+		{"recheck failed today", models.Server{ExitIP: "203.0.113.7", ExitChecked: now.Add(-8 * 24 * time.Hour), ExitTried: now.Add(-time.Hour)}, false},
+	}
+	for _, c := range cases {
+		if got := exitDue(c.server, now); got != c.want {
+			t.Errorf("%s: exitDue = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
+
+// Discovery needs a throwaway xray: under Mihomo a refresh skips it quietly.
+func TestDiscoverMissingExitsSkipsOtherCores(t *testing.T) {
+	srv, _ := subServer(t, sampleSub())
+	sm := NewSubscriptionManager(t.TempDir())
+	if _, err := sm.UpdateURL(srv.URL); err != nil {
+		t.Fatalf("UpdateURL: %v", err)
+	}
+	found, err := sm.DiscoverMissingExits(ExitDiscovery{Runtime: Runtime{Core: CoreMihomo}})
+	if found != 0 || err != nil {
+		t.Errorf("DiscoverMissingExits = %d, %v, want nothing done", found, err)
+	}
+}
@@ -0,0 +1,133 @@
+package xkeen
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+// subscriptionFetch is what one download of a subscription yielded.
+type subscriptionFetch struct {
+	servers []models.Server
+	report  *models.ParseReport       // nil when no response arrived
+	usage   *models.SubscriptionUsage // nil when the provider sent no account headers
+
+	notModified  bool // a conditional request came back 304
+	etag         string
+	lastModified string
+}
+
+// downloadAndParse fetches a subscription from sub.URL with its fetch options
+// and parses it. The report and usage come back whenever a response arrived,
+// including when it yielded no servers.
+//
+// conditional sends the validators of the last good response; a provider that
+// honours them answers 304 and the fetch is marked notModified.
+func (sm *SubscriptionManager) downloadAndParse(sub models.Subscription, conditional bool) (subscriptionFetch, error) {
+	var fetch subscriptionFetch
+
+	client, err := fetchClient(sub.Fetch)
+	if err != nil {
+		return fetch, err
+	}
+
+	req, err := http.NewRequest(http.MethodGet, sub.URL, nil)
+	if err != nil {
+		return fetch, fmt.Errorf("неверный URL подписки: %w", err)
+	}
+	if sub.Fetch.UserAgent != "" {
+		req.Header.Set("User-Agent", sub.Fetch.UserAgent)
+	}
+	for key, value := range sub.Fetch.Headers {
+		req.Header.Set(key, value)
+	}
+	if conditional {
+		if sub.ETag != "" {
+			req.Header.Set("If-None-Match", sub.ETag)
+		}
+		if sub.LastModified != "" {
+			req.Header.Set("If-Modified-Since", sub.LastModified)
+		}
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return fetch, fmt.Errorf("ошибка загрузки подписки: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotModified && conditional {
+		fetch.notModified = true
+		return fetch, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fetch, fmt.Errorf("сервер вернул код %d", resp.StatusCode)
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fetch, fmt.Errorf("ошибка чтения ответа: %w", err)
+	}
+
+	// Clash and sing-box documents are sniffed and read entry by entry
+	servers, report, err := ParseSubscriptionReport(string(body))
+	fetch.servers = servers
+	fetch.report = &report
+	fetch.usage = parseUsage(resp.Header)
+	fetch.etag = resp.Header.Get("ETag")
+	fetch.lastModified = resp.Header.Get("Last-Modified")
+	return fetch, err
+}
+
+// fetchClient builds the HTTP client a subscription is downloaded with.
+func fetchClient(opts models.FetchOptions) (*http.Client, error) {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if opts.Proxy != "" {
+		proxyURL, err := parseFetchProxy(opts.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+	if opts.Insecure {
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+
+	return &http.Client{Timeout: 30 * time.Second, Transport: transport}, nil
+}
+
+// parseFetchProxy accepts the proxy schemes net/http can dial through.
+func parseFetchProxy(raw string) (*url.URL, error) {
+	u, err := url.Parse(strings.TrimSpace(raw))
+	if err != nil || u.Host == "" {
+		return nil, fmt.Errorf("неверный адрес прокси: %q", raw)
+	}
+	switch u.Scheme {
+	case "http", "https", "socks5", "socks5h":
+		return u, nil
+	}
+	return nil, fmt.Errorf("прокси %q: поддерживаются http, https и socks5", raw)
+}
+
+// validateFetchOptions reports a broken option when it is set rather than at
+// the next refresh.
+func validateFetchOptions(opts models.FetchOptions) error {
+	if opts.Proxy != "" {
+		if _, err := parseFetchProxy(opts.Proxy); err != nil {
+			return err
+		}
+	}
+	for key := range opts.Headers {
+		if strings.TrimSpace(key) == "" || strings.ContainsAny(key, " :\r\n") {
+			return fmt.Errorf("неверное имя заголовка: %q", key)
+		}
+	}
+	return nil
+}
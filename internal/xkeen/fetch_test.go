@@ -0,0 +1,161 @@
+package xkeen
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"xkeen-panel/internal/models"
+)
+
+func TestFetchOptionsSent(t *testing.T) {
+	var gotUA, gotToken string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotUA, gotToken = r.UserAgent(), r.Header.Get("X-Token")
+		w.Write([]byte(body(uriA)))
+	}))
+	t.Cleanup(srv.Close)
+
+	sm := NewSubscriptionManager(t.TempDir())
+	sub := models.Subscription{Name: "main", URL: srv.URL, Enabled: true, Fetch: models.FetchOptions{
+		UserAgent: "v2rayNG/1.8.5",
+		Headers:   map[string]string{"X-Token": "abc"},
+	}}
+	if _, err := sm.AddSubscription(sub); err != nil {
+		t.Fatalf("AddSubscription: %v", err)
+	}
+	if gotUA != "v2rayNG/1.8.5" || gotToken != "abc" {
+		t.Errorf("request UA=%q X-Token=%q", gotUA, gotToken)
+	}
+}
+
+func TestFetchThroughProxy(t *testing.T) {
+	var proxied atomic.Bool
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// A forward proxy sees the absolute URL of the subscription
+		if r.URL.Host == "sub.invalid" {
+			proxied.Store(true)
+		}
+		w.Write([]byte(body(uriA)))
+	}))
+	t.Cleanup(proxy.Close)
+
+	sm := NewSubscriptionManager(t.TempDir())
+	sub := models.Subscription{Name: "main", URL: "http://sub.invalid/s", Enabled: true,
+		Fetch: models.FetchOptions{Proxy: proxy.URL}}
+	if _, err := sm.AddSubscription(sub); err != nil {
+		t.Fatalf("AddSubscription: %v", err)
+	}
+	if !proxied.Load() {
+		t.Error("the subscription was not fetched through the proxy")
+	}
+}
+
+func TestFetchInsecure(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body(uriA)))
+	}))
+	t.Cleanup(srv.Close)
+
+	sm := NewSubscriptionManager(t.TempDir())
+	if _, err := sm.AddSubscription(models.Subscription{Name: "strict", URL: srv.URL, Enabled: true}); err == nil {
+		t.Error("a self-signed certificate must fail verification by default")
+	}
+	sub := models.Subscription{Name: "lax", URL: srv.URL, Enabled: true, Fetch: models.FetchOptions{Insecure: true}}
+	if _, err := sm.AddSubscription(sub); err != nil {
+		t.Errorf("insecure fetch: %v", err)
+	}
+}
+
+func TestValidateFetchOptions(t *testing.T) {
+	bad := []models.FetchOptions{
+		{Proxy: "ftp://1.2.3.4:21"},
+		{Proxy: "127.0.0.1:1080"},
+		{Headers: map[string]string{"Bad Name": "x"}},
+	}
+	for _, opts := range bad {
+		if validateFetchOptions(opts) == nil {
+			t.Errorf("%+v must be rejected", opts)
+		}
+	}
+	if err := validateFetchOptions(models.FetchOptions{Proxy: "socks5://127.0.0.1:10808"}); err != nil {
+		t.Errorf("socks5 proxy: %v", err)
+	}
+}
+
+func TestRefreshNotModified(t *testing.T) {
+	var full, conditional atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			conditional.Add(1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		full.Add(1)
+		w.Header().Set("ETag", `"v1"`)
+		w.Write([]byte(body(uriA, uriB)))
+	}))
+	t.Cleanup(srv.Close)
+
+	sm := NewSubscriptionManager(t.TempDir())
+	if _, err := sm.UpdateURL(srv.URL); err != nil {
+		t.Fatalf("UpdateURL: %v", err)
+	}
+	if _, err := sm.SetActiveByRawURI(uriB); err != nil {
+		t.Fatalf("SetActiveByRawURI: %v", err)
+	}
+
+	changed, err := sm.RefreshIfChanged(DefaultSubscriptionName)
+	if err != nil || changed {
+		t.Fatalf("RefreshIfChanged = %v, %v; want an unchanged refresh", changed, err)
+	}
+	if full.Load() != 1 || conditional.Load() != 1 {
+		t.Errorf("full=%d conditional=%d", full.Load(), conditional.Load())
+	}
+	if len(sm.GetServers()) != 2 || sm.GetActiveServer().RawURI != uriB {
+		t.Error("a 304 must leave the catalogue as it was")
+	}
+	if sub := sm.Subscriptions()[0]; sub.LastError != "" || sub.LastUpdated.IsZero() {
+		t.Errorf("a 304 is a successful refresh: %+v", sub)
+	}
+}
+
+// Validators of a body that did not parse must not be sent back: the 304 would
+// pin the subscription to the broken version.
+func TestBrokenBodyKeepsNoValidators(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("ETag", `"broken"`)
+		w.Write([]byte("garbage"))
+	}))
+	t.Cleanup(srv.Close)
+
+	sm := NewSubscriptionManager(t.TempDir())
+	sm.data.Subscriptions = []models.Subscription{{Name: "main", URL: srv.URL, Enabled: true, ETag: `"old"`}}
+
+	if _, err := sm.RefreshIfChanged("main"); err == nil {
+		t.Fatal("garbage must not parse")
+	}
+	if etag := sm.Subscriptions()[0].ETag; etag != `"old"` {
+		t.Errorf("ETag = %q, want the one of the last good response", etag)
+	}
+}
+
+func TestFetchProxyUnreachable(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	sm := NewSubscriptionManager(t.TempDir())
+	sub := models.Subscription{Name: "main", URL: "http://sub.invalid/s", Enabled: true,
+		Fetch: models.FetchOptions{Proxy: "socks5://" + addr}}
+	_, err = sm.AddSubscription(sub)
+	if err == nil || !strings.Contains(err.Error(), "ошибка загрузки") {
+		t.Errorf("err = %v", err)
+	}
+}
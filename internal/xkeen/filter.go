@@ -0,0 +1,183 @@
+package xkeen
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"strings"
+
+	"xkeen-panel/internal/models"
+)
+
+// ServerSortKeys are the fields the server list can be sorted by.
+var ServerSortKeys = []string{"id", "name", "latency", "country", "protocol", "source", "priority"}
+
+// FilterServers keeps the servers matching f. inPool tells pool membership; a
+// nil one leaves InPool out of the match.
+func FilterServers(servers []models.Server, f models.ServerFilter, inPool func(models.Server) bool) []models.Server {
+	out := make([]models.Server, 0, len(servers))
+	for _, s := range servers {
+		if MatchesFilter(s, f, inPool) {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+// MatchesFilter reports whether a server passes every condition of f.
+func MatchesFilter(s models.Server, f models.ServerFilter, inPool func(models.Server) bool) bool {
+	if len(f.Protocols) > 0 && !containsFold(f.Protocols, s.Protocol) {
+		return false
+	}
+	if len(f.Countries) > 0 && !containsFold(f.Countries, effectiveCountry(s)) {
+		return false
+	}
+	if f.MinLatency > 0 || f.MaxLatency > 0 {
+		if s.Latency <= 0 || s.Latency < f.MinLatency {
+			return false
+		}
+		if f.MaxLatency > 0 && s.Latency > f.MaxLatency {
+			return false
+		}
+	}
+	if len(f.Tags) > 0 && !slices.ContainsFunc(s.Tags, func(tag string) bool { return containsFold(f.Tags, tag) }) {
+		return false
+	}
+	if len(f.Sources) > 0 && !containsFold(f.Sources, s.Source) {
+		return false
+	}
+	if f.InPool != nil && inPool != nil && inPool(s) != *f.InPool {
+		return false
+	}
+	if f.UDP != nil && UDPCapable(s) != *f.UDP {
+		return false
+	}
+	return true
+}
+
+// SortServers orders servers by one of ServerSortKeys, ties broken by ID.
+// Servers that never answered stay last in a latency sort either way.
+func SortServers(servers []models.Server, key string, desc bool) error {
+	var compare func(a, b models.Server) int
+	switch key {
+	case "", "id":
+		compare = func(a, b models.Server) int { return a.ID - b.ID }
+	case "name":
+		compare = func(a, b models.Server) int {
+			return strings.Compare(strings.ToLower(DisplayName(a)), strings.ToLower(DisplayName(b)))
+		}
+	case "latency":
+		compare = func(a, b models.Server) int { return a.Latency - b.Latency }
+	case "country":
+		compare = func(a, b models.Server) int { return strings.Compare(effectiveCountry(a), effectiveCountry(b)) }
+	case "protocol":
+		compare = func(a, b models.Server) int { return strings.Compare(a.Protocol, b.Protocol) }
+	case "source":
+		compare = func(a, b models.Server) int { return strings.Compare(a.Source, b.Source) }
+	case "priority":
+		compare = func(a, b models.Server) int { return a.Priority - b.Priority }
+	default:
+		return fmt.Errorf("неизвестное поле сортировки %q, доступны: %s", key, strings.Join(ServerSortKeys, ", "))
+	}
+
+	sort.SliceStable(servers, func(i, j int) bool {
+		a, b := servers[i], servers[j]
+		if key == "latency" {
+			if answered := a.Latency > 0; answered != (b.Latency > 0) {
+				return answered
+			}
+		}
+		c := compare(a, b)
+		if desc {
+			c = -c
+		}
+		if c != 0 {
+			return c < 0
+		}
+		return a.ID < b.ID
+	})
+	return nil
+}
+
+// PoolMembership reads which servers the pool currently holds, by endpoint.
+func PoolMembership(outboundsPath, selector string) (func(models.Server) bool, error) {
+	layout, err := ReadPoolLayout(outboundsPath, selector)
+	if err != nil {
+		return nil, err
+	}
+	endpoints := layout.Endpoints()
+	return func(s models.Server) bool {
+		ep, ok := endpointOfServer(s)
+		return ok && endpoints[ep]
+	}, nil
+}
+
+// UDPCapable reports whether the last UDP check through the server passed.
+func UDPCapable(s models.Server) bool {
+	return s.UDP != nil && s.UDP.OK
+}
+
+// effectiveCountry is where the server is judged to be: the manual override,
+// then the exit once known, then the entry — the order pool selection and
+// failover go by.
+func effectiveCountry(s models.Server) string {
+	if s.CountryOverride != "" {
+		return s.CountryOverride
+	}
+	if s.ExitCountry != "" {
+		return s.ExitCountry
+	}
+	return s.Country
+}
+
+func containsFold(list []string, value string) bool {
+	for _, v := range list {
+		if strings.EqualFold(strings.TrimSpace(v), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// Filters returns the saved server filters.
+func (sm *SubscriptionManager) Filters() map[string]models.ServerFilter {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return maps.Clone(sm.data.Filters)
+}
+
+// Filter looks up a saved filter by name.
+func (sm *SubscriptionManager) Filter(name string) (models.ServerFilter, bool) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	f, ok := sm.data.Filters[name]
+	return f, ok
+}
+
+// SaveFilter stores a filter under a name, replacing one saved before.
+func (sm *SubscriptionManager) SaveFilter(name string, f models.ServerFilter) error {
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return fmt.Errorf("у фильтра должно быть имя")
+	}
+
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.data.Filters == nil {
+		sm.data.Filters = map[string]models.ServerFilter{}
+	}
+	sm.data.Filters[name] = f
+	return sm.writeLocked()
+}
+
+// DeleteFilter removes a saved filter.
+func (sm *SubscriptionManager) DeleteFilter(name string) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if _, ok := sm.data.Filters[name]; !ok {
+		return fmt.Errorf("фильтр %q не найден", name)
+	}
+	delete(sm.data.Filters, name)
+	return sm.writeLocked()
+}
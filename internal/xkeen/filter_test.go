@@ -0,0 +1,104 @@
+package xkeen
+
+import (
+	"testing"
+
+	"xkeen-panel/internal/models"
+)
+
+func filterFixture() []models.Server {
+	return []models.Server{
+		{ID: 0, Name: "nl", Protocol: "vless", Country: "NL", Latency: 120, Source: "main", Tags: []string{"Streaming"}},
+		{ID: 1, Name: "de", Protocol: "trojan", Country: "DE", Latency: 40, Source: "main"},
+		{ID: 2, Name: "fi", Protocol: "vless", Country: "RU", CountryOverride: "FI", ExitCountry: "SE", Latency: -1, Source: "backup"},
+		{ID: 3, Name: "tr", Protocol: "vless", Country: "TR", ExitCountry: "NL", Latency: 0, Source: "backup", Tags: []string{"cheap"}},
+	}
+}
+
+func TestFilterServers(t *testing.T) {
+	yes := true
+	inPool := func(s models.Server) bool { return s.ID == 1 || s.ID == 3 }
+
+	cases := []struct {
+		name   string
+		filter models.ServerFilter
+		want   []int
+	}{
+		{"everything", models.ServerFilter{}, []int{0, 1, 2, 3}},
+		{"protocol", models.ServerFilter{Protocols: []string{"VLESS"}}, []int{0, 2, 3}},
+		{"country override wins", models.ServerFilter{Countries: []string{"fi"}}, []int{2}},
+		{"exit over entry", models.ServerFilter{Countries: []string{"nl"}}, []int{0, 3}},
+		{"entry behind a known exit", models.ServerFilter{Countries: []string{"tr"}}, nil},
+		{"latency range skips unanswered", models.ServerFilter{MaxLatency: 200}, []int{0, 1}},
+		{"tag any of", models.ServerFilter{Tags: []string{"streaming", "cheap"}}, []int{0, 3}},
+		{"source and pool", models.ServerFilter{Sources: []string{"backup"}, InPool: &yes}, []int{3}},
+		{"source ignores case", models.ServerFilter{Sources: []string{"Backup"}, InPool: &yes}, []int{3}},
+	}
+	for _, c := range cases {
+		var got []int
+		for _, s := range FilterServers(filterFixture(), c.filter, inPool) {
+			got = append(got, s.ID)
+		}
+		if len(got) != len(c.want) {
+			t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+			continue
+		}
+		for i := range got {
+			if got[i] != c.want[i] {
+				t.Errorf("%s: got %v, want %v", c.name, got, c.want)
+				break
+			}
+		}
+	}
+}
+
+// Servers that never answered stay at the bottom whichever way latency sorts.
+func TestSortServersByLatency(t *testing.T) {
+	for _, desc := range []bool{false, true} {
+		servers := filterFixture()
+		if err := SortServers(servers, "latency", desc); err != nil {
+			t.Fatalf("SortServers: %v", err)
+		}
+		first, last := servers[0].ID, servers[3].ID
+		if desc && first != 0 || !desc && first != 1 {
+			t.Errorf("desc=%v: first = %d", desc, first)
+		}
+		if servers[2].Latency > 0 || servers[3].Latency > 0 {
+			t.Errorf("desc=%v: unanswered servers not last (last = %d)", desc, last)
+		}
+	}
+
+	if err := SortServers(filterFixture(), "speed", false); err == nil {
+		t.Error("an unknown sort key must be an error")
+	}
+}
+
+func TestPoolSelectionAppliesFilter(t *testing.T) {
+	servers := []models.Server{
+		{Protocol: "vless", RawURI: realityURI, Country: "NL"},
+		{Protocol: "vless", RawURI: wsURI, Country: "DE", Favorite: true},
+	}
+	got := SelectPoolServers(servers, PoolSelection{Filter: &models.ServerFilter{Countries: []string{"NL"}}})
+	if len(got) != 1 || got[0].RawURI != realityURI {
+		t.Errorf("pool = %v, want only the NL server, favourite or not", got)
+	}
+}
+
+func TestSavedFiltersPersist(t *testing.T) {
+	dir := t.TempDir()
+	sm := NewSubscriptionManager(dir)
+	if err := sm.SaveFilter("fast-nl", models.ServerFilter{Countries: []string{"NL"}, MaxLatency: 150}); err != nil {
+		t.Fatalf("SaveFilter: %v", err)
+	}
+
+	reloaded := NewSubscriptionManager(dir)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if f, ok := reloaded.Filter("fast-nl"); !ok || f.MaxLatency != 150 {
+		t.Errorf("filter after reload = %+v, %v", f, ok)
+	}
+	if err := reloaded.DeleteFilter("missing"); err == nil {
+		t.Error("deleting an unknown filter must fail")
+	}
+}
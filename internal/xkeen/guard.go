@@ -0,0 +1,127 @@
+package xkeen
+
+import (
+	"fmt"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+// DefaultMaxRemovedPercent is the share of a subscription's servers one refresh
+// may take away before it is held for approval.
+const DefaultMaxRemovedPercent = 50
+
+// OnQuarantine is called when a refresh is held back; main.go publishes it
+// over SSE.
+var OnQuarantine func(name string, q models.Quarantine)
+
+// QuarantineError is returned by a refresh the guard held back. The servers
+// the subscription had stay in place.
+type QuarantineError struct {
+	Name   string
+	Reason string
+}
+
+func (e *QuarantineError) Error() string {
+	return "обновление в карантине: " + e.Reason
+}
+
+// SetRefreshGuard sets the sanity thresholds of automatic refreshes: the most
+// a refresh may remove, in percent of the servers the subscription had, and
+// the fewest servers a shrinking list may end up with. Zero turns a check off.
+// The guard covers the scheduled refresh and the one the watchdog runs on
+// failover; a refresh the user asks for is applied as it is.
+func (sm *SubscriptionManager) SetRefreshGuard(maxRemovedPercent, minServers int) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.maxRemovedPercent = maxRemovedPercent
+	sm.minServers = minServers
+}
+
+// guardLocked says why a freshly downloaded list must not replace the
+// subscription's current servers, or "" when it may.
+//
+// A provider glitch answers with a handful of servers instead of forty; applied
+// blindly, that shrinks the pool to the handful. The minimum applies only to a
+// list that shrinks: a subscription that was always small is not suspicious.
+func (sm *SubscriptionManager) guardLocked(name string, fresh []models.Server) string {
+	var current []models.Server
+	for _, s := range sm.data.Servers {
+		if s.Source == name {
+			current = append(current, s)
+		}
+	}
+	if len(current) == 0 {
+		return ""
+	}
+
+	keep := make(map[string]bool, len(fresh))
+	for _, s := range fresh {
+		keep[serverKey(s)] = true
+	}
+	removed := 0
+	for _, s := range current {
+		if !keep[serverKey(s)] {
+			removed++
+		}
+	}
+
+	if sm.maxRemovedPercent > 0 && removed*100 > sm.maxRemovedPercent*len(current) {
+		return fmt.Sprintf("удалено %d из %d серверов — больше %d%%", removed, len(current), sm.maxRemovedPercent)
+	}
+	if sm.minServers > 0 && len(fresh) < sm.minServers && len(fresh) < len(current) {
+		return fmt.Sprintf("в списке %d серверов, меньше минимума %d", len(fresh), sm.minServers)
+	}
+	return ""
+}
+
+// quarantineLocked holds a refresh back for manual approval.
+func (sm *SubscriptionManager) quarantineLocked(name string, fetch subscriptionFetch, reason string) models.Quarantine {
+	q := models.Quarantine{
+		Time:         time.Now(),
+		Reason:       reason,
+		Servers:      fetch.servers,
+		ETag:         fetch.etag,
+		LastModified: fetch.lastModified,
+	}
+	if idx := sm.indexLocked(name); idx >= 0 {
+		sm.data.Subscriptions[idx].Quarantine = &q
+	}
+	return q
+}
+
+// ApproveQuarantine applies the refresh held back for a subscription.
+func (sm *SubscriptionManager) ApproveQuarantine(name string) ([]models.Server, error) {
+	sm.mu.Lock()
+	idx := sm.indexLocked(name)
+	if idx < 0 || sm.data.Subscriptions[idx].Quarantine == nil {
+		sm.mu.Unlock()
+		return nil, fmt.Errorf("у подписки %q нет обновления в карантине", name)
+	}
+	sub := &sm.data.Subscriptions[idx]
+	q := sub.Quarantine
+	sub.Quarantine = nil
+	sub.LastError = ""
+	sub.LastUpdated = time.Now()
+	sub.ETag, sub.LastModified = q.ETag, q.LastModified
+	sm.applyRefreshLocked(name, q.Servers)
+	sm.mu.Unlock()
+
+	Log("[SUBSCRIPTION] %s: обновление из карантина применено (%d серверов)", name, len(q.Servers))
+	return sm.GetServers(), sm.Save()
+}
+
+// DiscardQuarantine drops the refresh held back for a subscription.
+func (sm *SubscriptionManager) DiscardQuarantine(name string) error {
+	sm.mu.Lock()
+	idx := sm.indexLocked(name)
+	if idx < 0 || sm.data.Subscriptions[idx].Quarantine == nil {
+		sm.mu.Unlock()
+		return fmt.Errorf("у подписки %q нет обновления в карантине", name)
+	}
+	sm.data.Subscriptions[idx].Quarantine = nil
+	sm.mu.Unlock()
+
+	Log("[SUBSCRIPTION] %s: обновление из карантина отклонено", name)
+	return sm.Save()
+}
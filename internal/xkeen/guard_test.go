@@ -0,0 +1,122 @@
+package xkeen
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"xkeen-panel/internal/models"
+)
+
+const uriD = "vless://dddddddd-dddd-dddd-dddd-dddddddddddd@4.4.4.4:443?type=tcp&security=reality&sni=d.com&fp=chrome#SE-4"
+
+func TestGuardQuarantinesShrunkList(t *testing.T) {
+	srv, set := subServer(t, body(uriA, uriB, uriC, uriD))
+	sm := NewSubscriptionManager(t.TempDir())
+	sm.SetRefreshGuard(50, 0)
+	if _, err := sm.UpdateURL(srv.URL); err != nil {
+		t.Fatalf("UpdateURL: %v", err)
+	}
+
+	var notified string
+	OnQuarantine = func(name string, q models.Quarantine) { notified = name }
+	t.Cleanup(func() { OnQuarantine = nil })
+
+	// 3 of 4 gone: held back
+	set(body(uriA))
+	_, err := sm.RefreshIfChanged(DefaultSubscriptionName)
+	var qerr *QuarantineError
+	if !errors.As(err, &qerr) || !strings.Contains(qerr.Reason, "3 из 4") {
+		t.Fatalf("err = %v, want a quarantine", err)
+	}
+	if len(sm.GetServers()) != 4 {
+		t.Error("the current servers must stay while the refresh is held")
+	}
+	sub := sm.Subscriptions()[0]
+	if sub.Quarantine == nil || len(sub.Quarantine.Servers) != 1 || sub.LastError == "" {
+		t.Fatalf("subscription = %+v", sub)
+	}
+	if notified != DefaultSubscriptionName {
+		t.Error("OnQuarantine was not called")
+	}
+
+	servers, err := sm.ApproveQuarantine(DefaultSubscriptionName)
+	if err != nil {
+		t.Fatalf("ApproveQuarantine: %v", err)
+	}
+	if len(servers) != 1 || sm.Subscriptions()[0].Quarantine != nil || sm.Subscriptions()[0].LastError != "" {
+		t.Errorf("approval must apply the held list: %d servers", len(servers))
+	}
+}
+
+func TestGuardAllowsSmallChanges(t *testing.T) {
+	srv, set := subServer(t, body(uriA, uriB, uriC, uriD))
+	sm := NewSubscriptionManager(t.TempDir())
+	sm.SetRefreshGuard(50, 3)
+	sm.UpdateURL(srv.URL)
+
+	set(body(uriA, uriB, uriC))
+	if _, err := sm.RefreshIfChanged(DefaultSubscriptionName); err != nil {
+		t.Fatalf("one server of four removed must pass: %v", err)
+	}
+
+	set(body(uriA, uriB))
+	_, err := sm.RefreshIfChanged(DefaultSubscriptionName)
+	var qerr *QuarantineError
+	if !errors.As(err, &qerr) || !strings.Contains(qerr.Reason, "минимума 3") {
+		t.Fatalf("err = %v, want the minimum to hold", err)
+	}
+
+	if err := sm.DiscardQuarantine(DefaultSubscriptionName); err != nil {
+		t.Fatalf("DiscardQuarantine: %v", err)
+	}
+	if len(sm.GetServers()) != 3 || sm.Subscriptions()[0].Quarantine != nil {
+		t.Error("discarding must keep the current servers")
+	}
+	if err := sm.DiscardQuarantine(DefaultSubscriptionName); err == nil {
+		t.Error("nothing left to discard")
+	}
+}
+
+// A provider that recovers on its own clears the quarantine.
+func TestGuardClearedByGoodRefresh(t *testing.T) {
+	srv, set := subServer(t, body(uriA, uriB))
+	sm := NewSubscriptionManager(t.TempDir())
+	sm.SetRefreshGuard(50, 0)
+	sm.UpdateURL(srv.URL)
+
+	set(body(uriC))
+	sm.RefreshIfChanged(DefaultSubscriptionName)
+	if sm.Subscriptions()[0].Quarantine == nil {
+		t.Fatal("a fully replaced list must be held")
+	}
+
+	set(body(uriA, uriB))
+	if _, err := sm.RefreshIfChanged(DefaultSubscriptionName); err != nil {
+		t.Fatalf("RefreshIfChanged: %v", err)
+	}
+	if sm.Subscriptions()[0].Quarantine != nil {
+		t.Error("the quarantine must be dropped once the provider is back")
+	}
+}
+
+// A refresh the user asked for is how they accept a list that really shrank.
+func TestGuardSkipsRefreshByUser(t *testing.T) {
+	srv, set := subServer(t, body(uriA, uriB, uriC, uriD))
+	sm := NewSubscriptionManager(t.TempDir())
+	sm.SetRefreshGuard(50, 0)
+	sm.UpdateURL(srv.URL)
+
+	set(body(uriA))
+	if _, err := sm.RefreshIfChanged(DefaultSubscriptionName); err == nil {
+		t.Fatal("a scheduled refresh must be held")
+	}
+
+	servers, err := sm.RefreshSubscriptionByUser(DefaultSubscriptionName)
+	if err != nil {
+		t.Fatalf("RefreshSubscriptionByUser: %v", err)
+	}
+	if len(servers) != 1 || sm.Subscriptions()[0].Quarantine != nil {
+		t.Errorf("%d servers, quarantine %v: the user's refresh must apply", len(servers), sm.Subscriptions()[0].Quarantine)
+	}
+}
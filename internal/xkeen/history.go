@@ -0,0 +1,275 @@
+package xkeen
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+// DefaultHistorySize is how many server lists are kept per subscription.
+const DefaultHistorySize = 10
+
+// SetHistorySize sets how many server lists are kept per subscription; zero
+// or less takes the default.
+func (sm *SubscriptionManager) SetHistorySize(n int) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if n <= 0 {
+		n = DefaultHistorySize
+	}
+	sm.historySize = n
+}
+
+func (sm *SubscriptionManager) historyPath() string {
+	return filepath.Join(sm.dataDir, "subscription_history.json")
+}
+
+// loadHistoryLocked reads the snapshot file. A missing or broken one only
+// costs the history, never the subscription.
+func (sm *SubscriptionManager) loadHistoryLocked() {
+	data, err := os.ReadFile(sm.historyPath())
+	if err != nil {
+		return
+	}
+	var history []models.SubscriptionSnapshot
+	if err := json.Unmarshal(data, &history); err != nil {
+		Log("[SUBSCRIPTION] История подписок не прочитана: %v", err)
+		return
+	}
+	sm.history = history
+}
+
+// saveHistoryLocked writes the snapshot file when it changed. The history sits
+// apart from subscription.json so that the file written on every latency
+// check does not carry ten copies of the catalogue.
+func (sm *SubscriptionManager) saveHistoryLocked() error {
+	if !sm.historyDirty {
+		return nil
+	}
+	data, err := json.MarshalIndent(sm.history, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(sm.historyPath(), data, 0600); err != nil {
+		return err
+	}
+	sm.historyDirty = false
+	return nil
+}
+
+// applyRefreshLocked puts a freshly delivered server list in the catalogue and
+// keeps a snapshot of it. Call with sm.mu held.
+func (sm *SubscriptionManager) applyRefreshLocked(source string, fresh []models.Server) {
+	sm.recordSnapshotLocked(source, fresh, 0)
+	sm.rebuildLocked(source, fresh)
+}
+
+// recordSnapshotLocked appends a snapshot unless the list is the one the
+// subscription already has on record — an unchanged refresh is not history.
+func (sm *SubscriptionManager) recordSnapshotLocked(source string, servers []models.Server, restoredFrom int) {
+	for i := len(sm.history) - 1; i >= 0; i-- {
+		if sm.history[i].Subscription != source {
+			continue
+		}
+		if restoredFrom == 0 && sameURIs(sm.history[i].Servers, servers) {
+			return
+		}
+		break
+	}
+
+	id := 1
+	if n := len(sm.history); n > 0 {
+		id = sm.history[n-1].ID + 1
+	}
+	sm.history = append(sm.history, models.SubscriptionSnapshot{
+		ID:           id,
+		Subscription: source,
+		Time:         time.Now(),
+		ServerCount:  len(servers),
+		Servers:      append([]models.Server(nil), servers...),
+		RestoredFrom: restoredFrom,
+	})
+	sm.historyDirty = true
+
+	// Drop the oldest snapshots of this subscription beyond the limit
+	limit := sm.historySize
+	if limit <= 0 {
+		limit = DefaultHistorySize
+	}
+	kept := 0
+	for i := len(sm.history) - 1; i >= 0; i-- {
+		if sm.history[i].Subscription != source {
+			continue
+		}
+		if kept++; kept > limit {
+			sm.history = slices.Delete(sm.history, i, i+1)
+		}
+	}
+}
+
+func sameURIs(a, b []models.Server) bool {
+	return slices.EqualFunc(a, b, func(x, y models.Server) bool { return x.RawURI == y.RawURI })
+}
+
+// History lists the kept snapshots, newest first, without their servers. An
+// empty name lists every subscription.
+func (sm *SubscriptionManager) History(name string) []models.SubscriptionSnapshot {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	var out []models.SubscriptionSnapshot
+	for i := len(sm.history) - 1; i >= 0; i-- {
+		snap := sm.history[i]
+		if name != "" && snap.Subscription != name {
+			continue
+		}
+		snap.Servers = nil
+		out = append(out, snap)
+	}
+	return out
+}
+
+func (sm *SubscriptionManager) snapshotLocked(id int) (models.SubscriptionSnapshot, bool) {
+	for _, snap := range sm.history {
+		if snap.ID == id {
+			return snap, true
+		}
+	}
+	return models.SubscriptionSnapshot{}, false
+}
+
+// DiffSnapshots compares two snapshots by endpoint: servers that appeared,
+// servers that went away, and servers still there under a new name or with
+// new connection parameters.
+func (sm *SubscriptionManager) DiffSnapshots(from, to int) (models.SnapshotDiff, error) {
+	sm.mu.RLock()
+	a, okA := sm.snapshotLocked(from)
+	b, okB := sm.snapshotLocked(to)
+	sm.mu.RUnlock()
+
+	if !okA {
+		return models.SnapshotDiff{}, fmt.Errorf("снимок %d не найден", from)
+	}
+	if !okB {
+		return models.SnapshotDiff{}, fmt.Errorf("снимок %d не найден", to)
+	}
+
+	return diffServers(a.Servers, b.Servers, from, to), nil
+}
+
+func diffServers(before, after []models.Server, from, to int) models.SnapshotDiff {
+	diff := models.SnapshotDiff{From: from, To: to}
+
+	old := make(map[string]models.Server, len(before))
+	for _, s := range before {
+		old[serverKey(s)] = s
+	}
+	seen := make(map[string]bool, len(after))
+
+	for _, s := range after {
+		key := serverKey(s)
+		seen[key] = true
+		prev, ok := old[key]
+		if !ok {
+			diff.Added = append(diff.Added, diffEntry(key, s))
+			continue
+		}
+		if fields := changedFields(prev, s); len(fields) > 0 {
+			diff.Changed = append(diff.Changed, models.DiffChange{
+				Key:    key,
+				Before: diffEntry(key, prev),
+				After:  diffEntry(key, s),
+				Fields: fields,
+			})
+		}
+	}
+	for _, s := range before {
+		if key := serverKey(s); !seen[key] {
+			diff.Removed = append(diff.Removed, diffEntry(key, s))
+		}
+	}
+
+	return diff
+}
+
+// serverKey is endpoint.Key() for every protocol that has one; a link the
+// parser cannot read is keyed by itself.
+func serverKey(s models.Server) string {
+	if key, ok := EndpointKey(s); ok {
+		return key
+	}
+	return s.RawURI
+}
+
+func diffEntry(key string, s models.Server) models.DiffEntry {
+	return models.DiffEntry{Key: key, Name: s.Name, Protocol: s.Protocol, Address: s.Address, Port: s.Port}
+}
+
+// changedFields names what differs between two servers on the same endpoint.
+func changedFields(a, b models.Server) []string {
+	var fields []string
+	if a.Name != b.Name {
+		fields = append(fields, "name")
+	}
+	if a.Protocol != b.Protocol {
+		fields = append(fields, "protocol")
+	}
+	if connParams(a.RawURI) != connParams(b.RawURI) {
+		fields = append(fields, "params")
+	}
+	return fields
+}
+
+// connParams renders what a link connects with, leaving out its name: parsed
+// parameters when the link reads, the link without its fragment otherwise.
+// Parsed, a provider merely reordering query keys changes nothing.
+func connParams(uri string) string {
+	if p, err := ParseProxyURI(uri); err == nil {
+		if data, err := json.Marshal(p); err == nil {
+			return string(data)
+		}
+	}
+	before, _, _ := strings.Cut(uri, "#")
+	return before
+}
+
+// Rollback puts the server list of a snapshot back in place of what its
+// subscription currently has. The restore is itself recorded, so it can be
+// undone the same way.
+//
+// The validators of the subscription are left alone: while the provider keeps
+// answering 304 the restored list stays; a list that really changed replaces
+// it at the next refresh.
+func (sm *SubscriptionManager) Rollback(id int) ([]models.Server, error) {
+	sm.mu.Lock()
+	snap, ok := sm.snapshotLocked(id)
+	if !ok {
+		sm.mu.Unlock()
+		return nil, fmt.Errorf("снимок %d не найден", id)
+	}
+	idx := sm.indexLocked(snap.Subscription)
+	if idx < 0 {
+		sm.mu.Unlock()
+		return nil, fmt.Errorf("подписка %q удалена", snap.Subscription)
+	}
+	if !sm.data.Subscriptions[idx].Enabled {
+		sm.mu.Unlock()
+		return nil, fmt.Errorf("подписка %q выключена", snap.Subscription)
+	}
+
+	servers := append([]models.Server(nil), snap.Servers...)
+	sm.recordSnapshotLocked(snap.Subscription, servers, id)
+	sm.rebuildLocked(snap.Subscription, servers)
+	sm.mu.Unlock()
+
+	Log("[SUBSCRIPTION] %s: восстановлен список от %s (снимок %d, %d серверов)",
+		snap.Subscription, snap.Time.Local().Format("02.01.2006 15:04"), id, len(servers))
+
+	return sm.GetServers(), sm.Save()
+}
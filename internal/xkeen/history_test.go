@@ -0,0 +1,121 @@
+package xkeen
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHistoryRecordsChangedLists(t *testing.T) {
+	srv, set := subServer(t, body(uriA, uriB))
+	sm := NewSubscriptionManager(t.TempDir())
+	if _, err := sm.UpdateURL(srv.URL); err != nil {
+		t.Fatalf("UpdateURL: %v", err)
+	}
+
+	// Unchanged: no new snapshot
+	sm.Refresh()
+	if h := sm.History(""); len(h) != 1 || h[0].ServerCount != 2 || h[0].Servers != nil {
+		t.Fatalf("history = %+v", h)
+	}
+
+	set(body(uriC))
+	sm.Refresh()
+	h := sm.History(DefaultSubscriptionName)
+	if len(h) != 2 || h[0].ServerCount != 1 || h[0].ID <= h[1].ID {
+		t.Fatalf("history must list the newest first: %+v", h)
+	}
+}
+
+func TestHistoryLimit(t *testing.T) {
+	srv, set := subServer(t, body(uriA))
+	sm := NewSubscriptionManager(t.TempDir())
+	sm.SetHistorySize(2)
+	sm.UpdateURL(srv.URL)
+	set(body(uriB))
+	sm.Refresh()
+	set(body(uriC))
+	sm.Refresh()
+
+	h := sm.History("")
+	if len(h) != 2 || h[1].ServerCount != 1 {
+		t.Fatalf("history = %+v", h)
+	}
+	if _, err := sm.DiffSnapshots(1, h[0].ID); err == nil {
+		t.Error("the oldest snapshot must have been dropped")
+	}
+}
+
+func TestDiffSnapshots(t *testing.T) {
+	renamed := strings.Replace(uriB, "#DE-2", "#DE-2 renamed", 1)
+	moved := strings.Replace(uriA, "sni=a.com", "sni=new.com", 1)
+
+	srv, set := subServer(t, body(uriA, uriB, uriC))
+	sm := NewSubscriptionManager(t.TempDir())
+	sm.UpdateURL(srv.URL)
+	set(body(moved, renamed, "trojan://pw@4.4.4.4:443#TR"))
+	sm.Refresh()
+
+	h := sm.History("")
+	diff, err := sm.DiffSnapshots(h[1].ID, h[0].ID)
+	if err != nil {
+		t.Fatalf("DiffSnapshots: %v", err)
+	}
+
+	if len(diff.Added) != 1 || diff.Added[0].Name != "TR" || diff.Added[0].Key != "4.4.4.4:443:pw" {
+		t.Errorf("added = %+v", diff.Added)
+	}
+	if len(diff.Removed) != 1 || diff.Removed[0].Name != "FI-3" {
+		t.Errorf("removed = %+v", diff.Removed)
+	}
+	if len(diff.Changed) != 2 {
+		t.Fatalf("changed = %+v", diff.Changed)
+	}
+	fields := map[string]string{}
+	for _, c := range diff.Changed {
+		fields[c.Before.Name] = strings.Join(c.Fields, ",")
+	}
+	if fields["NL-1"] != "params" || fields["DE-2"] != "name" {
+		t.Errorf("changed fields = %v", fields)
+	}
+
+	if _, err := sm.DiffSnapshots(h[0].ID, 999); err == nil {
+		t.Error("an unknown snapshot must be an error")
+	}
+}
+
+func TestRollbackRestoresList(t *testing.T) {
+	srv, set := subServer(t, body(uriA, uriB))
+	dir := t.TempDir()
+	sm := NewSubscriptionManager(dir)
+	sm.UpdateURL(srv.URL)
+	good := sm.History("")[0].ID
+
+	set(body(uriC))
+	sm.Refresh()
+
+	servers, err := sm.Rollback(good)
+	if err != nil {
+		t.Fatalf("Rollback: %v", err)
+	}
+	if len(servers) != 2 || findByURI(servers, uriA) == nil || findByURI(servers, uriC) != nil {
+		t.Fatalf("servers after rollback = %+v", servers)
+	}
+
+	h := sm.History("")
+	if h[0].RestoredFrom != good {
+		t.Errorf("the rollback must be recorded: %+v", h[0])
+	}
+
+	// The history survives a restart of the panel
+	reloaded := NewSubscriptionManager(dir)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if len(reloaded.History("")) != len(h) {
+		t.Errorf("reloaded history = %d snapshots, want %d", len(reloaded.History("")), len(h))
+	}
+
+	if _, err := sm.Rollback(999); err == nil {
+		t.Error("an unknown snapshot must be an error")
+	}
+}
@@ -0,0 +1,129 @@
+package xkeen
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"xkeen-panel/internal/models"
+)
+
+// ManualSource is the Source of servers added by hand. The name is reserved:
+// no subscription may take it.
+const ManualSource = "manual"
+
+// ImportContent feeds subscription content obtained out of band — pasted, or an
+// uploaded file — through the same parser as a download. It is meant for an
+// outage, when the provider's URL is exactly what cannot be reached.
+//
+// The servers replace those of the named subscription, which is created
+// without a URL if it does not exist (an empty name means the primary one). A
+// subscription with a URL goes back to its provider at the next refresh.
+func (sm *SubscriptionManager) ImportContent(name, content string) ([]models.Server, *models.ParseReport, error) {
+	name = strings.TrimSpace(name)
+	if err := checkSubscriptionName(name); err != nil {
+		return nil, nil, err
+	}
+	if strings.TrimSpace(content) == "" {
+		return nil, nil, fmt.Errorf("пустое содержимое подписки")
+	}
+
+	servers, report, err := ParseSubscriptionReport(content)
+	if err != nil {
+		return nil, &report, err
+	}
+
+	sm.mu.Lock()
+	if name == "" {
+		name = DefaultSubscriptionName
+		if len(sm.data.Subscriptions) > 0 {
+			name = sm.data.Subscriptions[0].Name
+		}
+	}
+	idx := sm.indexLocked(name)
+	if idx < 0 {
+		sm.data.Subscriptions = append(sm.data.Subscriptions, models.Subscription{Name: name, Enabled: true})
+		idx = len(sm.data.Subscriptions) - 1
+	}
+	sub := &sm.data.Subscriptions[idx]
+	sub.Enabled = true
+	// The validators describe what the provider served, not this content: a
+	// 304 must not keep the import in place of a changed subscription
+	sub.ETag, sub.LastModified = "", ""
+	// Pasted content carries no headers; the last known usage still holds
+	sm.markRefreshedLocked(name, subscriptionFetch{servers: servers, report: &report, usage: sub.Usage}, nil)
+	sm.applyRefreshLocked(name, servers)
+	sm.mu.Unlock()
+
+	return sm.GetServers(), &report, sm.Save()
+}
+
+// AddManual adds a hand-written share link. Manual servers sit after the
+// subscriptions in the catalogue and are left alone by every refresh.
+func (sm *SubscriptionManager) AddManual(uri string) ([]models.Server, error) {
+	uri = strings.TrimSpace(uri)
+	if _, err := manualServer(uri); err != nil {
+		return nil, err
+	}
+
+	sm.mu.Lock()
+	if slices.Contains(sm.data.Manual, uri) {
+		sm.mu.Unlock()
+		return nil, fmt.Errorf("сервер уже добавлен")
+	}
+	sm.data.Manual = append(sm.data.Manual, uri)
+	sm.rebuildLocked("", nil)
+	sm.mu.Unlock()
+
+	return sm.GetServers(), sm.Save()
+}
+
+// RemoveManual drops a manual server by its catalogue ID.
+func (sm *SubscriptionManager) RemoveManual(id int) ([]models.Server, error) {
+	sm.mu.Lock()
+	if id < 0 || id >= len(sm.data.Servers) || sm.data.Servers[id].Source != ManualSource {
+		sm.mu.Unlock()
+		return nil, fmt.Errorf("ручной сервер %d не найден", id)
+	}
+	uri := sm.data.Servers[id].RawURI
+	sm.data.Manual = slices.DeleteFunc(sm.data.Manual, func(m string) bool { return m == uri })
+	sm.rebuildLocked("", nil)
+	sm.mu.Unlock()
+
+	return sm.GetServers(), sm.Save()
+}
+
+// manualServersLocked lays out the manual servers, keeping the latency and
+// overrides of those already in the catalogue. Call with sm.mu held.
+func (sm *SubscriptionManager) manualServersLocked(old []models.Server) []models.Server {
+	var out []models.Server
+	for _, uri := range sm.data.Manual {
+		idx := slices.IndexFunc(old, func(s models.Server) bool {
+			return s.Source == ManualSource && s.RawURI == uri
+		})
+		if idx >= 0 {
+			out = append(out, old[idx])
+			continue
+		}
+		server, err := manualServer(uri)
+		if err != nil {
+			continue
+		}
+		out = append(out, *server)
+	}
+	return out
+}
+
+func manualServer(uri string) (*models.Server, error) {
+	if uri == "" {
+		return nil, fmt.Errorf("ссылка на сервер обязательна")
+	}
+	server, err := parseLine(uri)
+	if err != nil {
+		return nil, fmt.Errorf("ссылка не разобрана: %s", errorText(err))
+	}
+	server.RawURI = uri
+	server.Country = detectCountry(server.Name)
+	server.Source = ManualSource
+	return server, nil
+}
@@ -0,0 +1,135 @@
+package xkeen
+
+import (
+	"testing"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+func TestImportContentOffline(t *testing.T) {
+	sm := NewSubscriptionManager(t.TempDir())
+
+	servers, report, err := sm.ImportContent("", body(uriA, uriB, "socks://x@1.1.1.1:1"))
+	if err != nil {
+		t.Fatalf("ImportContent: %v", err)
+	}
+	if len(servers) != 2 || report == nil || report.Accepted != 2 || len(report.Rejected) != 1 {
+		t.Fatalf("servers=%d report=%+v", len(servers), report)
+	}
+
+	subs := sm.Subscriptions()
+	if len(subs) != 1 || subs[0].Name != DefaultSubscriptionName || subs[0].URL != "" || subs[0].LastUpdated.IsZero() {
+		t.Fatalf("subscriptions = %+v", subs)
+	}
+
+	// Without a URL there is nothing to download: the refresh must not fail
+	// over a subscription that only ever came from an import
+	if due := sm.DueSubscriptions(time.Minute, false, subs[0].LastUpdated.Add(24*time.Hour)); len(due) != 0 {
+		t.Errorf("an imported subscription is not due for download: %v", due)
+	}
+}
+
+func TestImportReplacesDownloadedServers(t *testing.T) {
+	srv, _ := subServer(t, body(uriA))
+	sm := NewSubscriptionManager(t.TempDir())
+	if _, err := sm.AddSubscription(models.Subscription{Name: "main", URL: srv.URL, Enabled: true}); err != nil {
+		t.Fatalf("AddSubscription: %v", err)
+	}
+
+	servers, _, err := sm.ImportContent("main", body(uriB, uriC))
+	if err != nil {
+		t.Fatalf("ImportContent: %v", err)
+	}
+	if len(servers) != 2 || findByURI(servers, uriA) != nil || findByURI(servers, uriB).Source != "main" {
+		t.Fatalf("import must replace the servers of the subscription: %+v", servers)
+	}
+
+	// The provider is back: the next refresh restores its own list
+	if _, err := sm.Refresh(); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	if findByURI(sm.GetServers(), uriA) == nil {
+		t.Error("the refresh must bring back the provider's servers")
+	}
+}
+
+func TestImportRejectsGarbage(t *testing.T) {
+	sm := NewSubscriptionManager(t.TempDir())
+	_, report, err := sm.ImportContent("", "<html>error</html>")
+	if err == nil || report == nil || len(report.Rejected) != 1 {
+		t.Fatalf("err=%v report=%+v", err, report)
+	}
+	if len(sm.Subscriptions()) != 0 {
+		t.Error("a failed import must not create a subscription")
+	}
+}
+
+func TestManualServersSurviveRefresh(t *testing.T) {
+	srv, set := subServer(t, body(uriA))
+	sm := NewSubscriptionManager(t.TempDir())
+	if _, err := sm.UpdateURL(srv.URL); err != nil {
+		t.Fatalf("UpdateURL: %v", err)
+	}
+
+	servers, err := sm.AddManual(uriC)
+	if err != nil {
+		t.Fatalf("AddManual: %v", err)
+	}
+	if len(servers) != 2 || servers[1].RawURI != uriC || servers[1].Source != ManualSource {
+		t.Fatalf("servers = %+v", servers)
+	}
+	if _, err := sm.AddManual(uriC); err == nil {
+		t.Error("a duplicate manual server must be rejected")
+	}
+	if _, err := sm.AddManual("socks://1.1.1.1:1080"); err == nil {
+		t.Error("an unsupported link must be rejected")
+	}
+	if _, err := sm.SetActiveByRawURI(uriC); err != nil {
+		t.Fatalf("SetActiveByRawURI: %v", err)
+	}
+
+	set(body(uriB))
+	servers, err = sm.Refresh()
+	if err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+	manual := findByURI(servers, uriC)
+	if manual == nil || !manual.Active {
+		t.Fatalf("the manual server must survive the refresh and stay active: %+v", servers)
+	}
+
+	if _, err := sm.RemoveManual(0); err == nil {
+		t.Error("a subscription server must not be removable as manual")
+	}
+	servers, err = sm.RemoveManual(manual.ID)
+	if err != nil {
+		t.Fatalf("RemoveManual: %v", err)
+	}
+	if findByURI(servers, uriC) != nil || len(sm.GetData().Manual) != 0 {
+		t.Error("the manual server was not removed")
+	}
+}
+
+func TestManualNameReserved(t *testing.T) {
+	sm := NewSubscriptionManager(t.TempDir())
+	if _, err := sm.AddSubscription(models.Subscription{Name: ManualSource, URL: "http://x"}); err == nil {
+		t.Error("a subscription must not take the manual source name")
+	}
+	if _, _, err := sm.ImportContent(ManualSource, body(uriA)); err == nil {
+		t.Error("an import must not take the manual source name")
+	}
+}
+
+// The static routes under /api/subscriptions would shadow these names
+func TestRouteNamesReserved(t *testing.T) {
+	sm := NewSubscriptionManager(t.TempDir())
+	for _, name := range []string{"history", "import"} {
+		if _, err := sm.AddSubscription(models.Subscription{Name: name, URL: "http://x"}); err == nil {
+			t.Errorf("a subscription must not be named %q", name)
+		}
+		if _, _, err := sm.ImportContent(name, body(uriA)); err == nil {
+			t.Errorf("an import must not be named %q", name)
+		}
+	}
+}
@@ -0,0 +1,424 @@
+package xkeen
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+// Retention of the latency history, used when config.yaml leaves it at zero.
+// 288 samples is a day of probes five minutes apart.
+const (
+	DefaultLatencyHistorySize = 288
+	DefaultLatencyHistoryAge  = 7 * 24 * time.Hour
+	DefaultLatencyFlushEvery  = 15 * time.Minute
+)
+
+// sparklineLength is how many of the latest samples a sparkline shows.
+const sparklineLength = 30
+
+// Incident kinds: a health round that found services failing through the node,
+// and the node being condemned — blacklisted on failover or rotated away from.
+const (
+	IncidentHealth    = "health"
+	IncidentBlacklist = "blacklist"
+)
+
+// maxIncidents caps the incidents kept per endpoint.
+const maxIncidents = 50
+
+type latencyIncident struct {
+	Time int64  `json:"t"`
+	Kind string `json:"k"`
+}
+
+// latencyFile is what latency_history.json holds.
+type latencyFile struct {
+	Series    map[string][]latencySample   `json:"series"`
+	Incidents map[string][]latencyIncident `json:"incidents,omitempty"`
+}
+
+// latencySample is one probe result; -1 is a probe that got no answer. It is
+// written as a [unix, ms] pair, with a third 1 for a real delay — the file
+// holds thousands of them.
+//
+// The kind is kept because the two are not comparable: a real delay carries a
+// whole request through the node, a connect time only reaches its port. Summed
+// up together, the spread would measure the gap between the probes.
+type latencySample struct {
+	Time    int64
+	Latency int
+	Real    bool
+}
+
+func (s latencySample) MarshalJSON() ([]byte, error) {
+	if s.Real {
+		return json.Marshal([3]int64{s.Time, int64(s.Latency), 1})
+	}
+	return json.Marshal([2]int64{s.Time, int64(s.Latency)})
+}
+
+func (s *latencySample) UnmarshalJSON(data []byte) error {
+	var fields []int64
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return err
+	}
+	if len(fields) < 2 {
+		return fmt.Errorf("замер из %d полей", len(fields))
+	}
+	s.Time, s.Latency = fields[0], int(fields[1])
+	s.Real = len(fields) > 2 && fields[2] == 1
+	return nil
+}
+
+// probeKind is the kind of probe a latency_probe mode runs: the real delay, or
+// the transport probe for anything else.
+func probeKind(mode string) string {
+	if mode == ProbeModeReal {
+		return ProbeModeReal
+	}
+	return ProbeModeTCP
+}
+
+// LatencyHistory keeps the last probe results of every endpoint, so a node
+// that is consistently good can be told from one that was lucky once.
+//
+// The series are keyed by endpoint, not by catalogue ID or link: IDs shift on
+// every refresh and providers rename servers, while the endpoint stays.
+//
+// Router storage is flash, so results are held in memory and written at most
+// every flushEvery, and at shutdown. A crash costs minutes of history, nothing
+// else.
+type LatencyHistory struct {
+	path string
+
+	// flushMu keeps writes of the file one at a time
+	flushMu sync.Mutex
+
+	mu         sync.Mutex
+	series     map[string][]latencySample // oldest first, at most size long
+	incidents  map[string][]latencyIncident
+	size       int
+	maxAge     time.Duration
+	flushEvery time.Duration
+	dirty      bool
+	lastFlush  time.Time
+	kind       string // the probe kind Stats sums up
+}
+
+func NewLatencyHistory(dataDir string) *LatencyHistory {
+	return &LatencyHistory{
+		path:       filepath.Join(dataDir, "latency_history.json"),
+		series:     map[string][]latencySample{},
+		incidents:  map[string][]latencyIncident{},
+		size:       DefaultLatencyHistorySize,
+		maxAge:     DefaultLatencyHistoryAge,
+		flushEvery: DefaultLatencyFlushEvery,
+		lastFlush:  time.Now(),
+		kind:       ProbeModeTCP,
+	}
+}
+
+// SetProbeKind sets which probes Stats sums up: those of the latency_probe
+// mode, the ones the catalogue check, pinning and failover run.
+func (h *LatencyHistory) SetProbeKind(mode string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.kind = probeKind(mode)
+}
+
+// SetRetention sets how many samples are kept per endpoint, for how long, and
+// how often the file is written. Zero keeps the default.
+func (h *LatencyHistory) SetRetention(size int, maxAge, flushEvery time.Duration) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if size > 0 {
+		h.size = size
+	}
+	if maxAge > 0 {
+		h.maxAge = maxAge
+	}
+	if flushEvery > 0 {
+		h.flushEvery = flushEvery
+	}
+}
+
+// Load reads the stored history. A missing or broken file only costs the
+// history.
+func (h *LatencyHistory) Load() {
+	data, err := os.ReadFile(h.path)
+	if err != nil {
+		return
+	}
+	var file latencyFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		Log("[PROBE] История задержек не прочитана: %v", err)
+		return
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if file.Series != nil {
+		h.series = file.Series
+	}
+	if file.Incidents != nil {
+		h.incidents = file.Incidents
+	}
+	h.pruneLocked(time.Now())
+}
+
+// Record adds the results of a probe of the given kind, ProbeModeTCP or
+// ProbeModeReal. Servers with no endpoint — pool nodes the subscription no
+// longer has — are skipped.
+func (h *LatencyHistory) Record(servers []models.Server, kind string, at time.Time) {
+	isReal := probeKind(kind) == ProbeModeReal
+	h.mu.Lock()
+	for _, s := range servers {
+		key, ok := EndpointKey(s)
+		if !ok {
+			continue
+		}
+		series := append(h.series[key], latencySample{Time: at.Unix(), Latency: s.Latency, Real: isReal})
+		if len(series) > h.size {
+			series = slices.Delete(series, 0, len(series)-h.size)
+		}
+		h.series[key] = series
+		h.dirty = true
+	}
+	// Probes report from many goroutines at once: the first to find the write
+	// due takes it, the rest see it done
+	due := h.dirty && time.Since(h.lastFlush) >= h.flushEvery
+	if due {
+		h.lastFlush = time.Now()
+	}
+	h.mu.Unlock()
+
+	if due {
+		if err := h.Flush(); err != nil {
+			Log("[PROBE] История задержек не сохранена: %v", err)
+		}
+	}
+}
+
+// Flush writes the history when it changed since the last write.
+func (h *LatencyHistory) Flush() error {
+	// Two writers would share the temporary file and could rename a mix of both
+	h.flushMu.Lock()
+	defer h.flushMu.Unlock()
+
+	h.mu.Lock()
+	if !h.dirty {
+		h.mu.Unlock()
+		return nil
+	}
+	h.pruneLocked(time.Now())
+	data, err := json.Marshal(latencyFile{Series: h.series, Incidents: h.incidents})
+	h.dirty = false
+	h.lastFlush = time.Now()
+	h.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(h.path), 0700); err != nil {
+		return err
+	}
+	// Written aside and renamed: a power cut mid-write must not leave half a file
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, h.path)
+}
+
+// RecordIncident files something that went wrong with the node behind key, an
+// endpoint key as EndpointKey gives it.
+func (h *LatencyHistory) RecordIncident(key, kind string, at time.Time) {
+	if key == "" {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	incidents := append(h.incidents[key], latencyIncident{Time: at.Unix(), Kind: kind})
+	if len(incidents) > maxIncidents {
+		incidents = slices.Delete(incidents, 0, len(incidents)-maxIncidents)
+	}
+	h.incidents[key] = incidents
+	h.dirty = true
+}
+
+// Incidents counts the incidents of each kind filed under key since a time.
+func (h *LatencyHistory) Incidents(key string, since time.Time) map[string]int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	counts := map[string]int{}
+	for _, incident := range h.incidents[key] {
+		if incident.Time >= since.Unix() {
+			counts[incident.Kind]++
+		}
+	}
+	return counts
+}
+
+// pruneLocked drops samples past the retention age, and with them endpoints
+// that have not been probed for that long — servers long gone from every
+// subscription.
+func (h *LatencyHistory) pruneLocked(now time.Time) {
+	cutoff := now.Add(-h.maxAge).Unix()
+	for key, incidents := range h.incidents {
+		first := slices.IndexFunc(incidents, func(i latencyIncident) bool { return i.Time >= cutoff })
+		switch {
+		case first < 0:
+			delete(h.incidents, key)
+		case first > 0:
+			h.incidents[key] = slices.Delete(incidents, 0, first)
+		}
+	}
+	for key, series := range h.series {
+		first := slices.IndexFunc(series, func(s latencySample) bool { return s.Time >= cutoff })
+		switch {
+		case first < 0:
+			delete(h.series, key)
+		case first > 0:
+			h.series[key] = slices.Delete(series, 0, first)
+		}
+		if len(h.series[key]) > h.size {
+			h.series[key] = slices.Delete(h.series[key], 0, len(h.series[key])-h.size)
+		}
+	}
+}
+
+// Stats sums up the history of a server, of the kind SetProbeKind chose.
+func (h *LatencyHistory) Stats(server models.Server) models.LatencyStats {
+	h.mu.Lock()
+	kind := h.kind
+	h.mu.Unlock()
+	return h.StatsOf(server, kind)
+}
+
+// StatsOf sums up the probes of one kind in the history of a server. A server
+// with none of that kind — one the real delay cannot carry only ever gets
+// connect times — is summed up by the other kind; Kind says which it was.
+func (h *LatencyHistory) StatsOf(server models.Server, kind string) models.LatencyStats {
+	stats := models.LatencyStats{ID: server.ID, Name: server.Name, P50: -1, P90: -1, P99: -1, Last: -1}
+
+	key, ok := EndpointKey(server)
+	if !ok {
+		return stats
+	}
+	stats.Key = key
+
+	isReal := probeKind(kind) == ProbeModeReal
+	h.mu.Lock()
+	series := ofKind(h.series[key], isReal)
+	if len(series) == 0 {
+		isReal = !isReal
+		series = ofKind(h.series[key], isReal)
+	}
+	h.mu.Unlock()
+
+	if len(series) > 0 {
+		stats.Kind = ProbeModeTCP
+		if isReal {
+			stats.Kind = ProbeModeReal
+		}
+	}
+	return summarize(stats, series)
+}
+
+// ofKind copies out the samples of one kind.
+func ofKind(series []latencySample, isReal bool) []latencySample {
+	var out []latencySample
+	for _, s := range series {
+		if s.Real == isReal {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func summarize(stats models.LatencyStats, series []latencySample) models.LatencyStats {
+	stats.Samples = len(series)
+	if len(series) == 0 {
+		return stats
+	}
+
+	var ok []int
+	for _, s := range series {
+		if s.Latency >= 0 {
+			ok = append(ok, s.Latency)
+		}
+	}
+	stats.Loss = float64(len(series)-len(ok)) / float64(len(series))
+
+	last := series[len(series)-1]
+	stats.Last = last.Latency
+	stats.LastTime = time.Unix(last.Time, 0)
+
+	if len(ok) > 0 {
+		slices.Sort(ok)
+		stats.P50 = percentile(ok, 50)
+		stats.P90 = percentile(ok, 90)
+		stats.P99 = percentile(ok, 99)
+	}
+
+	tail := series[max(0, len(series)-sparklineLength):]
+	stats.Sparkline = make([]int, len(tail))
+	for i, s := range tail {
+		stats.Sparkline[i] = s.Latency
+	}
+
+	return stats
+}
+
+// percentile is the nearest-rank percentile of sorted values.
+func percentile(sorted []int, p int) int {
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// EndpointKey is the endpoint a server's results are filed under, the same
+// key PoolState.PinnedNode holds.
+func EndpointKey(s models.Server) (string, bool) {
+	if ep, ok := endpointOfServer(s); ok {
+		return ep.Key(), true
+	}
+	if p, err := ParseProxyURI(s.RawURI); err == nil {
+		return endpoint{Address: p.Address, Port: p.Port, UUID: p.Credential()}.Key(), true
+	}
+	return "", false
+}
+
+// LatencyHistory is where probes record their results.
+func (sm *SubscriptionManager) LatencyHistory() *LatencyHistory {
+	return sm.latency
+}
+
+// LatencyStats sums up the latency history of every server in the catalogue.
+func (sm *SubscriptionManager) LatencyStats() []models.LatencyStats {
+	servers := sm.GetServers()
+	out := make([]models.LatencyStats, 0, len(servers))
+	for _, s := range servers {
+		out = append(out, sm.latency.Stats(s))
+	}
+	return out
+}
+
+// ServerLatencyStats sums up the latency history of one server.
+func (sm *SubscriptionManager) ServerLatencyStats(id int) (models.LatencyStats, error) {
+	for _, s := range sm.GetServers() {
+		if s.ID == id {
+			return sm.latency.Stats(s), nil
+		}
+	}
+	return models.LatencyStats{}, fmt.Errorf("сервер %d не найден", id)
+}
@@ -0,0 +1,168 @@
+package xkeen
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+func probed(uri string, latency int) models.Server {
+	return models.Server{Protocol: "vless", RawURI: uri, Latency: latency}
+}
+
+func TestLatencyStats(t *testing.T) {
+	h := NewLatencyHistory(t.TempDir())
+	start := time.Now().Add(-time.Hour)
+	for i, lat := range []int{100, 120, -1, 110, 400, 105, 115, -1, 108, 112} {
+		h.Record([]models.Server{probed(realityURI, lat)}, ProbeModeTCP, start.Add(time.Duration(i)*time.Minute))
+	}
+
+	stats := h.Stats(probed(realityURI, 0))
+	if stats.Samples != 10 {
+		t.Fatalf("samples = %d, want 10", stats.Samples)
+	}
+	if stats.Loss != 0.2 {
+		t.Errorf("loss = %v, want 0.2", stats.Loss)
+	}
+	if stats.P50 != 110 || stats.P90 != 400 {
+		t.Errorf("p50/p90 = %d/%d, want 110/400", stats.P50, stats.P90)
+	}
+	if stats.Last != 112 || len(stats.Sparkline) != 10 || stats.Sparkline[2] != -1 {
+		t.Errorf("last = %d, sparkline = %v", stats.Last, stats.Sparkline)
+	}
+
+	if none := h.Stats(probed(wsURI, 0)); none.Samples != 0 || none.P50 != -1 {
+		t.Errorf("never probed = %+v, want no samples and p50 -1", none)
+	}
+}
+
+// A provider renaming a server must not cost it its history.
+func TestLatencyHistoryKeyedByEndpoint(t *testing.T) {
+	h := NewLatencyHistory(t.TempDir())
+	h.Record([]models.Server{probed(realityURI+"#Old name", 90)}, ProbeModeTCP, time.Now())
+	h.Record([]models.Server{probed(realityURI+"#New name", 95)}, ProbeModeTCP, time.Now())
+
+	if got := h.Stats(probed(realityURI, 0)).Samples; got != 2 {
+		t.Errorf("samples = %d, want both names counted together", got)
+	}
+}
+
+func TestLatencyHistoryRetention(t *testing.T) {
+	dir := t.TempDir()
+	h := NewLatencyHistory(dir)
+	h.SetRetention(3, 24*time.Hour, 0)
+
+	now := time.Now()
+	for i := range 5 {
+		h.Record([]models.Server{probed(realityURI, 100+i)}, ProbeModeTCP, now.Add(time.Duration(i)*time.Second))
+	}
+	// Probed two days ago and never since: gone at the next write
+	h.Record([]models.Server{probed(wsURI, 50)}, ProbeModeTCP, now.Add(-48*time.Hour))
+
+	if err := h.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	reloaded := NewLatencyHistory(dir)
+	reloaded.Load()
+
+	stats := reloaded.Stats(probed(realityURI, 0))
+	if stats.Samples != 3 || stats.Sparkline[0] != 102 {
+		t.Errorf("kept %v, want the newest three samples", stats.Sparkline)
+	}
+	if got := reloaded.Stats(probed(wsURI, 0)).Samples; got != 0 {
+		t.Errorf("stale endpoint kept %d samples, want it pruned", got)
+	}
+}
+
+// Results stay in memory until the flush interval passes: the router writes
+// to flash.
+func TestLatencyHistoryBatchesWrites(t *testing.T) {
+	dir := t.TempDir()
+	h := NewLatencyHistory(dir)
+	h.SetRetention(0, 0, time.Hour)
+
+	h.Record([]models.Server{probed(realityURI, 100)}, ProbeModeTCP, time.Now())
+	if _, err := os.Stat(filepath.Join(dir, "latency_history.json")); !os.IsNotExist(err) {
+		t.Errorf("history written after one probe (err = %v), want it batched", err)
+	}
+}
+
+// Every probe, whatever ran it, lands in the history.
+func TestLatencyProbeRecordsHistory(t *testing.T) {
+	h := NewLatencyHistory(t.TempDir())
+	probe := LatencyProbe{Timeout: 200 * time.Millisecond, History: h}
+
+	// Nothing listens on port 1: a loss is recorded too
+	server := models.Server{Protocol: "vless", Address: "127.0.0.1", Port: 1,
+		RawURI: "vless://id@127.0.0.1:1?type=tcp"}
+	probe.Check([]models.Server{server})
+
+	stats := h.Stats(server)
+	if stats.Samples != 1 || stats.Loss != 1 {
+		t.Errorf("stats = %+v, want one lost probe", stats)
+	}
+}
+
+// Connect times and real delays are filed apart: the spread of a mix would be
+// the gap between the probes, not the node's.
+func TestLatencyHistoryKeepsProbeKindsApart(t *testing.T) {
+	dir := t.TempDir()
+	h := NewLatencyHistory(dir)
+	now := time.Now()
+	for i := range 4 {
+		h.Record([]models.Server{probed(realityURI, 20+i)}, ProbeModeTCP, now.Add(time.Duration(i)*time.Second))
+		h.Record([]models.Server{probed(realityURI, 300+i)}, ProbeModeReal, now.Add(time.Duration(i)*time.Second))
+	}
+	h.Record([]models.Server{probed(wsURI, 40)}, ProbeModeTCP, now)
+
+	if err := h.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+	reloaded := NewLatencyHistory(dir)
+	reloaded.Load()
+
+	tcp := reloaded.StatsOf(probed(realityURI, 0), ProbeModeTCP)
+	if tcp.Kind != ProbeModeTCP || tcp.Samples != 4 || tcp.P90 != 23 {
+		t.Errorf("tcp = %+v, want the four connect times alone", tcp)
+	}
+	reloaded.SetProbeKind(ProbeModeReal)
+	delays := reloaded.Stats(probed(realityURI, 0))
+	if delays.Kind != ProbeModeReal || delays.Samples != 4 || delays.P50 != 301 {
+		t.Errorf("real = %+v, want the four real delays alone", delays)
+	}
+	// Only ever connected to: summed up by what there is
+	if ws := reloaded.Stats(probed(wsURI, 0)); ws.Kind != ProbeModeTCP || ws.Samples != 1 {
+		t.Errorf("ws = %+v, want its connect time", ws)
+	}
+}
+
+// Probes report from many goroutines; every write must leave a whole file.
+func TestLatencyHistoryConcurrentFlushes(t *testing.T) {
+	dir := t.TempDir()
+	h := NewLatencyHistory(dir)
+	h.SetRetention(0, 0, time.Nanosecond)
+
+	var wg sync.WaitGroup
+	for i := range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.Record([]models.Server{probed(realityURI, 100+i)}, ProbeModeTCP, time.Now())
+		}()
+	}
+	wg.Wait()
+	if err := h.Flush(); err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	reloaded := NewLatencyHistory(dir)
+	reloaded.Load()
+	if got := reloaded.Stats(probed(realityURI, 0)).Samples; got != 20 {
+		t.Errorf("samples = %d, want all 20 written", got)
+	}
+}
@@ -0,0 +1,155 @@
+package xkeen
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+// observatoryDeadDelay is the delay Xray's observatory reports for a node that
+// failed its probe.
+const observatoryDeadDelay = 99999999
+
+// NodeObservation is what the core's own observatory last saw of an outbound.
+// It complements the panel's probes: those run from a throwaway core on the
+// panel's schedule, this is what the balancer actually ranks by.
+type NodeObservation struct {
+	Alive     bool      `json:"alive"`
+	Delay     int       `json:"delay_ms"` // -1 while the node is down
+	LastSeen  time.Time `json:"last_seen,omitzero"`
+	LastTry   time.Time `json:"last_try,omitzero"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// ObservatoryState reads the core's observatory, keyed by outbound tag.
+//
+// `xray api` has no command for the observatory, so it is read where Xray
+// publishes it: the expvar page of the metrics listener the panel's api file
+// carries. Either observatory kind shows up there the same way.
+func ObservatoryState(metricsAddr string) (map[string]NodeObservation, error) {
+	if metricsAddr == "" {
+		return nil, fmt.Errorf("адрес metrics не задан")
+	}
+
+	client := &http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get("http://" + metricsAddr + "/debug/vars")
+	if err != nil {
+		return nil, fmt.Errorf("metrics ядра недоступны: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("metrics ядра ответили %s", resp.Status)
+	}
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, 4<<20))
+	if err != nil {
+		return nil, fmt.Errorf("ошибка чтения metrics: %w", err)
+	}
+	return parseObservatoryVars(body)
+}
+
+// parseObservatoryVars picks the observatory out of Xray's expvar page:
+//
+//	{"observatory": {"proxy-1": {"alive": true, "delay": 212,
+//	  "outbound_tag": "proxy-1", "last_seen_time": 1700000000, ...}}}
+//
+// Fields are omitted when zero, so a dead node comes without "alive". A core
+// without an observatory has no such key, which reads as an empty state.
+func parseObservatoryVars(body []byte) (map[string]NodeObservation, error) {
+	var vars struct {
+		Observatory map[string]struct {
+			Alive       bool   `json:"alive"`
+			Delay       int64  `json:"delay"`
+			LastError   string `json:"last_error_reason"`
+			OutboundTag string `json:"outbound_tag"`
+			LastSeen    int64  `json:"last_seen_time"`
+			LastTry     int64  `json:"last_try_time"`
+		} `json:"observatory"`
+	}
+	if err := json.Unmarshal(body, &vars); err != nil {
+		return nil, fmt.Errorf("некорректный ответ metrics: %w", err)
+	}
+
+	state := make(map[string]NodeObservation, len(vars.Observatory))
+	for key, s := range vars.Observatory {
+		tag := s.OutboundTag
+		if tag == "" {
+			tag = key
+		}
+		obs := NodeObservation{Alive: s.Alive, Delay: int(s.Delay), LastError: s.LastError}
+		if !s.Alive || s.Delay >= observatoryDeadDelay {
+			obs.Delay = -1
+		}
+		if s.LastSeen > 0 {
+			obs.LastSeen = time.Unix(s.LastSeen, 0)
+		}
+		if s.LastTry > 0 {
+			obs.LastTry = time.Unix(s.LastTry, 0)
+		}
+		state[tag] = obs
+	}
+	return state, nil
+}
+
+// PoolNodeStatus is one pool node as both sides see it: the panel's last probe
+// of the server behind it and the core's observatory.
+type PoolNodeStatus struct {
+	Tag      string           `json:"tag"`
+	ServerID int              `json:"server_id,omitempty"`
+	Server   string           `json:"server,omitempty"` // empty when the node is not in the subscription
+	Latency  int              `json:"latency_ms"`       // panel-side, -1 when unknown
+	Core     *NodeObservation `json:"core,omitempty"`   // nil until the observatory probed it
+}
+
+// ObservePoolNodes merges the observatory into the nodes.
+func ObservePoolNodes(nodes []PoolNode, state map[string]NodeObservation) []PoolNodeStatus {
+	out := make([]PoolNodeStatus, 0, len(nodes))
+	for _, node := range nodes {
+		status := PoolNodeStatus{Tag: node.Tag, Latency: -1}
+		if node.Server != nil {
+			status.ServerID = node.Server.ID
+			status.Server = node.Server.Name
+			status.Latency = node.Server.Latency
+		}
+		if obs, ok := state[node.Tag]; ok {
+			status.Core = &obs
+		}
+		out = append(out, status)
+	}
+	return out
+}
+
+// ObservedPoolNodes lists a balancer's nodes with the core's view merged in. A
+// nil state gives the panel-side view alone.
+func ObservedPoolNodes(outboundsPath string, top Topology, servers []models.Server, state map[string]NodeObservation) ([]PoolNodeStatus, error) {
+	selector := DefaultPoolSelector
+	if len(top.Selectors) > 0 {
+		selector = top.Selectors[0]
+	}
+	nodes, err := PoolNodes(outboundsPath, selector, servers)
+	if err != nil {
+		return nil, err
+	}
+	return ObservePoolNodes(nodes, state), nil
+}
+
+// SameObservations reports whether two readouts would look the same in the UI.
+// Probe times are left out: they move on every cycle even when nothing else did.
+func SameObservations(a, b []PoolNodeStatus) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].Tag != b[i].Tag || a[i].Latency != b[i].Latency || (a[i].Core == nil) != (b[i].Core == nil) {
+			return false
+		}
+		if x, y := a[i].Core, b[i].Core; x != nil && (x.Alive != y.Alive || x.Delay != y.Delay || x.LastError != y.LastError) {
+			return false
+		}
+	}
+	return true
+}
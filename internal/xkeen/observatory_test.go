@@ -0,0 +1,129 @@
+package xkeen
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"xkeen-panel/internal/models"
+)
+
+// As Xray serves it: zero fields omitted, so the dead node has no "alive".
+const observatoryVars = `{
+	"cmdline": ["xray", "run"],
+	"observatory": {
+		"proxy-1": {"alive": true, "delay": 212, "outbound_tag": "proxy-1", "last_seen_time": 1700000000, "last_try_time": 1700000010},
+		"proxy-2": {"delay": 99999999, "last_error_reason": "context deadline exceeded", "outbound_tag": "proxy-2", "last_try_time": 1700000010}
+	}
+}`
+
+func TestParseObservatoryVars(t *testing.T) {
+	state, err := parseObservatoryVars([]byte(observatoryVars))
+	if err != nil {
+		t.Fatalf("parseObservatoryVars: %v", err)
+	}
+
+	alive := state["proxy-1"]
+	if !alive.Alive || alive.Delay != 212 || alive.LastSeen.Unix() != 1700000000 {
+		t.Errorf("proxy-1 = %+v", alive)
+	}
+	dead := state["proxy-2"]
+	if dead.Alive || dead.Delay != -1 || dead.LastError == "" || !dead.LastSeen.IsZero() {
+		t.Errorf("proxy-2 = %+v, want down with its error and never seen", dead)
+	}
+}
+
+func TestParseObservatoryVarsWithoutObservatory(t *testing.T) {
+	state, err := parseObservatoryVars([]byte(`{"cmdline": ["xray"]}`))
+	if err != nil || len(state) != 0 {
+		t.Errorf("state = %v, err = %v, want empty", state, err)
+	}
+}
+
+func TestObservatoryStateReadsMetrics(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/debug/vars" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte(observatoryVars))
+	}))
+	defer srv.Close()
+
+	state, err := ObservatoryState(strings.TrimPrefix(srv.URL, "http://"))
+	if err != nil {
+		t.Fatalf("ObservatoryState: %v", err)
+	}
+	if len(state) != 2 {
+		t.Errorf("state = %v", state)
+	}
+
+	if _, err := ObservatoryState(""); err == nil {
+		t.Error("no address accepted")
+	}
+}
+
+func TestObservePoolNodes(t *testing.T) {
+	server := &models.Server{ID: 7, Name: "Amsterdam", Latency: 180}
+	nodes := []PoolNode{{Tag: "proxy-1", Server: server}, {Tag: "proxy-3"}}
+	state := map[string]NodeObservation{"proxy-1": {Alive: true, Delay: 212}}
+
+	got := ObservePoolNodes(nodes, state)
+	if got[0].Server != "Amsterdam" || got[0].Latency != 180 || got[0].Core == nil || got[0].Core.Delay != 212 {
+		t.Errorf("node 0 = %+v", got[0])
+	}
+	// Not in the subscription, not yet probed by the core
+	if got[1].Latency != -1 || got[1].Core != nil {
+		t.Errorf("node 1 = %+v", got[1])
+	}
+
+	// A new probe time alone is no change worth pushing
+	later := ObservePoolNodes(nodes, map[string]NodeObservation{"proxy-1": {Alive: true, Delay: 212, LastTry: got[0].Core.LastTry.Add(1)}})
+	if !SameObservations(got, later) {
+		t.Error("probe time counted as a change")
+	}
+	down := ObservePoolNodes(nodes, map[string]NodeObservation{"proxy-1": {Delay: -1}})
+	if SameObservations(got, down) {
+		t.Error("node going down not counted as a change")
+	}
+}
+
+func TestEnablePoolWritesMetrics(t *testing.T) {
+	rt, outboundsPath := liveConfDir(t)
+
+	state, err := EnablePool(rt, outboundsPath, poolServers(), PoolOptions{APIAddr: "127.0.0.1:10085", MetricsAddr: "127.0.0.1:10086"})
+	if err != nil {
+		t.Fatalf("EnablePool: %v", err)
+	}
+
+	var cfg map[string]interface{}
+	if err := ReadJSONC(state.APIFile, &cfg); err != nil {
+		t.Fatalf("read api config: %v", err)
+	}
+	metrics, _ := cfg["metrics"].(map[string]interface{})
+	if metrics["listen"] != "127.0.0.1:10086" {
+		t.Errorf("metrics = %v", cfg["metrics"])
+	}
+}
+
+// A pool built before the readout gets the metrics listener on startup.
+func TestEnsureAPIConfigAddsMetrics(t *testing.T) {
+	path := filepath.Join(t.TempDir(), apiConfigFile)
+	current := `{"api":{"tag":"api","listen":"127.0.0.1:10085","services":["RoutingService","HandlerService"]}}`
+	if err := os.WriteFile(path, []byte(current), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	if upgraded, _ := ensureAPIConfig(Runtime{}, path, "127.0.0.1:10085", ""); upgraded {
+		t.Error("no metrics address, yet the file changed")
+	}
+	if upgraded, err := ensureAPIConfig(Runtime{}, path, "127.0.0.1:10085", "127.0.0.1:10086"); !upgraded || err != nil {
+		t.Fatalf("upgraded=%v err=%v, want the metrics listener added", upgraded, err)
+	}
+	if again, _ := ensureAPIConfig(Runtime{}, path, "127.0.0.1:10085", "127.0.0.1:10086"); again {
+		t.Error("metrics already in place, yet reported as changed")
+	}
+}
@@ -1,11 +1,18 @@
 package xkeen
 
-import "strings"
+import (
+	"net"
+	"strconv"
+	"strings"
+)
 
-// Xray accepts two shapes for a VLESS outbound:
+// Xray accepts two shapes for a proxy outbound:
+//
+//	classic: settings.vnext[0].{address,port,users[0].{id,flow,encryption}}   (VLESS, VMess)
+//	         settings.servers[0].{address,port,password,method}             (Trojan, Shadowsocks)
+//	flat:    settings.{address,port,id|password,…}   (Xray 25.x and newer)
 //
-//	classic: settings.vnext[0].{address,port,users[0].{id,flow,encryption}}
-//	flat:    settings.{address,port,id,flow,encryption}   (Xray 25.x and newer)
+// WireGuard has a single shape of its own: settings.{secretKey,peers[0].endpoint}.
 //
 // Both are live in the wild — the fork's own docs point at generators that emit
 // the flat one. The panel keeps whichever shape the file already uses instead of
@@ -48,6 +55,9 @@ func detectOutboundFormat(ob map[string]interface{}) outboundFormat {
 	if _, ok := settings["vnext"]; ok {
 		return formatVNext
 	}
+	if _, ok := settings["servers"]; ok {
+		return formatVNext
+	}
 	return formatFlat
 }
 
@@ -64,6 +74,21 @@ func canonicalNetwork(n string) string {
 	}
 }
 
+// buildProxySettings renders the credentials of any supported protocol in the
+// requested shape.
+func buildProxySettings(p *ProxyParams, format outboundFormat) map[string]interface{} {
+	switch p.xrayProtocol() {
+	case "vmess":
+		return buildVMessSettings(p, format)
+	case "trojan", "shadowsocks":
+		return buildServerSettings(p, format)
+	case "wireguard":
+		return buildWireGuardSettings(p)
+	default:
+		return buildVLESSSettings(p, format)
+	}
+}
+
 // buildVLESSSettings renders the credentials in the requested shape.
 func buildVLESSSettings(p *VLESSParams, format outboundFormat) map[string]interface{} {
 	encryption := p.Encryption
@@ -104,7 +129,104 @@ func buildVLESSSettings(p *VLESSParams, format outboundFormat) map[string]interf
 	}
 }
 
-// readProxyEndpoint extracts address/port/uuid from either shape.
+// buildVMessSettings renders VMess credentials. Only the classic shape has an
+// alterId; the flat one is AEAD-only.
+func buildVMessSettings(p *ProxyParams, format outboundFormat) map[string]interface{} {
+	cipher := p.Cipher
+	if cipher == "" {
+		cipher = "auto"
+	}
+
+	if format == formatFlat {
+		return map[string]interface{}{
+			"address":  p.Address,
+			"port":     p.Port,
+			"id":       p.UUID,
+			"security": cipher,
+		}
+	}
+
+	return map[string]interface{}{
+		"vnext": []interface{}{
+			map[string]interface{}{
+				"address": p.Address,
+				"port":    p.Port,
+				"users": []interface{}{
+					map[string]interface{}{
+						"id":       p.UUID,
+						"alterId":  p.AlterID,
+						"security": cipher,
+						"level":    0,
+					},
+				},
+			},
+		},
+	}
+}
+
+// buildServerSettings renders Trojan and Shadowsocks credentials, which Xray
+// keeps in a servers list rather than vnext users.
+func buildServerSettings(p *ProxyParams, format outboundFormat) map[string]interface{} {
+	server := map[string]interface{}{
+		"address":  p.Address,
+		"port":     p.Port,
+		"password": p.Password,
+	}
+	if p.Method != "" {
+		server["method"] = p.Method
+	}
+	if p.Flow != "" && p.xrayProtocol() == "trojan" {
+		server["flow"] = p.Flow
+	}
+
+	if format == formatFlat {
+		return server
+	}
+
+	server["level"] = 0
+	return map[string]interface{}{
+		"servers": []interface{}{server},
+	}
+}
+
+// buildWireGuardSettings renders a WireGuard interface with its single peer.
+// The shape is the same in every Xray version, so there is no format to follow.
+func buildWireGuardSettings(p *ProxyParams) map[string]interface{} {
+	peer := map[string]interface{}{
+		"publicKey": p.PublicKey,
+		"endpoint":  net.JoinHostPort(p.Address, strconv.Itoa(p.Port)),
+	}
+	if p.PresharedKey != "" {
+		peer["preSharedKey"] = p.PresharedKey
+	}
+
+	settings := map[string]interface{}{
+		"secretKey": p.PrivateKey,
+		"peers":     []interface{}{peer},
+	}
+	if len(p.LocalAddress) > 0 {
+		addresses := make([]interface{}, len(p.LocalAddress))
+		for i, a := range p.LocalAddress {
+			addresses[i] = a
+		}
+		settings["address"] = addresses
+	}
+	if len(p.Reserved) > 0 {
+		reserved := make([]interface{}, len(p.Reserved))
+		for i, r := range p.Reserved {
+			reserved[i] = r
+		}
+		settings["reserved"] = reserved
+	}
+	if p.MTU > 0 {
+		settings["mtu"] = p.MTU
+	}
+
+	return settings
+}
+
+// readProxyEndpoint extracts address, port and credential (uuid or password)
+// from any shape.
 func readProxyEndpoint(ob map[string]interface{}) (address string, port int, uuid string, ok bool) {
 	settings, _ := ob["settings"].(map[string]interface{})
 	if settings == nil {
@@ -129,9 +251,41 @@ func readProxyEndpoint(ob map[string]interface{}) (address string, port int, uui
 		return address, port, uuid, address != ""
 	}
 
+	if servers, isServers := settings["servers"].([]interface{}); isServers {
+		if len(servers) == 0 {
+			return "", 0, "", false
+		}
+		entry, _ := servers[0].(map[string]interface{})
+		if entry == nil {
+			return "", 0, "", false
+		}
+		address, _ = entry["address"].(string)
+		port = toInt(entry["port"])
+		uuid, _ = entry["password"].(string)
+		return address, port, uuid, address != ""
+	}
+
+	if peers, isWireGuard := settings["peers"].([]interface{}); isWireGuard {
+		if len(peers) == 0 {
+			return "", 0, "", false
+		}
+		peer, _ := peers[0].(map[string]interface{})
+		endpoint, _ := peer["endpoint"].(string)
+		host, portText, err := net.SplitHostPort(endpoint)
+		if err != nil {
+			return "", 0, "", false
+		}
+		port, _ = strconv.Atoi(portText)
+		uuid, _ = settings["secretKey"].(string)
+		return host, port, uuid, host != ""
+	}
+
 	address, _ = settings["address"].(string)
 	port = toInt(settings["port"])
 	uuid, _ = settings["id"].(string)
+	if uuid == "" {
+		uuid, _ = settings["password"].(string)
+	}
 
 	return address, port, uuid, address != ""
 }
@@ -196,7 +350,7 @@ func mergeStreamSettings(existing, generated map[string]interface{}) map[string]
 	// Preserve the owner's transport spelling ("raw" vs "tcp") when equivalent
 	if oldNet, ok := existing["network"].(string); ok {
 		newNet, _ := merged["network"].(string)
-		if canonicalNetwork(oldNet) == canonicalNetwork(newNet) {
+		if newNet != "" && canonicalNetwork(oldNet) == canonicalNetwork(newNet) {
 			merged["network"] = oldNet
 		}
 	}
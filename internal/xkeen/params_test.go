@@ -0,0 +1,238 @@
+package xkeen
+
+import (
+	"encoding/base64"
+	"strings"
+	"testing"
+
+	"xkeen-panel/internal/models"
+)
+
+const trojanURI = "trojan://p%40ss@t.example.com:8443?type=grpc&serviceName=svc&sni=sni.example.com&allowInsecure=1#Trojan"
+
+func vmessParamsURI() string {
+	j := `{"v":"2","ps":"VM","add":"v.example.com","port":8080,"id":"uuid-v","aid":"0","scy":"aes-128-gcm","net":"ws","host":"cdn.example.com","path":"/ws","tls":"tls","sni":"v.example.com"}`
+	return "vmess://" + base64.StdEncoding.EncodeToString([]byte(j))
+}
+
+func TestParseVMessParams(t *testing.T) {
+	p, err := ParseVMess(vmessParamsURI())
+	if err != nil {
+		t.Fatalf("ParseVMess: %v", err)
+	}
+	if p.Protocol != "vmess" || p.Address != "v.example.com" || p.Port != 8080 || p.UUID != "uuid-v" {
+		t.Errorf("endpoint = %+v", p)
+	}
+	if p.Cipher != "aes-128-gcm" || p.Network != "ws" || p.Security != "tls" || p.Host != "cdn.example.com" {
+		t.Errorf("transport = %+v", p)
+	}
+}
+
+func TestParseTrojanParams(t *testing.T) {
+	p, err := ParseTrojan(trojanURI)
+	if err != nil {
+		t.Fatalf("ParseTrojan: %v", err)
+	}
+	if p.Password != "p@ss" {
+		t.Errorf("Password = %q, want the unescaped p@ss", p.Password)
+	}
+	if p.Security != "tls" {
+		t.Errorf("Security = %q, want tls by default", p.Security)
+	}
+	if p.Path != "svc" {
+		t.Errorf("Path = %q, want serviceName svc for grpc", p.Path)
+	}
+	if !p.Insecure {
+		t.Error("allowInsecure=1 was lost")
+	}
+}
+
+func TestParseShadowsocksForms(t *testing.T) {
+	cases := []struct {
+		name, uri string
+	}{
+		{"sip002 base64", "ss://" + base64.RawURLEncoding.EncodeToString([]byte("aes-256-gcm:secret")) + "@1.2.3.4:8388#SS"},
+		{"sip002 plain", "ss://aes-256-gcm:secret@1.2.3.4:8388/#SS"},
+		{"legacy", "ss://" + base64.StdEncoding.EncodeToString([]byte("aes-256-gcm:secret@1.2.3.4:8388")) + "#SS"},
+	}
+	for _, c := range cases {
+		p, err := ParseShadowsocks(c.uri)
+		if err != nil {
+			t.Errorf("%s: %v", c.name, err)
+			continue
+		}
+		if p.Method != "aes-256-gcm" || p.Password != "secret" || p.Address != "1.2.3.4" || p.Port != 8388 {
+			t.Errorf("%s: got %+v", c.name, p)
+		}
+	}
+}
+
+// A plugin link parses — Mihomo runs it — but is kept away from Xray, which
+// has no SIP003 plugins: an outbound without the plugin would connect to a
+// port speaking obfs or v2ray-plugin and silently fail.
+func TestShadowsocksPluginIsMihomoOnly(t *testing.T) {
+	uri := "ss://YWVzLTI1Ni1nY206c2VjcmV0@1.2.3.4:8388/?plugin=obfs-local%3Bobfs%3Dhttp#SS"
+	p, err := ParseShadowsocks(uri)
+	if err != nil {
+		t.Fatalf("ParseShadowsocks: %v", err)
+	}
+	if p.Plugin != "obfs-local;obfs=http" {
+		t.Errorf("Plugin = %q", p.Plugin)
+	}
+	if again, _ := ParseProxyURI(p.URI("SS")); again == nil || again.Plugin != p.Plugin {
+		t.Errorf("the plugin did not survive the round trip: %+v", again)
+	}
+
+	if OutboundSupported(models.Server{Protocol: "shadowsocks", RawURI: uri}) {
+		t.Error("a plugin link must not be rendered for Xray")
+	}
+	if !OutboundSupported(models.Server{Protocol: "shadowsocks", RawURI: "ss://YWVzLTI1Ni1nY206c2VjcmV0@1.2.3.4:8388#SS"}) {
+		t.Error("a plain link is fine for Xray")
+	}
+}
+
+func TestBuildOutboundVMess(t *testing.T) {
+	p, err := ParseVMess(vmessParamsURI())
+	if err != nil {
+		t.Fatalf("ParseVMess: %v", err)
+	}
+
+	ob := buildOutboundFromURI(p, "proxy", formatVNext)
+	if ob["protocol"] != "vmess" {
+		t.Errorf("protocol = %v, want vmess", ob["protocol"])
+	}
+	user := vnextEntry(t, ob)["users"].([]interface{})[0].(map[string]interface{})
+	if user["id"] != "uuid-v" || user["security"] != "aes-128-gcm" {
+		t.Errorf("user = %v", user)
+	}
+
+	ss := ob["streamSettings"].(map[string]interface{})
+	if ss["network"] != "ws" || ss["security"] != "tls" {
+		t.Errorf("streamSettings = %v, want ws over tls", ss)
+	}
+}
+
+func TestBuildOutboundTrojanAndShadowsocks(t *testing.T) {
+	trojan, err := ParseTrojan(trojanURI)
+	if err != nil {
+		t.Fatalf("ParseTrojan: %v", err)
+	}
+	ob := buildOutboundFromURI(trojan, "proxy", formatVNext)
+	server := ob["settings"].(map[string]interface{})["servers"].([]interface{})[0].(map[string]interface{})
+	if ob["protocol"] != "trojan" || server["password"] != "p@ss" {
+		t.Errorf("trojan outbound = %v", ob)
+	}
+	ss := ob["streamSettings"].(map[string]interface{})
+	if grpc := ss["grpcSettings"].(map[string]interface{}); grpc["serviceName"] != "svc" {
+		t.Errorf("grpcSettings = %v, want serviceName svc", grpc)
+	}
+	if ts := ss["tlsSettings"].(map[string]interface{}); ts["allowInsecure"] != true {
+		t.Errorf("tlsSettings = %v, want allowInsecure", ts)
+	}
+
+	shadow, err := ParseShadowsocks("ss://aes-256-gcm:secret@1.2.3.4:8388#SS")
+	if err != nil {
+		t.Fatalf("ParseShadowsocks: %v", err)
+	}
+	flat := buildOutboundFromURI(shadow, "proxy", formatFlat)
+	settings := flat["settings"].(map[string]interface{})
+	if flat["protocol"] != "shadowsocks" || settings["method"] != "aes-256-gcm" || settings["password"] != "secret" {
+		t.Errorf("shadowsocks outbound = %v", flat)
+	}
+	if _, tls := flat["streamSettings"].(map[string]interface{})["security"]; tls {
+		t.Error("shadowsocks must not get a TLS layer")
+	}
+}
+
+const (
+	hy2URI  = "hy2://secret@h.example.com:443,20000-30000/?sni=cdn.example.com&obfs=salamander&obfs-password=salt&insecure=1#HY2"
+	tuicURI = "tuic://3f0b1c2d-0000-4000-8000-000000000001:pw@t.example.com:8443?congestion_control=bbr&udp_relay_mode=native&sni=t.example.com&alpn=h3#TUIC"
+	// the keys are arbitrary 32-byte values
+	wgURI = "wireguard://AQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQEBAQE%3D@162.159.192.1:2408?publickey=ztBvKOdLsPbfVdzIIy3RuhPrQpUiLGdrfRqPAc9FPmM%3D&address=172.16.0.2,2606:4700::2&reserved=1,2,3&mtu=1280#WARP"
+)
+
+func TestParseHysteria2(t *testing.T) {
+	p, err := ParseProxyURI(hy2URI)
+	if err != nil {
+		t.Fatalf("ParseProxyURI: %v", err)
+	}
+	if p.Protocol != "hysteria2" || p.Address != "h.example.com" || p.Port != 443 || p.Password != "secret" {
+		t.Errorf("endpoint = %+v, want the first port of the hopping range", p)
+	}
+	if p.Obfs != "salamander" || p.ObfsPassword != "salt" || !p.Insecure || p.SNI != "cdn.example.com" {
+		t.Errorf("options = %+v", p)
+	}
+}
+
+func TestParseTUIC(t *testing.T) {
+	p, err := ParseProxyURI(tuicURI)
+	if err != nil {
+		t.Fatalf("ParseProxyURI: %v", err)
+	}
+	if p.UUID != "3f0b1c2d-0000-4000-8000-000000000001" || p.Password != "pw" || p.Port != 8443 {
+		t.Errorf("credentials = %+v", p)
+	}
+	if p.CongestionControl != "bbr" || p.UDPRelayMode != "native" || p.ALPN != "h3" {
+		t.Errorf("options = %+v", p)
+	}
+}
+
+func TestParseWireGuard(t *testing.T) {
+	p, err := ParseProxyURI(wgURI)
+	if err != nil {
+		t.Fatalf("ParseProxyURI: %v", err)
+	}
+	if p.Address != "162.159.192.1" || p.Port != 2408 || p.PrivateKey == "" || p.PublicKey == "" {
+		t.Errorf("endpoint = %+v", p)
+	}
+	if len(p.LocalAddress) != 2 || p.LocalAddress[0] != "172.16.0.2/32" || p.LocalAddress[1] != "2606:4700::2/128" {
+		t.Errorf("LocalAddress = %v, want CIDR forms", p.LocalAddress)
+	}
+	if len(p.Reserved) != 3 || p.MTU != 1280 {
+		t.Errorf("Reserved = %v, MTU = %d", p.Reserved, p.MTU)
+	}
+}
+
+func TestParseWireGuardNeedsKeys(t *testing.T) {
+	if _, err := ParseWireGuard("wireguard://@1.2.3.4:51820?address=10.0.0.2"); err == nil {
+		t.Error("expected an error without keys")
+	}
+}
+
+func TestBuildOutboundWireGuard(t *testing.T) {
+	p, err := ParseWireGuard(wgURI)
+	if err != nil {
+		t.Fatalf("ParseWireGuard: %v", err)
+	}
+
+	ob := mergeOutbound(
+		map[string]interface{}{"tag": "proxy", "protocol": "vless",
+			"streamSettings": map[string]interface{}{"network": "raw", "sockopt": map[string]interface{}{"mark": 255}}},
+		buildOutboundFromURI(p, "proxy", formatVNext),
+	)
+	if ob["protocol"] != "wireguard" {
+		t.Errorf("protocol = %v, want wireguard", ob["protocol"])
+	}
+	ss := ob["streamSettings"].(map[string]interface{})
+	if _, ok := ss["sockopt"]; !ok {
+		t.Error("sockopt mark was dropped")
+	}
+	if _, ok := ss["network"]; ok {
+		t.Errorf("streamSettings = %v, WireGuard takes no transport", ss)
+	}
+
+	address, port, key, ok := readProxyEndpoint(ob)
+	if !ok || address != "162.159.192.1" || port != 2408 || key != p.PrivateKey {
+		t.Errorf("endpoint = %s:%d/%s, want the peer endpoint and secret key", address, port, key)
+	}
+}
+
+// Xray has no client for these, so applying one must explain why instead of
+// writing a config the core rejects.
+func TestUpdateOutboundRefusesMihomoOnly(t *testing.T) {
+	path := liveOutbounds(t)
+	err := UpdateOutbound(path, &models.Server{Protocol: "hysteria2", RawURI: hy2URI})
+	if err == nil || !strings.Contains(err.Error(), "Mihomo") {
+		t.Errorf("err = %v, want a pointer to the Mihomo core", err)
+	}
+}
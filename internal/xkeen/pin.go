@@ -3,8 +3,6 @@ package xkeen
 import (
 	"fmt"
 	"log"
-	"sort"
-	"time"
 
 	"xkeen-panel/internal/models"
 )
@@ -33,11 +31,11 @@ func PoolNodes(outboundsPath, selector string, servers []models.Server) ([]PoolN
 
 	byEndpoint := make(map[[3]interface{}]*models.Server, len(servers))
 	for i := range servers {
-		params, err := ParseVLESS(servers[i].RawURI)
+		params, err := ParseProxyURI(servers[i].RawURI)
 		if err != nil {
 			continue
 		}
-		byEndpoint[[3]interface{}{params.Address, params.Port, params.UUID}] = &servers[i]
+		byEndpoint[[3]interface{}{params.Address, params.Port, params.Credential()}] = &servers[i]
 	}
 
 	nodes := make([]PoolNode, 0, len(raw))
@@ -83,13 +81,18 @@ func PinDrifted(outboundsPath, selector, tag, node string) bool {
 	return NodeKeyForTag(outboundsPath, selector, tag) != node
 }
 
-// PinBestNode measures the pool and pins the fastest node the caller has not
-// excluded, returning its tag.
+// PinBestNode measures the pool and pins the best-scoring node the caller has
+// not excluded, returning its tag.
 //
 // Pinning is what makes a pool usable for everyday traffic: a balancer picks an
 // outbound per connection, so without an override the outgoing IP moves between
 // nodes and anything IP-bound — Telegram sessions, CDN anti-abuse — breaks.
-func PinBestNode(rt Runtime, apiAddr, outboundsPath string, top Topology, servers []models.Server, excluded map[string]bool, probeTimeout time.Duration, concurrency int) (string, error) {
+//
+// Favourites and higher priorities go first, as long as they answer. A probe
+// without a timeout skips measuring and pins the first node. With the
+// real delay on, only nodes matched to a subscription server can be fetched
+// through; the rest get the transport probe. A nil scorer ranks by latency.
+func PinBestNode(rt Runtime, apiAddr, outboundsPath string, top Topology, servers []models.Server, excluded map[string]bool, probe LatencyProbe, scorer Scorer) (string, error) {
 	selector := DefaultPoolSelector
 	if len(top.Selectors) > 0 {
 		selector = top.Selectors[0]
@@ -104,44 +107,34 @@ func PinBestNode(rt Runtime, apiAddr, outboundsPath string, top Topology, server
 	}
 
 	candidates := make([]models.Server, 0, len(nodes))
-	tagOf := make(map[string]string, len(nodes))
 	for _, node := range nodes {
-		if excluded[node.Tag] {
+		if excluded[node.Tag] || (node.Server != nil && node.Server.Excluded) {
 			continue
 		}
-		candidates = append(candidates, models.Server{
-			Name:    node.Tag,
-			Address: node.Address,
-			Port:    node.Port,
-			RawURI:  node.Tag,
-		})
-		tagOf[node.Tag] = node.Tag
+		candidates = append(candidates, nodeCandidate(node))
 	}
 
 	// Everything is excluded — better a suspect node than no traffic at all
 	if len(candidates) == 0 {
 		log.Printf("[PIN] Все ноды исключены — снимаю исключения")
 		for _, node := range nodes {
-			candidates = append(candidates, models.Server{Name: node.Tag, Address: node.Address, Port: node.Port, RawURI: node.Tag})
+			candidates = append(candidates, nodeCandidate(node))
 		}
 	}
 
-	if probeTimeout > 0 {
-		checked := CheckAllLatencies(candidates, probeTimeout, concurrency)
-		sort.SliceStable(checked, func(i, j int) bool {
-			switch {
-			case checked[i].Latency < 0:
-				return false
-			case checked[j].Latency < 0:
-				return true
-			default:
-				return checked[i].Latency < checked[j].Latency
-			}
-		})
-		candidates = checked
+	if probe.Timeout > 0 {
+		candidates, _ = RankServers(probe.Check(candidates), scorer)
 	}
+	candidates = OrderByPreference(candidates)
 
+	// A favourite that did not answer leads the order but is no pin
 	best := candidates[0].Name
+	for _, c := range candidates {
+		if c.Latency >= 0 {
+			best = c.Name
+			break
+		}
+	}
 	if err := OverrideBalancerTarget(rt, apiAddr, top.BalancerTag, best); err != nil {
 		return "", err
 	}
@@ -178,3 +171,16 @@ func EnsurePinned(rt Runtime, apiAddr string, top Topology, wanted string) (bool
 
 	return true, nil
 }
+
+// nodeCandidate stands a node in for a server when probing: named by its tag,
+// and carrying the link of the server behind it when there is one.
+func nodeCandidate(node PoolNode) models.Server {
+	candidate := models.Server{Name: node.Tag, Address: node.Address, Port: node.Port, RawURI: node.Tag}
+	if node.Server != nil {
+		candidate.Protocol = node.Server.Protocol
+		candidate.RawURI = node.Server.RawURI
+		candidate.Favorite = node.Server.Favorite
+		candidate.Priority = node.Server.Priority
+	}
+	return candidate
+}
@@ -73,7 +73,7 @@ func TestPinBestNodeSkipsExcluded(t *testing.T) {
 	// No dispatcher in the fixture, so the override call fails — but the choice
 	// is made before that, and the error names the tag it tried
 	_, err := PinBestNode(rt, "", outboundsPath, Topology{BalancerTag: "balancer"},
-		poolServers(), map[string]bool{"sub-1": true}, 0, 1)
+		poolServers(), map[string]bool{"sub-1": true}, LatencyProbe{}, nil)
 	if err == nil {
 		t.Skip("override unexpectedly succeeded without a core")
 	}
@@ -91,7 +91,7 @@ func TestPinBestNodeFallsBackWhenAllExcluded(t *testing.T) {
 	}
 
 	_, err := PinBestNode(rt, "", outboundsPath, Topology{BalancerTag: "balancer"},
-		poolServers(), map[string]bool{"sub-1": true, "sub-2": true}, 0, 1)
+		poolServers(), map[string]bool{"sub-1": true, "sub-2": true}, LatencyProbe{}, nil)
 
 	if err == nil {
 		t.Skip("override unexpectedly succeeded without a core")
@@ -105,7 +105,7 @@ func TestPinBestNodeEmptyPool(t *testing.T) {
 	rt, outboundsPath := liveConfDir(t)
 
 	if _, err := PinBestNode(rt, "", outboundsPath, Topology{BalancerTag: "balancer"},
-		[]models.Server{}, nil, 0, 1); err == nil {
+		[]models.Server{}, nil, LatencyProbe{}, nil); err == nil {
 		t.Error("expected an error when the config holds no pool")
 	}
 }
@@ -0,0 +1,133 @@
+package xkeen
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+// bypassSuffix ends the tag of a pool's unpinned twin: a second balancer over
+// the same nodes that never gets an override. A balancer override covers all
+// of its traffic, so traffic that should skip the pin needs a balancer of its
+// own.
+const bypassSuffix = "-free"
+
+// BypassBalancerTag is the tag of a balancer's unpinned twin.
+func BypassBalancerTag(balancerTag string) string {
+	return balancerTag + bypassSuffix
+}
+
+// IsBypassBalancerTag reports whether a balancer is some pool's unpinned twin.
+func IsBypassBalancerTag(tag string) bool {
+	return strings.HasSuffix(tag, bypassSuffix)
+}
+
+// ValidatePinPolicy checks a pin policy from config.yaml.
+func ValidatePinPolicy(p models.PinPolicy) error {
+	if p.RotateAt == "" {
+		return nil
+	}
+	if _, err := time.Parse("15:04", p.RotateAt); err != nil {
+		return fmt.Errorf("rotate_at %q: ожидается время ЧЧ:ММ", p.RotateAt)
+	}
+	return nil
+}
+
+// PinRotationDue reports whether a scheduled rotation came up since the pin
+// was set: the latest rotate_at time at or before now is after pinnedAt. A pin
+// whose time is unknown is not due — the caller stamps it first, so an upgrade
+// does not move every pin at once.
+func PinRotationDue(p models.PinPolicy, pinnedAt, now time.Time) bool {
+	if p.RotateAt == "" || pinnedAt.IsZero() {
+		return false
+	}
+	clock, err := time.Parse("15:04", p.RotateAt)
+	if err != nil {
+		return false
+	}
+
+	last := time.Date(now.Year(), now.Month(), now.Day(), clock.Hour(), clock.Minute(), 0, 0, now.Location())
+	if last.After(now) {
+		last = last.AddDate(0, 0, -1)
+	}
+	return pinnedAt.Before(last)
+}
+
+// bypassRules send the policy's bypass traffic to the unpinned twin, one rule
+// per kind of condition, as a named pool's rules do.
+func bypassRules(freeTag string, p models.PinPolicy) []interface{} {
+	var rules []interface{}
+	add := func(key string, value interface{}) {
+		rules = append(rules, map[string]interface{}{"type": "field", key: value, "balancerTag": freeTag})
+	}
+	if len(p.BypassDomains) > 0 {
+		add("domain", anySlice(p.BypassDomains))
+	}
+	if p.BypassDestPorts != "" {
+		add("port", p.BypassDestPorts)
+	}
+	if len(p.BypassInboundTags) > 0 {
+		add("inboundTag", anySlice(p.BypassInboundTags))
+	}
+	return rules
+}
+
+// applyPinBypass brings a balancer's unpinned twin in line with the policy:
+// the twin and its rules when the policy has bypass traffic, neither when it
+// has none. The rules go right before the first rule leading to the pinned
+// balancer, so they catch their traffic before it does. Reports whether the
+// routing changed.
+func applyPinBypass(routing map[string]interface{}, balancerTag, selector string, strategy BalancerStrategy, p models.PinPolicy) bool {
+	freeTag := BypassBalancerTag(balancerTag)
+	before := snapshotRouting(routing)
+
+	removeBypass(routing, balancerTag)
+	if rules := bypassRules(freeTag, p); len(rules) > 0 {
+		current := asSlice(routing["rules"])
+		at := slices.IndexFunc(current, func(raw interface{}) bool {
+			rule, ok := raw.(map[string]interface{})
+			return ok && ruleTargetsBalancer(balancerTag)(rule)
+		})
+		if at < 0 {
+			at = len(current)
+		}
+		routing["rules"] = slices.Concat(current[:at], rules, current[at:])
+		putBalancer(routing, balancerBlock(freeTag, selector, strategy))
+	}
+
+	return before != snapshotRouting(routing)
+}
+
+// removeBypass drops a balancer's unpinned twin and the rules leading to it.
+// A routing without them is left as it was.
+func removeBypass(routing map[string]interface{}, balancerTag string) {
+	freeTag := BypassBalancerTag(balancerTag)
+
+	rules := asSlice(routing["rules"])
+	if slices.ContainsFunc(rules, func(raw interface{}) bool {
+		rule, ok := raw.(map[string]interface{})
+		return ok && ruleTargetsBalancer(freeTag)(rule)
+	}) {
+		removeBalancerRules(routing, freeTag)
+	}
+
+	balancers := asSlice(routing["balancers"])
+	kept := slices.DeleteFunc(slices.Clone(balancers), func(raw interface{}) bool {
+		b, ok := raw.(map[string]interface{})
+		return ok && b["tag"] == freeTag
+	})
+	if len(kept) != len(balancers) {
+		routing["balancers"] = kept
+	}
+}
+
+// snapshotRouting renders the part of routing applyPinBypass touches, so it
+// can be compared after the maps were edited in place.
+func snapshotRouting(routing map[string]interface{}) string {
+	data, _ := json.Marshal([]interface{}{routing["rules"], routing["balancers"]})
+	return string(data)
+}
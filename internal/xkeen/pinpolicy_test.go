@@ -0,0 +1,126 @@
+package xkeen
+
+import (
+	"testing"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+func TestPinRotationDue(t *testing.T) {
+	nightly := models.PinPolicy{RotateAt: "04:00"}
+	at := func(day, hour, min int) time.Time { return time.Date(2026, 10, day, hour, min, 0, 0, time.Local) }
+
+	for _, tc := range []struct {
+		name          string
+		policy        models.PinPolicy
+		pinnedAt, now time.Time
+		want          bool
+	}{
+		{"forever", models.PinPolicy{}, at(1, 3, 0), at(9, 5, 0), false},
+		{"before today's time", nightly, at(10, 1, 0), at(10, 3, 59), false},
+		{"today's time passed", nightly, at(10, 1, 0), at(10, 4, 0), true},
+		{"pinned after today's", nightly, at(10, 4, 1), at(10, 23, 0), false},
+		{"yesterday's time", nightly, at(9, 3, 0), at(10, 2, 0), true},
+		{"unknown pin time", nightly, time.Time{}, at(10, 5, 0), false},
+	} {
+		if got := PinRotationDue(tc.policy, tc.pinnedAt, tc.now); got != tc.want {
+			t.Errorf("%s: due = %v, want %v", tc.name, got, tc.want)
+		}
+	}
+}
+
+func TestApplyPinBypassRoundTrip(t *testing.T) {
+	routing := map[string]interface{}{
+		"rules": []interface{}{
+			map[string]interface{}{"type": "field", "ip": []interface{}{"geoip:private"}, "outboundTag": "direct"},
+			map[string]interface{}{"type": "field", "inboundTag": []interface{}{"redirect"}, "balancerTag": "proxy"},
+		},
+		"balancers": []interface{}{balancerBlock("proxy", "proxy-", BalancerStrategy{})},
+	}
+	policy := models.PinPolicy{BypassDomains: []string{"geosite:speedtest"}, BypassDestPorts: "50000-60000"}
+
+	if !applyPinBypass(routing, "proxy", "proxy-", BalancerStrategy{}, policy) {
+		t.Fatal("bypass not reported as a change")
+	}
+	rules := asSlice(routing["rules"])
+	if len(rules) != 4 {
+		t.Fatalf("rules = %v, want two bypass rules added", rules)
+	}
+	// After direct, ahead of the pinned balancer
+	for i, want := range []string{"", "proxy-free", "proxy-free", "proxy"} {
+		if got, _ := rules[i].(map[string]interface{})["balancerTag"].(string); got != want {
+			t.Errorf("rule %d goes to %q, want %q", i, got, want)
+		}
+	}
+	if balancers := asSlice(routing["balancers"]); len(balancers) != 2 {
+		t.Errorf("balancers = %v, want the twin next to the pool", balancers)
+	}
+
+	// Settled: applying again changes nothing
+	if applyPinBypass(routing, "proxy", "proxy-", BalancerStrategy{}, policy) {
+		t.Error("unchanged policy reported as a change")
+	}
+
+	// Policy dropped: the twin and its rules go
+	if !applyPinBypass(routing, "proxy", "proxy-", BalancerStrategy{}, models.PinPolicy{}) {
+		t.Error("dropped bypass not reported as a change")
+	}
+	if len(asSlice(routing["rules"])) != 2 || len(asSlice(routing["balancers"])) != 1 {
+		t.Errorf("routing = %v, want the original back", routing)
+	}
+}
+
+// The twin is no candidate for the main pool, whatever order it is listed in.
+func TestTopologySkipsBypassBalancer(t *testing.T) {
+	rt, outboundsPath := liveConfDir(t)
+
+	pin := models.PinPolicy{BypassDomains: []string{"geosite:speedtest"}}
+	if _, err := EnablePool(rt, outboundsPath, poolServers(), PoolOptions{Selection: PoolSelection{Pin: pin}}); err != nil {
+		t.Fatalf("EnablePool: %v", err)
+	}
+
+	top := ReadTopology(rt)
+	if top.BalancerTag != DefaultBalancerTag {
+		t.Errorf("main balancer = %q", top.BalancerTag)
+	}
+	if _, ok := top.Balancer(BypassBalancerTag(DefaultBalancerTag)); !ok {
+		t.Error("twin balancer not written")
+	}
+}
+
+// A bypass added in config.yaml reaches the routing on the next refresh, and
+// leaving pool mode takes the twin along.
+func TestRefreshPoolFollowsPinBypass(t *testing.T) {
+	rt, outboundsPath := liveConfDir(t)
+
+	state, err := EnablePool(rt, outboundsPath, poolServers(), PoolOptions{})
+	if err != nil {
+		t.Fatalf("EnablePool: %v", err)
+	}
+
+	sel := PoolSelection{Pin: models.PinPolicy{BypassInboundTags: []string{"socks-in"}}}
+	result, err := RefreshPool(rt, outboundsPath, "", poolServers(), state, sel)
+	if err != nil {
+		t.Fatalf("RefreshPool: %v", err)
+	}
+	if !result.Changed || !result.BypassChanged {
+		t.Errorf("result = %+v, want the bypass applied", result)
+	}
+	if _, ok := ReadTopology(rt).Balancer(BypassBalancerTag(DefaultBalancerTag)); !ok {
+		t.Fatal("twin balancer not written")
+	}
+
+	if err := DisablePool(rt, outboundsPath, &poolServers()[0], state); err != nil {
+		t.Fatalf("DisablePool: %v", err)
+	}
+	routing, _ := readRouting(t, rt)["routing"].(map[string]interface{})
+	for _, raw := range asSlice(routing["rules"]) {
+		if rule, _ := raw.(map[string]interface{}); rule["balancerTag"] != nil {
+			t.Errorf("rule %v still leads to a balancer", rule)
+		}
+	}
+	if balancers := asSlice(routing["balancers"]); len(balancers) != 0 {
+		t.Errorf("balancers = %v, want none", balancers)
+	}
+}
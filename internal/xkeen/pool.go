@@ -6,6 +6,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -41,7 +42,7 @@ func BuildPoolOutbounds(servers []models.Server, selector string, template map[s
 
 	var nodes []interface{}
 	for _, entry := range assignTags(servers, selector, existing) {
-		params, err := ParseVLESS(entry.Server.RawURI)
+		params, err := ParseProxyURI(entry.Server.RawURI)
 		if err != nil {
 			continue
 		}
@@ -49,7 +50,7 @@ func BuildPoolOutbounds(servers []models.Server, selector string, template map[s
 	}
 
 	if len(nodes) == 0 {
-		return nil, fmt.Errorf("нет VLESS-серверов для пула")
+		return nil, fmt.Errorf("нет серверов для пула")
 	}
 
 	return nodes, nil
@@ -102,14 +103,75 @@ func PoolNodeTags(nodes []interface{}) []string {
 	return tags
 }
 
-// balancerBlock is the routing.balancers entry the panel writes. leastPing is
-// the only strategy that resolves to a single node, which both the failover
-// story and XKeen's own speed balancer depend on.
-func balancerBlock(tag, selector string) map[string]interface{} {
+// Balancer strategies a pool can run.
+const (
+	StrategyLeastPing  = "leastPing"
+	StrategyLeastLoad  = "leastLoad"
+	StrategyRandom     = "random"
+	StrategyRoundRobin = "roundRobin"
+)
+
+var balancerStrategies = []string{StrategyLeastPing, StrategyLeastLoad, StrategyRandom, StrategyRoundRobin}
+
+// ValidateStrategy checks a strategy name from config.yaml; "" is leastPing.
+func ValidateStrategy(strategy string) error {
+	if strategy != "" && !slices.Contains(balancerStrategies, strategy) {
+		return fmt.Errorf("неизвестная стратегия %q (%s)", strategy, strings.Join(balancerStrategies, ", "))
+	}
+	return nil
+}
+
+// BalancerStrategy is how a pool's balancer picks among its nodes.
+type BalancerStrategy struct {
+	Type      string
+	LeastLoad models.LeastLoadConfig // read only by leastLoad
+}
+
+// BalancerStrategyFromConfig is the main pool's strategy.
+func BalancerStrategyFromConfig(cfg *models.Config) BalancerStrategy {
+	return BalancerStrategy{Type: cfg.PoolStrategy, LeastLoad: cfg.PoolLeastLoad}
+}
+
+// name is the strategy type with the default filled in. leastPing is the
+// default: it is the only strategy that resolves to a single node, which both
+// the failover story and XKeen's own speed balancer depend on.
+func (s BalancerStrategy) name() string {
+	if s.Type == "" {
+		return StrategyLeastPing
+	}
+	return s.Type
+}
+
+// block is the balancer's strategy object. Settings are written only for
+// leastLoad and only those set, so Xray's own defaults apply to the rest.
+func (s BalancerStrategy) block() map[string]interface{} {
+	block := map[string]interface{}{"type": s.name()}
+	if s.name() != StrategyLeastLoad {
+		return block
+	}
+
+	settings := map[string]interface{}{}
+	if s.LeastLoad.Expected > 0 {
+		settings["expected"] = s.LeastLoad.Expected
+	}
+	if len(s.LeastLoad.Baselines) > 0 {
+		settings["baselines"] = anySlice(s.LeastLoad.Baselines)
+	}
+	if s.LeastLoad.Tolerance > 0 {
+		settings["tolerance"] = s.LeastLoad.Tolerance
+	}
+	if len(settings) > 0 {
+		block["settings"] = settings
+	}
+	return block
+}
+
+// balancerBlock is the routing.balancers entry the panel writes.
+func balancerBlock(tag, selector string, strategy BalancerStrategy) map[string]interface{} {
 	return map[string]interface{}{
 		"tag":      tag,
 		"selector": []interface{}{selector},
-		"strategy": map[string]interface{}{"type": "leastPing"},
+		"strategy": strategy.block(),
 	}
 }
 
@@ -129,18 +191,34 @@ var apiServices = []interface{}{"RoutingService", "HandlerService"}
 // rule ordering across merged config files and adds an inbound that XKeen scans
 // when deriving the transparent proxy ports. Xray reports the outcome as
 // "API server listening on …", so a failure is visible in its log.
-func apiConfigDoc(apiAddr string) (map[string]interface{}, error) {
+//
+// A metrics listener rides along when metricsAddr is set: it is the only place
+// the core publishes its observatory.
+func apiConfigDoc(apiAddr, metricsAddr string) (map[string]interface{}, error) {
 	if _, _, err := splitAPIAddr(apiAddr); err != nil {
 		return nil, err
 	}
 
-	return map[string]interface{}{
+	doc := map[string]interface{}{
 		"api": map[string]interface{}{
 			"tag":      "api",
 			"listen":   apiAddr,
 			"services": apiServices,
 		},
-	}, nil
+	}
+	if metricsAddr != "" {
+		if _, _, err := splitAPIAddr(metricsAddr); err != nil {
+			return nil, err
+		}
+		doc["metrics"] = metricsBlock(metricsAddr)
+	}
+	return doc, nil
+}
+
+// metricsBlock makes Xray serve its expvar page, observatory included, on
+// metricsAddr. Like `api.listen`, `metrics.listen` needs no inbound.
+func metricsBlock(metricsAddr string) map[string]interface{} {
+	return map[string]interface{}{"tag": "metrics", "listen": metricsAddr}
 }
 
 func splitAPIAddr(addr string) (string, int, error) {
@@ -157,18 +235,66 @@ func splitAPIAddr(addr string) (string, int, error) {
 	return host, port, nil
 }
 
-// observatoryBlock enables the probing leastPing needs — without it the strategy
-// has no latency data to rank nodes by.
+// The two observatories Xray has; a config runs one of them.
+const (
+	observatoryKey      = "observatory"
+	burstObservatoryKey = "burstObservatory"
+)
+
+// burstSampling is how many recent probes of a node leastLoad weighs.
+const burstSampling = 5
+
+// observatoryBlock enables the probing the balancers need — without it
+// leastPing has no latency data to rank nodes by, and random or roundRobin
+// cannot skip a dead node. leastLoad needs burstObservatory instead: several
+// samples per node, so a node that answers fast but drops every third probe
+// loses to a steady one.
 //
 // The interval scales with pool size: observatory probes every node separately,
 // so a minute-long cycle over a large pool means constant handshakes on the
 // router.
-func observatoryBlock(selector string, nodes int) map[string]interface{} {
+func observatoryBlock(key string, selectors []interface{}, interval string) map[string]interface{} {
+	if key == burstObservatoryKey {
+		return map[string]interface{}{
+			"subjectSelector": selectors,
+			"pingConfig": map[string]interface{}{
+				"destination": defaultProbeURL,
+				"interval":    interval,
+				"sampling":    burstSampling,
+				"timeout":     "5s",
+			},
+		}
+	}
 	return map[string]interface{}{
-		"subjectSelector": []interface{}{selector},
+		"subjectSelector": selectors,
 		"probeURL":        defaultProbeURL,
-		"probeInterval":   probeIntervalFor(nodes),
+		"probeInterval":   interval,
+	}
+}
+
+// observatoryInterval reads the probe interval of either kind of block.
+func observatoryInterval(key string, block map[string]interface{}) string {
+	if key == burstObservatoryKey {
+		ping, _ := block["pingConfig"].(map[string]interface{})
+		interval, _ := ping["interval"].(string)
+		return interval
+	}
+	interval, _ := block["probeInterval"].(string)
+	return interval
+}
+
+// setObservatoryInterval writes the probe interval into either kind of block.
+func setObservatoryInterval(key string, block map[string]interface{}, interval string) {
+	if key != burstObservatoryKey {
+		block["probeInterval"] = interval
+		return
+	}
+	ping, ok := block["pingConfig"].(map[string]interface{})
+	if !ok {
+		ping = map[string]interface{}{"destination": defaultProbeURL, "sampling": burstSampling}
+		block["pingConfig"] = ping
 	}
+	ping["interval"] = interval
 }
 
 func probeIntervalFor(nodes int) string {
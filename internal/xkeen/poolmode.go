@@ -5,6 +5,7 @@ import (
 	"log"
 	"os"
 	"path/filepath"
+	"slices"
 
 	"xkeen-panel/internal/models"
 )
@@ -14,16 +15,18 @@ import (
 const apiConfigFile = "00_api.json"
 
 // PoolOptions tunes pool creation. Zero values mean the panel's defaults, and an
-// empty APIAddr skips installing the gRPC api block.
+// empty APIAddr skips installing the gRPC api block. MetricsAddr adds the
+// metrics listener to that block.
 type PoolOptions struct {
 	BalancerTag string
 	Selector    string
 	APIAddr     string
+	MetricsAddr string
 	Selection   PoolSelection
 }
 
 // EnablePool converts a single-upstream config into a balancer pool built from
-// the subscription: one outbound per server, a leastPing balancer over them, and
+// the subscription: one outbound per server, a balancer over them, and
 // the routing rules retargeted from the outbound to the balancer.
 //
 // Xray then picks the node itself and drops a dead one without a restart, which
@@ -69,11 +72,12 @@ func EnablePool(rt Runtime, outboundsPath string, servers []models.Server, opts
 	if err != nil {
 		return state, err
 	}
-	if err := enableBalancerRouting(doc, balancerTag, selector, proxyTags, len(nodes)); err != nil {
+	if err := enableBalancerRouting(doc, balancerTag, selector, proxyTags, len(nodes), opts.Selection.Strategy); err != nil {
 		return state, err
 	}
+	applyPinBypass(doc.routing, balancerTag, selector, opts.Selection.Strategy, opts.Selection.Pin)
 
-	config["outbounds"] = append(nodes, serviceOutbounds(outbounds)...)
+	config["outbounds"] = withPoolNodes(outbounds, selector, nodes)
 
 	writes := map[string]map[string]interface{}{
 		outboundsPath: config,
@@ -87,7 +91,7 @@ func EnablePool(rt Runtime, outboundsPath string, servers []models.Server, opts
 	apiCreated := false
 	if opts.APIAddr != "" {
 		if _, err := os.Stat(apiPath); os.IsNotExist(err) {
-			apiDoc, err := apiConfigDoc(opts.APIAddr)
+			apiDoc, err := apiConfigDoc(opts.APIAddr, opts.MetricsAddr)
 			if err != nil {
 				return state, err
 			}
@@ -147,7 +151,7 @@ func DisablePool(rt Runtime, outboundsPath string, server *models.Server, state
 		return fmt.Errorf("outbounds не найдены в %s", outboundsPath)
 	}
 
-	params, err := ParseVLESS(server.RawURI)
+	params, err := ParseProxyURI(server.RawURI)
 	if err != nil {
 		return fmt.Errorf("ошибка парсинга URI: %w", err)
 	}
@@ -206,7 +210,7 @@ func SyncPool(rt Runtime, outboundsPath string, servers []models.Server, state P
 		return err
 	}
 
-	config["outbounds"] = append(nodes, serviceOutbounds(outbounds)...)
+	config["outbounds"] = withPoolNodes(outbounds, state.Selector, nodes)
 
 	return applyConfigs(rt, map[string]map[string]interface{}{outboundsPath: config})
 }
@@ -225,6 +229,15 @@ func applyConfigs(rt Runtime, writes map[string]map[string]interface{}) error {
 		written = append(written, path)
 	}
 
+	// A plan writes into a scratch copy, which the dispatcher cannot test
+	if rt.dryRun {
+		if err := testScratchConfig(rt); err != nil {
+			rollback(written)
+			return err
+		}
+		return nil
+	}
+
 	if !rt.Installed || rt.Dispatcher == "" {
 		return nil
 	}
@@ -247,6 +260,42 @@ func rollback(paths []string) {
 	}
 }
 
+// withPoolNodes puts a pool's nodes in place of the ones it had. Service
+// outbounds and the nodes of the other pools stay; for the main pool anything
+// else — the single outbound it replaces — goes. The main pool leads the list,
+// since the first outbound is where unrouted traffic goes; a named pool's
+// nodes go before the service outbounds.
+func withPoolNodes(outbounds []interface{}, selector string, nodes []interface{}) []interface{} {
+	named := isNamedPoolTag(selector)
+
+	var rest []interface{}
+	for _, raw := range outbounds {
+		ob, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		tag, _ := ob["tag"].(string)
+		if containsSelector(tag, selector) && !isServiceOutbound(ob) {
+			continue
+		}
+		if isServiceOutbound(ob) || named || isNamedPoolTag(tag) {
+			rest = append(rest, raw)
+		}
+	}
+
+	if !named {
+		return append(nodes, rest...)
+	}
+	at := len(rest)
+	for i, raw := range rest {
+		if ob, _ := raw.(map[string]interface{}); isServiceOutbound(ob) {
+			at = i
+			break
+		}
+	}
+	return slices.Concat(rest[:at], nodes, rest[at:])
+}
+
 // serviceOutbounds keeps direct/block and friends in their original order.
 func serviceOutbounds(outbounds []interface{}) []interface{} {
 	var kept []interface{}
@@ -0,0 +1,480 @@
+package xkeen
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+// PoolPlan is what a pool operation would do, worked out without touching the
+// config files or the core. The operation itself runs, against a scratch copy
+// of the config directory, so the files it writes and how it applies them are
+// the real run's.
+//
+// Which nodes make the pool is the exception. A real run probes the candidates
+// first; a plan ranks them by the latencies already known, since probing would
+// leave its results in the latency history. When the selection probes, the
+// nodes added, removed or replaced are an estimate — a node that answers the
+// real probe faster can take another's place — and Estimated says so.
+type PoolPlan struct {
+	Files      []FileChange `json:"files"`
+	Added      []string     `json:"added,omitempty"`
+	Removed    []string     `json:"removed,omitempty"`
+	Replaced   []string     `json:"replaced,omitempty"`
+	Retargeted []RuleChange `json:"retargeted,omitempty"`
+	Live       bool         `json:"live"`    // applied through the core API, no connections dropped
+	Restart    bool         `json:"restart"` // the core would be restarted
+
+	// Estimated is set when the membership came from known latencies, not the
+	// probe the real run would take
+	Estimated bool `json:"estimated"`
+}
+
+// Changed reports whether the operation would change anything at all.
+func (p PoolPlan) Changed() bool {
+	return len(p.Files) > 0
+}
+
+// FileChange is one config file the operation would write.
+type FileChange struct {
+	Path    string       `json:"path"`
+	Created bool         `json:"created,omitempty"`
+	Diff    []JSONChange `json:"diff"`
+}
+
+// JSONChange is one difference inside a config file. Path walks the parsed
+// tree: keys joined with dots, array elements by tag where they have one —
+// "outbounds[proxy-2].settings" — and by index otherwise.
+type JSONChange struct {
+	Path string      `json:"path"`
+	Op   string      `json:"op"` // add | remove | replace
+	Old  interface{} `json:"old,omitempty"`
+	New  interface{} `json:"new,omitempty"`
+}
+
+// RuleChange is a routing rule whose target would change. A rule that would
+// be added has no From, one that would go has no To. Targets read
+// "outbound:<tag>" or "balancer:<tag>".
+type RuleChange struct {
+	Rule map[string]interface{} `json:"rule"` // the rule's conditions
+	From string                 `json:"from,omitempty"`
+	To   string                 `json:"to,omitempty"`
+}
+
+// PlanEnablePool is EnablePool without the writes. Enabling always ends in a
+// restart — the new balancer lives in the routing file.
+func PlanEnablePool(rt Runtime, outboundsPath string, servers []models.Server, opts PoolOptions) (PoolPlan, error) {
+	estimated := opts.Selection.ProbeTimeout > 0
+	opts.Selection = opts.Selection.withoutProbes()
+	selector := opts.Selector
+	if selector == "" {
+		selector = DefaultPoolSelector
+	}
+	plan, err := planPool(rt, outboundsPath, selector, nil, func(rt Runtime, outboundsPath string, _ PoolState) error {
+		_, err := EnablePool(rt, outboundsPath, servers, opts)
+		return err
+	})
+	plan.Restart = plan.Changed()
+	plan.Estimated = estimated
+	return plan, err
+}
+
+// PlanEnableNamedPool is EnableNamedPool without the writes.
+func PlanEnableNamedPool(rt Runtime, outboundsPath string, main Topology, servers []models.Server, p NamedPool, sel PoolSelection) (PoolPlan, error) {
+	estimated := sel.ProbeTimeout > 0
+	sel = sel.withoutProbes()
+	plan, err := planPool(rt, outboundsPath, p.Selector, nil, func(rt Runtime, outboundsPath string, _ PoolState) error {
+		_, err := EnableNamedPool(rt, outboundsPath, main, servers, p, sel)
+		return err
+	})
+	plan.Restart = plan.Changed()
+	plan.Estimated = estimated
+	return plan, err
+}
+
+// PlanRefreshPool is RefreshPool without the writes. Whether the change would
+// go live is decided as RefreshPool decides it, down to asking the core
+// whether its API answers.
+//
+// It is the plan of a pool sync as well: /api/pool/sync runs RefreshPool, and
+// SyncPool is the restart path RefreshPool falls back to, planned along with it.
+func PlanRefreshPool(rt Runtime, outboundsPath, apiAddr string, servers []models.Server, state PoolState, sel PoolSelection) (PoolPlan, error) {
+	estimated := sel.ProbeTimeout > 0
+	sel = sel.withoutProbes()
+	var result SyncResult
+	plan, err := planPool(rt, outboundsPath, state.Selector, &state, func(rt Runtime, outboundsPath string, state PoolState) error {
+		var err error
+		result, err = RefreshPool(rt, outboundsPath, apiAddr, servers, state, sel)
+		return err
+	})
+	plan.Live = result.Live
+	plan.Restart = result.Restarted
+	plan.Estimated = estimated
+	return plan, err
+}
+
+// planPool runs op against a scratch copy of the config files and reports
+// how the copy came out different. state, when given, is handed to op with
+// its file paths moved into the copy.
+func planPool(rt Runtime, outboundsPath, selector string, state *PoolState, op func(Runtime, string, PoolState) error) (PoolPlan, error) {
+	var plan PoolPlan
+
+	s, err := newScratch(rt, outboundsPath)
+	if err != nil {
+		return plan, err
+	}
+	defer os.RemoveAll(s.dir)
+
+	scratchRT := rt
+	scratchRT.XrayConfDir = s.path(rt.XrayConfDir)
+	scratchRT.RoutingFile = s.path(rt.RoutingFile)
+	scratchRT.dryRun = true
+
+	var scratchState PoolState
+	if state != nil {
+		scratchState = *state
+		scratchState.RoutingFile = s.path(state.RoutingFile)
+		scratchState.APIFile = s.path(state.APIFile)
+	}
+
+	if err := op(scratchRT, s.path(outboundsPath), scratchState); err != nil {
+		return plan, err
+	}
+
+	if err := s.compare(&plan); err != nil {
+		return plan, err
+	}
+
+	before, errBefore := ReadPoolLayout(outboundsPath, selector)
+	after, errAfter := ReadPoolLayout(s.path(outboundsPath), selector)
+	if errBefore == nil && errAfter == nil {
+		plan.Added = tagsMissingFrom(after, before)
+		plan.Removed = tagsMissingFrom(before, after)
+		plan.Replaced = changedTags(before, after)
+	}
+
+	return plan, nil
+}
+
+// scratch is a throwaway copy of the core's config directory, plus any file
+// an operation names outside it.
+type scratch struct {
+	dir     string
+	confDir string            // the real directory the copy mirrors
+	outside map[string]string // real path -> copy, for files outside confDir
+}
+
+func newScratch(rt Runtime, extra ...string) (*scratch, error) {
+	dir, err := os.MkdirTemp("", "xkeen-panel-plan-*")
+	if err != nil {
+		return nil, fmt.Errorf("не удалось создать временную папку: %w", err)
+	}
+	s := &scratch{dir: dir, confDir: rt.XrayConfDir, outside: map[string]string{}}
+
+	if err := os.MkdirAll(s.path(rt.XrayConfDir), 0700); err != nil {
+		os.RemoveAll(dir)
+		return nil, err
+	}
+	for _, real := range append(ConfigFiles(rt), extra...) {
+		if err := copyIfExists(real, s.path(real)); err != nil {
+			os.RemoveAll(dir)
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// path is where a real path lives in the copy. "" stays "".
+func (s *scratch) path(real string) string {
+	if real == "" {
+		return ""
+	}
+	if real == s.confDir {
+		return filepath.Join(s.dir, "conf")
+	}
+	if filepath.Dir(real) == s.confDir {
+		return filepath.Join(s.dir, "conf", filepath.Base(real))
+	}
+	if copied, ok := s.outside[real]; ok {
+		return copied
+	}
+	copied := filepath.Join(s.dir, "outside", strconv.Itoa(len(s.outside))+"_"+filepath.Base(real))
+	s.outside[real] = copied
+	return copied
+}
+
+// compare adds every file of the copy that differs from the real one to the
+// plan, with the rules that would be retargeted.
+func (s *scratch) compare(plan *PoolPlan) error {
+	pairs := map[string]string{} // real -> copy
+	copies, _ := filepath.Glob(filepath.Join(s.dir, "conf", "*.json"))
+	for _, copied := range copies {
+		pairs[filepath.Join(s.confDir, filepath.Base(copied))] = copied
+	}
+	for real, copied := range s.outside {
+		pairs[real] = copied
+	}
+
+	reals := make([]string, 0, len(pairs))
+	for real := range pairs {
+		reals = append(reals, real)
+	}
+	sort.Strings(reals)
+
+	for _, real := range reals {
+		var after map[string]interface{}
+		if err := ReadJSONC(pairs[real], &after); err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				continue
+			}
+			return err
+		}
+		var before map[string]interface{}
+		created := false
+		if err := ReadJSONC(real, &before); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) {
+				return err
+			}
+			created = true
+		}
+		if !created && sameJSON(before, after) {
+			continue
+		}
+
+		change := FileChange{Path: real, Created: created}
+		diffJSON("", before, after, &change.Diff)
+		plan.Files = append(plan.Files, change)
+
+		beforeRouting, _ := before["routing"].(map[string]interface{})
+		afterRouting, _ := after["routing"].(map[string]interface{})
+		plan.Retargeted = append(plan.Retargeted, retargetedRules(asSlice(beforeRouting["rules"]), asSlice(afterRouting["rules"]))...)
+	}
+	return nil
+}
+
+func copyIfExists(from, to string) error {
+	data, err := os.ReadFile(from)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return fmt.Errorf("ошибка чтения %s: %w", from, err)
+	}
+	if err := os.MkdirAll(filepath.Dir(to), 0700); err != nil {
+		return err
+	}
+	return os.WriteFile(to, data, 0600)
+}
+
+// diffJSON lists how b differs from a. Objects are compared key by key;
+// arrays element by element, lined up by tag or, for untagged elements, by
+// content, so one node added at the front reads as one addition rather than
+// every element shifted.
+func diffJSON(path string, a, b interface{}, out *[]JSONChange) {
+	if sameJSON(a, b) {
+		return
+	}
+	switch x := a.(type) {
+	case map[string]interface{}:
+		y, ok := b.(map[string]interface{})
+		if !ok {
+			break
+		}
+		keys := make([]string, 0, len(x)+len(y))
+		for k := range x {
+			keys = append(keys, k)
+		}
+		for k := range y {
+			if _, seen := x[k]; !seen {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			child := k
+			if path != "" {
+				child = path + "." + k
+			}
+			av, inA := x[k]
+			bv, inB := y[k]
+			switch {
+			case !inA:
+				*out = append(*out, JSONChange{Path: child, Op: "add", New: bv})
+			case !inB:
+				*out = append(*out, JSONChange{Path: child, Op: "remove", Old: av})
+			default:
+				diffJSON(child, av, bv, out)
+			}
+		}
+		return
+	case []interface{}:
+		if y, ok := b.([]interface{}); ok {
+			diffSlices(path, x, y, out)
+			return
+		}
+	case nil:
+		*out = append(*out, JSONChange{Path: path, Op: "add", New: b})
+		return
+	}
+	*out = append(*out, JSONChange{Path: path, Op: "replace", Old: a, New: b})
+}
+
+// diffSlices lines two arrays up by their longest common run of elements with
+// the same identity and reports the rest as additions and removals.
+func diffSlices(path string, a, b []interface{}, out *[]JSONChange) {
+	keyA, keyB := make([]string, len(a)), make([]string, len(b))
+	for i := range a {
+		keyA[i] = elementKey(a[i])
+	}
+	for j := range b {
+		keyB[j] = elementKey(b[j])
+	}
+
+	// lcs[i][j] is the longest common run of a[i:] and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if keyA[i] == keyB[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else {
+				lcs[i][j] = max(lcs[i+1][j], lcs[i][j+1])
+			}
+		}
+	}
+
+	elementPath := func(v interface{}, index int) string {
+		if ob, ok := v.(map[string]interface{}); ok {
+			if tag, _ := ob["tag"].(string); tag != "" {
+				return path + "[" + tag + "]"
+			}
+		}
+		return path + "[" + strconv.Itoa(index) + "]"
+	}
+
+	i, j := 0, 0
+	for i < len(a) || j < len(b) {
+		switch {
+		case i < len(a) && j < len(b) && keyA[i] == keyB[j]:
+			diffJSON(elementPath(b[j], j), a[i], b[j], out)
+			i++
+			j++
+		case j < len(b) && (i == len(a) || lcs[i][j+1] >= lcs[i+1][j]):
+			*out = append(*out, JSONChange{Path: elementPath(b[j], j), Op: "add", New: b[j]})
+			j++
+		default:
+			*out = append(*out, JSONChange{Path: elementPath(a[i], i), Op: "remove", Old: a[i]})
+			i++
+		}
+	}
+}
+
+// elementKey is what makes two array elements the same element: the tag for
+// outbounds and balancers, the whole content for everything else.
+func elementKey(v interface{}) string {
+	if ob, ok := v.(map[string]interface{}); ok {
+		if tag, _ := ob["tag"].(string); tag != "" {
+			return "tag:" + tag
+		}
+	}
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// retargetedRules pairs rules by their conditions and reports those whose
+// target differs, plus rules that appear or go.
+func retargetedRules(before, after []interface{}) []RuleChange {
+	pending := map[string][]map[string]interface{}{}
+	for _, raw := range before {
+		if rule, ok := raw.(map[string]interface{}); ok {
+			key := elementKey(ruleConditions(rule))
+			pending[key] = append(pending[key], rule)
+		}
+	}
+
+	var changes []RuleChange
+	for _, raw := range after {
+		rule, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		conditions := ruleConditions(rule)
+		key := elementKey(conditions)
+		if matches := pending[key]; len(matches) > 0 {
+			pending[key] = matches[1:]
+			if from, to := ruleTarget(matches[0]), ruleTarget(rule); from != to {
+				changes = append(changes, RuleChange{Rule: conditions, From: from, To: to})
+			}
+			continue
+		}
+		changes = append(changes, RuleChange{Rule: conditions, To: ruleTarget(rule)})
+	}
+
+	for _, raw := range before {
+		rule, ok := raw.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		key := elementKey(ruleConditions(rule))
+		if matches := pending[key]; len(matches) > 0 && sameJSON(matches[0], rule) {
+			pending[key] = matches[1:]
+			changes = append(changes, RuleChange{Rule: ruleConditions(rule), From: ruleTarget(rule)})
+		}
+	}
+	return changes
+}
+
+// ruleConditions is a rule without its target.
+func ruleConditions(rule map[string]interface{}) map[string]interface{} {
+	conditions := make(map[string]interface{}, len(rule))
+	for k, v := range rule {
+		if k != "outboundTag" && k != "balancerTag" {
+			conditions[k] = v
+		}
+	}
+	return conditions
+}
+
+func ruleTarget(rule map[string]interface{}) string {
+	if tag, _ := rule["balancerTag"].(string); tag != "" {
+		return "balancer:" + tag
+	}
+	if tag, _ := rule["outboundTag"].(string); tag != "" {
+		return "outbound:" + tag
+	}
+	return ""
+}
+
+// testScratchConfig checks a planned config the way the core would load it.
+// `xkeen -xtest` only ever tests the live directory, so a plan asks xray
+// itself; without the binary the plan goes unchecked.
+func testScratchConfig(rt Runtime) error {
+	if rt.Core != CoreXray || rt.CoreBin == "" {
+		return nil
+	}
+	if _, err := os.Stat(rt.CoreBin); err != nil {
+		return nil
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	out, err := exec.CommandContext(ctx, rt.CoreBin, "run", "-test", "-confdir", rt.XrayConfDir).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("конфигурация xray не прошла проверку: %s", TailLines(strings.TrimSpace(string(out)), 4))
+	}
+	return nil
+}
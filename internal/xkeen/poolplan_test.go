@@ -0,0 +1,173 @@
+package xkeen
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// snapshotDir reads every file of a directory, to prove a plan left it alone.
+func snapshotDir(t *testing.T, dir string) map[string]string {
+	t.Helper()
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatalf("read dir: %v", err)
+	}
+	files := map[string]string{}
+	for _, e := range entries {
+		data, err := os.ReadFile(filepath.Join(dir, e.Name()))
+		if err != nil {
+			t.Fatalf("read %s: %v", e.Name(), err)
+		}
+		files[e.Name()] = string(data)
+	}
+	return files
+}
+
+func planFile(plan PoolPlan, path string) (FileChange, bool) {
+	for _, f := range plan.Files {
+		if f.Path == path {
+			return f, true
+		}
+	}
+	return FileChange{}, false
+}
+
+func TestPlanEnablePool(t *testing.T) {
+	rt, outboundsPath := liveConfDir(t)
+	before := snapshotDir(t, rt.XrayConfDir)
+
+	plan, err := PlanEnablePool(rt, outboundsPath, poolServers(), PoolOptions{APIAddr: "127.0.0.1:10085"})
+	if err != nil {
+		t.Fatalf("PlanEnablePool: %v", err)
+	}
+
+	if after := snapshotDir(t, rt.XrayConfDir); !sameJSON(before, after) {
+		t.Errorf("a plan touched the config directory: %v", after)
+	}
+
+	if _, ok := planFile(plan, outboundsPath); !ok {
+		t.Errorf("Files = %+v, want the outbounds", plan.Files)
+	}
+	if _, ok := planFile(plan, rt.RoutingFile); !ok {
+		t.Errorf("Files = %+v, want the routing", plan.Files)
+	}
+	if api, ok := planFile(plan, filepath.Join(rt.XrayConfDir, apiConfigFile)); !ok || !api.Created {
+		t.Errorf("Files = %+v, want the api file created", plan.Files)
+	}
+	if !slices.Equal(plan.Added, []string{"sub-1", "sub-2"}) {
+		t.Errorf("Added = %v, want both nodes", plan.Added)
+	}
+	if !plan.Restart || plan.Live {
+		t.Errorf("Restart = %v, Live = %v: a new balancer only loads on restart", plan.Restart, plan.Live)
+	}
+	if plan.Estimated {
+		t.Error("nothing would be probed, so the nodes are exact")
+	}
+
+	catchAll := slices.IndexFunc(plan.Retargeted, func(c RuleChange) bool {
+		return c.From == "outbound:vless-reality" && c.To == "balancer:"+DefaultBalancerTag
+	})
+	if catchAll < 0 {
+		t.Errorf("Retargeted = %+v, want the catch-all rule moved onto the balancer", plan.Retargeted)
+	}
+}
+
+func TestPlanRefreshPool(t *testing.T) {
+	rt, outboundsPath := liveConfDir(t)
+	state, err := EnablePool(rt, outboundsPath, poolServers(), PoolOptions{})
+	if err != nil {
+		t.Fatalf("EnablePool: %v", err)
+	}
+	before := snapshotDir(t, rt.XrayConfDir)
+
+	plan, err := PlanRefreshPool(rt, outboundsPath, "", poolServers()[:1], state, PoolSelection{})
+	if err != nil {
+		t.Fatalf("PlanRefreshPool: %v", err)
+	}
+
+	if after := snapshotDir(t, rt.XrayConfDir); !sameJSON(before, after) {
+		t.Error("a plan touched the config directory")
+	}
+	if !slices.Equal(plan.Removed, []string{"sub-2"}) {
+		t.Errorf("Removed = %v, want [sub-2]", plan.Removed)
+	}
+	// No api address in the fixture, so the change could only go by restart
+	if !plan.Restart || plan.Live {
+		t.Errorf("Restart = %v, Live = %v, want a restart", plan.Restart, plan.Live)
+	}
+
+	outbounds, ok := planFile(plan, outboundsPath)
+	if !ok {
+		t.Fatalf("Files = %+v, want the outbounds", plan.Files)
+	}
+	if !slices.ContainsFunc(outbounds.Diff, func(c JSONChange) bool {
+		return c.Path == "outbounds[sub-2]" && c.Op == "remove"
+	}) {
+		t.Errorf("Diff = %+v, want sub-2 removed by tag", outbounds.Diff)
+	}
+}
+
+func TestPlanRefreshPoolUnchanged(t *testing.T) {
+	rt, outboundsPath := liveConfDir(t)
+	state, err := EnablePool(rt, outboundsPath, poolServers(), PoolOptions{})
+	if err != nil {
+		t.Fatalf("EnablePool: %v", err)
+	}
+
+	plan, err := PlanRefreshPool(rt, outboundsPath, "", poolServers(), state, PoolSelection{})
+	if err != nil {
+		t.Fatalf("PlanRefreshPool: %v", err)
+	}
+	if plan.Changed() || plan.Restart {
+		t.Errorf("plan = %+v, want nothing to do", plan)
+	}
+}
+
+// A plan ranks by what is known: a probe would land in the history, which is
+// flushed to disk.
+func TestPlanEnablePoolRecordsNoProbes(t *testing.T) {
+	rt, outboundsPath := liveConfDir(t)
+	history := NewLatencyHistory(t.TempDir())
+
+	sel := PoolSelection{MaxNodes: 1, ProbeTimeout: 50 * time.Millisecond, History: history}
+	plan, err := PlanEnablePool(rt, outboundsPath, poolServers(), PoolOptions{Selection: sel})
+	if err != nil {
+		t.Fatalf("PlanEnablePool: %v", err)
+	}
+	if !plan.Estimated {
+		t.Error("a plan that skipped the probe must say its nodes are an estimate")
+	}
+
+	for _, server := range poolServers() {
+		if stats := history.Stats(server); stats.Samples != 0 {
+			t.Errorf("%s: %d samples recorded by a plan", server.Name, stats.Samples)
+		}
+	}
+}
+
+// A node added at the front is one addition, not every element shifted.
+func TestDiffJSONLinesArraysUpByTag(t *testing.T) {
+	a := map[string]interface{}{"outbounds": []interface{}{
+		map[string]interface{}{"tag": "sub-1", "port": 443.0},
+		map[string]interface{}{"tag": "direct"},
+	}}
+	b := map[string]interface{}{"outbounds": []interface{}{
+		map[string]interface{}{"tag": "sub-0"},
+		map[string]interface{}{"tag": "sub-1", "port": 8443.0},
+		map[string]interface{}{"tag": "direct"},
+	}}
+
+	var diff []JSONChange
+	diffJSON("", a, b, &diff)
+
+	want := []JSONChange{
+		{Path: "outbounds[sub-0]", Op: "add", New: map[string]interface{}{"tag": "sub-0"}},
+		{Path: "outbounds[sub-1].port", Op: "replace", Old: 443.0, New: 8443.0},
+	}
+	if !sameJSON(diff, want) {
+		t.Errorf("diff = %+v, want %+v", diff, want)
+	}
+}
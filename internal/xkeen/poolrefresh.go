@@ -16,6 +16,13 @@ type SyncResult struct {
 	Replaced  []string `json:"replaced,omitempty"`
 	Restarted bool     `json:"restarted"`
 	Live      bool     `json:"live"` // applied through the API, no connections dropped
+
+	// StrategyChanged is set when the balancer strategy or the observatory
+	// was rewritten to match the config
+	StrategyChanged bool `json:"strategy_changed,omitempty"`
+	// BypassChanged is set when the traffic skipping the pin was rerouted to
+	// match the pin policy
+	BypassChanged bool `json:"bypass_changed,omitempty"`
 }
 
 // RefreshPool brings the pool in line with the subscription.
@@ -49,42 +56,50 @@ func RefreshPool(rt Runtime, outboundsPath, apiAddr string, servers []models.Ser
 	if err != nil {
 		return result, err
 	}
-	if matches {
-		return result, nil
-	}
 
 	before := current
+	after := current
+	upgraded := false
+	if !matches {
+		if err := SyncPool(rt, outboundsPath, wanted, state, PoolSelection{MaxNodes: len(wanted)}); err != nil {
+			return result, err
+		}
 
-	if err := SyncPool(rt, outboundsPath, wanted, state, PoolSelection{MaxNodes: len(wanted)}); err != nil {
-		return result, err
-	}
-
-	after, err := ReadPoolLayout(outboundsPath, selector)
-	if err != nil {
-		return result, err
-	}
+		after, err = ReadPoolLayout(outboundsPath, selector)
+		if err != nil {
+			return result, err
+		}
 
-	result.Changed = true
-	result.Added = tagsMissingFrom(after, before)
-	result.Removed = tagsMissingFrom(before, after)
+		result.Added = tagsMissingFrom(after, before)
+		result.Removed = tagsMissingFrom(before, after)
 
-	// A pool built by an older panel has an api block that never listened, so the
-	// hot path would fail every time until the file is migrated
-	upgraded, err := ensureAPIConfig(state.APIFile, apiAddr)
-	if err != nil {
-		log.Printf("[POOL] Не удалось обновить api-блок: %v", err)
-	}
-	if upgraded {
-		log.Printf("[POOL] api-блок приведён к текущей форме — применяю перезапуском")
+		// A pool built by an older panel has an api block that never listened, so the
+		// hot path would fail every time until the file is migrated
+		upgraded, err = ensureAPIConfig(rt, state.APIFile, apiAddr, "")
+		if err != nil {
+			log.Printf("[POOL] Не удалось обновить api-блок: %v", err)
+		}
+		if upgraded {
+			log.Printf("[POOL] api-блок приведён к текущей форме — применяю перезапуском")
+		}
 	}
 
-	// Probe load scales with pool size, so a pool that shrank or grew may need a
-	// different interval. This lives in the routing file, which the API cannot
-	// reload — changing it forces the restart path.
-	observatoryChanged, err := updateObservatoryInterval(rt, selector, len(wanted))
+	// The strategy and the pin bypass follow config.yaml, and probe load scales
+	// with pool size, so a pool that shrank or grew may need a different
+	// interval. All of it lives in the routing file, which the API cannot
+	// reload — changing it forces the restart path. A balancer the panel did
+	// not build keeps the owner's strategy and routing.
+	balancing, err := updateBalancing(rt, outboundsPath, state, selector, sel)
 	if err != nil {
-		log.Printf("[POOL] Не удалось обновить observatory: %v", err)
+		log.Printf("[POOL] Не удалось обновить стратегию и observatory: %v", err)
+	}
+	if matches && !balancing.changed() {
+		return result, nil
 	}
+	result.Changed = true
+	result.StrategyChanged = balancing.strategy || balancing.kind
+	result.BypassChanged = balancing.bypass
+	observatoryChanged := balancing.changed()
 
 	// Only the tags whose endpoint actually changed need touching in the running
 	// core. Treating every surviving tag as replaced tore down all ten outbounds
@@ -94,7 +109,17 @@ func RefreshPool(rt Runtime, outboundsPath, apiAddr string, servers []models.Ser
 	// The live path is attempted only for an api block the panel wrote, because
 	// only then is HandlerService guaranteed present. Otherwise the removals
 	// would land and the additions would fail, leaving the core with no nodes.
-	if !upgraded && !observatoryChanged && state.APIFile != "" {
+	canLive := !upgraded && !observatoryChanged && state.APIFile != ""
+
+	// A plan asks the core only whether the live path would be open; it
+	// changes nothing in it
+	if rt.dryRun {
+		result.Live = canLive && liveAvailable(rt, apiAddr, state.BalancerTag, result.Added, result.Replaced, result.Removed)
+		result.Restarted = !result.Live
+		return result, nil
+	}
+
+	if canLive {
 		if err := applyPoolLive(rt, apiAddr, outboundsPath, selector, result.Added, result.Replaced, result.Removed); err == nil {
 			result.Live = true
 			return result, nil
@@ -111,43 +136,106 @@ func RefreshPool(rt Runtime, outboundsPath, apiAddr string, servers []models.Ser
 	return result, nil
 }
 
-// updateObservatoryInterval keeps the probe interval in step with pool size.
-func updateObservatoryInterval(rt Runtime, selector string, nodes int) (bool, error) {
-	doc, err := findRoutingDoc(rt, func(map[string]interface{}) bool { return false })
+// balancingUpdate is what updateBalancing rewrote.
+type balancingUpdate struct {
+	strategy, kind, interval, bypass bool
+}
+
+func (u balancingUpdate) changed() bool {
+	return u.strategy || u.kind || u.interval || u.bypass
+}
+
+// updateBalancing brings the routing file in line with the pool: for a pool
+// the panel built, the balancer's strategy and the pin bypass; for any pool,
+// the observatory kind the strategies need and its probe interval. The file is
+// written and validated only when something changed.
+func updateBalancing(rt Runtime, outboundsPath string, state PoolState, selector string, sel PoolSelection) (balancingUpdate, error) {
+	var update balancingUpdate
+	balancerTag, strategy := state.BalancerTag, sel.Strategy
+
+	doc, err := findRoutingDoc(rt, ruleTargetsBalancer(balancerTag))
 	if err != nil {
-		return false, err
+		return update, err
 	}
 
-	observatory, ok := doc.config["observatory"].(map[string]interface{})
-	if !ok {
-		return false, nil
+	if state.Enabled && balancerTag != "" {
+		update.strategy = setBalancerStrategy(doc.routing, balancerTag, strategy)
+		update.bypass = applyPinBypass(doc.routing, balancerTag, selector, strategy, sel.Pin)
+	}
+	update.kind = fitObservatory(doc)
+	if update.interval, err = updateObservatoryInterval(doc, outboundsPath); err != nil {
+		return balancingUpdate{}, err
+	}
+	if !update.changed() {
+		return update, nil
 	}
 
-	want := probeIntervalFor(nodes)
-	if current, _ := observatory["probeInterval"].(string); current == want {
-		return false, nil
+	if update.strategy {
+		log.Printf("[POOL] Стратегия балансировщика %s: %s", balancerTag, strategy.name())
+	}
+	if update.bypass {
+		log.Printf("[POOL] Трафик мимо закрепления %s приведён к конфигу", balancerTag)
 	}
+	doc.config["routing"] = doc.routing
+	if err := applyConfigs(rt, map[string]map[string]interface{}{doc.path: doc.config}); err != nil {
+		return balancingUpdate{}, err
+	}
+	return update, nil
+}
 
-	observatory["probeInterval"] = want
-	doc.config["observatory"] = observatory
+// updateObservatoryInterval keeps the probe interval in step with the number
+// of nodes observatory probes — every pool's, since they share it. It works on
+// either kind of observatory and only edits doc; the caller writes it.
+func updateObservatoryInterval(doc *routingDoc, outboundsPath string) (bool, error) {
+	key, observatory := currentObservatory(doc.config)
+	if observatory == nil {
+		return false, nil
+	}
 
-	if err := WriteOutboundsConfig(doc.path, doc.config); err != nil {
+	nodes, err := observedNodes(outboundsPath, stringsOf(observatory["subjectSelector"]))
+	if err != nil {
 		return false, err
 	}
+	want := probeIntervalFor(nodes)
+	if observatoryInterval(key, observatory) == want {
+		return false, nil
+	}
 
+	setObservatoryInterval(key, observatory, want)
+	doc.config[key] = observatory
 	return true, nil
 }
 
+// observedNodes counts the outbounds the selectors pick, matched the way Xray
+// does: by substring.
+func observedNodes(outboundsPath string, selectors []string) (int, error) {
+	config, err := ReadOutboundsConfig(outboundsPath)
+	if err != nil {
+		return 0, err
+	}
+	var tags []string
+	for _, raw := range asSlice(config["outbounds"]) {
+		if ob, ok := raw.(map[string]interface{}); ok && !isServiceOutbound(ob) {
+			if tag, _ := ob["tag"].(string); tag != "" {
+				tags = append(tags, tag)
+			}
+		}
+	}
+	return len(matchSelectors(tags, selectors)), nil
+}
+
 // EnsureAPIConfig migrates the api block on startup.
 //
 // A pool whose subscription has not drifted never reaches the refresh path, so
 // an install carrying the old non-listening api block would keep failing to pin
 // forever. Returns true when the file changed and the core has to be restarted.
-func EnsureAPIConfig(state PoolState, apiAddr string) (bool, error) {
+// A migrated file the core rejects is rolled back and reported as an error, so
+// startup never restarts into a config that does not load.
+func EnsureAPIConfig(rt Runtime, state PoolState, apiAddr, metricsAddr string) (bool, error) {
 	if !state.Enabled {
 		return false, nil
 	}
-	return ensureAPIConfig(state.APIFile, apiAddr)
+	return ensureAPIConfig(rt, state.APIFile, apiAddr, metricsAddr)
 }
 
 // ensureAPIConfig brings an api block the panel created up to the current shape.
@@ -156,8 +244,9 @@ func EnsureAPIConfig(state PoolState, apiAddr string) (bool, error) {
 // Two migrations happen here. Early pools asked only for RoutingService, which
 // is not enough to swap outbounds in a running core. And the original recipe
 // bound the port through a dokodemo-door inbound plus a routing rule, which did
-// not actually listen — `api.listen` replaces both.
-func ensureAPIConfig(apiPath, apiAddr string) (bool, error) {
+// not actually listen — `api.listen` replaces both. A metricsAddr also adds or
+// moves the metrics listener; an empty one leaves it as it is.
+func ensureAPIConfig(rt Runtime, apiPath, apiAddr, metricsAddr string) (bool, error) {
 	if apiPath == "" || apiAddr == "" {
 		return false, nil
 	}
@@ -184,6 +273,13 @@ func ensureAPIConfig(apiPath, apiAddr string) (bool, error) {
 		changed = true
 	}
 
+	if metricsAddr != "" {
+		if metrics, _ := cfg["metrics"].(map[string]interface{}); metrics["listen"] != metricsAddr {
+			cfg["metrics"] = metricsBlock(metricsAddr)
+			changed = true
+		}
+	}
+
 	// The inbound and its rule only existed to reach the api tag; with a direct
 	// listener they are dead weight, and the inbound confuses XKeen's port scan
 	if _, present := cfg["inbounds"]; present {
@@ -197,7 +293,7 @@ func ensureAPIConfig(apiPath, apiAddr string) (bool, error) {
 	}
 
 	cfg["api"] = api
-	if err := WriteOutboundsConfig(apiPath, cfg); err != nil {
+	if err := applyConfigs(rt, map[string]map[string]interface{}{apiPath: cfg}); err != nil {
 		return false, err
 	}
 
@@ -213,6 +309,15 @@ func hasService(services interface{}, want string) bool {
 	return false
 }
 
+// liveAvailable is whether applyPoolLive would get through, asked without
+// touching the running core.
+func liveAvailable(rt Runtime, apiAddr, balancerTag string, added, replaced, removed []string) bool {
+	if rt.Core != CoreXray || apiAddr == "" {
+		return false
+	}
+	return len(added)+len(replaced)+len(removed) == 0 || BalancerAPIAvailable(rt, apiAddr, balancerTag)
+}
+
 // applyPoolLive pushes only the difference into the running core: tags that are
 // gone are dropped, tags whose endpoint changed are replaced, new tags added.
 //
@@ -100,7 +100,7 @@ func TestEnsureAPIConfigMigratesOldBlock(t *testing.T) {
 		t.Fatalf("write: %v", err)
 	}
 
-	upgraded, err := ensureAPIConfig(path, "127.0.0.1:10085")
+	upgraded, err := ensureAPIConfig(Runtime{}, path, "127.0.0.1:10085", "")
 	if err != nil {
 		t.Fatalf("ensureAPIConfig: %v", err)
 	}
@@ -129,19 +129,19 @@ func TestEnsureAPIConfigMigratesOldBlock(t *testing.T) {
 	}
 
 	// Second call must be a no-op
-	if again, _ := ensureAPIConfig(path, "127.0.0.1:10085"); again {
+	if again, _ := ensureAPIConfig(Runtime{}, path, "127.0.0.1:10085", ""); again {
 		t.Error("already-migrated block reported as changed")
 	}
 }
 
 func TestEnsureAPIConfigIgnoresForeignBlock(t *testing.T) {
-	if upgraded, err := ensureAPIConfig("", "127.0.0.1:10085"); upgraded || err != nil {
+	if upgraded, err := ensureAPIConfig(Runtime{}, "", "127.0.0.1:10085", ""); upgraded || err != nil {
 		t.Errorf("upgraded=%v err=%v, want a no-op when the panel does not own the file", upgraded, err)
 	}
 }
 
 func TestEnsureAPIConfigSkipsDisabledPool(t *testing.T) {
-	if upgraded, err := EnsureAPIConfig(PoolState{Enabled: false, APIFile: "/nope"}, "127.0.0.1:10085"); upgraded || err != nil {
+	if upgraded, err := EnsureAPIConfig(Runtime{}, PoolState{Enabled: false, APIFile: "/nope"}, "127.0.0.1:10085", ""); upgraded || err != nil {
 		t.Errorf("upgraded=%v err=%v, want a no-op without a pool", upgraded, err)
 	}
 }
@@ -175,3 +175,109 @@ func TestNewPoolWritesHandlerService(t *testing.T) {
 		t.Error("a listening api block needs no dokodemo-door inbound")
 	}
 }
+
+// readRouting parses the routing file a test pool lives in.
+func readRouting(t *testing.T, rt Runtime) map[string]interface{} {
+	t.Helper()
+	var cfg map[string]interface{}
+	if err := ReadJSONC(rt.RoutingFile, &cfg); err != nil {
+		t.Fatalf("read routing: %v", err)
+	}
+	return cfg
+}
+
+func balancerStrategyOf(cfg map[string]interface{}) map[string]interface{} {
+	routing, _ := cfg["routing"].(map[string]interface{})
+	for _, raw := range asSlice(routing["balancers"]) {
+		if b, _ := raw.(map[string]interface{}); b["tag"] == DefaultBalancerTag {
+			strategy, _ := b["strategy"].(map[string]interface{})
+			return strategy
+		}
+	}
+	return nil
+}
+
+func TestEnablePoolLeastLoadUsesBurstObservatory(t *testing.T) {
+	rt, outboundsPath := liveConfDir(t)
+
+	strategy := BalancerStrategy{Type: StrategyLeastLoad, LeastLoad: models.LeastLoadConfig{Expected: 2, Baselines: []string{"1s"}}}
+	if _, err := EnablePool(rt, outboundsPath, poolServers(), PoolOptions{Selection: PoolSelection{Strategy: strategy}}); err != nil {
+		t.Fatalf("EnablePool: %v", err)
+	}
+
+	cfg := readRouting(t, rt)
+	if _, plain := cfg[observatoryKey]; plain {
+		t.Error("leastLoad pool written with plain observatory")
+	}
+	burst, ok := cfg[burstObservatoryKey].(map[string]interface{})
+	if !ok || stringsOf(burst["subjectSelector"])[0] != DefaultPoolSelector {
+		t.Fatalf("burstObservatory = %v", cfg[burstObservatoryKey])
+	}
+	settings, _ := balancerStrategyOf(cfg)["settings"].(map[string]interface{})
+	if settings["expected"] != float64(2) || len(asSlice(settings["baselines"])) != 1 {
+		t.Errorf("strategy settings = %v", settings)
+	}
+	if _, set := settings["tolerance"]; set {
+		t.Error("unset tolerance written instead of leaving Xray's default")
+	}
+}
+
+// A strategy changed in config.yaml reaches the routing file on the next
+// refresh, even when the pool's members did not change.
+func TestRefreshPoolFollowsStrategy(t *testing.T) {
+	rt, outboundsPath := liveConfDir(t)
+
+	state, err := EnablePool(rt, outboundsPath, poolServers(), PoolOptions{})
+	if err != nil {
+		t.Fatalf("EnablePool: %v", err)
+	}
+
+	leastLoad := PoolSelection{Strategy: BalancerStrategy{Type: StrategyLeastLoad}}
+	result, err := RefreshPool(rt, outboundsPath, "", poolServers(), state, leastLoad)
+	if err != nil {
+		t.Fatalf("RefreshPool: %v", err)
+	}
+	if !result.Changed || !result.StrategyChanged || result.Live {
+		t.Errorf("result = %+v, want a strategy change applied by restart", result)
+	}
+	cfg := readRouting(t, rt)
+	if balancerStrategyOf(cfg)["type"] != StrategyLeastLoad || cfg[burstObservatoryKey] == nil || cfg[observatoryKey] != nil {
+		t.Fatalf("routing = %v, want leastLoad over burstObservatory", cfg)
+	}
+
+	// Settled: the next refresh leaves it alone
+	if result, _ := RefreshPool(rt, outboundsPath, "", poolServers(), state, leastLoad); result.Changed {
+		t.Errorf("second refresh = %+v, want no change", result)
+	}
+
+	// And back: the observatory keeps its selectors
+	if _, err := RefreshPool(rt, outboundsPath, "", poolServers(), state, PoolSelection{Strategy: BalancerStrategy{Type: StrategyRoundRobin}}); err != nil {
+		t.Fatalf("RefreshPool: %v", err)
+	}
+	cfg = readRouting(t, rt)
+	observatory, ok := cfg[observatoryKey].(map[string]interface{})
+	if balancerStrategyOf(cfg)["type"] != StrategyRoundRobin || !ok || cfg[burstObservatoryKey] != nil {
+		t.Fatalf("routing = %v, want roundRobin over plain observatory", cfg)
+	}
+	if selectors := stringsOf(observatory["subjectSelector"]); len(selectors) != 1 || selectors[0] != DefaultPoolSelector {
+		t.Errorf("selectors = %v", selectors)
+	}
+}
+
+// A balancer the panel did not build keeps the strategy its owner chose.
+func TestRefreshPoolLeavesForeignStrategy(t *testing.T) {
+	rt, outboundsPath := liveConfDir(t)
+
+	state, err := EnablePool(rt, outboundsPath, poolServers(), PoolOptions{})
+	if err != nil {
+		t.Fatalf("EnablePool: %v", err)
+	}
+	state.Enabled = false
+
+	if _, err := RefreshPool(rt, outboundsPath, "", poolServers(), state, PoolSelection{Strategy: BalancerStrategy{Type: StrategyRandom}}); err != nil {
+		t.Fatalf("RefreshPool: %v", err)
+	}
+	if got := balancerStrategyOf(readRouting(t, rt))["type"]; got != StrategyLeastPing {
+		t.Errorf("strategy = %v, want the original leastPing", got)
+	}
+}
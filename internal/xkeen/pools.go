@@ -0,0 +1,267 @@
+package xkeen
+
+import (
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+
+	"xkeen-panel/internal/geoip"
+	"xkeen-panel/internal/models"
+)
+
+// namedPoolPrefix starts the balancer tag, the selector and every node tag of
+// a named pool. It tells them apart from the main pool and from the owner's
+// own balancers.
+const namedPoolPrefix = "pool-"
+
+// poolNamePattern keeps names free of "-": Xray selects by substring, and
+// with a dash in a name "pool-eu-" would also select the nodes of "eu-fast".
+var poolNamePattern = regexp.MustCompile(`^[a-z0-9_]+$`)
+
+func isNamedPoolTag(tag string) bool {
+	return strings.HasPrefix(tag, namedPoolPrefix)
+}
+
+// NamedPool is a pool running next to the main one: its own balancer over its
+// own nodes, and routing rules that send chosen traffic to it. The main pool
+// keeps everything else.
+type NamedPool struct {
+	models.PoolConfig
+	BalancerTag string
+	Selector    string
+}
+
+// NamedPoolsFromConfig reads the pools section of the config. A broken entry
+// fails the whole list: a pool half-described would route traffic nobody
+// meant it to.
+func NamedPoolsFromConfig(cfg *models.Config) ([]NamedPool, error) {
+	pools := make([]NamedPool, 0, len(cfg.Pools))
+	for _, pc := range cfg.Pools {
+		pc.Name = strings.TrimSpace(pc.Name)
+		if !poolNamePattern.MatchString(pc.Name) {
+			return nil, fmt.Errorf("имя пула %q: только строчные латинские буквы, цифры и _", pc.Name)
+		}
+		if slices.ContainsFunc(pools, func(p NamedPool) bool { return p.Name == pc.Name }) {
+			return nil, fmt.Errorf("пул %q описан дважды", pc.Name)
+		}
+		if err := ValidateStrategy(pc.Strategy); err != nil {
+			return nil, fmt.Errorf("пул %q: %w", pc.Name, err)
+		}
+		if err := ValidatePinPolicy(pc.Pin); err != nil {
+			return nil, fmt.Errorf("пул %q: %w", pc.Name, err)
+		}
+		if len(pc.Domains) == 0 && len(pc.IPs) == 0 && pc.Ports == "" && len(pc.InboundTags) == 0 {
+			return nil, fmt.Errorf("пул %q: не задано, какой трафик через него идёт (domains, ips, ports, inbound_tags)", pc.Name)
+		}
+		pools = append(pools, NamedPool{
+			PoolConfig:  pc,
+			BalancerTag: namedPoolPrefix + pc.Name,
+			Selector:    namedPoolPrefix + pc.Name + "-",
+		})
+	}
+	return pools, nil
+}
+
+// FindNamedPool looks a pool up by name in the config.
+func FindNamedPool(cfg *models.Config, name string) (NamedPool, error) {
+	pools, err := NamedPoolsFromConfig(cfg)
+	if err != nil {
+		return NamedPool{}, err
+	}
+	for _, p := range pools {
+		if p.Name == name {
+			return p, nil
+		}
+	}
+	return NamedPool{}, fmt.Errorf("пул %q не описан в config.yaml", name)
+}
+
+// Selection is the pool's own membership rules on top of the panel-wide ones
+// (avoided countries, scoring, speed, UDP). pool_filter belongs to the main
+// pool; a named pool goes by its own filter, countries and tags.
+func (p NamedPool) Selection(cfg *models.Config, matcher *geoip.Matcher, sm *SubscriptionManager) PoolSelection {
+	sel := basePoolSelection(cfg, matcher, sm)
+	if p.MaxNodes > 0 {
+		sel.MaxNodes = p.MaxNodes
+	}
+	sel.Countries = p.Countries
+	sel.Strategy = BalancerStrategy{Type: p.Strategy, LeastLoad: cfg.PoolLeastLoad}
+	sel.Pin = p.Pin
+
+	var filter models.ServerFilter
+	if p.Filter != "" {
+		if saved, ok := sm.Filter(p.Filter); ok {
+			filter = saved
+		} else {
+			log.Printf("[POOL] Фильтр %q пула %s не найден — без него", p.Filter, p.Name)
+		}
+	}
+	if len(p.Tags) > 0 {
+		filter.Tags = p.Tags
+	}
+	sel.Filter = &filter
+	return sel
+}
+
+// routingRules are the rules sending the pool's traffic to its balancer, one
+// per kind of condition: Xray ANDs the conditions of a rule.
+func (p NamedPool) routingRules() []interface{} {
+	var rules []interface{}
+	add := func(key string, value interface{}) {
+		rules = append(rules, map[string]interface{}{"type": "field", key: value, "balancerTag": p.BalancerTag})
+	}
+	if len(p.Domains) > 0 {
+		add("domain", anySlice(p.Domains))
+	}
+	if len(p.IPs) > 0 {
+		add("ip", anySlice(p.IPs))
+	}
+	if p.Ports != "" {
+		add("port", p.Ports)
+	}
+	if len(p.InboundTags) > 0 {
+		add("inboundTag", anySlice(p.InboundTags))
+	}
+	return rules
+}
+
+func anySlice(values []string) []interface{} {
+	out := make([]interface{}, len(values))
+	for i, v := range values {
+		out[i] = v
+	}
+	return out
+}
+
+// EnableNamedPool builds a named pool next to the main one: its nodes among
+// the outbounds, its balancer, its rules ahead of the main pool's and its
+// selector in observatory. Enabling a pool that is already built rebuilds it
+// in place, so changed routing in config.yaml takes effect; nodes keep their
+// tags.
+//
+// The routing file is rewritten from the parsed tree, comments lost, as with
+// EnablePool.
+func EnableNamedPool(rt Runtime, outboundsPath string, main Topology, servers []models.Server, p NamedPool, sel PoolSelection) (PoolState, error) {
+	if main.Mode != TopologyPool {
+		return PoolState{}, fmt.Errorf("пулы работают рядом с основным — сначала включите пул")
+	}
+	for _, s := range main.Selectors {
+		if strings.Contains(p.Selector, s) {
+			return PoolState{}, fmt.Errorf("селектор основного пула %q выбрал бы и ноды пула %s — переименуйте пул", s, p.Name)
+		}
+	}
+
+	config, err := ReadOutboundsConfig(outboundsPath)
+	if err != nil {
+		return PoolState{}, err
+	}
+	outbounds, ok := config["outbounds"].([]interface{})
+	if !ok {
+		return PoolState{}, fmt.Errorf("outbounds не найдены в %s", outboundsPath)
+	}
+	_, template := findProxyOutbound(outbounds)
+
+	layout, err := ReadPoolLayout(outboundsPath, p.Selector)
+	if err != nil {
+		return PoolState{}, err
+	}
+	nodes, err := BuildPoolOutbounds(SelectPoolServers(servers, sel.WithCurrentPool(layout)), p.Selector, template, layout)
+	if err != nil {
+		return PoolState{}, fmt.Errorf("пул %s: %w", p.Name, err)
+	}
+	config["outbounds"] = withPoolNodes(outbounds, p.Selector, nodes)
+
+	doc, err := findRoutingDoc(rt, ruleTargetsBalancer(main.BalancerTag))
+	if err != nil {
+		return PoolState{}, err
+	}
+	enableNamedRouting(doc, p, main.BalancerTag, sel.Strategy)
+	applyPinBypass(doc.routing, p.BalancerTag, p.Selector, sel.Strategy, sel.Pin)
+
+	if err := applyConfigs(rt, map[string]map[string]interface{}{
+		outboundsPath: config,
+		doc.path:      doc.config,
+	}); err != nil {
+		return PoolState{}, err
+	}
+
+	return PoolState{
+		Enabled:     true,
+		BalancerTag: p.BalancerTag,
+		Selector:    p.Selector,
+		RoutingFile: doc.path,
+	}, nil
+}
+
+// DisableNamedPool takes a named pool out: nodes, balancer, rules and its
+// observatory selector. Its traffic falls back to the main pool. It works from
+// the stored state, so a pool already gone from config.yaml can be removed.
+func DisableNamedPool(rt Runtime, outboundsPath string, state PoolState) error {
+	if !isNamedPoolTag(state.BalancerTag) || !isNamedPoolTag(state.Selector) {
+		return fmt.Errorf("это не именованный пул")
+	}
+
+	config, err := ReadOutboundsConfig(outboundsPath)
+	if err != nil {
+		return err
+	}
+	outbounds, ok := config["outbounds"].([]interface{})
+	if !ok {
+		return fmt.Errorf("outbounds не найдены в %s", outboundsPath)
+	}
+	config["outbounds"] = withPoolNodes(outbounds, state.Selector, nil)
+
+	doc, err := findRoutingDoc(rt, ruleTargetsBalancer(state.BalancerTag))
+	if err != nil {
+		return err
+	}
+	disableNamedRouting(doc, state.BalancerTag, state.Selector)
+
+	return applyConfigs(rt, map[string]map[string]interface{}{
+		outboundsPath: config,
+		doc.path:      doc.config,
+	})
+}
+
+// NamedSync is what refreshing one named pool did.
+type NamedSync struct {
+	Pool   string     `json:"pool"`
+	Result SyncResult `json:"result"`
+	Error  string     `json:"error,omitempty"`
+}
+
+// RefreshNamedPools brings every built named pool in line with the
+// subscription, each by its own rules. A pool that fails does not hold up the
+// others; one no longer in config.yaml is left as it is until disabled.
+func RefreshNamedPools(rt Runtime, cfg *models.Config, matcher *geoip.Matcher, sm *SubscriptionManager, store *PoolStore) []NamedSync {
+	names := store.EnabledNamed()
+	if len(names) == 0 {
+		return nil
+	}
+	pools, err := NamedPoolsFromConfig(cfg)
+	if err != nil {
+		log.Printf("[POOL] Пулы в config.yaml с ошибкой, не обновляю их: %v", err)
+		return nil
+	}
+
+	// The live path needs an api block the panel wrote; that is the main pool's
+	apiFile := store.Get().APIFile
+
+	var out []NamedSync
+	for _, p := range pools {
+		if !slices.Contains(names, p.Name) {
+			continue
+		}
+		state := store.GetPool(p.Name)
+		state.APIFile = apiFile
+		result, err := RefreshPool(rt, cfg.OutboundsFile, cfg.XrayAPIAddr, sm.GetServers(), state, p.Selection(cfg, matcher, sm))
+		sync := NamedSync{Pool: p.Name, Result: result}
+		if err != nil {
+			sync.Error = err.Error()
+		}
+		out = append(out, sync)
+	}
+	return out
+}
@@ -0,0 +1,193 @@
+package xkeen
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"xkeen-panel/internal/models"
+)
+
+func TestNamedPoolsFromConfig(t *testing.T) {
+	routed := models.PoolConfig{Name: "video", Domains: []string{"geosite:youtube"}}
+	pools, err := NamedPoolsFromConfig(&models.Config{Pools: []models.PoolConfig{routed}})
+	if err != nil {
+		t.Fatalf("NamedPoolsFromConfig: %v", err)
+	}
+	if pools[0].BalancerTag != "pool-video" || pools[0].Selector != "pool-video-" {
+		t.Errorf("pool = %+v, want pool-video tags", pools[0])
+	}
+
+	for name, pc := range map[string][]models.PoolConfig{
+		"dash in name":    {{Name: "eu-fast", Ports: "443"}},
+		"capitals":        {{Name: "Video", Ports: "443"}},
+		"no routing":      {{Name: "video"}},
+		"described twice": {routed, routed},
+		"bad strategy":    {{Name: "video", Ports: "443", Strategy: "fastest"}},
+		"bad rotate_at":   {{Name: "video", Ports: "443", Pin: models.PinPolicy{RotateAt: "4am"}}},
+	} {
+		if _, err := NamedPoolsFromConfig(&models.Config{Pools: pc}); err == nil {
+			t.Errorf("%s: accepted", name)
+		}
+	}
+}
+
+// A named pool replaces only its own nodes; the main pool and direct stay.
+func TestWithPoolNodesNamed(t *testing.T) {
+	outbounds := []interface{}{
+		map[string]interface{}{"tag": "proxy-1", "protocol": "vless"},
+		map[string]interface{}{"tag": "pool-video-1", "protocol": "vless"},
+		map[string]interface{}{"tag": "direct", "protocol": "freedom"},
+	}
+	nodes := []interface{}{
+		map[string]interface{}{"tag": "pool-video-2", "protocol": "vless"},
+		map[string]interface{}{"tag": "pool-video-3", "protocol": "vless"},
+	}
+
+	got := proxyOutboundTags(withPoolNodes(outbounds, "pool-video-", nodes))
+	want := []string{"proxy-1", "pool-video-2", "pool-video-3"}
+	if len(got) != len(want) {
+		t.Fatalf("proxies = %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("proxies = %v, want %v", got, want)
+		}
+	}
+
+	// Rebuilding the main pool leaves the named one alone
+	main := withPoolNodes(outbounds, "proxy-", []interface{}{map[string]interface{}{"tag": "proxy-9", "protocol": "vless"}})
+	if tags := proxyOutboundTags(main); len(tags) != 2 || tags[0] != "proxy-9" || tags[1] != "pool-video-1" {
+		t.Errorf("main rebuild = %v, want [proxy-9 pool-video-1]", tags)
+	}
+}
+
+func TestNamedRoutingRoundTrip(t *testing.T) {
+	doc := &routingDoc{config: map[string]interface{}{
+		"observatory": map[string]interface{}{"subjectSelector": []interface{}{"proxy-"}},
+	}}
+	doc.routing = map[string]interface{}{
+		"rules": []interface{}{
+			map[string]interface{}{"type": "field", "ip": []interface{}{"geoip:private"}, "outboundTag": "direct"},
+			map[string]interface{}{"type": "field", "inboundTag": []interface{}{"redirect"}, "balancerTag": "proxy"},
+		},
+		"balancers": []interface{}{balancerBlock("proxy", "proxy-", BalancerStrategy{})},
+	}
+	p := NamedPool{
+		PoolConfig:  models.PoolConfig{Name: "video", Domains: []string{"geosite:youtube"}, Ports: "443"},
+		BalancerTag: "pool-video",
+		Selector:    "pool-video-",
+	}
+
+	enableNamedRouting(doc, p, "proxy", BalancerStrategy{})
+	rules := asSlice(doc.routing["rules"])
+	if len(rules) != 4 {
+		t.Fatalf("rules = %v, want two pool rules added", rules)
+	}
+	for i, want := range []string{"", "pool-video", "pool-video", "proxy"} {
+		if got, _ := rules[i].(map[string]interface{})["balancerTag"].(string); got != want {
+			t.Errorf("rule %d goes to %q, want %q", i, got, want)
+		}
+	}
+	if len(asSlice(doc.routing["balancers"])) != 2 {
+		t.Errorf("balancers = %v, want the pool's added", doc.routing["balancers"])
+	}
+	observatory := doc.config["observatory"].(map[string]interface{})
+	if selectors := stringsOf(observatory["subjectSelector"]); len(selectors) != 2 || selectors[1] != "pool-video-" {
+		t.Errorf("observatory selectors = %v", selectors)
+	}
+
+	// Enabling again replaces rather than stacks
+	enableNamedRouting(doc, p, "proxy", BalancerStrategy{})
+	if n := len(asSlice(doc.routing["rules"])); n != 4 {
+		t.Errorf("rules after re-enable = %d, want 4", n)
+	}
+
+	disableNamedRouting(doc, p.BalancerTag, p.Selector)
+	if n := len(asSlice(doc.routing["rules"])); n != 2 {
+		t.Errorf("rules after disable = %d, want the original 2", n)
+	}
+	if n := len(asSlice(doc.routing["balancers"])); n != 1 {
+		t.Errorf("balancers after disable = %d, want 1", n)
+	}
+	if selectors := stringsOf(observatory["subjectSelector"]); len(selectors) != 1 || selectors[0] != "proxy-" {
+		t.Errorf("observatory selectors after disable = %v", selectors)
+	}
+}
+
+// The main pool is the balancer that is not a named pool's, whatever the order.
+func TestReadTopologyNamedPools(t *testing.T) {
+	rt := confDirFromFixtures(t, nil, map[string]string{
+		"04_outbounds.json": `{"outbounds":[
+			{"tag":"pool-video-1","protocol":"vless"},
+			{"tag":"proxy-1","protocol":"vless"},
+			{"tag":"proxy-2","protocol":"vless"},
+			{"tag":"direct","protocol":"freedom"}]}`,
+		"05_routing.json": `{"routing":{"balancers":[
+			{"tag":"pool-video","selector":["pool-video-"]},
+			{"tag":"proxy","selector":["proxy-"]}],
+			"rules":[{"inboundTag":["redirect"],"balancerTag":"proxy"}]}}`,
+	})
+
+	top := ReadTopology(rt)
+	if top.BalancerTag != "proxy" || len(top.PoolTags) != 2 {
+		t.Errorf("main = %q %v, want proxy with two nodes", top.BalancerTag, top.PoolTags)
+	}
+	video, ok := top.Balancer("pool-video")
+	if !ok || len(video.PoolTags) != 1 || video.PoolTags[0] != "pool-video-1" {
+		t.Errorf("pool-video = %+v, %v", video, ok)
+	}
+}
+
+func TestPoolStoreNamed(t *testing.T) {
+	dir := t.TempDir()
+	// A file from before named pools
+	if err := os.WriteFile(filepath.Join(dir, "pool.json"), []byte(`{"enabled":true,"balancer_tag":"proxy"}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+	store := NewPoolStore(dir)
+	if err := store.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !store.Get().Enabled || store.Get().BalancerTag != "proxy" {
+		t.Fatalf("main = %+v, want the old file read", store.Get())
+	}
+
+	if err := store.SetPool("video", PoolState{Enabled: true, BalancerTag: "pool-video"}); err != nil {
+		t.Fatalf("SetPool: %v", err)
+	}
+	if err := store.SetPinnedIn("video", "pool-video-2", "key"); err != nil {
+		t.Fatalf("SetPinnedIn: %v", err)
+	}
+
+	reloaded := NewPoolStore(dir)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if got := reloaded.GetPool("video"); got.PinnedTag != "pool-video-2" || reloaded.Get().PinnedTag != "" {
+		t.Errorf("video = %+v, main = %+v: pins mixed up", got, reloaded.Get())
+	}
+	if names := reloaded.EnabledNamed(); len(names) != 1 || names[0] != "video" {
+		t.Errorf("EnabledNamed = %v", names)
+	}
+
+	if err := reloaded.SetPool("video", PoolState{}); err != nil {
+		t.Fatalf("SetPool: %v", err)
+	}
+	if names := reloaded.EnabledNamed(); len(names) != 0 {
+		t.Errorf("EnabledNamed after disable = %v", names)
+	}
+}
+
+// Countries go by the exit when it is known.
+func TestPoolSelectionCountries(t *testing.T) {
+	servers := []models.Server{
+		{Protocol: "vless", RawURI: realityURI, Country: "NL", ExitCountry: "DE"},
+		{Protocol: "vless", RawURI: wsURI, Country: "DE"},
+		{Protocol: "vless", RawURI: steadyURI, Country: "DE", ExitCountry: "US"},
+	}
+	got := SelectPoolServers(servers, PoolSelection{Countries: []string{"de"}})
+	if len(got) != 2 || got[0].RawURI != realityURI || got[1].RawURI != wsURI {
+		t.Errorf("pool = %v, want the two servers leaving through DE", got)
+	}
+}
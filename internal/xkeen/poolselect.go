@@ -2,7 +2,6 @@ package xkeen
 
 import (
 	"log"
-	"sort"
 	"strings"
 	"time"
 
@@ -13,7 +12,7 @@ import (
 // DefaultPoolMaxNodes caps how many subscription servers end up in a pool.
 //
 // Every node is probed separately by observatory, so a pool built from a large
-// subscription turns into constant VLESS handshakes on a router that has better
+// subscription turns into constant proxy handshakes on a router that has better
 // things to do. A handful of the closest live nodes is what leastPing needs.
 const DefaultPoolMaxNodes = 10
 
@@ -25,13 +24,52 @@ type PoolSelection struct {
 	ProbeTimeout     time.Duration
 	ProbeConcurrency int
 
+	// Filter, when set, is a saved filter every pool node must match
+	Filter *models.ServerFilter
+
+	// Countries, when set, keeps only servers leaving through one of them
+	Countries []string
+
+	// RequireUDP keeps only servers whose UDP check passed
+	RequireUDP bool
+
+	// MinSpeedMbps leaves out servers whose recent speed test came out slower.
+	// Servers never tested are not held against it.
+	MinSpeedMbps float64
+
+	// Strategy is how the balancer picks among the selected nodes; a refresh
+	// brings the routing in line with it
+	Strategy BalancerStrategy
+
+	// Pin is the pin policy; its bypass traffic is routing, kept in line by a
+	// refresh the same way
+	Pin models.PinPolicy
+
+	// History records the probes; Scorer ranks the probed servers. Without a
+	// scorer they go by latency alone.
+	History *LatencyHistory
+	Scorer  Scorer
+
 	// Keep holds the endpoints already in the pool. They stay in it as long as
 	// they answer, so ordinary latency jitter cannot reshuffle membership.
 	Keep map[endpoint]bool
+
+	// noProbe ranks by the latencies already known instead of probing, for
+	// plans that must leave no trace
+	noProbe bool
+}
+
+// withoutProbes is the selection a plan uses: ranked by what is already
+// known, with nothing probed and nothing recorded into the history.
+func (sel PoolSelection) withoutProbes() PoolSelection {
+	sel.History = nil
+	sel.noProbe = true
+	return sel
 }
 
 // SelectPoolServers filters and ranks the subscription for pool membership:
-// VLESS only, no avoided countries, live first, closest first.
+// Renderable protocols only, no avoided countries, nothing the user excluded,
+// no set-aside duplicates, favourites always, then live first, higher priority first, best score first.
 //
 // The country filter matters because the balancer picks the node — an RU server
 // left in the pool is one the balancer may route through, whatever
@@ -44,10 +82,24 @@ func SelectPoolServers(servers []models.Server, sel PoolSelection) []models.Serv
 
 	var allowed []models.Server
 	for _, server := range servers {
-		if server.RawURI == "" || (server.Protocol != "" && server.Protocol != "vless") {
+		if server.RawURI == "" || !OutboundSupported(server) || server.Excluded {
 			continue
 		}
-		if sel.avoided(server) {
+		// A copy would take a slot and a probe of its own for the same node
+		if server.DuplicateOf != nil {
+			continue
+		}
+		// Pool membership is what is being decided, so a filter cannot ask for it
+		if sel.Filter != nil && !MatchesFilter(server, *sel.Filter, nil) {
+			continue
+		}
+		if sel.RequireUDP && !UDPCapable(server) {
+			continue
+		}
+		if sel.avoided(server) || !sel.inCountries(server) {
+			continue
+		}
+		if !server.Favorite && sel.tooSlow(server, time.Now()) {
 			continue
 		}
 		allowed = append(allowed, server)
@@ -57,20 +109,30 @@ func SelectPoolServers(servers []models.Server, sel PoolSelection) []models.Serv
 		return nil
 	}
 	if len(allowed) <= max && sel.ProbeTimeout <= 0 {
-		return allowed
+		return OrderByPreference(allowed)
 	}
 
-	ranked := sel.rankByLatency(allowed)
-	ranked = sel.incumbentsFirst(ranked)
-	if len(ranked) > max {
-		ranked = ranked[:max]
+	ranked := sel.rankByScore(allowed)
+	ranked = OrderByPreference(sel.incumbentsFirst(ranked))
+
+	// Favourites are in whatever the cap says; they lead the list
+	favorites := 0
+	for favorites < len(ranked) && ranked[favorites].Favorite {
+		favorites++
+	}
+	limit := max
+	if favorites > limit {
+		limit = favorites
+	}
+	if len(ranked) > limit {
+		ranked = ranked[:limit]
 	}
 
 	return ranked
 }
 
 // incumbentsFirst moves servers already in the pool ahead of newcomers, keeping
-// each group in latency order.
+// each group in score order.
 //
 // Ranking purely by latency meant a node could drop out of the pool because a
 // measurement wobbled by a few milliseconds. Every such reshuffle rewrote the
@@ -94,43 +156,54 @@ func (sel PoolSelection) incumbentsFirst(servers []models.Server) []models.Serve
 	return append(incumbents, newcomers...)
 }
 
-// rankByLatency probes the candidates and puts the responding ones first.
+// rankByScore probes the candidates and puts the responding ones first, best
+// score first.
 //
 // A probe failure is not proof a server is dead — the router's own uplink may be
 // down, which is exactly when a pool rebuild happens — so unreachable servers
 // are kept as a tail rather than dropped. An empty pool would be worse.
-func (sel PoolSelection) rankByLatency(servers []models.Server) []models.Server {
+func (sel PoolSelection) rankByScore(servers []models.Server) []models.Server {
 	if sel.ProbeTimeout <= 0 {
 		return servers
 	}
-
-	checked := CheckAllLatencies(servers, sel.ProbeTimeout, sel.ProbeConcurrency)
-
-	var live, dead []models.Server
-	for _, server := range checked {
-		if server.Latency >= 0 {
-			live = append(live, server)
-		} else {
-			dead = append(dead, server)
-		}
+	if sel.noProbe {
+		ranked, _ := RankServers(servers, sel.Scorer)
+		return ranked
 	}
 
-	sort.SliceStable(live, func(i, j int) bool { return live[i].Latency < live[j].Latency })
+	probe := LatencyProbe{Timeout: sel.ProbeTimeout, Concurrency: sel.ProbeConcurrency, History: sel.History}
+	ranked, scores := RankServers(probe.Check(servers), sel.Scorer)
 
-	if len(live) == 0 {
+	if len(scores) > 0 && !scores[0].Reachable {
 		log.Printf("[POOL] Ни один сервер не ответил на пинг — беру список как есть")
-		return dead
 	}
 
-	return append(live, dead...)
+	return ranked
+}
+
+// SpeedTestMaxAge is how long a speed test result counts for pool selection.
+// Speeds change with the time of day; a week-old result says little.
+const SpeedTestMaxAge = 24 * time.Hour
+
+func (sel PoolSelection) tooSlow(server models.Server, now time.Time) bool {
+	if sel.MinSpeedMbps <= 0 || server.Speed == nil || now.Sub(server.Speed.Time) > SpeedTestMaxAge {
+		return false
+	}
+	return server.Speed.Mbps < sel.MinSpeedMbps
 }
 
 func (sel PoolSelection) avoided(server models.Server) bool {
-	country := server.CountryOverride
-	if country == "" {
-		country = server.Country
+	// A manual override is the owner's decision and outranks any measurement
+	if server.CountryOverride != "" {
+		return sel.isAvoidedCode(server.CountryOverride)
+	}
+
+	// The exit is where traffic really leaves; once known, the entry does not count
+	if server.ExitCountry != "" {
+		return sel.isAvoidedCode(server.ExitCountry)
 	}
-	if country != "" && sel.isAvoidedCode(country) {
+
+	if country := server.Country; country != "" && sel.isAvoidedCode(country) {
 		return true
 	}
 
@@ -144,6 +217,17 @@ func (sel PoolSelection) avoided(server models.Server) bool {
 	return false
 }
 
+// inCountries reports whether the server leaves through one of the wanted
+// countries: the manual override when set, then its exit when known, its entry
+// otherwise.
+func (sel PoolSelection) inCountries(server models.Server) bool {
+	if len(sel.Countries) == 0 {
+		return true
+	}
+	country := effectiveCountry(server)
+	return country != "" && containsFold(sel.Countries, country)
+}
+
 func (sel PoolSelection) isAvoidedCode(code string) bool {
 	code = strings.ToUpper(strings.TrimSpace(code))
 	for _, avoided := range sel.AvoidCountries {
@@ -154,14 +238,38 @@ func (sel PoolSelection) isAvoidedCode(code string) bool {
 	return false
 }
 
-// PoolSelectionFromConfig builds the selection rules out of the panel config.
-func PoolSelectionFromConfig(cfg *models.Config, matcher *geoip.Matcher) PoolSelection {
+// PoolSelectionFromConfig builds the selection rules out of the panel config,
+// ranking by the score over the subscription's latency history and narrowing
+// to the saved filter pool_filter names. A filter that is not saved is logged
+// and ignored: a typo must not empty the pool.
+func PoolSelectionFromConfig(cfg *models.Config, matcher *geoip.Matcher, sm *SubscriptionManager) PoolSelection {
+	sel := basePoolSelection(cfg, matcher, sm)
+	sel.Strategy = BalancerStrategyFromConfig(cfg)
+	sel.Pin = cfg.PoolPin
+	if cfg.PoolFilter != "" {
+		if f, ok := sm.Filter(cfg.PoolFilter); ok {
+			sel.Filter = &f
+		} else {
+			log.Printf("[POOL] Фильтр %q из pool_filter не найден — пул из всех серверов", cfg.PoolFilter)
+		}
+	}
+	return sel
+}
+
+// basePoolSelection is what every pool shares: the panel-wide limits and the
+// scoring. Pool selection probes by connect, so it weighs connect times.
+func basePoolSelection(cfg *models.Config, matcher *geoip.Matcher, sm *SubscriptionManager) PoolSelection {
+	history := sm.LatencyHistory()
 	return PoolSelection{
 		MaxNodes:         cfg.PoolMaxNodes,
 		AvoidCountries:   cfg.AutoSwitchAvoidCountries,
 		GeoIP:            matcher,
 		ProbeTimeout:     time.Duration(cfg.ProbeTimeoutMs) * time.Millisecond,
 		ProbeConcurrency: cfg.ProbeConcurrency,
+		MinSpeedMbps:     cfg.PoolMinSpeedMbps,
+		RequireUDP:       cfg.PoolRequireUDP,
+		History:          history,
+		Scorer:           NewHistoryScorer(history, cfg.ScoreWeights, ProbeModeTCP),
 	}
 }
 
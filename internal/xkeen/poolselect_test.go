@@ -53,15 +53,22 @@ func TestSelectPoolServersHonoursCountryOverride(t *testing.T) {
 	}
 }
 
-func TestSelectPoolServersSkipsNonVLESS(t *testing.T) {
+func TestSelectPoolServersSkipsUnrenderable(t *testing.T) {
 	servers := []models.Server{
 		vlessAt("NL-1", "NL", "nl.example", 443),
-		{Name: "ss", Protocol: "shadowsocks", RawURI: "ss://x@h:1"},
+		{Name: "ss", Country: "NL", Protocol: "shadowsocks", RawURI: "ss://aes-256-gcm:secret@h:1"},
+		{Name: "socks", Country: "NL", Protocol: "socks", RawURI: "socks://h:1"},
 		{Name: "no-uri", Protocol: "vless"},
 	}
 
-	if got := SelectPoolServers(servers, PoolSelection{}); len(got) != 1 {
-		t.Errorf("selected %d, want only the VLESS entry", len(got))
+	got := SelectPoolServers(servers, PoolSelection{})
+	if len(got) != 2 {
+		t.Fatalf("selected %d, want the VLESS and Shadowsocks entries", len(got))
+	}
+	for _, server := range got {
+		if server.Name == "socks" || server.Name == "no-uri" {
+			t.Errorf("%s must not be in the pool", server.Name)
+		}
 	}
 }
 
@@ -4,7 +4,9 @@ import (
 	"encoding/json"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 )
 
 // PoolState remembers what the panel changed when it built a pool.
@@ -25,13 +27,24 @@ type PoolState struct {
 	// slots, not identities: a refresh can leave the tag in place and put a
 	// different server behind it, and then the pin silently means something else.
 	PinnedNode string `json:"pinned_node,omitempty"`
+	// PinnedAt is when the pin was set, which a scheduled rotation counts from
+	PinnedAt time.Time `json:"pinned_at,omitzero"`
 }
 
-// PoolStore persists PoolState next to the panel's other data.
+// PoolStore persists PoolState next to the panel's other data: the main pool
+// at the top of the file, named pools under "pools".
 type PoolStore struct {
 	dataDir string
 	mu      sync.RWMutex
 	state   PoolState
+	named   map[string]PoolState
+}
+
+// poolFile is pool.json. The main pool's fields stay at the top level, so a
+// file from before named pools reads the same.
+type poolFile struct {
+	PoolState
+	Pools map[string]PoolState `json:"pools,omitempty"`
 }
 
 func NewPoolStore(dataDir string) *PoolStore {
@@ -56,19 +69,50 @@ func (s *PoolStore) Load() error {
 		return err
 	}
 
-	return json.Unmarshal(data, &s.state)
+	var file poolFile
+	if err := json.Unmarshal(data, &file); err != nil {
+		return err
+	}
+	s.state, s.named = file.PoolState, file.Pools
+	return nil
 }
 
+// Get returns the main pool's state.
 func (s *PoolStore) Get() PoolState {
+	return s.GetPool("")
+}
+
+// Set replaces the main pool's state.
+func (s *PoolStore) Set(state PoolState) error {
+	return s.SetPool("", state)
+}
+
+// GetPool returns the state of a named pool; "" is the main one.
+func (s *PoolStore) GetPool(name string) PoolState {
 	s.mu.RLock()
 	defer s.mu.RUnlock()
-	return s.state
+	if name == "" {
+		return s.state
+	}
+	return s.named[name]
 }
 
-func (s *PoolStore) Set(state PoolState) error {
+// SetPool replaces the state of a named pool; "" is the main one. A disabled
+// named pool is forgotten.
+func (s *PoolStore) SetPool(name string, state PoolState) error {
 	s.mu.Lock()
-	s.state = state
-	data, err := json.MarshalIndent(state, "", "  ")
+	switch {
+	case name == "":
+		s.state = state
+	case state.Enabled:
+		if s.named == nil {
+			s.named = map[string]PoolState{}
+		}
+		s.named[name] = state
+	default:
+		delete(s.named, name)
+	}
+	data, err := json.MarshalIndent(poolFile{PoolState: s.state, Pools: s.named}, "", "  ")
 	s.mu.Unlock()
 
 	if err != nil {
@@ -81,12 +125,35 @@ func (s *PoolStore) Set(state PoolState) error {
 	return os.WriteFile(s.filePath(), data, 0600)
 }
 
+// EnabledNamed lists the named pools currently built, sorted.
+func (s *PoolStore) EnabledNamed() []string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	names := make([]string, 0, len(s.named))
+	for name, state := range s.named {
+		if state.Enabled {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
 // SetPinned records the pinned node so it can be re-applied after a restart —
 // a balancer override lives only in Xray's memory — and so that the tag moving
 // to a different server is detectable.
 func (s *PoolStore) SetPinned(tag, node string) error {
-	state := s.Get()
+	return s.SetPinnedIn("", tag, node)
+}
+
+// SetPinnedIn is SetPinned for a named pool.
+func (s *PoolStore) SetPinnedIn(name, tag, node string) error {
+	state := s.GetPool(name)
 	state.PinnedTag = tag
 	state.PinnedNode = node
-	return s.Set(state)
+	state.PinnedAt = time.Time{}
+	if tag != "" {
+		state.PinnedAt = time.Now()
+	}
+	return s.SetPool(name, state)
 }
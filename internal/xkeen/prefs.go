@@ -0,0 +1,144 @@
+package xkeen
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+
+	"xkeen-panel/internal/models"
+)
+
+// applyPrefsLocked copies the stored user attributes onto the servers. Prefs
+// are keyed by endpoint, so a refresh that renumbers or renames servers finds
+// them again. Duplicates are marked afresh, since prefs decide which server of
+// a group is kept. Call with sm.mu held.
+func (sm *SubscriptionManager) applyPrefsLocked() {
+	for i := range sm.data.Servers {
+		var prefs models.ServerPrefs
+		if key, ok := EndpointKey(sm.data.Servers[i]); ok {
+			prefs = sm.data.Prefs[key]
+		}
+		s := &sm.data.Servers[i]
+		s.Favorite = prefs.Favorite
+		s.Excluded = prefs.Excluded
+		s.CustomName = prefs.Name
+		s.Priority = prefs.Priority
+		s.Tags = slices.Clone(prefs.Tags)
+		s.ProbeMode = prefs.Probe
+	}
+	sm.markDuplicatesLocked()
+}
+
+// normalizeTags trims the tags and drops empty and repeated ones, keeping the
+// order they were given in.
+func normalizeTags(tags []string) []string {
+	var out []string
+	for _, tag := range tags {
+		tag = strings.TrimSpace(tag)
+		if tag != "" && !containsFold(out, tag) {
+			out = append(out, tag)
+		}
+	}
+	return out
+}
+
+// ServerPrefs returns the user attributes of a server.
+func (sm *SubscriptionManager) ServerPrefs(id int) (models.ServerPrefs, error) {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	if id < 0 || id >= len(sm.data.Servers) {
+		return models.ServerPrefs{}, fmt.Errorf("сервер с id %d не найден", id)
+	}
+	key, ok := EndpointKey(sm.data.Servers[id])
+	if !ok {
+		return models.ServerPrefs{}, nil
+	}
+	return sm.data.Prefs[key], nil
+}
+
+// SetServerPrefs changes the user attributes of a server; fields left nil stay
+// as they are. A server both favourite and excluded makes no sense, so setting
+// one clears the other.
+func (sm *SubscriptionManager) SetServerPrefs(id int, req models.SetServerPrefsRequest) (models.ServerPrefs, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	if id < 0 || id >= len(sm.data.Servers) {
+		return models.ServerPrefs{}, fmt.Errorf("сервер с id %d не найден", id)
+	}
+	key, ok := EndpointKey(sm.data.Servers[id])
+	if !ok {
+		return models.ServerPrefs{}, fmt.Errorf("у сервера %d не распознан адрес — настройки не к чему привязать", id)
+	}
+
+	prefs := sm.data.Prefs[key]
+	if req.Favorite != nil {
+		prefs.Favorite = *req.Favorite
+		if prefs.Favorite {
+			prefs.Excluded = false
+		}
+	}
+	if req.Excluded != nil {
+		prefs.Excluded = *req.Excluded
+		if prefs.Excluded {
+			prefs.Favorite = false
+		}
+	}
+	if req.Name != nil {
+		prefs.Name = strings.TrimSpace(*req.Name)
+	}
+	if req.Priority != nil {
+		prefs.Priority = *req.Priority
+	}
+	if req.Tags != nil {
+		prefs.Tags = normalizeTags(*req.Tags)
+	}
+	if req.Probe != nil {
+		switch probe := strings.ToLower(strings.TrimSpace(*req.Probe)); probe {
+		case "", ServerProbeTCP, ServerProbeQUIC:
+			prefs.Probe = probe
+		default:
+			return models.ServerPrefs{}, fmt.Errorf("неизвестный режим проверки %q: tcp, quic или пусто", *req.Probe)
+		}
+	}
+
+	if prefs.IsZero() {
+		delete(sm.data.Prefs, key)
+	} else {
+		if sm.data.Prefs == nil {
+			sm.data.Prefs = map[string]models.ServerPrefs{}
+		}
+		sm.data.Prefs[key] = prefs
+	}
+	sm.applyPrefsLocked()
+	return prefs, sm.writeLocked()
+}
+
+// DisplayName is the name the user gave a server, or the provider's.
+func DisplayName(s models.Server) string {
+	if s.CustomName != "" {
+		return s.CustomName
+	}
+	return s.Name
+}
+
+// OrderByPreference reorders ranked servers by what the user asked for:
+// favourites first whether or not they answered, then the live servers, then
+// the higher priority. Within each group the incoming order — the score — is
+// kept.
+func OrderByPreference(servers []models.Server) []models.Server {
+	out := append([]models.Server(nil), servers...)
+	sort.SliceStable(out, func(i, j int) bool {
+		a, b := out[i], out[j]
+		if a.Favorite != b.Favorite {
+			return a.Favorite
+		}
+		if live := a.Latency >= 0; live != (b.Latency >= 0) {
+			return live
+		}
+		return a.Priority > b.Priority
+	})
+	return out
+}
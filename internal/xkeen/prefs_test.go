@@ -0,0 +1,104 @@
+package xkeen
+
+import (
+	"strings"
+	"testing"
+
+	"xkeen-panel/internal/models"
+)
+
+// Prefs follow the endpoint: a refresh that adds a server in front and renames
+// this one must not lose them.
+func TestPrefsSurviveRenumberingRefresh(t *testing.T) {
+	srv, set := subServer(t, sampleSub())
+	sm := NewSubscriptionManager(t.TempDir())
+	servers, err := sm.UpdateURL(srv.URL)
+	if err != nil {
+		t.Fatalf("UpdateURL: %v", err)
+	}
+	finland := servers[3]
+
+	yes := true
+	name, priority := "Дача", 5
+	if _, err := sm.SetServerPrefs(finland.ID, models.SetServerPrefsRequest{Favorite: &yes, Name: &name, Priority: &priority}); err != nil {
+		t.Fatalf("SetServerPrefs: %v", err)
+	}
+
+	set(uriD + "\n" + strings.Replace(sampleSub(), "#Finland", "#Suomi", 1))
+	if _, err := sm.Refresh(); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	got := sm.GetServers()[4]
+	if got.Name != "Suomi" {
+		t.Fatalf("server 4 = %q, want the renamed Finland", got.Name)
+	}
+	if !got.Favorite || got.CustomName != "Дача" || got.Priority != 5 {
+		t.Errorf("prefs after refresh = %+v, want favourite, name and priority kept", got)
+	}
+
+	reloaded := NewSubscriptionManager(sm.dataDir)
+	if err := reloaded.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+	if !reloaded.GetServers()[4].Favorite {
+		t.Error("favourite lost across a restart")
+	}
+}
+
+func TestSetServerPrefsExcludeClearsFavourite(t *testing.T) {
+	srv, _ := subServer(t, sampleSub())
+	sm := NewSubscriptionManager(t.TempDir())
+	if _, err := sm.UpdateURL(srv.URL); err != nil {
+		t.Fatalf("UpdateURL: %v", err)
+	}
+
+	yes, no := true, false
+	sm.SetServerPrefs(0, models.SetServerPrefsRequest{Favorite: &yes})
+	prefs, err := sm.SetServerPrefs(0, models.SetServerPrefsRequest{Excluded: &yes})
+	if err != nil {
+		t.Fatalf("SetServerPrefs: %v", err)
+	}
+	if prefs.Favorite || !prefs.Excluded {
+		t.Errorf("prefs = %+v, want excluded and no longer favourite", prefs)
+	}
+
+	// Clearing everything drops the entry rather than storing zeros
+	sm.SetServerPrefs(0, models.SetServerPrefsRequest{Excluded: &no})
+	if len(sm.GetData().Prefs) != 0 {
+		t.Errorf("prefs = %v, want the emptied entry removed", sm.GetData().Prefs)
+	}
+}
+
+func TestOrderByPreference(t *testing.T) {
+	servers := []models.Server{
+		{Name: "best", Latency: 50},
+		{Name: "priority", Latency: 200, Priority: 1},
+		{Name: "dead favourite", Latency: -1, Favorite: true},
+		{Name: "dead priority", Latency: -1, Priority: 9},
+		{Name: "second", Latency: 80},
+	}
+
+	var got []string
+	for _, s := range OrderByPreference(servers) {
+		got = append(got, s.Name)
+	}
+	want := []string{"dead favourite", "priority", "best", "second", "dead priority"}
+	if strings.Join(got, ",") != strings.Join(want, ",") {
+		t.Errorf("order = %v, want %v", got, want)
+	}
+}
+
+func TestPoolSelectionHonoursPrefs(t *testing.T) {
+	servers := []models.Server{
+		{Protocol: "vless", RawURI: realityURI, Latency: 50, Excluded: true},
+		{Protocol: "vless", RawURI: wsURI, Latency: 90},
+		{Protocol: "vless", RawURI: steadyURI, Latency: 300, Favorite: true},
+		{Protocol: "vless", RawURI: uriD, Latency: 60},
+	}
+
+	got := SelectPoolServers(servers, PoolSelection{MaxNodes: 2})
+	if len(got) != 2 || got[0].RawURI != steadyURI || got[1].RawURI != wsURI {
+		t.Errorf("pool = %v, want the favourite first, then the first allowed server, no excluded one", got)
+	}
+}
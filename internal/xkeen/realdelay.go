@@ -0,0 +1,389 @@
+package xkeen
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+// Latency probe modes (config.yaml latency_probe).
+const (
+	ProbeModeTCP  = "tcp"
+	ProbeModeReal = "real"
+)
+
+// DefaultRealDelayTimeout bounds one request through a node. It covers the
+// node's own handshake as well as the request, so it is far above a TCP connect.
+const DefaultRealDelayTimeout = 5 * time.Second
+
+// realDelayStartup is how long the throwaway core gets to open its inbounds.
+const realDelayStartup = 5 * time.Second
+
+// LatencyProbe says how servers are measured.
+//
+// A TCP connect only shows that something listens on the port: a node with an
+// expired account or a broken upstream answers it as fast as a healthy one. The
+// real delay fetches a URL through the node itself, so a number means the node
+// actually carried a request.
+type LatencyProbe struct {
+	Real          bool
+	Runtime       Runtime
+	OutboundsPath string // the sockopt of its proxy outbound is copied onto every probe
+	URL           string
+	Timeout       time.Duration // TCP connect and handshake probes
+	RealTimeout   time.Duration // one request through a node
+	Concurrency   int
+	History       *LatencyHistory // every result is recorded here when set
+}
+
+// LatencyProbeFromConfig builds the probe the config asks for, recording into
+// history.
+func LatencyProbeFromConfig(cfg *models.Config, rt Runtime, history *LatencyHistory) LatencyProbe {
+	return LatencyProbe{
+		Real:          cfg.LatencyProbe == ProbeModeReal,
+		Runtime:       rt,
+		OutboundsPath: cfg.OutboundsFile,
+		URL:           cfg.LatencyProbeURL,
+		Timeout:       time.Duration(cfg.ProbeTimeoutMs) * time.Millisecond,
+		RealTimeout:   time.Duration(cfg.LatencyProbeTimeoutMs) * time.Millisecond,
+		Concurrency:   cfg.ProbeConcurrency,
+		History:       history,
+	}
+}
+
+// Check returns copies of the servers with Latency filled in.
+func (p LatencyProbe) Check(servers []models.Server) []models.Server {
+	result := make([]models.Server, len(servers))
+	copy(result, servers)
+	p.Each(servers, func(idx, latency int) {
+		result[idx].Latency = latency
+	})
+	return result
+}
+
+// Each measures every server and reports each result as soon as it is known;
+// report may be called from several goroutines at once. -1 means the server
+// did not answer.
+//
+// With the real delay on, servers the throwaway core cannot carry, and every
+// server when it does not start at all, fall back to the transport probe.
+func (p LatencyProbe) Each(servers []models.Server, report func(idx, latency int)) {
+	// The history files each result under the probe that took it
+	record := func(idx, latency int, kind string) {
+		if p.History != nil {
+			measured := servers[idx]
+			measured.Latency = latency
+			p.History.Record([]models.Server{measured}, kind, time.Now())
+		}
+		report(idx, latency)
+	}
+
+	if p.Real {
+		err := p.realDelays(servers, record)
+		if err == nil {
+			return
+		}
+		Log("[PROBE] Реальная задержка недоступна, проверяю подключением: %v", err)
+	}
+	p.transportDelays(servers, nil, record)
+}
+
+// kindReport takes a result together with the kind of probe that took it.
+type kindReport func(idx, latency int, kind string)
+
+// transportDelays runs CheckServerLatency over the servers, or over only the
+// listed indexes when there are any.
+func (p LatencyProbe) transportDelays(servers []models.Server, only []int, report kindReport) {
+	if only == nil {
+		only = make([]int, len(servers))
+		for i := range servers {
+			only[i] = i
+		}
+	}
+
+	parallel(only, p.Concurrency, func(idx int) {
+		report(idx, CheckServerLatency(servers[idx], p.Timeout), ProbeModeTCP)
+	})
+}
+
+// parallel runs fn over the indexes with at most concurrency at a time.
+func parallel(indexes []int, concurrency int, fn func(idx int)) {
+	if concurrency <= 0 {
+		concurrency = 20
+	}
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, concurrency)
+	for _, idx := range indexes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(idx int) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			fn(idx)
+		}(idx)
+	}
+	wg.Wait()
+}
+
+// realDelays starts one throwaway xray with a local socks inbound per node,
+// each routed to that node's outbound, and fetches the probe URL through every
+// inbound. The running core is never touched: a probe cannot disturb live
+// traffic, and a node that breaks xray only breaks the throwaway instance.
+func (p LatencyProbe) realDelays(servers []models.Server, report kindReport) error {
+	if err := checkProbeCore(p.Runtime); err != nil {
+		return err
+	}
+
+	var nodes []int
+	var fallback []int
+	var outbounds []map[string]interface{}
+	template := probeTemplate(p.OutboundsPath)
+	for i, s := range servers {
+		ob, ok := probeOutbound(s, template)
+		if !ok {
+			fallback = append(fallback, i)
+			continue
+		}
+		nodes = append(nodes, i)
+		outbounds = append(outbounds, ob)
+	}
+	if len(nodes) == 0 {
+		p.transportDelays(servers, fallback, report)
+		return nil
+	}
+
+	ports, err := freePorts(len(nodes))
+	if err != nil {
+		return err
+	}
+
+	stop, err := startProbeCore(p.Runtime.CoreBin, realDelayConfig(outbounds, ports), ports[0])
+	if err != nil {
+		return err
+	}
+	defer stop()
+
+	target := p.URL
+	if target == "" {
+		target = defaultProbeURL
+	}
+	timeout := p.RealTimeout
+	if timeout <= 0 {
+		timeout = DefaultRealDelayTimeout
+	}
+
+	positions := make([]int, len(nodes))
+	for i := range positions {
+		positions[i] = i
+	}
+	parallel(positions, p.Concurrency, func(n int) {
+		proxy := &url.URL{Scheme: "socks5", Host: fmt.Sprintf("127.0.0.1:%d", ports[n])}
+		report(nodes[n], fetchThrough(proxy, target, timeout), ProbeModeReal)
+	})
+
+	if len(fallback) > 0 {
+		p.transportDelays(servers, fallback, report)
+	}
+	return nil
+}
+
+// checkProbeCore says why no throwaway core can be started, if it cannot.
+func checkProbeCore(rt Runtime) error {
+	if rt.Core != CoreXray {
+		return fmt.Errorf("нужно ядро xray, активно %s", rt.Core)
+	}
+	if _, err := os.Stat(rt.CoreBin); err != nil {
+		return fmt.Errorf("бинарь xray не найден (%s)", rt.CoreBin)
+	}
+	return nil
+}
+
+// probeOutbound renders the outbound a throwaway core reaches the server with;
+// false when xray cannot carry it.
+func probeOutbound(server models.Server, template map[string]interface{}) (map[string]interface{}, bool) {
+	if !OutboundSupported(server) {
+		return nil, false
+	}
+	params, err := ParseProxyURI(server.RawURI)
+	if err != nil {
+		return nil, false
+	}
+	return mergeOutbound(template, buildOutboundFromURI(params, "", detectOutboundFormat(template))), true
+}
+
+// probeTemplate keeps only the sockopt of the live proxy outbound: XKeen marks
+// the core's own traffic with it so the transparent proxy lets it out, and the
+// throwaway core's traffic needs the same pass.
+func probeTemplate(outboundsPath string) map[string]interface{} {
+	if outboundsPath == "" {
+		return nil
+	}
+	config, err := ReadOutboundsConfig(outboundsPath)
+	if err != nil {
+		return nil
+	}
+	outbounds, _ := config["outbounds"].([]interface{})
+	_, ob := findProxyOutbound(outbounds)
+	sockopt := mapOf(mapOf(ob["streamSettings"])["sockopt"])
+	if sockopt == nil {
+		return nil
+	}
+	return map[string]interface{}{"streamSettings": map[string]interface{}{"sockopt": sockopt}}
+}
+
+// realDelayConfig wires inbound probe-in-N to outbound probe-N.
+func realDelayConfig(outbounds []map[string]interface{}, ports []int) map[string]interface{} {
+	inbounds := make([]interface{}, 0, len(outbounds))
+	obs := make([]interface{}, 0, len(outbounds))
+	rules := make([]interface{}, 0, len(outbounds))
+
+	for i, ob := range outbounds {
+		inTag := fmt.Sprintf("probe-in-%d", i)
+		outTag := fmt.Sprintf("probe-%d", i)
+
+		inbounds = append(inbounds, map[string]interface{}{
+			"tag":      inTag,
+			"listen":   "127.0.0.1",
+			"port":     ports[i],
+			"protocol": "socks",
+			"settings": map[string]interface{}{"auth": "noauth", "udp": false},
+		})
+		ob["tag"] = outTag
+		obs = append(obs, ob)
+		rules = append(rules, map[string]interface{}{
+			"type":        "field",
+			"inboundTag":  []string{inTag},
+			"outboundTag": outTag,
+		})
+	}
+
+	return map[string]interface{}{
+		"log":       map[string]interface{}{"loglevel": "none"},
+		"inbounds":  inbounds,
+		"outbounds": obs,
+		"routing":   map[string]interface{}{"rules": rules},
+	}
+}
+
+// freePorts reserves n loopback ports. Every listener stays open until all are
+// picked, so the kernel cannot hand out the same port twice.
+func freePorts(n int) ([]int, error) {
+	listeners := make([]net.Listener, 0, n)
+	defer func() {
+		for _, l := range listeners {
+			l.Close()
+		}
+	}()
+
+	ports := make([]int, 0, n)
+	for range n {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			return nil, fmt.Errorf("нет свободного порта для проверки: %w", err)
+		}
+		listeners = append(listeners, l)
+		ports = append(ports, l.Addr().(*net.TCPAddr).Port)
+	}
+	return ports, nil
+}
+
+// startProbeCore runs the core on a temporary config and waits until it
+// listens. stop kills it and removes the config.
+func startProbeCore(coreBin string, config map[string]interface{}, readyPort int) (stop func(), err error) {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.CreateTemp("", "xkeen-panel-probe-*.json")
+	if err != nil {
+		return nil, err
+	}
+	path := file.Name()
+	_, err = file.Write(data)
+	file.Close()
+	if err != nil {
+		os.Remove(path)
+		return nil, err
+	}
+
+	var output bytes.Buffer
+	cmd := exec.Command(coreBin, "run", "-c", path)
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+	if err := cmd.Start(); err != nil {
+		os.Remove(path)
+		return nil, fmt.Errorf("запуск xray для проверки: %w", err)
+	}
+
+	exited := make(chan struct{})
+	go func() {
+		cmd.Wait()
+		close(exited)
+	}()
+	stop = func() {
+		cmd.Process.Kill()
+		<-exited
+		os.Remove(path)
+	}
+
+	deadline := time.Now().Add(realDelayStartup)
+	for time.Now().Before(deadline) {
+		select {
+		case <-exited:
+			os.Remove(path)
+			return nil, fmt.Errorf("xray для проверки завершился: %s", TailLines(strings.TrimSpace(output.String()), 2))
+		default:
+		}
+		if conn, err := net.DialTimeout("tcp", fmt.Sprintf("127.0.0.1:%d", readyPort), 200*time.Millisecond); err == nil {
+			conn.Close()
+			return stop, nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	stop()
+	return nil, fmt.Errorf("xray для проверки не открыл порт за %s", realDelayStartup)
+}
+
+// fetchThrough times a GET of target through the proxy, from the first byte
+// sent to the response headers. The connection is never reused, so the time
+// includes the node's handshake — what a new connection of a client pays.
+// Anything but a 2xx or 3xx answer counts as a failure.
+func fetchThrough(proxy *url.URL, target string, timeout time.Duration) int {
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			Proxy:             http.ProxyURL(proxy),
+			DisableKeepAlives: true,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	start := time.Now()
+	resp, err := client.Get(target)
+	if err != nil {
+		return -1
+	}
+	elapsed := time.Since(start)
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+
+	if resp.StatusCode >= 400 {
+		return -1
+	}
+	return int(elapsed.Milliseconds())
+}
@@ -0,0 +1,145 @@
+package xkeen
+
+import (
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+// proxyStub answers every request sent through it as an HTTP proxy with the
+// given status, standing in for the socks inbound of the throwaway core.
+func proxyStub(t *testing.T, status int) *url.URL {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.URL.IsAbs() {
+			http.Error(w, "not a proxy request", http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(status)
+	}))
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	return u
+}
+
+func TestFetchThrough(t *testing.T) {
+	if got := fetchThrough(proxyStub(t, http.StatusNoContent), "http://probe.example/generate_204", time.Second); got < 0 {
+		t.Errorf("204 through the node = %d, want a latency", got)
+	}
+
+	// The node answered, but with an error page: it is not carrying traffic
+	if got := fetchThrough(proxyStub(t, http.StatusBadGateway), "http://probe.example/generate_204", time.Second); got != -1 {
+		t.Errorf("502 through the node = %d, want -1", got)
+	}
+
+	dead := &url.URL{Scheme: "socks5", Host: "127.0.0.1:1"}
+	if got := fetchThrough(dead, "http://probe.example/", time.Second); got != -1 {
+		t.Errorf("unreachable proxy = %d, want -1", got)
+	}
+}
+
+// Every node gets its own inbound, routed to its own outbound and nowhere else.
+func TestRealDelayConfigWiresInboundToOutbound(t *testing.T) {
+	p, err := ParseProxyURI(realityURI)
+	if err != nil {
+		t.Fatalf("ParseProxyURI: %v", err)
+	}
+	outbounds := []map[string]interface{}{
+		buildOutboundFromURI(p, "", formatVNext),
+		buildOutboundFromURI(p, "", formatVNext),
+	}
+
+	config := realDelayConfig(outbounds, []int{20001, 20002})
+
+	inbounds := config["inbounds"].([]interface{})
+	obs := config["outbounds"].([]interface{})
+	rules := config["routing"].(map[string]interface{})["rules"].([]interface{})
+	if len(inbounds) != 2 || len(obs) != 2 || len(rules) != 2 {
+		t.Fatalf("inbounds/outbounds/rules = %d/%d/%d, want 2 each", len(inbounds), len(obs), len(rules))
+	}
+
+	for i := range inbounds {
+		in := inbounds[i].(map[string]interface{})
+		rule := rules[i].(map[string]interface{})
+		ob := obs[i].(map[string]interface{})
+
+		if in["listen"] != "127.0.0.1" || in["protocol"] != "socks" {
+			t.Errorf("inbound %d = %v, want a loopback socks inbound", i, in)
+		}
+		if in["port"] != 20001+i {
+			t.Errorf("inbound %d port = %v", i, in["port"])
+		}
+		if rule["inboundTag"].([]string)[0] != in["tag"] || rule["outboundTag"] != ob["tag"] {
+			t.Errorf("rule %d = %v does not tie %v to %v", i, rule, in["tag"], ob["tag"])
+		}
+	}
+}
+
+// The throwaway core's traffic must carry the mark XKeen lets out, or the
+// transparent proxy loops it back into the live core.
+func TestProbeTemplateKeepsOnlySockopt(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "04_outbounds.json")
+	initial := `{"outbounds":[
+		{"tag":"vless-reality","protocol":"vless",
+		 "settings":{"address":"old.example.com","port":443,"id":"old-uuid"},
+		 "streamSettings":{"network":"raw","security":"tls","sockopt":{"mark":255}},
+		 "mux":{"enabled":true}},
+		{"protocol":"freedom","tag":"direct"}]}`
+	if err := os.WriteFile(path, []byte(initial), 0644); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	template := probeTemplate(path)
+	if _, ok := template["mux"]; ok {
+		t.Error("mux of the live outbound leaked into the probe")
+	}
+	ss := mapOf(template["streamSettings"])
+	if len(ss) != 1 || mapOf(ss["sockopt"])["mark"] != float64(255) {
+		t.Errorf("streamSettings = %v, want only the sockopt", ss)
+	}
+
+	if probeTemplate(filepath.Join(t.TempDir(), "missing.json")) != nil {
+		t.Error("a missing config must give no template")
+	}
+}
+
+// Without xray there is nothing to fetch through: the probe falls back to the
+// transport check instead of failing every server.
+func TestRealDelayFallsBackWithoutXray(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	port := ln.Addr().(*net.TCPAddr).Port
+
+	servers := []models.Server{{
+		Protocol: "vless",
+		Address:  "127.0.0.1",
+		Port:     port,
+		RawURI:   "vless://id@127.0.0.1:" + strconv.Itoa(port) + "?type=tcp",
+	}}
+	probe := LatencyProbe{Real: true, Runtime: Runtime{Core: CoreMihomo}, Timeout: time.Second}
+
+	checked := probe.Check(servers)
+	if checked[0].Latency < 0 {
+		t.Errorf("latency = %d, want the TCP fallback to reach the listener", checked[0].Latency)
+	}
+}
@@ -0,0 +1,103 @@
+package xkeen
+
+import (
+	"encoding/json"
+	"errors"
+	"net/url"
+	"strings"
+	"unicode/utf8"
+)
+
+const redacted = "***"
+
+// maxRedactedLen keeps a garbage line — a whole HTML page on one line — from
+// bloating the stored report.
+const maxRedactedLen = 200
+
+// secretParams are the query keys that carry credentials in share links.
+var secretParams = map[string]bool{
+	"password":       true,
+	"obfs-password":  true,
+	"auth":           true,
+	"token":          true,
+	"privatekey":     true,
+	"private-key":    true,
+	"presharedkey":   true,
+	"pre-shared-key": true,
+	"uuid":           true,
+	"id":             true,
+}
+
+// redactLine masks the credentials of a share link, keeping what identifies
+// the server: scheme, host, port, transport options and name.
+func redactLine(line string) string {
+	scheme, rest, found := strings.Cut(line, "://")
+	if !found {
+		return truncate(line)
+	}
+
+	// The whole vmess link is base64 JSON; rebuild it from the harmless fields
+	if scheme == "vmess" {
+		if decoded, err := decodeBase64(rest); err == nil {
+			var doc map[string]interface{}
+			if json.Unmarshal(decoded, &doc) == nil {
+				m := docMap(doc)
+				return truncate("vmess://" + redacted + "@" + m.str("add") + ":" + m.str("port") + "#" + m.str("ps"))
+			}
+		}
+		return "vmess://" + redacted
+	}
+
+	// Legacy ss://base64(method:password@host:port) hides everything
+	if scheme == "ss" && !strings.Contains(rest, "@") {
+		return "ss://" + redacted
+	}
+
+	u, err := url.Parse(line)
+	if err != nil || u.Host == "" {
+		return scheme + "://" + redacted
+	}
+
+	var b strings.Builder
+	b.WriteString(scheme + "://")
+	if u.User != nil {
+		b.WriteString(redacted + "@")
+	}
+	b.WriteString(u.Host)
+	b.WriteString(u.EscapedPath())
+
+	if query := u.Query(); len(query) > 0 {
+		for key := range query {
+			if secretParams[strings.ToLower(key)] {
+				query.Set(key, redacted)
+			}
+		}
+		b.WriteString("?" + strings.ReplaceAll(query.Encode(), url.QueryEscape(redacted), redacted))
+	}
+	if u.Fragment != "" {
+		b.WriteString("#" + u.Fragment)
+	}
+
+	return truncate(b.String())
+}
+
+// errorText drops the URL that net/url errors quote in full — with the
+// credentials in it.
+func errorText(err error) string {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		return urlErr.Err.Error()
+	}
+	return err.Error()
+}
+
+func truncate(s string) string {
+	if len(s) <= maxRedactedLen {
+		return s
+	}
+	cut := maxRedactedLen
+	for cut > 0 && !utf8.RuneStart(s[cut]) {
+		cut--
+	}
+	return s[:cut] + "…"
+}
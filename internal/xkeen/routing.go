@@ -1,7 +1,10 @@
 package xkeen
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
+	"slices"
 )
 
 // routingDoc is a config file that carries a routing section.
@@ -101,7 +104,7 @@ func retargetRules(routing map[string]interface{}, from, to string, toBalancer b
 }
 
 // enableBalancerRouting installs the balancer and points the proxy rules at it.
-func enableBalancerRouting(doc *routingDoc, balancerTag, selector string, proxyTags []string, nodes int) error {
+func enableBalancerRouting(doc *routingDoc, balancerTag, selector string, proxyTags []string, nodes int, strategy BalancerStrategy) error {
 	changed := 0
 	for _, tag := range proxyTags {
 		changed += retargetRules(doc.routing, tag, balancerTag, true)
@@ -110,26 +113,14 @@ func enableBalancerRouting(doc *routingDoc, balancerTag, selector string, proxyT
 		return fmt.Errorf("в %s нет правил, ведущих на прокси-outbound — маршрутизацию нужно настроить вручную", doc.path)
 	}
 
-	balancers := asSlice(doc.routing["balancers"])
-	replaced := false
-	for i, raw := range balancers {
-		if b, ok := raw.(map[string]interface{}); ok {
-			if tag, _ := b["tag"].(string); tag == balancerTag {
-				balancers[i] = balancerBlock(balancerTag, selector)
-				replaced = true
-				break
-			}
-		}
-	}
-	if !replaced {
-		balancers = append(balancers, balancerBlock(balancerTag, selector))
-	}
-	doc.routing["balancers"] = balancers
+	putBalancer(doc.routing, balancerBlock(balancerTag, selector, strategy))
 
 	// observatory is a top-level key, not part of routing
-	if _, exists := doc.config["observatory"]; !exists {
-		doc.config["observatory"] = observatoryBlock(selector, nodes)
+	if key, _ := currentObservatory(doc.config); key == "" {
+		key = neededObservatory(doc.routing)
+		doc.config[key] = observatoryBlock(key, []interface{}{selector}, probeIntervalFor(nodes))
 	}
+	fitObservatory(doc)
 
 	doc.config["routing"] = doc.routing
 
@@ -142,6 +133,8 @@ func disableBalancerRouting(doc *routingDoc, balancerTag, outboundTag string) er
 	if changed := retargetRules(doc.routing, balancerTag, outboundTag, false); changed == 0 {
 		return fmt.Errorf("в %s нет правил, ведущих на балансировщик %q", doc.path, balancerTag)
 	}
+	// Traffic that skipped the pin goes back to the outbound with the rest
+	removeBypass(doc.routing, balancerTag)
 
 	var kept []interface{}
 	for _, raw := range asSlice(doc.routing["balancers"]) {
@@ -154,12 +147,169 @@ func disableBalancerRouting(doc *routingDoc, balancerTag, outboundTag string) er
 	}
 	if len(kept) == 0 {
 		delete(doc.routing, "balancers")
-		delete(doc.config, "observatory")
+		delete(doc.config, observatoryKey)
+		delete(doc.config, burstObservatoryKey)
 	} else {
 		doc.routing["balancers"] = kept
+		fitObservatory(doc)
 	}
 
 	doc.config["routing"] = doc.routing
 
 	return nil
 }
+
+// putBalancer replaces the balancer with the block's tag, or adds it.
+func putBalancer(routing map[string]interface{}, block map[string]interface{}) {
+	balancers := asSlice(routing["balancers"])
+	for i, raw := range balancers {
+		if b, ok := raw.(map[string]interface{}); ok && b["tag"] == block["tag"] {
+			balancers[i] = block
+			routing["balancers"] = balancers
+			return
+		}
+	}
+	routing["balancers"] = append(balancers, block)
+}
+
+// enableNamedRouting installs a named pool's balancer and rules. The rules go
+// right before the first one leading to the main pool: rules are tried in
+// order, so ahead of the catch-all proxy rules they take the pool's traffic,
+// while the owner's direct and block rules above still win.
+func enableNamedRouting(doc *routingDoc, p NamedPool, mainBalancer string, strategy BalancerStrategy) {
+	removeBalancerRules(doc.routing, p.BalancerTag)
+
+	rules := asSlice(doc.routing["rules"])
+	at := len(rules)
+	for i, raw := range rules {
+		if rule, ok := raw.(map[string]interface{}); ok && ruleTargetsBalancer(mainBalancer)(rule) {
+			at = i
+			break
+		}
+	}
+	doc.routing["rules"] = slices.Concat(rules[:at], p.routingRules(), rules[at:])
+	putBalancer(doc.routing, balancerBlock(p.BalancerTag, p.Selector, strategy))
+
+	// One observatory probes for every pool
+	key, observatory := currentObservatory(doc.config)
+	if observatory == nil {
+		key = neededObservatory(doc.routing)
+		observatory = observatoryBlock(key, nil, defaultProbeEvery)
+	}
+	selectors := asSlice(observatory["subjectSelector"])
+	if !slices.Contains(stringsOf(selectors), p.Selector) {
+		observatory["subjectSelector"] = append(selectors, p.Selector)
+	}
+	doc.config[key] = observatory
+	fitObservatory(doc)
+	doc.config["routing"] = doc.routing
+}
+
+// disableNamedRouting removes what enableNamedRouting installed.
+func disableNamedRouting(doc *routingDoc, balancerTag, selector string) {
+	removeBalancerRules(doc.routing, balancerTag)
+	removeBypass(doc.routing, balancerTag)
+
+	var kept []interface{}
+	for _, raw := range asSlice(doc.routing["balancers"]) {
+		if b, ok := raw.(map[string]interface{}); ok && b["tag"] == balancerTag {
+			continue
+		}
+		kept = append(kept, raw)
+	}
+	doc.routing["balancers"] = kept
+
+	if _, observatory := currentObservatory(doc.config); observatory != nil {
+		var selectors []interface{}
+		for _, s := range stringsOf(observatory["subjectSelector"]) {
+			if s != selector {
+				selectors = append(selectors, s)
+			}
+		}
+		observatory["subjectSelector"] = selectors
+	}
+	// The pool may have been the one that needed burstObservatory
+	fitObservatory(doc)
+	doc.config["routing"] = doc.routing
+}
+
+// setBalancerStrategy rewrites a balancer's strategy when it differs from the
+// wanted one. Reports whether it did.
+func setBalancerStrategy(routing map[string]interface{}, balancerTag string, strategy BalancerStrategy) bool {
+	for _, raw := range asSlice(routing["balancers"]) {
+		b, ok := raw.(map[string]interface{})
+		if !ok || b["tag"] != balancerTag {
+			continue
+		}
+		want := strategy.block()
+		if sameJSON(b["strategy"], want) {
+			return false
+		}
+		b["strategy"] = want
+		return true
+	}
+	return false
+}
+
+// neededObservatory is the observatory the balancers in routing need:
+// leastLoad ranks by burstObservatory's samples, the other strategies read
+// plain observatory. Xray runs one of the two, so a single leastLoad pool makes
+// it burstObservatory for every pool.
+func neededObservatory(routing map[string]interface{}) string {
+	for _, raw := range asSlice(routing["balancers"]) {
+		b, _ := raw.(map[string]interface{})
+		if strategy, _ := b["strategy"].(map[string]interface{}); strategy["type"] == StrategyLeastLoad {
+			return burstObservatoryKey
+		}
+	}
+	return observatoryKey
+}
+
+// currentObservatory returns whichever observatory the config has, "" and nil
+// for none.
+func currentObservatory(config map[string]interface{}) (string, map[string]interface{}) {
+	for _, key := range []string{observatoryKey, burstObservatoryKey} {
+		if block, ok := config[key].(map[string]interface{}); ok {
+			return key, block
+		}
+	}
+	return "", nil
+}
+
+// fitObservatory swaps the observatory for the kind the balancers need, keeping
+// its selectors and interval. A config without one is left without. Reports
+// whether it changed.
+func fitObservatory(doc *routingDoc) bool {
+	key, block := currentObservatory(doc.config)
+	want := neededObservatory(doc.routing)
+	if block == nil || key == want {
+		return false
+	}
+	interval := observatoryInterval(key, block)
+	if interval == "" {
+		interval = defaultProbeEvery
+	}
+	delete(doc.config, key)
+	doc.config[want] = observatoryBlock(want, asSlice(block["subjectSelector"]), interval)
+	return true
+}
+
+// sameJSON compares two config values the way they end up in the file, so a
+// freshly built block equals the one parsed back.
+func sameJSON(a, b interface{}) bool {
+	x, errA := json.Marshal(a)
+	y, errB := json.Marshal(b)
+	return errA == nil && errB == nil && bytes.Equal(x, y)
+}
+
+// removeBalancerRules drops the rules leading to a balancer.
+func removeBalancerRules(routing map[string]interface{}, balancerTag string) {
+	var kept []interface{}
+	for _, raw := range asSlice(routing["rules"]) {
+		if rule, ok := raw.(map[string]interface{}); ok && ruleTargetsBalancer(balancerTag)(rule) {
+			continue
+		}
+		kept = append(kept, raw)
+	}
+	routing["rules"] = kept
+}
@@ -30,6 +30,10 @@ type Runtime struct {
 	MihomoConf  string `json:"-"`
 	XkeenJSON   string `json:"-"`
 	Installed   bool   `json:"installed"`
+
+	// dryRun marks a runtime pointed at a scratch copy of the config by a
+	// plan: writes land in the copy and the core is left alone
+	dryRun bool
 }
 
 // Detector resolves the XKeen layout. Every field is an optional override from
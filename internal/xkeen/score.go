@@ -0,0 +1,196 @@
+package xkeen
+
+import (
+	"sort"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+// DefaultScoreWeights price every factor in milliseconds of latency: 10% loss
+// weighs like 100 ms, a blacklisting in the last day like 400 ms.
+var DefaultScoreWeights = models.ScoreWeights{
+	Latency:   1,
+	Jitter:    0.5,
+	Loss:      1000,
+	Health:    150,
+	Blacklist: 400,
+}
+
+// scoreIncidentWindow is how far back incidents count against a node.
+const scoreIncidentWindow = 24 * time.Hour
+
+// minScoreSamples is how much history a node needs before its percentiles
+// count: two lucky probes are not a track record.
+const minScoreSamples = 3
+
+// Scorer rates freshly probed servers; a lower score is better. Pool
+// membership, pinning and failover all rank through one, so they agree on what
+// the best node is.
+type Scorer interface {
+	Score(server models.Server) models.NodeScore
+}
+
+// ScorerFromConfig builds the scorer over the latency history with the weights
+// from config.yaml; a weight left at zero takes its default. It weighs probes
+// of the latency_probe mode, the ones LatencyProbeFromConfig takes.
+func ScorerFromConfig(cfg *models.Config, history *LatencyHistory) Scorer {
+	return NewHistoryScorer(history, cfg.ScoreWeights, cfg.LatencyProbe)
+}
+
+// NewHistoryScorer weighs a probe together with the node's track record of the
+// same kind of probe, ProbeModeTCP or ProbeModeReal. Zero weights take their
+// default.
+func NewHistoryScorer(history *LatencyHistory, weights models.ScoreWeights, kind string) Scorer {
+	return historyScorer{history: history, weights: EffectiveScoreWeights(weights), kind: probeKind(kind)}
+}
+
+// EffectiveScoreWeights fills the weights left at zero with their defaults.
+func EffectiveScoreWeights(weights models.ScoreWeights) models.ScoreWeights {
+	w := DefaultScoreWeights
+	if weights.Latency > 0 {
+		w.Latency = weights.Latency
+	}
+	if weights.Jitter > 0 {
+		w.Jitter = weights.Jitter
+	}
+	if weights.Loss > 0 {
+		w.Loss = weights.Loss
+	}
+	if weights.Health > 0 {
+		w.Health = weights.Health
+	}
+	if weights.Blacklist > 0 {
+		w.Blacklist = weights.Blacklist
+	}
+	return w
+}
+
+type historyScorer struct {
+	history *LatencyHistory
+	weights models.ScoreWeights
+	kind    string
+}
+
+// Score adds up the penalties of a server:
+//
+//   - latency: the probe just taken, averaged with the median of the history
+//     once there is one, so a single lucky or unlucky probe moves it only half
+//     way
+//   - jitter: the spread between the median and the 90th percentile
+//   - loss: the share of probes in the history that got no answer
+//   - health and blacklist: incidents filed against the node in the last day
+func (s historyScorer) Score(server models.Server) models.NodeScore {
+	score := newNodeScore(server)
+
+	latency := float64(server.Latency)
+	var jitter, loss float64
+	var health, blacklists int
+
+	if key, ok := EndpointKey(server); ok && s.history != nil {
+		stats := s.history.StatsOf(server, s.kind)
+		if stats.Samples >= minScoreSamples && stats.P50 >= 0 {
+			score.P50, score.P90 = stats.P50, stats.P90
+			jitter = float64(stats.P90 - stats.P50)
+			loss = stats.Loss
+			if score.Reachable {
+				latency = (latency + float64(stats.P50)) / 2
+			}
+		}
+		incidents := s.history.Incidents(key, time.Now().Add(-scoreIncidentWindow))
+		health, blacklists = incidents[IncidentHealth], incidents[IncidentBlacklist]
+	}
+	if !score.Reachable {
+		latency = 0
+	}
+
+	score.Jitter = int(jitter)
+	score.Loss = loss
+	score.HealthFailures = health
+	score.Blacklists = blacklists
+	score.Parts = map[string]float64{
+		"latency":   s.weights.Latency * latency,
+		"jitter":    s.weights.Jitter * jitter,
+		"loss":      s.weights.Loss * loss,
+		"health":    s.weights.Health * float64(health),
+		"blacklist": s.weights.Blacklist * float64(blacklists),
+	}
+	for _, part := range score.Parts {
+		score.Score += part
+	}
+	return score
+}
+
+// latencyScorer ranks by the probe alone — what every caller did before
+// there was a history to weigh.
+type latencyScorer struct{}
+
+func (latencyScorer) Score(server models.Server) models.NodeScore {
+	score := newNodeScore(server)
+	if score.Reachable {
+		score.Score = float64(server.Latency)
+		score.Parts = map[string]float64{"latency": score.Score}
+	}
+	return score
+}
+
+func newNodeScore(server models.Server) models.NodeScore {
+	return models.NodeScore{
+		ID:        server.ID,
+		Name:      server.Name,
+		Reachable: server.Latency >= 0,
+		Latency:   server.Latency,
+		P50:       -1,
+		P90:       -1,
+	}
+}
+
+// RankServers orders probed servers best first: reachable ones by score, then
+// the unreachable ones in their original order. A nil scorer ranks by latency
+// alone. The scores come back in the same order.
+func RankServers(checked []models.Server, scorer Scorer) ([]models.Server, []models.NodeScore) {
+	if scorer == nil {
+		scorer = latencyScorer{}
+	}
+
+	type rated struct {
+		server models.Server
+		score  models.NodeScore
+	}
+	all := make([]rated, len(checked))
+	for i, s := range checked {
+		all[i] = rated{server: s, score: scorer.Score(s)}
+	}
+
+	sort.SliceStable(all, func(i, j int) bool {
+		a, b := all[i].score, all[j].score
+		if a.Reachable != b.Reachable {
+			return a.Reachable
+		}
+		return a.Reachable && a.Score < b.Score
+	})
+
+	servers := make([]models.Server, len(all))
+	scores := make([]models.NodeScore, len(all))
+	for i, r := range all {
+		servers[i], scores[i] = r.server, r.score
+	}
+	return servers, scores
+}
+
+// Scores rates every server in the catalogue by its last measured latency,
+// for showing how the ranking comes about.
+func (sm *SubscriptionManager) Scores(scorer Scorer) []models.NodeScore {
+	servers := sm.GetServers()
+	if scorer == nil {
+		scorer = latencyScorer{}
+	}
+	out := make([]models.NodeScore, len(servers))
+	for i, s := range servers {
+		out[i] = scorer.Score(s)
+		if key, ok := EndpointKey(s); ok {
+			out[i].Key = key
+		}
+	}
+	return out
+}
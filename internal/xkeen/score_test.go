@@ -0,0 +1,74 @@
+package xkeen
+
+import (
+	"testing"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+const steadyURI = "vless://33333333-4444-5555-6666-777777777777@steady.example:443?type=tcp&security=tls#steady"
+
+// One fast probe must not beat a node that has been steady all along.
+func TestScorePrefersTrackRecordOverOneLuckyProbe(t *testing.T) {
+	h := NewLatencyHistory(t.TempDir())
+	start := time.Now().Add(-time.Hour)
+	for i, lat := range []int{400, -1, 90, -1, 500, 350} {
+		h.Record([]models.Server{probed(realityURI, lat)}, ProbeModeTCP, start.Add(time.Duration(i)*time.Minute))
+	}
+	for i := range 6 {
+		h.Record([]models.Server{probed(steadyURI, 120)}, ProbeModeTCP, start.Add(time.Duration(i)*time.Minute))
+	}
+
+	lucky := probed(realityURI, 60)
+	steady := probed(steadyURI, 120)
+
+	ranked, scores := RankServers([]models.Server{lucky, steady}, NewHistoryScorer(h, models.ScoreWeights{}, ProbeModeTCP))
+	if ranked[0].RawURI != steadyURI {
+		t.Errorf("best = %s (scores %+v), want the steady node", ranked[0].RawURI, scores)
+	}
+	if scores[1].Parts["loss"] <= 0 || scores[1].Jitter <= 0 {
+		t.Errorf("lucky node breakdown = %+v, want loss and jitter counted", scores[1])
+	}
+}
+
+func TestScoreCountsIncidents(t *testing.T) {
+	h := NewLatencyHistory(t.TempDir())
+	key, _ := EndpointKey(probed(realityURI, 0))
+	h.RecordIncident(key, IncidentBlacklist, time.Now())
+	h.RecordIncident(key, IncidentHealth, time.Now())
+	h.RecordIncident(key, IncidentHealth, time.Now().Add(-2*scoreIncidentWindow)) // too old to count
+
+	score := NewHistoryScorer(h, models.ScoreWeights{}, ProbeModeTCP).Score(probed(realityURI, 100))
+	if score.Blacklists != 1 || score.HealthFailures != 1 {
+		t.Fatalf("incidents = %d blacklist / %d health, want 1/1", score.Blacklists, score.HealthFailures)
+	}
+	want := 100 + DefaultScoreWeights.Blacklist + DefaultScoreWeights.Health
+	if score.Score != want {
+		t.Errorf("score = %v, want %v", score.Score, want)
+	}
+}
+
+func TestRankServersPutsUnreachableLast(t *testing.T) {
+	servers := []models.Server{
+		{Name: "dead", Latency: -1},
+		{Name: "slow", Latency: 300},
+		{Name: "fast", Latency: 50},
+	}
+
+	ranked, scores := RankServers(servers, nil)
+	got := []string{ranked[0].Name, ranked[1].Name, ranked[2].Name}
+	if got[0] != "fast" || got[1] != "slow" || got[2] != "dead" {
+		t.Errorf("order = %v, want fast, slow, dead", got)
+	}
+	if scores[2].Reachable {
+		t.Error("the dead server is reported reachable")
+	}
+}
+
+func TestEffectiveScoreWeights(t *testing.T) {
+	w := EffectiveScoreWeights(models.ScoreWeights{Loss: 5000})
+	if w.Loss != 5000 || w.Latency != DefaultScoreWeights.Latency {
+		t.Errorf("weights = %+v, want loss overridden and the rest default", w)
+	}
+}
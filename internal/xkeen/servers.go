@@ -2,19 +2,89 @@ package xkeen
 
 import (
 	"encoding/base64"
-	"encoding/json"
 	"fmt"
 	"net"
 	"net/url"
 	"strconv"
 	"strings"
-	"sync"
 	"time"
+	"unicode/utf8"
+
 	"xkeen-panel/internal/models"
 )
 
-// ParseSubscription parses subscription content, base64 or plain text.
+// maxRejectedLines bounds the rejections kept in a report: a provider serving
+// an HTML error page would otherwise store every line of it.
+const maxRejectedLines = 100
+
+// ParseSubscription parses subscription content: a link list (base64 or plain
+// text), a Clash/Mihomo YAML or a sing-box JSON document.
 func ParseSubscription(content string) ([]models.Server, error) {
+	servers, _, err := ParseSubscriptionReport(content)
+	return servers, err
+}
+
+// subscriptionEntry is one candidate server: a line of a link list, or a proxy
+// of a document already rendered into its link.
+type subscriptionEntry struct {
+	line   int
+	uri    string
+	scheme string
+	text   string // shown in the report instead of the redacted uri
+	err    error  // the entry was refused before it became a link
+}
+
+// ParseSubscriptionReport parses subscription content and accounts for every
+// entry in it. The report is returned even when no server survived.
+func ParseSubscriptionReport(content string) ([]models.Server, models.ParseReport, error) {
+	format := sniffSubscriptionFormat(content)
+	report := models.ParseReport{Format: format}
+
+	var entries []subscriptionEntry
+	var err error
+	switch format {
+	case formatClash:
+		entries, err = clashEntries(content)
+	case formatSingBox:
+		entries, err = singBoxEntries(content)
+	default:
+		entries = linkEntries(content)
+	}
+	if err != nil {
+		return nil, report, err
+	}
+
+	report.Total = len(entries)
+	var servers []models.Server
+
+	for _, entry := range entries {
+		if entry.err != nil {
+			rejectEntry(&report, entry, entry.err)
+			continue
+		}
+
+		server, err := parseLine(entry.uri)
+		if err != nil {
+			rejectEntry(&report, entry, err)
+			continue
+		}
+
+		server.ID = len(servers)
+		server.RawURI = entry.uri
+		server.Country = detectCountry(server.Name)
+		servers = append(servers, *server)
+	}
+
+	report.Accepted = len(servers)
+	if len(servers) == 0 {
+		return nil, report, fmt.Errorf("не удалось распарсить ни одного сервера")
+	}
+
+	return servers, report, nil
+}
+
+// linkEntries splits a link list, base64-wrapped or not, into its lines.
+func linkEntries(content string) []subscriptionEntry {
 	// Try base64
 	decoded, err := base64.StdEncoding.DecodeString(strings.TrimSpace(content))
 	if err != nil {
@@ -29,47 +99,79 @@ func ParseSubscription(content string) ([]models.Server, error) {
 			}
 		}
 	}
+	// A short plain word can happen to be valid base64 too
+	if !utf8.Valid(decoded) {
+		decoded = []byte(content)
+	}
 
-	lines := strings.Split(strings.TrimSpace(string(decoded)), "\n")
-	var servers []models.Server
-
-	for _, line := range lines {
+	var entries []subscriptionEntry
+	for i, line := range strings.Split(strings.TrimSpace(string(decoded)), "\n") {
 		line = strings.TrimSpace(line)
 		if line == "" {
 			continue
 		}
-
-		var server *models.Server
-		var parseErr error
-
-		switch {
-		case strings.HasPrefix(line, "vless://"):
-			server, parseErr = parseVLESS(line)
-		case strings.HasPrefix(line, "vmess://"):
-			server, parseErr = parseVMess(line)
-		case strings.HasPrefix(line, "trojan://"):
-			server, parseErr = parseTrojan(line)
-		case strings.HasPrefix(line, "ss://"):
-			server, parseErr = parseShadowsocks(line)
-		default:
-			continue
+		scheme, _, _ := strings.Cut(line, "://")
+		if scheme == line {
+			scheme = ""
 		}
+		entries = append(entries, subscriptionEntry{line: i + 1, uri: line, scheme: scheme})
+	}
 
-		if parseErr != nil || server == nil {
-			continue
-		}
+	return entries
+}
 
-		server.ID = len(servers)
-		server.RawURI = line
-		server.Country = detectCountry(server.Name)
-		servers = append(servers, *server)
+// parseLine reads the server a share link describes.
+func parseLine(line string) (*models.Server, error) {
+	var server *models.Server
+	var err error
+
+	switch {
+	case strings.HasPrefix(line, "vless://"):
+		server, err = parseVLESS(line)
+	case strings.HasPrefix(line, "vmess://"):
+		server, err = parseVMess(line)
+	case strings.HasPrefix(line, "trojan://"):
+		server, err = parseTrojan(line)
+	case strings.HasPrefix(line, "ss://"):
+		server, err = parseShadowsocks(line)
+	case strings.HasPrefix(line, "hysteria2://"), strings.HasPrefix(line, "hy2://"),
+		strings.HasPrefix(line, "tuic://"),
+		strings.HasPrefix(line, "wireguard://"), strings.HasPrefix(line, "wg://"):
+		server, err = parseUDPProxy(line)
+	case strings.Contains(line, "://"):
+		return nil, fmt.Errorf("неподдерживаемая схема")
+	default:
+		return nil, fmt.Errorf("не ссылка на сервер")
 	}
 
-	if len(servers) == 0 {
-		return nil, fmt.Errorf("не удалось распарсить ни одного сервера")
+	if err != nil {
+		return nil, err
+	}
+	if server == nil {
+		return nil, fmt.Errorf("пустой результат разбора")
 	}
 
-	return servers, nil
+	return server, nil
+}
+
+// rejectEntry records a dropped entry with its secrets masked.
+func rejectEntry(report *models.ParseReport, entry subscriptionEntry, err error) {
+	if len(report.Rejected) >= maxRejectedLines {
+		report.Omitted++
+		return
+	}
+
+	text := entry.text
+	if text == "" {
+		text = redactLine(entry.uri)
+	}
+
+	report.Rejected = append(report.Rejected, models.RejectedLine{
+		Line:   entry.line,
+		Scheme: entry.scheme,
+		Error:  errorText(err),
+		Text:   text,
+	})
 }
 
 // parseVLESS parses vless://uuid@host:port?params#name
@@ -99,43 +201,25 @@ func parseVLESS(uri string) (*models.Server, error) {
 	}, nil
 }
 
-// parseVMess parses vmess://base64json
+// parseVMess parses vmess://base64json through ParseVMess, so a link is
+// listed exactly when it can be rendered.
 func parseVMess(uri string) (*models.Server, error) {
-	encoded := strings.TrimPrefix(uri, "vmess://")
-
-	// Decode base64
-	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	p, err := ParseVMess(uri)
 	if err != nil {
-		decoded, err = base64.RawStdEncoding.DecodeString(encoded)
-		if err != nil {
-			return nil, fmt.Errorf("ошибка декодирования vmess: %w", err)
-		}
-	}
-
-	var vmessConfig map[string]interface{}
-	if err := json.Unmarshal(decoded, &vmessConfig); err != nil {
-		return nil, fmt.Errorf("ошибка парсинга vmess JSON: %w", err)
+		return nil, err
 	}
 
-	address, _ := vmessConfig["add"].(string)
-	portStr := fmt.Sprintf("%v", vmessConfig["port"])
-	port, _ := strconv.Atoi(portStr)
-	name, _ := vmessConfig["ps"].(string)
-
-	if address == "" {
-		return nil, fmt.Errorf("vmess: отсутствует адрес")
-	}
-	if port == 0 {
-		port = 443
-	}
+	// The remark is the one field the outbound has no use for
+	v, _ := decodeVMess(uri)
+	name, _ := v["ps"].(string)
 	if name == "" {
-		name = address
+		name = p.Address
 	}
 
 	return &models.Server{
 		Name:     name,
-		Address:  address,
-		Port:     port,
+		Address:  p.Address,
+		Port:     p.Port,
 		Protocol: "vmess",
 		Latency:  -1,
 	}, nil
@@ -236,6 +320,29 @@ func parseShadowsocks(uri string) (*models.Server, error) {
 	}, nil
 }
 
+// parseUDPProxy parses the QUIC- and WireGuard-based links. Unlike the TCP
+// protocols above they are read in full here: probing them needs their keys
+// and obfuscation settings, not just an address.
+func parseUDPProxy(uri string) (*models.Server, error) {
+	p, err := ParseProxyURI(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	name := uriName(uri)
+	if name == "" {
+		name = p.Address
+	}
+
+	return &models.Server{
+		Name:     name,
+		Address:  p.Address,
+		Port:     p.Port,
+		Protocol: p.Protocol,
+		Latency:  -1,
+	}, nil
+}
+
 // CheckLatency measures the TCP connect time to a server.
 func CheckLatency(address string, port int, timeout time.Duration) int {
 	start := time.Now()
@@ -246,29 +353,3 @@ func CheckLatency(address string, port int, timeout time.Duration) int {
 	conn.Close()
 	return int(time.Since(start).Milliseconds())
 }
-
-// CheckAllLatencies probes every server concurrently with a cap on simultaneous
-// connections — uncapped, a large subscription takes the router down.
-func CheckAllLatencies(servers []models.Server, timeout time.Duration, concurrency int) []models.Server {
-	if concurrency <= 0 {
-		concurrency = 20
-	}
-
-	var wg sync.WaitGroup
-	result := make([]models.Server, len(servers))
-	copy(result, servers)
-
-	sem := make(chan struct{}, concurrency)
-	for i := range result {
-		wg.Add(1)
-		sem <- struct{}{}
-		go func(idx int) {
-			defer wg.Done()
-			defer func() { <-sem }()
-			result[idx].Latency = CheckLatency(result[idx].Address, result[idx].Port, timeout)
-		}(i)
-	}
-
-	wg.Wait()
-	return result
-}
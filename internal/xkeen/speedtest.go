@@ -0,0 +1,190 @@
+package xkeen
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+// Defaults for the speed test, used when config.yaml leaves them at zero.
+const (
+	DefaultSpeedTestURL         = "https://speed.cloudflare.com/__down?bytes=26214400"
+	DefaultSpeedTestMaxBytes    = 25 << 20
+	DefaultSpeedTestMaxDuration = 15 * time.Second
+)
+
+// speedProgressEvery is how often a running test reports.
+const speedProgressEvery = 500 * time.Millisecond
+
+// SpeedTestOptions says what a speed test downloads and when it stops: after
+// MaxBytes or MaxDuration, whichever comes first.
+type SpeedTestOptions struct {
+	URL         string
+	MaxBytes    int64
+	MaxDuration time.Duration
+}
+
+// SpeedTestOptionsFromConfig builds the speed test the config asks for.
+func SpeedTestOptionsFromConfig(cfg *models.Config) SpeedTestOptions {
+	return SpeedTestOptions{
+		URL:         cfg.SpeedTestURL,
+		MaxBytes:    int64(cfg.SpeedTestMaxMB) << 20,
+		MaxDuration: time.Duration(cfg.SpeedTestMaxSeconds) * time.Second,
+	}
+}
+
+func (o SpeedTestOptions) withDefaults() SpeedTestOptions {
+	if o.URL == "" {
+		o.URL = DefaultSpeedTestURL
+	}
+	if o.MaxBytes <= 0 {
+		o.MaxBytes = DefaultSpeedTestMaxBytes
+	}
+	if o.MaxDuration <= 0 {
+		o.MaxDuration = DefaultSpeedTestMaxDuration
+	}
+	return o
+}
+
+// SpeedProgress is a running test's state, reported as it downloads.
+type SpeedProgress struct {
+	Bytes     int64   `json:"bytes"`
+	ElapsedMs int64   `json:"elapsed_ms"`
+	Mbps      float64 `json:"mbps"`
+}
+
+// SpeedTest downloads through the server in a throwaway core, the same way the
+// real delay probe reaches a node, so the live core and its traffic are left
+// alone. progress may be nil.
+//
+// A download that fails through the node is a result, with Error set: it says
+// the node is no good. An error means the test never got that far — no xray,
+// no port, a core that did not start, an endpoint refusing the request — and
+// says nothing about the node.
+func SpeedTest(ctx context.Context, rt Runtime, outboundsPath string, server models.Server, opts SpeedTestOptions, progress func(SpeedProgress)) (models.SpeedTest, error) {
+	if err := checkProbeCore(rt); err != nil {
+		return models.SpeedTest{}, err
+	}
+	ob, ok := probeOutbound(server, probeTemplate(outboundsPath))
+	if !ok {
+		return models.SpeedTest{}, fmt.Errorf("протокол %s не поддерживается xray", server.Protocol)
+	}
+
+	ports, err := freePorts(1)
+	if err != nil {
+		return models.SpeedTest{}, err
+	}
+	stop, err := startProbeCore(rt.CoreBin, realDelayConfig([]map[string]interface{}{ob}, ports), ports[0])
+	if err != nil {
+		return models.SpeedTest{}, err
+	}
+	defer stop()
+
+	proxy := &url.URL{Scheme: "socks5", Host: fmt.Sprintf("127.0.0.1:%d", ports[0])}
+	return measureDownload(ctx, proxy, opts, progress)
+}
+
+// measureDownload reads the test URL through the proxy until a cap is hit.
+// Running into the time cap is the normal end on a slow node, not an error;
+// the speed is what arrived in the time.
+func measureDownload(ctx context.Context, proxy *url.URL, opts SpeedTestOptions, progress func(SpeedProgress)) (models.SpeedTest, error) {
+	opts = opts.withDefaults()
+
+	failed := func(err error) (models.SpeedTest, error) {
+		return models.SpeedTest{Time: time.Now(), Error: err.Error()}, nil
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, opts.MaxDuration)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, opts.URL, nil)
+	if err != nil {
+		return models.SpeedTest{}, err
+	}
+	client := &http.Client{Transport: &http.Transport{
+		Proxy:              http.ProxyURL(proxy),
+		DisableKeepAlives:  true,
+		DisableCompression: true,
+	}}
+
+	start := time.Now()
+	resp, err := client.Do(req)
+	if err != nil {
+		return failed(fmt.Errorf("запрос через сервер: %w", err))
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return models.SpeedTest{}, fmt.Errorf("сервер теста ответил %s", resp.Status)
+	}
+
+	var total int64
+	body := io.LimitReader(resp.Body, opts.MaxBytes)
+	buf := make([]byte, 32<<10)
+	lastReport := start
+	for {
+		n, readErr := body.Read(buf)
+		total += int64(n)
+
+		if progress != nil && time.Since(lastReport) >= speedProgressEvery {
+			lastReport = time.Now()
+			progress(speedProgress(total, lastReport.Sub(start)))
+		}
+
+		if readErr == io.EOF {
+			break
+		}
+		if readErr != nil {
+			// The time cap cut the download short: that is the measurement
+			if ctx.Err() == context.DeadlineExceeded {
+				break
+			}
+			return failed(fmt.Errorf("загрузка прервана: %w", readErr))
+		}
+	}
+
+	elapsed := time.Since(start)
+	if total == 0 {
+		return failed(fmt.Errorf("через сервер не пришло ни байта"))
+	}
+
+	final := speedProgress(total, elapsed)
+	return models.SpeedTest{
+		Mbps:       final.Mbps,
+		Bytes:      total,
+		DurationMs: final.ElapsedMs,
+		Time:       time.Now(),
+	}, nil
+}
+
+func speedProgress(bytes int64, elapsed time.Duration) SpeedProgress {
+	p := SpeedProgress{Bytes: bytes, ElapsedMs: elapsed.Milliseconds()}
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		p.Mbps = float64(bytes) * 8 / seconds / 1e6
+	}
+	return p
+}
+
+// UpdateSpeed stores a speed test result on the server with the given link.
+// A failed download is stored too: a node that cannot download is the slowest.
+func (sm *SubscriptionManager) UpdateSpeed(rawURI string, result models.SpeedTest) error {
+	sm.mu.Lock()
+	found := false
+	for i := range sm.data.Servers {
+		if sm.data.Servers[i].RawURI == rawURI {
+			speed := result
+			sm.data.Servers[i].Speed = &speed
+			found = true
+		}
+	}
+	sm.mu.Unlock()
+
+	if !found {
+		return fmt.Errorf("сервер пропал из подписки")
+	}
+	return sm.Save()
+}
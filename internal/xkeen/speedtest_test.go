@@ -0,0 +1,154 @@
+package xkeen
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+// downloadStub stands in for the node and the test endpoint at once: an HTTP
+// proxy that answers every request with the handler.
+func downloadStub(t *testing.T, handler http.HandlerFunc) *url.URL {
+	t.Helper()
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	return u
+}
+
+func TestMeasureDownloadStopsAtByteCap(t *testing.T) {
+	proxy := downloadStub(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(strings.Repeat("x", 1<<20)))
+	})
+
+	result, err := measureDownload(context.Background(), proxy,
+		SpeedTestOptions{URL: "http://speed.example/down", MaxBytes: 256 << 10, MaxDuration: 5 * time.Second}, nil)
+	if err != nil {
+		t.Fatalf("measureDownload: %v", err)
+	}
+	if result.Bytes != 256<<10 {
+		t.Errorf("bytes = %d, want the 256 KiB cap", result.Bytes)
+	}
+	if result.Mbps <= 0 || result.Time.IsZero() {
+		t.Errorf("result = %+v, want a speed and a timestamp", result)
+	}
+}
+
+// A slow node hits the time cap; what arrived until then is the measurement.
+func TestMeasureDownloadStopsAtTimeCap(t *testing.T) {
+	proxy := downloadStub(t, func(w http.ResponseWriter, r *http.Request) {
+		flusher := w.(http.Flusher)
+		for {
+			if _, err := w.Write([]byte(strings.Repeat("x", 1024))); err != nil {
+				return
+			}
+			flusher.Flush()
+			select {
+			case <-r.Context().Done():
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+		}
+	})
+
+	var last SpeedProgress
+	start := time.Now()
+	result, err := measureDownload(context.Background(), proxy,
+		SpeedTestOptions{URL: "http://speed.example/down", MaxBytes: 1 << 30, MaxDuration: 1200 * time.Millisecond},
+		func(p SpeedProgress) { last = p })
+	if err != nil {
+		t.Fatalf("measureDownload: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Errorf("took %s, want the time cap to end it", elapsed)
+	}
+	if result.Bytes == 0 || result.Mbps <= 0 {
+		t.Errorf("result = %+v, want what arrived before the cap", result)
+	}
+	if last.Bytes == 0 {
+		t.Error("no progress was reported during a second-long download")
+	}
+}
+
+func TestMeasureDownloadRejectsErrorStatus(t *testing.T) {
+	proxy := downloadStub(t, func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "blocked", http.StatusForbidden)
+	})
+
+	if _, err := measureDownload(context.Background(), proxy,
+		SpeedTestOptions{URL: "http://speed.example/down"}, nil); err == nil {
+		t.Error("a 403 from the test endpoint must not count as a speed")
+	}
+}
+
+// A node that drops the download is a result; the endpoint refusing is not.
+func TestMeasureDownloadFailureThroughNodeIsResult(t *testing.T) {
+	proxy := downloadStub(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1024")
+		w.WriteHeader(http.StatusOK)
+	})
+
+	result, err := measureDownload(context.Background(), proxy,
+		SpeedTestOptions{URL: "http://speed.example/down"}, nil)
+	if err != nil {
+		t.Fatalf("measureDownload: %v, want a failed result", err)
+	}
+	if result.Error == "" || result.Mbps != 0 || result.Time.IsZero() {
+		t.Errorf("result = %+v, want a timestamped failure", result)
+	}
+}
+
+// A speed test costs real traffic: a refresh that keeps the server keeps it.
+func TestSpeedSurvivesRefresh(t *testing.T) {
+	srv, _ := subServer(t, sampleSub())
+	sm := NewSubscriptionManager(t.TempDir())
+	servers, err := sm.UpdateURL(srv.URL)
+	if err != nil {
+		t.Fatalf("UpdateURL: %v", err)
+	}
+
+	tested := models.SpeedTest{Mbps: 42, Bytes: 1 << 20, Time: time.Now()}
+	if err := sm.UpdateSpeed(servers[0].RawURI, tested); err != nil {
+		t.Fatalf("UpdateSpeed: %v", err)
+	}
+	if _, err := sm.Refresh(); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	got := sm.GetServers()[0].Speed
+	if got == nil || got.Mbps != 42 {
+		t.Errorf("speed after refresh = %+v, want the 42 Mbps result kept", got)
+	}
+}
+
+func TestPoolSelectionSkipsSlowServers(t *testing.T) {
+	now := time.Now()
+	fast := models.Server{Protocol: "vless", RawURI: realityURI, Speed: &models.SpeedTest{Mbps: 80, Time: now}}
+	slow := models.Server{Protocol: "vless", RawURI: wsURI, Speed: &models.SpeedTest{Mbps: 2, Time: now}}
+	stale := slow
+	stale.Speed = &models.SpeedTest{Mbps: 2, Time: now.Add(-2 * SpeedTestMaxAge)}
+	untested := models.Server{Protocol: "vless", RawURI: wsURI}
+
+	sel := PoolSelection{MinSpeedMbps: 10}
+	cases := []struct {
+		name   string
+		server models.Server
+		want   bool
+	}{
+		{"fast", fast, false},
+		{"slow", slow, true},
+		{"stale result", stale, false},
+		{"never tested", untested, false},
+	}
+	for _, c := range cases {
+		if got := sel.tooSlow(c.server, now); got != c.want {
+			t.Errorf("%s: tooSlow = %v, want %v", c.name, got, c.want)
+		}
+	}
+}
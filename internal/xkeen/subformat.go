@@ -0,0 +1,439 @@
+package xkeen
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Subscription documents other than a link list. Providers serve whatever the
+// client they target reads; the panel turns each proxy into the share link it
+// would have been, so a server has the same RawURI however it arrived.
+const (
+	formatLinks   = "links"
+	formatClash   = "clash"
+	formatSingBox = "sing-box"
+)
+
+// sniffSubscriptionFormat guesses the document type from its shape. A link list
+// — plain or base64 — never starts with a brace or carries a proxies: key.
+func sniffSubscriptionFormat(content string) string {
+	trimmed := strings.TrimSpace(strings.TrimPrefix(content, "\ufeff"))
+	if strings.HasPrefix(trimmed, "{") {
+		return formatSingBox
+	}
+	for _, line := range strings.Split(trimmed, "\n") {
+		if strings.HasPrefix(line, "proxies:") {
+			return formatClash
+		}
+	}
+	return formatLinks
+}
+
+// clashEntries reads the proxies: list of a Clash/Mihomo config.
+func clashEntries(content string) ([]subscriptionEntry, error) {
+	var doc struct {
+		Proxies []map[string]interface{} `yaml:"proxies"`
+	}
+	if err := yaml.Unmarshal([]byte(content), &doc); err != nil {
+		return nil, fmt.Errorf("ошибка разбора Clash YAML: %w", err)
+	}
+	if len(doc.Proxies) == 0 {
+		return nil, fmt.Errorf("в Clash-подписке нет proxies")
+	}
+
+	entries := make([]subscriptionEntry, 0, len(doc.Proxies))
+	for i, proxy := range doc.Proxies {
+		m := docMap(proxy)
+		p, err := clashParams(m)
+		entries = append(entries, documentEntry(i, m.str("type"), m.str("name"), m.str("server"), m.str("port"), p, err))
+	}
+
+	return entries, nil
+}
+
+// documentEntry turns a document proxy into a subscription entry. The report
+// text is assembled from fields that carry no credentials.
+func documentEntry(i int, kind, name, server, port string, p *ProxyParams, err error) subscriptionEntry {
+	entry := subscriptionEntry{
+		line:   i + 1,
+		scheme: kind,
+		text:   truncate(fmt.Sprintf("%s (%s %s:%s)", name, kind, server, port)),
+		err:    err,
+	}
+	if err == nil {
+		entry.uri = p.URI(name)
+	}
+	return entry
+}
+
+// clashParams maps one Clash proxy onto the panel's parameters. Types the
+// panel cannot express are refused rather than rendered into a node that
+// cannot connect.
+func clashParams(m docMap) (*ProxyParams, error) {
+	p := &ProxyParams{
+		Address:     m.str("server"),
+		Port:        m.num("port"),
+		Network:     m.str("network"),
+		SNI:         firstNonEmpty(m.str("servername"), m.str("sni")),
+		Fingerprint: m.str("client-fingerprint"),
+		ALPN:        strings.Join(m.list("alpn"), ","),
+		Insecure:    m.boolean("skip-cert-verify"),
+	}
+	if p.Address == "" || p.Port == 0 {
+		return nil, fmt.Errorf("нет адреса или порта")
+	}
+	if m.boolean("tls") {
+		p.Security = "tls"
+	}
+	if reality := m.sub("reality-opts"); reality != nil {
+		p.Security = "reality"
+		p.PublicKey = reality.str("public-key")
+		p.ShortID = reality.str("short-id")
+	}
+
+	switch m.str("type") {
+	case "vless":
+		p.Protocol = "vless"
+		p.UUID = m.str("uuid")
+		p.Flow = m.str("flow")
+	case "vmess":
+		p.Protocol = "vmess"
+		p.UUID = m.str("uuid")
+		p.AlterID = m.num("alterId")
+		p.Cipher = m.str("cipher")
+	case "trojan":
+		p.Protocol = "trojan"
+		p.Password = m.str("password")
+		if p.Security == "" {
+			p.Security = "tls"
+		}
+	case "ss":
+		p.Protocol = "shadowsocks"
+		p.Method = m.str("cipher")
+		p.Password = m.str("password")
+		p.Plugin = clashPlugin(m)
+		p.Security = ""
+	case "hysteria2":
+		p.Protocol = "hysteria2"
+		p.Password = m.str("password")
+		p.Obfs = m.str("obfs")
+		p.ObfsPassword = m.str("obfs-password")
+		p.Network = ""
+	case "tuic":
+		p.Protocol = "tuic"
+		p.UUID = m.str("uuid")
+		p.Password = m.str("password")
+		p.CongestionControl = m.str("congestion-controller")
+		p.UDPRelayMode = m.str("udp-relay-mode")
+		p.Network = ""
+	case "wireguard":
+		p.Protocol = "wireguard"
+		p.PrivateKey = m.str("private-key")
+		p.PublicKey = m.str("public-key")
+		p.PresharedKey = m.str("pre-shared-key")
+		p.MTU = m.num("mtu")
+		p.Reserved = m.ints("reserved")
+		p.Security = ""
+		if ip := m.str("ip"); ip != "" {
+			p.LocalAddress = append(p.LocalAddress, withPrefix(ip))
+		}
+		if ip := m.str("ipv6"); ip != "" {
+			p.LocalAddress = append(p.LocalAddress, withPrefix(ip))
+		}
+	default:
+		return nil, fmt.Errorf("тип %q не поддерживается", m.str("type"))
+	}
+
+	switch p.Network {
+	case "ws":
+		if ws := m.sub("ws-opts"); ws != nil {
+			p.Path = ws.str("path")
+			if headers := ws.sub("headers"); headers != nil {
+				p.Host = headers.str("Host")
+			}
+		}
+	case "grpc":
+		if grpc := m.sub("grpc-opts"); grpc != nil {
+			p.Path = grpc.str("grpc-service-name")
+		}
+	case "h2":
+		if h2 := m.sub("h2-opts"); h2 != nil {
+			p.Path = h2.str("path")
+			p.Host = strings.Join(h2.list("host"), ",")
+		}
+	case "http":
+		// Clash's "http" network is the TCP header disguise, not HTTP/2
+		p.Network = "tcp"
+		p.HeaderType = "http"
+		if opts := m.sub("http-opts"); opts != nil {
+			p.Path = strings.Join(opts.list("path"), ",")
+			if headers := opts.sub("headers"); headers != nil {
+				p.Host = strings.Join(headers.list("Host"), ",")
+			}
+		}
+	}
+
+	return p, nil
+}
+
+// clashPlugin renders a Clash Shadowsocks plugin in the SIP003 form ss:// links
+// carry it in: "obfs-local;obfs=http;obfs-host=example.com". Clash names the
+// simple-obfs client "obfs" and spells its options its own way.
+func clashPlugin(m docMap) string {
+	name := m.str("plugin")
+	if name == "" {
+		return ""
+	}
+	opts := m.sub("plugin-opts")
+
+	fields := []string{}
+	add := func(key, value string) {
+		if value != "" {
+			fields = append(fields, key+"="+value)
+		}
+	}
+	switch name {
+	case "obfs":
+		name = "obfs-local"
+		add("obfs", opts.str("mode"))
+		add("obfs-host", opts.str("host"))
+	default:
+		keys := make([]string, 0, len(opts))
+		for key := range opts {
+			keys = append(keys, key)
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			// A flag like v2ray-plugin's tls is a bare word in SIP003
+			if v, ok := opts[key].(bool); ok {
+				if v {
+					fields = append(fields, key)
+				}
+				continue
+			}
+			add(key, opts.str(key))
+		}
+	}
+	return strings.Join(append([]string{name}, fields...), ";")
+}
+
+// singBoxEntries reads the outbounds of a sing-box config. Selector, urltest and
+// the service outbounds are not servers and are left out of the count.
+func singBoxEntries(content string) ([]subscriptionEntry, error) {
+	var doc struct {
+		Outbounds []map[string]interface{} `json:"outbounds"`
+	}
+	if err := json.Unmarshal([]byte(strings.TrimPrefix(strings.TrimSpace(content), "\ufeff")), &doc); err != nil {
+		return nil, fmt.Errorf("ошибка разбора sing-box JSON: %w", err)
+	}
+	if len(doc.Outbounds) == 0 {
+		return nil, fmt.Errorf("в sing-box-подписке нет outbounds")
+	}
+
+	var entries []subscriptionEntry
+	for i, outbound := range doc.Outbounds {
+		m := docMap(outbound)
+		if singBoxServiceTypes[m.str("type")] {
+			continue
+		}
+		p, err := singBoxParams(m)
+		entries = append(entries, documentEntry(i, m.str("type"), m.str("tag"), m.str("server"), m.str("server_port"), p, err))
+	}
+
+	return entries, nil
+}
+
+// singBoxServiceTypes are outbounds that route rather than connect anywhere.
+var singBoxServiceTypes = map[string]bool{
+	"selector": true,
+	"urltest":  true,
+	"direct":   true,
+	"block":    true,
+	"dns":      true,
+}
+
+func singBoxParams(m docMap) (*ProxyParams, error) {
+	p := &ProxyParams{
+		Address: m.str("server"),
+		Port:    m.num("server_port"),
+	}
+	if p.Address == "" || p.Port == 0 {
+		return nil, fmt.Errorf("нет адреса или порта")
+	}
+
+	if tls := m.sub("tls"); tls != nil && tls.boolean("enabled") {
+		p.Security = "tls"
+		p.SNI = tls.str("server_name")
+		p.Insecure = tls.boolean("insecure")
+		p.ALPN = strings.Join(tls.list("alpn"), ",")
+		if utls := tls.sub("utls"); utls != nil && utls.boolean("enabled") {
+			p.Fingerprint = utls.str("fingerprint")
+		}
+		if reality := tls.sub("reality"); reality != nil && reality.boolean("enabled") {
+			p.Security = "reality"
+			p.PublicKey = reality.str("public_key")
+			p.ShortID = reality.str("short_id")
+		}
+	}
+
+	if transport := m.sub("transport"); transport != nil {
+		switch transport.str("type") {
+		case "ws":
+			p.Network = "ws"
+			p.Path = transport.str("path")
+			if headers := transport.sub("headers"); headers != nil {
+				p.Host = headers.str("Host")
+			}
+		case "grpc":
+			p.Network = "grpc"
+			p.Path = transport.str("service_name")
+		case "http":
+			p.Network = "h2"
+			p.Path = transport.str("path")
+			p.Host = strings.Join(transport.list("host"), ",")
+		case "httpupgrade":
+			p.Network = "httpupgrade"
+			p.Path = transport.str("path")
+			p.Host = transport.str("host")
+		default:
+			return nil, fmt.Errorf("транспорт %q не поддерживается", transport.str("type"))
+		}
+	}
+
+	switch m.str("type") {
+	case "vless":
+		p.Protocol = "vless"
+		p.UUID = m.str("uuid")
+		p.Flow = m.str("flow")
+	case "vmess":
+		p.Protocol = "vmess"
+		p.UUID = m.str("uuid")
+		p.AlterID = m.num("alter_id")
+		p.Cipher = m.str("security")
+	case "trojan":
+		p.Protocol = "trojan"
+		p.Password = m.str("password")
+	case "shadowsocks":
+		p.Protocol = "shadowsocks"
+		p.Method = m.str("method")
+		p.Password = m.str("password")
+		// sing-box already splits SIP003 into the plugin and its options
+		if plugin := m.str("plugin"); plugin != "" {
+			p.Plugin = strings.Trim(plugin+";"+m.str("plugin_opts"), ";")
+		}
+	case "hysteria2":
+		p.Protocol = "hysteria2"
+		p.Password = m.str("password")
+		if obfs := m.sub("obfs"); obfs != nil {
+			p.Obfs = obfs.str("type")
+			p.ObfsPassword = obfs.str("password")
+		}
+	case "tuic":
+		p.Protocol = "tuic"
+		p.UUID = m.str("uuid")
+		p.Password = m.str("password")
+		p.CongestionControl = m.str("congestion_control")
+		p.UDPRelayMode = m.str("udp_relay_mode")
+	case "wireguard":
+		p.Protocol = "wireguard"
+		p.PrivateKey = m.str("private_key")
+		p.PublicKey = m.str("peer_public_key")
+		p.PresharedKey = m.str("pre_shared_key")
+		p.MTU = m.num("mtu")
+		p.Reserved = m.ints("reserved")
+		for _, addr := range m.list("local_address") {
+			p.LocalAddress = append(p.LocalAddress, withPrefix(addr))
+		}
+	default:
+		return nil, fmt.Errorf("тип %q не поддерживается", m.str("type"))
+	}
+
+	return p, nil
+}
+
+// withPrefix adds the host prefix length an interface address needs.
+func withPrefix(ip string) string {
+	if strings.Contains(ip, "/") {
+		return ip
+	}
+	if strings.Contains(ip, ":") {
+		return ip + "/128"
+	}
+	return ip + "/32"
+}
+
+// docMap reads loosely typed documents: YAML and JSON disagree on whether a
+// port is a number or a string, and providers use both.
+type docMap map[string]interface{}
+
+func docString(m map[string]interface{}, key string) string {
+	return docMap(m).str(key)
+}
+
+func (m docMap) str(key string) string {
+	switch v := m[key].(type) {
+	case string:
+		return strings.TrimSpace(v)
+	case int:
+		return strconv.Itoa(v)
+	case float64:
+		return strconv.Itoa(int(v))
+	case bool:
+		return strconv.FormatBool(v)
+	}
+	return ""
+}
+
+func (m docMap) num(key string) int {
+	n, _ := strconv.Atoi(m.str(key))
+	return n
+}
+
+func (m docMap) boolean(key string) bool {
+	if v, ok := m[key].(bool); ok {
+		return v
+	}
+	return isTruthy(m.str(key))
+}
+
+func (m docMap) sub(key string) docMap {
+	if v, ok := m[key].(map[string]interface{}); ok {
+		return v
+	}
+	return nil
+}
+
+// list accepts both a sequence and a single comma-separated string.
+func (m docMap) list(key string) []string {
+	switch v := m[key].(type) {
+	case []interface{}:
+		out := make([]string, 0, len(v))
+		for _, item := range v {
+			if s := (docMap{"v": item}).str("v"); s != "" {
+				out = append(out, s)
+			}
+		}
+		return out
+	case string:
+		if v == "" {
+			return nil
+		}
+		return strings.Split(v, ",")
+	}
+	return nil
+}
+
+func (m docMap) ints(key string) []int {
+	var out []int
+	for _, s := range m.list(key) {
+		if n, err := strconv.Atoi(strings.TrimSpace(s)); err == nil {
+			out = append(out, n)
+		}
+	}
+	return out
+}
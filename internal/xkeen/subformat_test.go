@@ -0,0 +1,234 @@
+package xkeen
+
+import (
+	"strings"
+	"testing"
+)
+
+const clashSub = `mixed-port: 7890
+proxies:
+  - name: "NL Amsterdam"
+    type: vless
+    server: 1.2.3.4
+    port: 443
+    uuid: 11111111-2222-3333-4444-555555555555
+    network: tcp
+    tls: true
+    servername: example.com
+    flow: xtls-rprx-vision
+    client-fingerprint: chrome
+    reality-opts:
+      public-key: KEY
+      short-id: ab
+  - name: DE-Frankfurt
+    type: vmess
+    server: 5.6.7.8
+    port: "8080"
+    uuid: uuid-v
+    alterId: 0
+    cipher: auto
+    tls: true
+    network: ws
+    ws-opts:
+      path: /ws
+      headers:
+        Host: cdn.example.com
+  - name: FI-ss
+    type: ss
+    server: 9.9.9.9
+    port: 8388
+    cipher: aes-256-gcm
+    password: secret
+  - name: obfs-ss
+    type: ss
+    server: 9.9.9.8
+    port: 8388
+    cipher: aes-256-gcm
+    password: secret
+    plugin: obfs
+    plugin-opts:
+      mode: http
+      host: bing.com
+  - name: HY2 Tokyo JP
+    type: hysteria2
+    server: h.example.com
+    port: 443
+    password: pw
+    obfs: salamander
+    obfs-password: salt
+  - name: snell-x
+    type: snell
+    server: 9.9.9.7
+    port: 443
+    psk: secret
+proxy-groups:
+  - name: PROXY
+    type: select
+    proxies: [NL Amsterdam]
+`
+
+const singBoxSub = `{
+  "outbounds": [
+    {"type": "selector", "tag": "proxy", "outbounds": ["NL"]},
+    {"type": "vless", "tag": "NL", "server": "1.2.3.4", "server_port": 443,
+     "uuid": "11111111-2222-3333-4444-555555555555", "flow": "xtls-rprx-vision",
+     "tls": {"enabled": true, "server_name": "example.com",
+             "utls": {"enabled": true, "fingerprint": "chrome"},
+             "reality": {"enabled": true, "public_key": "KEY", "short_id": "ab"}}},
+    {"type": "trojan", "tag": "TR Istanbul", "server": "t.example.com", "server_port": 443,
+     "password": "pw", "tls": {"enabled": true, "server_name": "t.example.com"},
+     "transport": {"type": "grpc", "service_name": "svc"}},
+    {"type": "tuic", "tag": "TUIC", "server": "u.example.com", "server_port": 443,
+     "uuid": "id", "password": "pw", "congestion_control": "bbr",
+     "tls": {"enabled": true, "alpn": ["h3"]}},
+    {"type": "direct", "tag": "direct"}
+  ]
+}`
+
+func TestSniffSubscriptionFormat(t *testing.T) {
+	cases := map[string]string{
+		clashSub:    formatClash,
+		singBoxSub:  formatSingBox,
+		sampleSub(): formatLinks,
+	}
+	for content, want := range cases {
+		if got := sniffSubscriptionFormat(content); got != want {
+			t.Errorf("sniff = %q, want %q", got, want)
+		}
+	}
+}
+
+func TestClashSubscription(t *testing.T) {
+	servers, err := ParseSubscription(clashSub)
+	if err != nil {
+		t.Fatalf("ParseSubscription: %v", err)
+	}
+
+	// The snell node is dropped; the obfs one stays, for Mihomo
+	if len(servers) != 5 {
+		t.Fatalf("серверов = %d, want 5", len(servers))
+	}
+
+	want := []struct{ proto, name, country string }{
+		{"vless", "NL Amsterdam", "NL"},
+		{"vmess", "DE-Frankfurt", "DE"},
+		{"shadowsocks", "FI-ss", "FI"},
+		{"shadowsocks", "obfs-ss", ""},
+		{"hysteria2", "HY2 Tokyo JP", "JP"},
+	}
+	for i, w := range want {
+		s := servers[i]
+		if s.Protocol != w.proto || s.Name != w.name || s.Country != w.country {
+			t.Errorf("server[%d] = %s/%q/%s, want %s/%q/%s", i, s.Protocol, s.Name, s.Country, w.proto, w.name, w.country)
+		}
+	}
+
+	// The synthesised link carries everything the outbound needs
+	p, err := ParseProxyURI(servers[0].RawURI)
+	if err != nil {
+		t.Fatalf("ParseProxyURI(%s): %v", servers[0].RawURI, err)
+	}
+	if p.Security != "reality" || p.PublicKey != "KEY" || p.ShortID != "ab" || p.Flow != "xtls-rprx-vision" || p.SNI != "example.com" {
+		t.Errorf("vless params = %+v", p)
+	}
+
+	vm, err := ParseProxyURI(servers[1].RawURI)
+	if err != nil {
+		t.Fatalf("ParseProxyURI(vmess): %v", err)
+	}
+	if vm.Port != 8080 || vm.Network != "ws" || vm.Path != "/ws" || vm.Host != "cdn.example.com" || vm.Security != "tls" {
+		t.Errorf("vmess params = %+v", vm)
+	}
+
+	obfs, err := ParseProxyURI(servers[3].RawURI)
+	if err != nil || obfs.Plugin != "obfs-local;obfs=http;obfs-host=bing.com" {
+		t.Errorf("obfs plugin = %+v, %v", obfs, err)
+	}
+
+	hy, err := ParseProxyURI(servers[4].RawURI)
+	if err != nil {
+		t.Fatalf("ParseProxyURI(hy2): %v", err)
+	}
+	if hy.Obfs != "salamander" || hy.ObfsPassword != "salt" || hy.Password != "pw" {
+		t.Errorf("hysteria2 params = %+v", hy)
+	}
+}
+
+func TestSingBoxSubscription(t *testing.T) {
+	servers, err := ParseSubscription(singBoxSub)
+	if err != nil {
+		t.Fatalf("ParseSubscription: %v", err)
+	}
+
+	// selector and direct are not servers
+	if len(servers) != 3 {
+		t.Fatalf("серверов = %d, want 3", len(servers))
+	}
+
+	p, err := ParseProxyURI(servers[0].RawURI)
+	if err != nil {
+		t.Fatalf("ParseProxyURI: %v", err)
+	}
+	if p.Security != "reality" || p.Fingerprint != "chrome" || p.PublicKey != "KEY" {
+		t.Errorf("vless params = %+v", p)
+	}
+
+	tr, err := ParseProxyURI(servers[1].RawURI)
+	if err != nil {
+		t.Fatalf("ParseProxyURI(trojan): %v", err)
+	}
+	if servers[1].Name != "TR Istanbul" || tr.Network != "grpc" || tr.Path != "svc" || tr.Password != "pw" {
+		t.Errorf("trojan = %q %+v", servers[1].Name, tr)
+	}
+
+	tu, err := ParseProxyURI(servers[2].RawURI)
+	if err != nil {
+		t.Fatalf("ParseProxyURI(tuic): %v", err)
+	}
+	if tu.UUID != "id" || tu.Password != "pw" || tu.CongestionControl != "bbr" || tu.ALPN != "h3" {
+		t.Errorf("tuic params = %+v", tu)
+	}
+}
+
+// A document the panel builds a pool from has to produce the same endpoint as
+// the equivalent link, or a provider switching formats would reshuffle the pool.
+func TestDocumentEndpointMatchesLink(t *testing.T) {
+	fromDoc, err := ParseSubscription(singBoxSub)
+	if err != nil {
+		t.Fatalf("ParseSubscription: %v", err)
+	}
+	fromLink, err := ParseSubscription(realityURI + "#NL")
+	if err != nil {
+		t.Fatalf("ParseSubscription(link): %v", err)
+	}
+
+	a, okA := endpointOfServer(fromDoc[0])
+	b, okB := endpointOfServer(fromLink[0])
+	if !okA || !okB || a != b {
+		t.Errorf("endpoint from document %v != from link %v", a, b)
+	}
+}
+
+// The synthesised RawURI is what identifies the active server across refreshes,
+// so it has to come out the same every time the document is fetched.
+func TestClashSubscriptionKeepsActiveAcrossRefresh(t *testing.T) {
+	srv, set := subServer(t, clashSub)
+	sm := NewSubscriptionManager(t.TempDir())
+	if _, err := sm.UpdateURL(srv.URL); err != nil {
+		t.Fatalf("UpdateURL: %v", err)
+	}
+	if _, err := sm.SetActive(1); err != nil {
+		t.Fatalf("SetActive: %v", err)
+	}
+
+	// Same proxies, different order and an unrelated key added
+	set("log-level: info\n" + strings.Replace(clashSub, "proxies:\n", "proxies:\n  - {name: extra, type: trojan, server: x.example, port: 443, password: p}\n", 1))
+	if _, err := sm.Refresh(); err != nil {
+		t.Fatalf("Refresh: %v", err)
+	}
+
+	active := sm.GetActiveServer()
+	if active == nil || active.Name != "DE-Frankfurt" {
+		t.Fatalf("active = %+v, want DE-Frankfurt to survive the refresh", active)
+	}
+}
@@ -3,10 +3,11 @@ package xkeen
 import (
 	"encoding/json"
 	"fmt"
-	"io"
-	"net/http"
+	"maps"
 	"os"
 	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
 	"sync"
 	"time"
@@ -17,12 +18,29 @@ type SubscriptionManager struct {
 	dataDir string
 	data    *models.SubscriptionData
 	mu      sync.RWMutex
+
+	// Server lists as delivered, kept for diff and rollback
+	history      []models.SubscriptionSnapshot
+	historySize  int
+	historyDirty bool
+
+	// Refresh guard thresholds, see SetRefreshGuard
+	maxRemovedPercent int
+	minServers        int
+
+	// What happens to duplicates, see SetDuplicatePolicy
+	duplicateMode  string
+	duplicateRules []string
+
+	// Probe results per endpoint; has its own lock and file
+	latency *LatencyHistory
 }
 
 func NewSubscriptionManager(dataDir string) *SubscriptionManager {
 	return &SubscriptionManager{
 		dataDir: dataDir,
 		data:    &models.SubscriptionData{},
+		latency: NewLatencyHistory(dataDir),
 	}
 }
 
@@ -30,8 +48,14 @@ func (sm *SubscriptionManager) filePath() string {
 	return filepath.Join(sm.dataDir, "subscription.json")
 }
 
+// DefaultSubscriptionName names the subscription a single-URL install migrates
+// into, and the one UpdateURL edits.
+const DefaultSubscriptionName = "default"
+
 // Load reads the stored subscription.
 func (sm *SubscriptionManager) Load() error {
+	sm.latency.Load()
+
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
 
@@ -43,7 +67,37 @@ func (sm *SubscriptionManager) Load() error {
 		return err
 	}
 
-	return json.Unmarshal(data, sm.data)
+	if err := json.Unmarshal(data, sm.data); err != nil {
+		return err
+	}
+
+	sm.migrateLocked()
+	sm.applyPrefsLocked()
+	sm.loadHistoryLocked()
+	return nil
+}
+
+// migrateLocked turns a file from the single-provider days into a one-entry
+// subscription list, so its servers keep their source and a refresh does not
+// drop them as orphans.
+func (sm *SubscriptionManager) migrateLocked() {
+	if len(sm.data.Subscriptions) > 0 || sm.data.URL == "" {
+		return
+	}
+
+	sm.data.Subscriptions = []models.Subscription{{
+		Name:        DefaultSubscriptionName,
+		URL:         sm.data.URL,
+		Enabled:     true,
+		LastUpdated: sm.data.LastUpdated,
+	}}
+	sm.data.URL = ""
+
+	for i := range sm.data.Servers {
+		if sm.data.Servers[i].Source == "" {
+			sm.data.Servers[i].Source = DefaultSubscriptionName
+		}
+	}
 }
 
 // Save writes the subscription to disk.
@@ -60,89 +114,503 @@ func (sm *SubscriptionManager) Save() error {
 		return err
 	}
 
+	if err := os.WriteFile(sm.filePath(), data, 0600); err != nil {
+		return err
+	}
+	return sm.saveHistoryLocked()
+}
+
+// writeLocked writes the subscription file alone, without the snapshot
+// history. Call with sm.mu held.
+func (sm *SubscriptionManager) writeLocked() error {
+	data, err := json.MarshalIndent(sm.data, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(sm.dataDir, 0700); err != nil {
+		return err
+	}
 	return os.WriteFile(sm.filePath(), data, 0600)
 }
 
-// UpdateURL sets a new subscription URL, then downloads and parses it.
+// UpdateURL sets the URL of the primary subscription, then downloads and
+// parses it with the primary's fetch options. An install without subscriptions
+// gets the default one.
 func (sm *SubscriptionManager) UpdateURL(url string) ([]models.Server, error) {
-	servers, err := sm.downloadAndParse(url)
+	sm.mu.RLock()
+	var primary models.Subscription
+	if len(sm.data.Subscriptions) > 0 {
+		primary = sm.data.Subscriptions[0]
+	}
+	sm.mu.RUnlock()
+	primary.URL = url
+
+	fetch, err := sm.downloadAndParse(primary, false)
 	if err != nil {
 		return nil, err
 	}
 
 	sm.mu.Lock()
-	sm.data.URL = url
-	sm.applyRefreshLocked(servers)
+	if len(sm.data.Subscriptions) == 0 {
+		sm.data.Subscriptions = []models.Subscription{{Name: DefaultSubscriptionName, Enabled: true}}
+	}
+	sub := &sm.data.Subscriptions[0]
+	sub.URL = url
+	sub.Enabled = true
+	sm.markRefreshedLocked(sub.Name, fetch, nil)
+	sm.applyRefreshLocked(sub.Name, fetch.servers)
 	sm.mu.Unlock()
 
-	return servers, sm.Save()
+	return sm.GetServers(), sm.Save()
 }
 
-// Refresh reloads the servers from the current URL.
+// Refresh reloads every enabled subscription and returns the merged catalogue.
+//
+// One provider being down must not cost the servers of the others, so a
+// failing subscription keeps its previous servers and records the error. Only
+// when every subscription fails is the refresh an error.
+//
+// The refresh guard applies: the timer and the watchdog's failover run it, and
+// neither has anyone to look at a list that suddenly shrank.
 func (sm *SubscriptionManager) Refresh() ([]models.Server, error) {
+	return sm.refreshAll(true)
+}
+
+// RefreshByUser is Refresh for a refresh the user asked for. The guard stays
+// out of it: the user is looking at the result and may well mean to accept a
+// list that shrank.
+func (sm *SubscriptionManager) RefreshByUser() ([]models.Server, error) {
+	return sm.refreshAll(false)
+}
+
+func (sm *SubscriptionManager) refreshAll(guarded bool) ([]models.Server, error) {
+	var names []string
+	for _, sub := range sm.Subscriptions() {
+		if sub.Enabled && sub.URL != "" {
+			names = append(names, sub.Name)
+		}
+	}
+
+	if len(names) == 0 {
+		return nil, fmt.Errorf("URL подписки не задан")
+	}
+
+	var failures []string
+	var lastErr error
+	for _, name := range names {
+		if _, err := sm.refreshIfChanged(name, guarded); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", name, err))
+			lastErr = err
+		}
+	}
+
+	if len(failures) == len(names) {
+		if len(names) == 1 {
+			return nil, lastErr
+		}
+		return nil, fmt.Errorf("ни одна подписка не обновилась: %s", strings.Join(failures, "; "))
+	}
+	for _, failure := range failures {
+		Log("[SUBSCRIPTION] Подписка не обновилась, её серверы оставлены прежними — %s", failure)
+	}
+
+	return sm.GetServers(), nil
+}
+
+// RefreshSubscriptionByUser reloads one subscription the user asked to
+// refresh and returns the merged catalogue. Like RefreshByUser, it skips the
+// guard.
+func (sm *SubscriptionManager) RefreshSubscriptionByUser(name string) ([]models.Server, error) {
+	if _, err := sm.refreshIfChanged(name, false); err != nil {
+		return nil, err
+	}
+	return sm.GetServers(), nil
+}
+
+// RefreshIfChanged reloads one subscription and says whether its servers may
+// have changed. A provider answering the conditional request with 304 leaves
+// the catalogue untouched, and the caller has nothing to sync.
+func (sm *SubscriptionManager) RefreshIfChanged(name string) (bool, error) {
+	return sm.refreshIfChanged(name, true)
+}
+
+// refreshIfChanged is RefreshIfChanged with the guard optional: scheduled
+// refreshes answer to it, ones the user asked for do not.
+func (sm *SubscriptionManager) refreshIfChanged(name string, guarded bool) (bool, error) {
 	sm.mu.RLock()
-	url := sm.data.URL
+	sub, ok := sm.findLocked(name)
 	sm.mu.RUnlock()
 
-	if url == "" {
-		return nil, fmt.Errorf("URL подписки не задан")
+	if !ok {
+		return false, fmt.Errorf("подписка %q не найдена", name)
+	}
+	if sub.URL == "" {
+		return false, fmt.Errorf("URL подписки %q не задан", name)
+	}
+
+	fetch, err := sm.downloadAndParse(sub, true)
+
+	var quarantine *models.Quarantine
+	sm.mu.Lock()
+	if err == nil && !fetch.notModified && guarded {
+		if reason := sm.guardLocked(name, fetch.servers); reason != "" {
+			q := sm.quarantineLocked(name, fetch, reason)
+			quarantine = &q
+			err = &QuarantineError{Name: name, Reason: reason}
+		}
+	}
+	sm.markRefreshedLocked(name, fetch, err)
+	if err == nil && !fetch.notModified {
+		sm.applyRefreshLocked(name, fetch.servers)
+	}
+	sm.mu.Unlock()
+
+	if quarantine != nil {
+		Log("[SUBSCRIPTION] %s: обновление в карантине, серверы оставлены прежними — %s", name, quarantine.Reason)
+		if OnQuarantine != nil {
+			OnQuarantine(name, *quarantine)
+		}
 	}
 
-	servers, err := sm.downloadAndParse(url)
+	if saveErr := sm.Save(); err == nil && saveErr != nil {
+		return false, saveErr
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return !fetch.notModified, nil
+}
+
+// DueSubscriptions lists the enabled subscriptions whose refresh interval has
+// passed since the last attempt. A subscription without its own interval uses
+// the one its provider suggests when providerInterval is set, else fallback;
+// zero on all of them means it is refreshed only by hand.
+//
+// The last attempt counts, not the last success: a provider that is down
+// would otherwise be hammered on every tick.
+func (sm *SubscriptionManager) DueSubscriptions(fallback time.Duration, providerInterval bool, now time.Time) []string {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+
+	var due []string
+	for _, sub := range sm.data.Subscriptions {
+		if !sub.Enabled || sub.URL == "" {
+			continue
+		}
+		interval := fallback
+		switch {
+		case sub.RefreshInterval > 0:
+			interval = time.Duration(sub.RefreshInterval) * time.Second
+		case providerInterval && sub.Usage != nil && sub.Usage.UpdateInterval > 0:
+			interval = time.Duration(sub.Usage.UpdateInterval) * time.Second
+		}
+		if interval <= 0 {
+			continue
+		}
+
+		last := sub.LastAttempt
+		if sub.LastUpdated.After(last) {
+			last = sub.LastUpdated
+		}
+		if now.Sub(last) >= interval {
+			due = append(due, sub.Name)
+		}
+	}
+
+	return due
+}
+
+// Subscriptions returns the configured subscriptions.
+func (sm *SubscriptionManager) Subscriptions() []models.Subscription {
+	sm.mu.RLock()
+	defer sm.mu.RUnlock()
+	return append([]models.Subscription(nil), sm.data.Subscriptions...)
+}
+
+// routeNames are the static routes under /api/subscriptions: a subscription
+// named after one could not be reached by /api/subscriptions/{name}.
+var routeNames = []string{"history", "import"}
+
+// checkSubscriptionName refuses the names a subscription may not take.
+func checkSubscriptionName(name string) error {
+	if name == ManualSource {
+		return fmt.Errorf("имя %q зарезервировано для ручных серверов", ManualSource)
+	}
+	if slices.Contains(routeNames, name) {
+		return fmt.Errorf("имя %q зарезервировано панелью", name)
+	}
+	return nil
+}
+
+// AddSubscription registers a new subscription and downloads it at once, so a
+// wrong URL is reported now rather than at the next timer tick.
+func (sm *SubscriptionManager) AddSubscription(sub models.Subscription) ([]models.Server, error) {
+	sub.Name = strings.TrimSpace(sub.Name)
+	if sub.Name == "" {
+		return nil, fmt.Errorf("имя подписки обязательно")
+	}
+	if err := checkSubscriptionName(sub.Name); err != nil {
+		return nil, err
+	}
+	if sub.URL == "" {
+		return nil, fmt.Errorf("URL обязателен")
+	}
+	if sub.RefreshInterval < 0 {
+		return nil, fmt.Errorf("интервал обновления не может быть отрицательным")
+	}
+	if err := validateFetchOptions(sub.Fetch); err != nil {
+		return nil, err
+	}
+
+	fetch, err := sm.downloadAndParse(sub, false)
 	if err != nil {
 		return nil, err
 	}
 
 	sm.mu.Lock()
-	sm.applyRefreshLocked(servers)
+	if _, exists := sm.findLocked(sub.Name); exists {
+		sm.mu.Unlock()
+		return nil, fmt.Errorf("подписка %q уже есть", sub.Name)
+	}
+	sub.LastError = ""
+	sm.data.Subscriptions = append(sm.data.Subscriptions, sub)
+	sm.markRefreshedLocked(sub.Name, fetch, nil)
+	sm.applyRefreshLocked(sub.Name, fetch.servers)
+	sm.mu.Unlock()
+
+	return sm.GetServers(), sm.Save()
+}
+
+// UpdateSubscription edits a subscription in place. A changed URL is downloaded
+// before it is stored; a disabled subscription leaves the catalogue at once.
+func (sm *SubscriptionManager) UpdateSubscription(req models.SubscriptionRequest) ([]models.Server, error) {
+	sm.mu.RLock()
+	current, ok := sm.findLocked(req.Name)
+	sm.mu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("подписка %q не найдена", req.Name)
+	}
+
+	if req.RefreshInterval != nil && *req.RefreshInterval < 0 {
+		return nil, fmt.Errorf("интервал обновления не может быть отрицательным")
+	}
+	if req.Fetch != nil {
+		if err := validateFetchOptions(*req.Fetch); err != nil {
+			return nil, err
+		}
+	}
+
+	enabled := current.Enabled
+	if req.Enabled != nil {
+		enabled = *req.Enabled
+	}
+
+	var fetch *subscriptionFetch
+	urlChanged := req.URL != nil && *req.URL != current.URL
+	if req.URL != nil && *req.URL == "" {
+		return nil, fmt.Errorf("URL обязателен")
+	}
+	// New fetch options are tried at once: a User-Agent the provider does not
+	// like should fail here, not at the next refresh
+	fetchChanged := req.Fetch != nil && !reflect.DeepEqual(*req.Fetch, current.Fetch)
+	// An imported subscription has no URL to download; it comes back empty
+	// and waits for the next import
+	hasURL := current.URL != "" || req.URL != nil
+	if enabled && hasURL && (urlChanged || fetchChanged || !current.Enabled) {
+		target := current
+		if req.URL != nil {
+			target.URL = *req.URL
+		}
+		if req.Fetch != nil {
+			target.Fetch = *req.Fetch
+		}
+		fetched, err := sm.downloadAndParse(target, false)
+		if err != nil {
+			return nil, err
+		}
+		fetch = &fetched
+	}
+
+	sm.mu.Lock()
+	idx := sm.indexLocked(req.Name)
+	if idx < 0 {
+		sm.mu.Unlock()
+		return nil, fmt.Errorf("подписка %q не найдена", req.Name)
+	}
+	sub := &sm.data.Subscriptions[idx]
+	if req.URL != nil {
+		sub.URL = *req.URL
+	}
+	if req.RefreshInterval != nil {
+		sub.RefreshInterval = *req.RefreshInterval
+	}
+	if req.Fetch != nil {
+		sub.Fetch = *req.Fetch
+	}
+	sub.Enabled = enabled
+
+	if fetch != nil {
+		sm.markRefreshedLocked(sub.Name, *fetch, nil)
+		sm.applyRefreshLocked(sub.Name, fetch.servers)
+	} else {
+		sm.rebuildLocked("", nil)
+	}
+	sm.mu.Unlock()
+
+	return sm.GetServers(), sm.Save()
+}
+
+// RemoveSubscription drops a subscription together with its servers.
+func (sm *SubscriptionManager) RemoveSubscription(name string) ([]models.Server, error) {
+	sm.mu.Lock()
+	idx := sm.indexLocked(name)
+	if idx < 0 {
+		sm.mu.Unlock()
+		return nil, fmt.Errorf("подписка %q не найдена", name)
+	}
+	sm.data.Subscriptions = append(sm.data.Subscriptions[:idx], sm.data.Subscriptions[idx+1:]...)
+	sm.rebuildLocked("", nil)
 	sm.mu.Unlock()
 
-	return servers, sm.Save()
+	return sm.GetServers(), sm.Save()
 }
 
-// applyRefreshLocked swaps the server list, keeping the active server matched by
-// RawURI rather than index and carrying manual country overrides across. Call
-// with sm.mu held.
-func (sm *SubscriptionManager) applyRefreshLocked(servers []models.Server) {
+func (sm *SubscriptionManager) indexLocked(name string) int {
+	for i := range sm.data.Subscriptions {
+		if sm.data.Subscriptions[i].Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (sm *SubscriptionManager) findLocked(name string) (models.Subscription, bool) {
+	if idx := sm.indexLocked(name); idx >= 0 {
+		return sm.data.Subscriptions[idx], true
+	}
+	return models.Subscription{}, false
+}
+
+// markRefreshedLocked records the outcome of a download attempt. A download
+// that never got a response, or got a 304, keeps the previous report and usage.
+//
+// Validators are kept only from a response that parsed: a 304 then means
+// "the same servers as now", never "the same broken body".
+func (sm *SubscriptionManager) markRefreshedLocked(name string, fetch subscriptionFetch, err error) {
+	idx := sm.indexLocked(name)
+	if idx < 0 {
+		return
+	}
+
+	sub := &sm.data.Subscriptions[idx]
+	sub.LastAttempt = time.Now()
+	if fetch.report != nil {
+		sub.Report = fetch.report
+		sub.Usage = fetch.usage
+	}
+	if err == nil && !fetch.notModified {
+		sub.ETag = fetch.etag
+		sub.LastModified = fetch.lastModified
+	}
+	if err != nil {
+		sub.LastError = err.Error()
+		return
+	}
+	sub.LastError = ""
+	sub.LastUpdated = sub.LastAttempt
+	// The provider is back to a list that passes: whatever was held is stale
+	sub.Quarantine = nil
+}
+
+// rebuildLocked reassembles the catalogue with fresh as the new servers of
+// source (empty source: nothing was downloaded, only membership changed).
+//
+// Servers are laid out subscription by subscription, in the order the
+// subscriptions are listed, so IDs stay predictable. The active server is
+// matched by RawURI rather than index, manual country overrides are carried
+// across and the user's prefs are applied by endpoint. Call with sm.mu held.
+func (sm *SubscriptionManager) rebuildLocked(source string, fresh []models.Server) {
+	old := sm.data.Servers
+
 	var activeURI string
-	if sm.data.ActiveID >= 0 && sm.data.ActiveID < len(sm.data.Servers) {
-		activeURI = sm.data.Servers[sm.data.ActiveID].RawURI
+	if sm.data.ActiveID >= 0 && sm.data.ActiveID < len(old) {
+		activeURI = old[sm.data.ActiveID].RawURI
 	}
 
-	carryOverrides(sm.data.Servers, servers)
+	for i := range fresh {
+		fresh[i].Source = source
+	}
+	carryOverrides(old, fresh)
 
-	sm.data.LastUpdated = time.Now()
-	sm.data.Servers = servers
-
-	newActive := 0
-	if activeURI != "" {
-		for i := range servers {
-			if servers[i].RawURI == activeURI {
-				newActive = i
-				break
+	var merged []models.Server
+	for _, sub := range sm.data.Subscriptions {
+		if !sub.Enabled {
+			continue
+		}
+		if source != "" && sub.Name == source {
+			merged = append(merged, fresh...)
+			continue
+		}
+		for _, server := range old {
+			if server.Source == sub.Name {
+				merged = append(merged, server)
 			}
 		}
 	}
-	sm.data.ActiveID = newActive
-	for i := range sm.data.Servers {
-		sm.data.Servers[i].Active = i == newActive
+	merged = append(merged, sm.manualServersLocked(old)...)
+
+	newActive := -1
+	for i := range merged {
+		merged[i].ID = i
+		if newActive < 0 && activeURI != "" && merged[i].RawURI == activeURI {
+			newActive = i
+		}
+	}
+	if newActive < 0 {
+		newActive = 0
+	}
+	for i := range merged {
+		merged[i].Active = i == newActive
 	}
+
+	sm.data.LastUpdated = time.Now()
+	sm.data.Servers = merged
+	sm.data.ActiveID = newActive
+	sm.applyPrefsLocked()
 }
 
-// carryOverrides moves manual CountryOverride values onto the new list by RawURI.
+// carryOverrides moves manual CountryOverride values, speed test results,
+// discovered exits and UDP checks onto the new list by RawURI. A speed test
+// costs real traffic and the others a throwaway core, so a refresh must not
+// throw them away.
 func carryOverrides(old, fresh []models.Server) {
 	if len(old) == 0 {
 		return
 	}
-	overrides := make(map[string]string, len(old))
+	byURI := make(map[string]models.Server, len(old))
 	for i := range old {
-		if old[i].CountryOverride != "" && old[i].RawURI != "" {
-			overrides[old[i].RawURI] = old[i].CountryOverride
+		if old[i].RawURI != "" {
+			byURI[old[i].RawURI] = old[i]
 		}
 	}
 	for i := range fresh {
-		if ov, ok := overrides[fresh[i].RawURI]; ok {
-			fresh[i].CountryOverride = ov
+		prev, ok := byURI[fresh[i].RawURI]
+		if !ok {
+			continue
+		}
+		if prev.CountryOverride != "" {
+			fresh[i].CountryOverride = prev.CountryOverride
+		}
+		if fresh[i].Speed == nil {
+			fresh[i].Speed = prev.Speed
+		}
+		if fresh[i].UDP == nil {
+			fresh[i].UDP = prev.UDP
+		}
+		if fresh[i].ExitChecked.IsZero() && fresh[i].ExitTried.IsZero() {
+			fresh[i].ExitIP, fresh[i].ExitCountry, fresh[i].ExitChecked = prev.ExitIP, prev.ExitCountry, prev.ExitChecked
+			fresh[i].ExitTried = prev.ExitTried
 		}
 	}
 }
@@ -154,6 +622,9 @@ func (sm *SubscriptionManager) GetData() models.SubscriptionData {
 	defer sm.mu.RUnlock()
 	d := *sm.data
 	d.Servers = append([]models.Server(nil), sm.data.Servers...)
+	d.Manual = append([]string(nil), sm.data.Manual...)
+	d.Prefs = maps.Clone(sm.data.Prefs)
+	d.Filters = maps.Clone(sm.data.Filters)
 	return d
 }
 
@@ -322,23 +793,3 @@ func (sm *SubscriptionManager) SelectNext() (*models.Server, error) {
 	next := (current + 1) % count
 	return sm.SetActive(next)
 }
-
-func (sm *SubscriptionManager) downloadAndParse(url string) ([]models.Server, error) {
-	client := &http.Client{Timeout: 30 * time.Second}
-	resp, err := client.Get(url)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка загрузки подписки: %w", err)
-	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("сервер вернул код %d", resp.StatusCode)
-	}
-
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("ошибка чтения ответа: %w", err)
-	}
-
-	return ParseSubscription(string(body))
-}
@@ -3,9 +3,12 @@ package xkeen
 import (
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strings"
 	"sync"
 	"testing"
+	"time"
 	"xkeen-panel/internal/models"
 )
 
@@ -223,3 +226,192 @@ func TestSetActiveBounds(t *testing.T) {
 		t.Errorf("SetActive(0): неожиданная ошибка %v", err)
 	}
 }
+
+func TestMultipleSubscriptionsMerge(t *testing.T) {
+	primary, _ := subServer(t, body(uriA, uriB))
+	backup, _ := subServer(t, body(uriC))
+	sm := NewSubscriptionManager(t.TempDir())
+
+	if _, err := sm.AddSubscription(models.Subscription{Name: "primary", URL: primary.URL, Enabled: true}); err != nil {
+		t.Fatalf("AddSubscription primary: %v", err)
+	}
+	servers, err := sm.AddSubscription(models.Subscription{Name: "backup", URL: backup.URL, Enabled: true})
+	if err != nil {
+		t.Fatalf("AddSubscription backup: %v", err)
+	}
+
+	if len(servers) != 3 {
+		t.Fatalf("got %d servers, want 3 from both providers", len(servers))
+	}
+	for i, s := range servers {
+		if s.ID != i {
+			t.Errorf("server %d has ID %d — IDs must index the merged catalogue", i, s.ID)
+		}
+	}
+	if s := findByURI(servers, uriC); s == nil || s.Source != "backup" {
+		t.Errorf("C must be tagged with its source: %+v", s)
+	}
+	if s := findByURI(servers, uriA); s == nil || s.Source != "primary" {
+		t.Errorf("A must be tagged with its source: %+v", s)
+	}
+
+	if _, err := sm.AddSubscription(models.Subscription{Name: "backup", URL: backup.URL}); err == nil {
+		t.Error("a duplicate name must be rejected")
+	}
+}
+
+// One provider being down must not take the servers of the other one with it.
+func TestRefreshKeepsServersOfFailingSubscription(t *testing.T) {
+	primary, _ := subServer(t, body(uriA))
+	backup, setBackup := subServer(t, body(uriC))
+	sm := NewSubscriptionManager(t.TempDir())
+
+	sm.AddSubscription(models.Subscription{Name: "primary", URL: primary.URL, Enabled: true})
+	sm.AddSubscription(models.Subscription{Name: "backup", URL: backup.URL, Enabled: true})
+
+	setBackup("garbage")
+	servers, err := sm.Refresh()
+	if err != nil {
+		t.Fatalf("Refresh with one provider healthy: %v", err)
+	}
+	if findByURI(servers, uriC) == nil {
+		t.Error("servers of the failing subscription were dropped")
+	}
+
+	for _, sub := range sm.Subscriptions() {
+		if sub.Name == "backup" && sub.LastError == "" {
+			t.Error("the failure must be recorded on the subscription")
+		}
+		if sub.Name == "primary" && sub.LastError != "" {
+			t.Errorf("primary reports an error it did not have: %s", sub.LastError)
+		}
+	}
+}
+
+func TestDisabledSubscriptionLeavesCatalogue(t *testing.T) {
+	primary, _ := subServer(t, body(uriA, uriB))
+	backup, _ := subServer(t, body(uriC))
+	sm := NewSubscriptionManager(t.TempDir())
+
+	sm.AddSubscription(models.Subscription{Name: "primary", URL: primary.URL, Enabled: true})
+	sm.AddSubscription(models.Subscription{Name: "backup", URL: backup.URL, Enabled: true})
+	if _, err := sm.SetActiveByRawURI(uriC); err != nil {
+		t.Fatalf("SetActiveByRawURI: %v", err)
+	}
+
+	off := false
+	servers, err := sm.UpdateSubscription(models.SubscriptionRequest{Name: "backup", Enabled: &off})
+	if err != nil {
+		t.Fatalf("UpdateSubscription: %v", err)
+	}
+	if len(servers) != 2 || findByURI(servers, uriC) != nil {
+		t.Fatalf("disabled subscription still in the catalogue: %+v", servers)
+	}
+	if active := sm.GetActiveServer(); active == nil || active.RawURI != uriA {
+		t.Errorf("active server must fall back to the first one, got %+v", active)
+	}
+
+	if _, err := sm.RemoveSubscription("primary"); err != nil {
+		t.Fatalf("RemoveSubscription: %v", err)
+	}
+	if got := sm.GetServers(); len(got) != 0 {
+		t.Errorf("removed subscription left %d servers behind", len(got))
+	}
+}
+
+// A subscription.json from the single-URL days must load as one subscription
+// that owns the servers already stored.
+func TestLoadMigratesSingleURL(t *testing.T) {
+	dir := t.TempDir()
+	legacy := `{"url":"https://example.com/sub","servers":[{"id":0,"raw_uri":"` + uriA + `"}],"active_id":0}`
+	if err := os.WriteFile(filepath.Join(dir, "subscription.json"), []byte(legacy), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	sm := NewSubscriptionManager(dir)
+	if err := sm.Load(); err != nil {
+		t.Fatalf("Load: %v", err)
+	}
+
+	subs := sm.Subscriptions()
+	if len(subs) != 1 || subs[0].URL != "https://example.com/sub" || !subs[0].Enabled {
+		t.Fatalf("legacy URL not migrated: %+v", subs)
+	}
+	if got := sm.GetServers()[0].Source; got != DefaultSubscriptionName {
+		t.Errorf("Source = %q, want %q", got, DefaultSubscriptionName)
+	}
+}
+
+func TestDueSubscriptions(t *testing.T) {
+	now := time.Now()
+	sm := loadSub(t, nil, 0)
+	sm.data.Subscriptions = []models.Subscription{
+		{Name: "fresh", URL: "u1", Enabled: true, LastUpdated: now.Add(-time.Minute)},
+		{Name: "stale", URL: "u2", Enabled: true, LastUpdated: now.Add(-time.Hour)},
+		{Name: "own", URL: "u3", Enabled: true, RefreshInterval: 30, LastUpdated: now.Add(-time.Minute)},
+		{Name: "retried", URL: "u4", Enabled: true, LastAttempt: now.Add(-time.Minute)},
+		{Name: "off", URL: "u5", Enabled: false},
+		{Name: "provider", URL: "u6", Enabled: true, LastUpdated: now.Add(-10 * time.Minute),
+			Usage: &models.SubscriptionUsage{UpdateInterval: 300}},
+	}
+
+	due := sm.DueSubscriptions(30*time.Minute, false, now)
+	if strings.Join(due, ",") != "stale,own" {
+		t.Errorf("due = %v, want [stale own]", due)
+	}
+
+	if due := sm.DueSubscriptions(0, false, now); strings.Join(due, ",") != "own" {
+		t.Errorf("with the global interval off only own intervals count, got %v", due)
+	}
+
+	if due := sm.DueSubscriptions(30*time.Minute, true, now); strings.Join(due, ",") != "stale,own,provider" {
+		t.Errorf("the provider's interval must replace the global one, got %v", due)
+	}
+}
+
+func TestRefreshStoresReport(t *testing.T) {
+	srv, set := subServer(t, body(uriA, "socks://u:p@1.1.1.1:1080"))
+	sm := NewSubscriptionManager(t.TempDir())
+	if _, err := sm.UpdateURL(srv.URL); err != nil {
+		t.Fatalf("UpdateURL: %v", err)
+	}
+
+	report := sm.Subscriptions()[0].Report
+	if report == nil || report.Accepted != 1 || len(report.Rejected) != 1 {
+		t.Fatalf("report = %+v", report)
+	}
+
+	// A body with nothing usable still explains itself
+	set("garbage")
+	sm.Refresh()
+	report = sm.Subscriptions()[0].Report
+	if report == nil || report.Accepted != 0 || len(report.Rejected) != 1 || report.Rejected[0].Text != "garbage" {
+		t.Fatalf("report after a failed parse = %+v", report)
+	}
+}
+
+func TestRefreshStoresUsage(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Subscription-Userinfo", "upload=100; download=850; total=1000; expire=4102444800")
+		w.Header().Set("Profile-Update-Interval", "12")
+		w.Header().Set("Profile-Title", "base64:0JzQvtC5INCS0J/QnQ==")
+		w.Write([]byte(body(uriA)))
+	}))
+	t.Cleanup(srv.Close)
+
+	sm := NewSubscriptionManager(t.TempDir())
+	if _, err := sm.UpdateURL(srv.URL); err != nil {
+		t.Fatalf("UpdateURL: %v", err)
+	}
+
+	usage := sm.Subscriptions()[0].Usage
+	if usage == nil || usage.Upload != 100 || usage.Download != 850 || usage.Total != 1000 ||
+		usage.Expire.Year() != 2100 || usage.UpdateInterval != 12*3600 || usage.Title != "Мой ВПН" {
+		t.Fatalf("usage = %+v", usage)
+	}
+
+	status := sm.UsageStatus(0, 0, time.Now())
+	if len(status) != 1 || len(status[0].Warnings) != 1 || !strings.Contains(status[0].Warnings[0], "95%") {
+		t.Errorf("status = %+v, want a quota warning", status)
+	}
+}
@@ -17,6 +17,35 @@ type Topology struct {
 	Selectors   []string `json:"-"`
 	PoolTags    []string `json:"pool_tags,omitempty"`
 	ProxyTags   []string `json:"proxy_tags,omitempty"`
+
+	// Balancers lists every balancer with a usable selector, the main one
+	// included; the fields above describe the main one
+	Balancers []TopologyBalancer `json:"balancers,omitempty"`
+}
+
+// TopologyBalancer is one balancer and the tags it selects.
+type TopologyBalancer struct {
+	Tag       string   `json:"tag"`
+	Selectors []string `json:"selectors"`
+	PoolTags  []string `json:"pool_tags,omitempty"`
+}
+
+// Balancer views one balancer as a pool topology of its own, which is what
+// pinning and pool refreshes work on.
+func (t Topology) Balancer(tag string) (Topology, bool) {
+	for _, b := range t.Balancers {
+		if b.Tag == tag {
+			return Topology{
+				Mode:        TopologyPool,
+				BalancerTag: b.Tag,
+				Selectors:   b.Selectors,
+				PoolTags:    b.PoolTags,
+				ProxyTags:   t.ProxyTags,
+				Balancers:   []TopologyBalancer{b},
+			}, true
+		}
+	}
+	return Topology{}, false
 }
 
 const (
@@ -57,8 +86,6 @@ func ReadTopology(rt Runtime) Topology {
 		}
 	}
 
-	// The first balancer with a usable selector wins — XKeen's own speed
-	// balancer works the same way, on one tag at a time.
 	for _, raw := range balancers {
 		balancer, ok := raw.(map[string]interface{})
 		if !ok {
@@ -72,11 +99,24 @@ func ReadTopology(rt Runtime) Topology {
 		if tag == "" {
 			continue
 		}
+		top.Balancers = append(top.Balancers, TopologyBalancer{
+			Tag:       tag,
+			Selectors: selectors,
+			PoolTags:  matchSelectors(top.ProxyTags, selectors),
+		})
+	}
 
+	// The first balancer that is not a named pool is the main one — XKeen's
+	// own speed balancer works the same way, on one tag at a time. Named pools
+	// and the unpinned twins only ever run next to it.
+	for _, b := range top.Balancers {
+		if isNamedPoolTag(b.Tag) || IsBypassBalancerTag(b.Tag) {
+			continue
+		}
 		top.Mode = TopologyPool
-		top.BalancerTag = tag
-		top.Selectors = selectors
-		top.PoolTags = matchSelectors(top.ProxyTags, selectors)
+		top.BalancerTag = b.Tag
+		top.Selectors = b.Selectors
+		top.PoolTags = b.PoolTags
 		break
 	}
 
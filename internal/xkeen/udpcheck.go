@@ -0,0 +1,264 @@
+package xkeen
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+// DefaultUDPCheckDNS is the resolver the UDP check queries through a node.
+const DefaultUDPCheckDNS = "1.1.1.1:53"
+
+// udpCheckName is the name the check resolves; any answer will do.
+const udpCheckName = "cloudflare.com"
+
+// UDPChecker learns whether UDP gets through each node.
+//
+// A node can carry TCP perfectly and still drop UDP — the server refuses it,
+// the transport cannot carry it, or a middlebox eats it — and games and calls
+// are what notices. The check sends a DNS query over UDP through the node in
+// a throwaway core, via the SOCKS5 UDP ASSOCIATE of its inbound.
+type UDPChecker struct {
+	Runtime       Runtime
+	OutboundsPath string
+	DNSServer     string // host:port
+	Timeout       time.Duration
+	Concurrency   int
+}
+
+// UDPCheckerFromConfig builds the checker the config describes.
+func UDPCheckerFromConfig(cfg *models.Config, rt Runtime) UDPChecker {
+	return UDPChecker{
+		Runtime:       rt,
+		OutboundsPath: cfg.OutboundsFile,
+		DNSServer:     cfg.UDPCheckDNS,
+		Timeout:       time.Duration(cfg.LatencyProbeTimeoutMs) * time.Millisecond,
+		Concurrency:   cfg.ProbeConcurrency,
+	}
+}
+
+// Check queries DNS through every server; results[i] belongs to servers[i].
+// A server the core cannot carry gets an error and no time: it was not
+// checked. The error returned means no node could be asked at all.
+func (c UDPChecker) Check(servers []models.Server) ([]models.UDPCheck, error) {
+	results := make([]models.UDPCheck, len(servers))
+	if len(servers) == 0 {
+		return results, nil
+	}
+	if err := checkProbeCore(c.Runtime); err != nil {
+		return nil, err
+	}
+
+	var nodes []int
+	var outbounds []map[string]interface{}
+	template := probeTemplate(c.OutboundsPath)
+	for i, s := range servers {
+		ob, ok := probeOutbound(s, template)
+		if !ok {
+			results[i].Error = fmt.Sprintf("протокол %s не поддерживается xray", s.Protocol)
+			continue
+		}
+		nodes = append(nodes, i)
+		outbounds = append(outbounds, ob)
+	}
+	if len(nodes) == 0 {
+		return results, nil
+	}
+
+	ports, err := freePorts(len(nodes))
+	if err != nil {
+		return nil, err
+	}
+	stop, err := startProbeCore(c.Runtime.CoreBin, withSocksUDP(realDelayConfig(outbounds, ports)), ports[0])
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+
+	dns := c.DNSServer
+	if dns == "" {
+		dns = DefaultUDPCheckDNS
+	}
+	timeout := c.Timeout
+	if timeout <= 0 {
+		timeout = DefaultRealDelayTimeout
+	}
+
+	positions := make([]int, len(nodes))
+	for i := range positions {
+		positions[i] = i
+	}
+	parallel(positions, c.Concurrency, func(n int) {
+		result := &results[nodes[n]]
+		result.Time = time.Now()
+		rtt, err := socksDNSQuery(fmt.Sprintf("127.0.0.1:%d", ports[n]), dns, timeout)
+		if err != nil {
+			result.Error = err.Error()
+			return
+		}
+		result.OK, result.LatencyMs = true, rtt
+	})
+	return results, nil
+}
+
+// withSocksUDP lets the probe inbounds relay UDP. Xray answers UDP ASSOCIATE
+// with the address in "ip", which has to be the loopback the client reaches.
+func withSocksUDP(config map[string]interface{}) map[string]interface{} {
+	inbounds, _ := config["inbounds"].([]interface{})
+	for _, raw := range inbounds {
+		if in, ok := raw.(map[string]interface{}); ok {
+			in["settings"] = map[string]interface{}{"auth": "noauth", "udp": true, "ip": "127.0.0.1"}
+		}
+	}
+	return config
+}
+
+// socksDNSQuery sends one DNS query to dns over UDP through the SOCKS5 proxy
+// and times the answer.
+func socksDNSQuery(proxy, dns string, timeout time.Duration) (int, error) {
+	host, portStr, err := net.SplitHostPort(dns)
+	if err != nil {
+		return 0, fmt.Errorf("неверный адрес DNS %q: %w", dns, err)
+	}
+	dnsIP := net.ParseIP(host).To4()
+	port, _ := strconv.Atoi(portStr)
+	if dnsIP == nil || port <= 0 {
+		return 0, fmt.Errorf("адрес DNS должен быть IPv4:порт, а не %q", dns)
+	}
+
+	deadline := time.Now().Add(timeout)
+	ctrl, err := net.DialTimeout("tcp", proxy, timeout)
+	if err != nil {
+		return 0, err
+	}
+	// The association lives as long as this connection
+	defer ctrl.Close()
+	ctrl.SetDeadline(deadline)
+
+	relay, err := socksUDPAssociate(ctrl)
+	if err != nil {
+		return 0, err
+	}
+	conn, err := net.DialUDP("udp", nil, relay)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	id, query := dnsQuery(udpCheckName)
+	// RSV(2) FRAG(1) ATYP=IPv4 ADDR PORT, then the payload
+	datagram := append([]byte{0, 0, 0, 1}, dnsIP...)
+	datagram = binary.BigEndian.AppendUint16(datagram, uint16(port))
+	datagram = append(datagram, query...)
+
+	start := time.Now()
+	if _, err := conn.Write(datagram); err != nil {
+		return 0, err
+	}
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return 0, fmt.Errorf("нет ответа DNS через сервер: %w", err)
+	}
+	rtt := int(time.Since(start).Milliseconds())
+
+	// Skip the SOCKS header: 4 bytes, the address, 2 bytes of port
+	if n < 10 || buf[3] != 1 {
+		return 0, fmt.Errorf("неожиданный ответ прокси")
+	}
+	answer := buf[10:n]
+	if len(answer) < 12 || binary.BigEndian.Uint16(answer) != id || answer[2]&0x80 == 0 {
+		return 0, fmt.Errorf("ответ не похож на DNS")
+	}
+	return rtt, nil
+}
+
+// socksUDPAssociate negotiates a UDP relay on a SOCKS5 control connection.
+func socksUDPAssociate(ctrl net.Conn) (*net.UDPAddr, error) {
+	if _, err := ctrl.Write([]byte{5, 1, 0}); err != nil {
+		return nil, err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, reply); err != nil || reply[0] != 5 || reply[1] != 0 {
+		return nil, fmt.Errorf("прокси не принял подключение")
+	}
+
+	// UDP ASSOCIATE with an unspecified client address
+	if _, err := ctrl.Write([]byte{5, 3, 0, 1, 0, 0, 0, 0, 0, 0}); err != nil {
+		return nil, err
+	}
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(ctrl, head); err != nil {
+		return nil, err
+	}
+	if head[1] != 0 {
+		return nil, fmt.Errorf("прокси отказал в UDP (код %d)", head[1])
+	}
+
+	var ip net.IP
+	switch head[3] {
+	case 1:
+		ip = make(net.IP, 4)
+	case 4:
+		ip = make(net.IP, 16)
+	default:
+		return nil, fmt.Errorf("прокси вернул адрес типа %d", head[3])
+	}
+	if _, err := io.ReadFull(ctrl, ip); err != nil {
+		return nil, err
+	}
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(ctrl, portBytes); err != nil {
+		return nil, err
+	}
+	if ip.IsUnspecified() {
+		ip = ctrl.RemoteAddr().(*net.TCPAddr).IP
+	}
+	return &net.UDPAddr{IP: ip, Port: int(binary.BigEndian.Uint16(portBytes))}, nil
+}
+
+// dnsQuery builds a recursive A query for name.
+func dnsQuery(name string) (uint16, []byte) {
+	var idBytes [2]byte
+	rand.Read(idBytes[:])
+	id := binary.BigEndian.Uint16(idBytes[:])
+
+	msg := binary.BigEndian.AppendUint16(nil, id)
+	msg = append(msg, 0x01, 0x00, 0, 1, 0, 0, 0, 0, 0, 0) // RD; one question
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0, 0, 1, 0, 1) // root, type A, class IN
+	return id, msg
+}
+
+// UpdateUDP stores UDP check results back into the catalogue by RawURI;
+// results[i] belongs to servers[i]. A server that was not checked keeps what
+// was known.
+func (sm *SubscriptionManager) UpdateUDP(servers []models.Server, results []models.UDPCheck) error {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+
+	byURI := make(map[string]models.UDPCheck, len(results))
+	for i, r := range results {
+		if i < len(servers) && servers[i].RawURI != "" && !r.Time.IsZero() {
+			byURI[servers[i].RawURI] = r
+		}
+	}
+	for i := range sm.data.Servers {
+		if r, ok := byURI[sm.data.Servers[i].RawURI]; ok {
+			check := r
+			sm.data.Servers[i].UDP = &check
+		}
+	}
+	return sm.writeLocked()
+}
@@ -0,0 +1,161 @@
+package xkeen
+
+import (
+	"encoding/binary"
+	"io"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+// fakeDNS answers every query by echoing it back with the response bit set.
+func fakeDNS(t *testing.T) *net.UDPAddr {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	go func() {
+		buf := make([]byte, 1500)
+		for {
+			n, from, err := conn.ReadFromUDP(buf)
+			if err != nil {
+				return
+			}
+			buf[2] |= 0x80
+			conn.WriteToUDP(buf[:n], from)
+		}
+	}()
+	return conn.LocalAddr().(*net.UDPAddr)
+}
+
+// fakeSocks is a SOCKS5 proxy that only does UDP ASSOCIATE, relaying IPv4
+// datagrams — or, with relayUDP off, accepting the association and dropping
+// everything, like a node that cannot carry UDP.
+func fakeSocks(t *testing.T, relayUDP bool) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	go func() {
+		for {
+			ctrl, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer ctrl.Close()
+				buf := make([]byte, 10)
+				if _, err := io.ReadFull(ctrl, buf[:3]); err != nil {
+					return
+				}
+				ctrl.Write([]byte{5, 0})
+				if _, err := io.ReadFull(ctrl, buf); err != nil || buf[1] != 3 {
+					return
+				}
+
+				relay, _ := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+				defer relay.Close()
+				port := relay.LocalAddr().(*net.UDPAddr).Port
+				ctrl.Write(binary.BigEndian.AppendUint16([]byte{5, 0, 0, 1, 127, 0, 0, 1}, uint16(port)))
+
+				go func() {
+					packet := make([]byte, 1500)
+					n, client, err := relay.ReadFromUDP(packet)
+					if err != nil || !relayUDP {
+						return
+					}
+					target := &net.UDPAddr{IP: net.IP(packet[4:8]), Port: int(binary.BigEndian.Uint16(packet[8:10]))}
+					upstream, err := net.DialUDP("udp", nil, target)
+					if err != nil {
+						return
+					}
+					defer upstream.Close()
+					upstream.Write(packet[10:n])
+					upstream.SetReadDeadline(time.Now().Add(time.Second))
+					answer := make([]byte, 1500)
+					m, err := upstream.Read(answer)
+					if err != nil {
+						return
+					}
+					relay.WriteToUDP(append(packet[:10:10], answer[:m]...), client)
+				}()
+				io.Copy(io.Discard, ctrl) // the association lasts until the client hangs up
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func TestSocksDNSQuery(t *testing.T) {
+	dns := fakeDNS(t)
+
+	if _, err := socksDNSQuery(fakeSocks(t, true), dns.String(), 2*time.Second); err != nil {
+		t.Errorf("through a UDP-capable proxy: %v", err)
+	}
+	if _, err := socksDNSQuery(fakeSocks(t, false), dns.String(), 300*time.Millisecond); err == nil {
+		t.Error("a proxy that drops UDP must fail the check")
+	}
+}
+
+func TestDNSQueryEncodesName(t *testing.T) {
+	_, msg := dnsQuery("cloudflare.com")
+	want := "\x0acloudflare\x03com\x00"
+	if got := string(msg[12 : 12+len(want)]); got != want {
+		t.Errorf("qname = %q, want %q", got, want)
+	}
+}
+
+func TestCheckServerLatencyHonoursProbeMode(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	defer l.Close()
+	port := l.Addr().(*net.TCPAddr).Port
+
+	// Nothing answers QUIC on this port, but the user asked for a TCP probe
+	server := models.Server{Protocol: "hysteria2", Address: "127.0.0.1", Port: port,
+		RawURI: "hy2://secret@127.0.0.1:" + strconv.Itoa(port) + "?sni=x#hy2", ProbeMode: ServerProbeTCP}
+	if got := CheckServerLatency(server, time.Second); got < 0 {
+		t.Errorf("TCP probe of a listening port = %d", got)
+	}
+	server.ProbeMode = ""
+	if got := CheckServerLatency(server, 300*time.Millisecond); got >= 0 {
+		t.Errorf("QUIC probe of a TCP-only port = %d, want -1", got)
+	}
+}
+
+func TestOverQUIC(t *testing.T) {
+	h3, _ := ParseProxyURI("vless://33333333-4444-5555-6666-777777777777@h3.example:443?type=xhttp&security=tls&alpn=h3#h3")
+	h2, _ := ParseProxyURI("vless://33333333-4444-5555-6666-777777777777@h3.example:443?type=xhttp&security=tls&alpn=h2#h2")
+	if h3 == nil || !overQUIC(h3) {
+		t.Error("xhttp over h3 must be probed over QUIC")
+	}
+	if h2 == nil || overQUIC(h2) {
+		t.Error("xhttp over h2 is TCP")
+	}
+	both, _ := ParseProxyURI("vless://33333333-4444-5555-6666-777777777777@h3.example:443?type=xhttp&security=tls&alpn=h3%2Ch2#both")
+	if both == nil || overQUIC(both) {
+		t.Error("xhttp with an ALPN list dials TCP, h3 in it or not")
+	}
+}
+
+func TestPoolSelectionRequiresUDP(t *testing.T) {
+	servers := []models.Server{
+		{Protocol: "vless", RawURI: realityURI, UDP: &models.UDPCheck{OK: true}},
+		{Protocol: "vless", RawURI: wsURI, UDP: &models.UDPCheck{OK: false, Error: "timeout"}},
+		{Protocol: "vless", RawURI: steadyURI},
+	}
+	got := SelectPoolServers(servers, PoolSelection{RequireUDP: true})
+	if len(got) != 1 || got[0].RawURI != realityURI {
+		t.Errorf("pool = %v, want only the server UDP was proven through", got)
+	}
+}
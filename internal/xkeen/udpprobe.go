@@ -0,0 +1,327 @@
+package xkeen
+
+import (
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"net"
+	"strconv"
+	"time"
+
+	"golang.org/x/crypto/blake2b"
+	"golang.org/x/crypto/blake2s"
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"xkeen-panel/internal/models"
+)
+
+// Per-server transport probes (ServerPrefs.Probe); empty goes by the protocol.
+const (
+	ServerProbeTCP  = "tcp"
+	ServerProbeQUIC = "quic"
+)
+
+// CheckServerLatency probes a server over the transport it actually uses. A TCP
+// connect to a Hysteria2, TUIC or WireGuard port says nothing — nothing listens
+// there on TCP — so those get a UDP exchange the server is bound to answer, and
+// so does xhttp carried over HTTP/3. A probe mode set on the server wins.
+func CheckServerLatency(server models.Server, timeout time.Duration) int {
+	if server.ProbeMode == ServerProbeTCP {
+		return CheckLatency(server.Address, server.Port, timeout)
+	}
+
+	p, err := ParseProxyURI(server.RawURI)
+	if err != nil {
+		if server.ProbeMode == "" {
+			return CheckLatency(server.Address, server.Port, timeout)
+		}
+		return -1
+	}
+
+	switch {
+	case p.Protocol == "wireguard":
+		return probeWireGuard(p, timeout)
+	case server.ProbeMode == ServerProbeQUIC, overQUIC(p):
+		return probeQUIC(p, timeout)
+	default:
+		return CheckLatency(server.Address, server.Port, timeout)
+	}
+}
+
+// overQUIC reports whether the server listens on UDP: the QUIC-based
+// protocols, and xhttp pinned to HTTP/3. Xray's xhttp dialer only goes over
+// QUIC when the ALPN is exactly "h3"; a list like "h3,h2" dials TCP with h2.
+func overQUIC(p *ProxyParams) bool {
+	switch p.Protocol {
+	case "hysteria2", "tuic":
+		return true
+	}
+	return p.Network == "xhttp" && p.ALPN == "h3"
+}
+
+// quicProbeVersion is a reserved version (RFC 9000 §15, the 0x?a?a?a?a
+// pattern) no server implements, so a live QUIC server answers the probe with a
+// Version Negotiation packet without any handshake taking place.
+const quicProbeVersion = 0x1a2a3a4a
+
+// probeQUIC measures the round trip of a QUIC Version Negotiation exchange.
+// Hysteria2's Salamander obfuscation wraps every datagram, the probe included —
+// without it the server drops the packet as noise.
+func probeQUIC(p *ProxyParams, timeout time.Duration) int {
+	// The server only answers a datagram of full Initial size (RFC 9000 §14.1)
+	packet := make([]byte, 1200)
+	packet[0] = 0xc0 // long header, fixed bit
+	binary.BigEndian.PutUint32(packet[1:5], quicProbeVersion)
+	packet[5] = 8
+	rand.Read(packet[6:14])
+	packet[14] = 8
+	rand.Read(packet[15:23])
+
+	salamander := p.Obfs == "salamander" && p.ObfsPassword != ""
+	if salamander {
+		packet = salamanderObfuscate(packet, p.ObfsPassword)
+	}
+
+	reply, rtt, err := udpExchange(p.Address, p.Port, packet, timeout)
+	if err != nil {
+		return -1
+	}
+
+	if salamander {
+		if reply = salamanderDeobfuscate(reply, p.ObfsPassword); reply == nil {
+			return -1
+		}
+	}
+
+	// Version Negotiation: long header with version 0
+	if len(reply) < 7 || reply[0]&0x80 == 0 || binary.BigEndian.Uint32(reply[1:5]) != 0 {
+		return -1
+	}
+
+	return rtt
+}
+
+// salamanderObfuscate implements Hysteria2's Salamander: an 8-byte random salt,
+// then the payload XORed with BLAKE2b-256(password || salt).
+func salamanderObfuscate(payload []byte, password string) []byte {
+	out := make([]byte, 8+len(payload))
+	rand.Read(out[:8])
+	key := blake2b.Sum256(append([]byte(password), out[:8]...))
+	for i, b := range payload {
+		out[8+i] = b ^ key[i%len(key)]
+	}
+	return out
+}
+
+func salamanderDeobfuscate(packet []byte, password string) []byte {
+	if len(packet) <= 8 {
+		return nil
+	}
+	key := blake2b.Sum256(append([]byte(password), packet[:8]...))
+	out := make([]byte, len(packet)-8)
+	for i, b := range packet[8:] {
+		out[i] = b ^ key[i%len(key)]
+	}
+	return out
+}
+
+// probeWireGuard measures the round trip of a WireGuard handshake. WireGuard
+// is silent towards anything it cannot authenticate, so the only packet that
+// gets an answer is a genuine handshake initiation made with the peer's keys.
+//
+// The probe is not free for a tunnel already using the same keys, such as the
+// router's own WireGuard outbound. An authenticated initiation is a roam to
+// the server: it moves the peer's endpoint to the probe's source address, and
+// the tunnel's return traffic goes there until the tunnel sends again. A busy
+// tunnel barely notices; an idle one loses what the server sends it until its
+// next packet or keepalive.
+func probeWireGuard(p *ProxyParams, timeout time.Duration) int {
+	initiation, err := wireGuardInitiation(p)
+	if err != nil {
+		return -1
+	}
+
+	reply, rtt, err := udpExchange(p.Address, p.Port, initiation, timeout)
+	if err != nil || len(reply) == 0 {
+		return -1
+	}
+
+	// Handshake response, or a cookie reply from a server under load — either
+	// way the peer is up and accepted the keys
+	switch reply[0] {
+	case 2, 3:
+		return rtt
+	}
+	return -1
+}
+
+const (
+	wgConstruction = "Noise_IKpsk2_25519_ChaChaPoly_BLAKE2s"
+	wgIdentifier   = "WireGuard v1 zx2c4 Jason@zx2c4.com"
+	wgLabelMac1    = "mac1----"
+)
+
+// wireGuardInitiation builds the first handshake message (type 1, 148 bytes)
+// as laid out in the WireGuard paper, §5.4.2.
+func wireGuardInitiation(p *ProxyParams) ([]byte, error) {
+	privateKey, err := decodeKey(p.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("приватный ключ: %w", err)
+	}
+	peerKey, err := decodeKey(p.PublicKey)
+	if err != nil {
+		return nil, fmt.Errorf("ключ сервера: %w", err)
+	}
+
+	curve := ecdh.X25519()
+	static, err := curve.NewPrivateKey(privateKey)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := curve.NewPublicKey(peerKey)
+	if err != nil {
+		return nil, err
+	}
+	ephemeral, err := curve.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := make([]byte, 148)
+	msg[0] = 1
+	// Cloudflare WARP routes by the client id carried in the reserved bytes
+	for i := 0; i < len(p.Reserved) && i < 3; i++ {
+		msg[1+i] = byte(p.Reserved[i])
+	}
+	rand.Read(msg[4:8]) // sender index
+
+	chainKey := blake2s.Sum256([]byte(wgConstruction))
+	h := wgHash(chainKey[:], []byte(wgIdentifier))
+	h = wgHash(h[:], peerKey)
+
+	ephemeralPub := ephemeral.PublicKey().Bytes()
+	copy(msg[8:40], ephemeralPub)
+	chainKey = wgKDF1(chainKey[:], ephemeralPub)
+	h = wgHash(h[:], ephemeralPub)
+
+	shared, err := ephemeral.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	var key [32]byte
+	chainKey, key = wgKDF2(chainKey[:], shared)
+	sealed, err := wgSeal(key[:], static.PublicKey().Bytes(), h[:])
+	if err != nil {
+		return nil, err
+	}
+	copy(msg[40:88], sealed)
+	h = wgHash(h[:], sealed)
+
+	shared, err = static.ECDH(peer)
+	if err != nil {
+		return nil, err
+	}
+	_, key = wgKDF2(chainKey[:], shared)
+	sealed, err = wgSeal(key[:], tai64n(time.Now()), h[:])
+	if err != nil {
+		return nil, err
+	}
+	copy(msg[88:116], sealed)
+
+	macKey := wgHash([]byte(wgLabelMac1), peerKey)
+	mac, err := blake2s.New128(macKey[:])
+	if err != nil {
+		return nil, err
+	}
+	mac.Write(msg[:116])
+	copy(msg[116:132], mac.Sum(nil))
+	// mac2 stays zero: it is only required once the server has sent a cookie
+
+	return msg, nil
+}
+
+func wgHash(a, b []byte) [32]byte {
+	return blake2s.Sum256(append(append([]byte{}, a...), b...))
+}
+
+func wgHMAC(key, data []byte) []byte {
+	mac := hmac.New(func() hash.Hash {
+		h, _ := blake2s.New256(nil)
+		return h
+	}, key)
+	mac.Write(data)
+	return mac.Sum(nil)
+}
+
+func wgKDF1(key, input []byte) [32]byte {
+	var out [32]byte
+	copy(out[:], wgHMAC(wgHMAC(key, input), []byte{1}))
+	return out
+}
+
+func wgKDF2(key, input []byte) (first, second [32]byte) {
+	prk := wgHMAC(key, input)
+	t1 := wgHMAC(prk, []byte{1})
+	t2 := wgHMAC(prk, append(append([]byte{}, t1...), 2))
+	copy(first[:], t1)
+	copy(second[:], t2)
+	return first, second
+}
+
+func wgSeal(key, plaintext, ad []byte) ([]byte, error) {
+	aead, err := chacha20poly1305.New(key)
+	if err != nil {
+		return nil, err
+	}
+	var nonce [chacha20poly1305.NonceSize]byte
+	return aead.Seal(nil, nonce[:], plaintext, ad), nil
+}
+
+// tai64n is WireGuard's replay-protection timestamp.
+func tai64n(t time.Time) []byte {
+	out := make([]byte, 12)
+	binary.BigEndian.PutUint64(out[:8], 0x400000000000000a+uint64(t.Unix()))
+	binary.BigEndian.PutUint32(out[8:], uint32(t.Nanosecond()))
+	return out
+}
+
+func decodeKey(text string) ([]byte, error) {
+	key, err := decodeBase64(text)
+	if err != nil {
+		return nil, err
+	}
+	if len(key) != 32 {
+		return nil, fmt.Errorf("длина ключа %d, ожидается 32", len(key))
+	}
+	return key, nil
+}
+
+// udpExchange sends one datagram and waits for one back, returning the round
+// trip in milliseconds.
+func udpExchange(address string, port int, packet []byte, timeout time.Duration) ([]byte, int, error) {
+	conn, err := net.DialTimeout("udp", net.JoinHostPort(address, strconv.Itoa(port)), timeout)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+
+	if err := conn.SetDeadline(time.Now().Add(timeout)); err != nil {
+		return nil, 0, err
+	}
+
+	start := time.Now()
+	if _, err := conn.Write(packet); err != nil {
+		return nil, 0, err
+	}
+
+	buf := make([]byte, 1500)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return buf[:n], int(time.Since(start).Milliseconds()), nil
+}
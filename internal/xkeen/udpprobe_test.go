@@ -0,0 +1,160 @@
+package xkeen
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/chacha20poly1305"
+
+	"xkeen-panel/internal/models"
+)
+
+// udpResponder answers every datagram with whatever reply returns; nil means
+// stay silent, like a server that did not recognise the packet.
+func udpResponder(t *testing.T, reply func([]byte) []byte) (string, int) {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listen: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 2048)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			if out := reply(append([]byte(nil), buf[:n]...)); out != nil {
+				conn.WriteTo(out, addr)
+			}
+		}
+	}()
+
+	a := conn.LocalAddr().(*net.UDPAddr)
+	return a.IP.String(), a.Port
+}
+
+// versionNegotiation answers a QUIC long-header packet the way RFC 9000 §17.2.1
+// says a server must when it does not speak the version.
+func versionNegotiation(packet []byte) []byte {
+	if len(packet) < 1200 || packet[0]&0x80 == 0 {
+		return nil
+	}
+	out := []byte{0x80, 0, 0, 0, 0}
+	out = append(out, packet[14:23]...) // echo the connection ids
+	out = append(out, packet[5:14]...)
+	return binary.BigEndian.AppendUint32(out, 1)
+}
+
+func TestCheckServerLatencyQUIC(t *testing.T) {
+	host, port := udpResponder(t, versionNegotiation)
+	server := models.Server{
+		Protocol: "tuic", Address: host, Port: port,
+		RawURI: fmt.Sprintf("tuic://id:pw@%s:%d", host, port),
+	}
+
+	if got := CheckServerLatency(server, time.Second); got < 0 {
+		t.Errorf("latency = %d, want a live QUIC server", got)
+	}
+}
+
+// With Salamander the server only understands obfuscated datagrams and answers
+// in kind; a plain probe would look like a dead node.
+func TestCheckServerLatencySalamander(t *testing.T) {
+	host, port := udpResponder(t, func(packet []byte) []byte {
+		plain := salamanderDeobfuscate(packet, "salt")
+		if reply := versionNegotiation(plain); reply != nil {
+			return salamanderObfuscate(reply, "salt")
+		}
+		return nil
+	})
+	server := models.Server{
+		Protocol: "hysteria2", Address: host, Port: port,
+		RawURI: fmt.Sprintf("hysteria2://pw@%s:%d/?obfs=salamander&obfs-password=salt", host, port),
+	}
+
+	if got := CheckServerLatency(server, time.Second); got < 0 {
+		t.Errorf("latency = %d, want the obfuscated exchange to succeed", got)
+	}
+}
+
+func TestCheckServerLatencyQUICSilent(t *testing.T) {
+	host, port := udpResponder(t, func([]byte) []byte { return nil })
+	server := models.Server{
+		Protocol: "tuic", Address: host, Port: port,
+		RawURI: fmt.Sprintf("tuic://id:pw@%s:%d", host, port),
+	}
+
+	if got := CheckServerLatency(server, 200*time.Millisecond); got != -1 {
+		t.Errorf("latency = %d, want -1 for a silent port", got)
+	}
+}
+
+// The responder decrypts the initiator's static key out of the handshake, the
+// way a WireGuard server authenticates a peer — a message built with the wrong
+// key schedule would not open and the server would never answer.
+func TestCheckServerLatencyWireGuard(t *testing.T) {
+	curve := ecdh.X25519()
+	serverKey, _ := curve.GenerateKey(rand.Reader)
+	clientKey, _ := curve.GenerateKey(rand.Reader)
+
+	authenticated := make(chan bool, 1)
+	host, port := udpResponder(t, func(msg []byte) []byte {
+		if len(msg) != 148 || msg[0] != 1 {
+			return nil
+		}
+		peerStatic, ok := openInitiatorStatic(serverKey, msg)
+		authenticated <- ok && string(peerStatic) == string(clientKey.PublicKey().Bytes())
+		response := make([]byte, 92)
+		response[0] = 2
+		return response
+	})
+
+	uri := fmt.Sprintf("wireguard://%s@%s:%d?publickey=%s&address=10.0.0.2",
+		url.QueryEscape(base64.StdEncoding.EncodeToString(clientKey.Bytes())), host, port,
+		url.QueryEscape(base64.StdEncoding.EncodeToString(serverKey.PublicKey().Bytes())))
+	server := models.Server{Protocol: "wireguard", Address: host, Port: port, RawURI: uri}
+
+	if got := CheckServerLatency(server, time.Second); got < 0 {
+		t.Errorf("latency = %d, want the handshake response to count", got)
+	}
+	if ok := <-authenticated; !ok {
+		t.Error("the responder could not authenticate the handshake initiation")
+	}
+}
+
+func openInitiatorStatic(serverKey *ecdh.PrivateKey, msg []byte) ([]byte, bool) {
+	serverPub := serverKey.PublicKey().Bytes()
+
+	chainKey := wgHash(nil, []byte(wgConstruction))
+	h := wgHash(chainKey[:], []byte(wgIdentifier))
+	h = wgHash(h[:], serverPub)
+
+	ephemeral := msg[8:40]
+	chainKey = wgKDF1(chainKey[:], ephemeral)
+	h = wgHash(h[:], ephemeral)
+
+	peer, err := ecdh.X25519().NewPublicKey(ephemeral)
+	if err != nil {
+		return nil, false
+	}
+	shared, err := serverKey.ECDH(peer)
+	if err != nil {
+		return nil, false
+	}
+	_, key := wgKDF2(chainKey[:], shared)
+
+	aead, _ := chacha20poly1305.New(key[:])
+	var nonce [chacha20poly1305.NonceSize]byte
+	static, err := aead.Open(nil, nonce[:], msg[40:88], h[:])
+	return static, err == nil
+}
@@ -0,0 +1,142 @@
+package xkeen
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// URI renders the parameters back into a share link, the inverse of
+// ParseProxyURI. Servers that arrive as Clash or sing-box documents get one, so
+// everything downstream — RawURI matching, pool building, pinning — keeps
+// working from links alone.
+func (p *ProxyParams) URI(name string) string {
+	if p.xrayProtocol() == "vmess" {
+		return p.vmessURI(name)
+	}
+
+	u := url.URL{
+		Host:     net.JoinHostPort(p.Address, strconv.Itoa(p.Port)),
+		Fragment: name,
+	}
+	q := url.Values{}
+	set := func(key, value string) {
+		if value != "" {
+			q.Set(key, value)
+		}
+	}
+	flag := func(key string, on bool) {
+		if on {
+			q.Set(key, "1")
+		}
+	}
+
+	switch p.xrayProtocol() {
+	case "shadowsocks":
+		// SIP002 with base64url userinfo: the one form every client reads
+		u.Scheme = "ss"
+		u.User = url.User(base64.RawURLEncoding.EncodeToString([]byte(p.Method + ":" + p.Password)))
+		set("plugin", p.Plugin)
+
+	case "hysteria2":
+		u.Scheme = "hysteria2"
+		u.User = url.User(p.Password)
+		set("sni", p.SNI)
+		set("alpn", p.ALPN)
+		set("obfs", p.Obfs)
+		set("obfs-password", p.ObfsPassword)
+		flag("insecure", p.Insecure)
+
+	case "tuic":
+		u.Scheme = "tuic"
+		u.User = url.UserPassword(p.UUID, p.Password)
+		set("sni", p.SNI)
+		set("alpn", p.ALPN)
+		set("congestion_control", p.CongestionControl)
+		set("udp_relay_mode", p.UDPRelayMode)
+		flag("allow_insecure", p.Insecure)
+
+	case "wireguard":
+		u.Scheme = "wireguard"
+		u.User = url.User(p.PrivateKey)
+		set("publickey", p.PublicKey)
+		set("presharedkey", p.PresharedKey)
+		set("address", strings.Join(p.LocalAddress, ","))
+		if len(p.Reserved) > 0 {
+			parts := make([]string, len(p.Reserved))
+			for i, r := range p.Reserved {
+				parts[i] = strconv.Itoa(r)
+			}
+			q.Set("reserved", strings.Join(parts, ","))
+		}
+		if p.MTU > 0 {
+			q.Set("mtu", strconv.Itoa(p.MTU))
+		}
+
+	default: // vless, trojan
+		u.Scheme = p.xrayProtocol()
+		if u.Scheme == "trojan" {
+			u.User = url.User(p.Password)
+		} else {
+			u.User = url.User(p.UUID)
+			set("encryption", p.Encryption)
+			set("flow", p.Flow)
+		}
+		set("type", p.Network)
+		set("security", p.Security)
+		set("sni", p.SNI)
+		set("fp", p.Fingerprint)
+		set("pbk", p.PublicKey)
+		set("sid", p.ShortID)
+		set("spx", p.SpiderX)
+		set("host", p.Host)
+		set("mode", p.Mode)
+		set("alpn", p.ALPN)
+		set("extra", p.Extra)
+		set("headerType", p.HeaderType)
+		if p.Network == "grpc" {
+			set("serviceName", p.Path)
+		} else {
+			set("path", p.Path)
+		}
+		flag("allowInsecure", p.Insecure)
+	}
+
+	u.RawQuery = q.Encode()
+	return u.String()
+}
+
+// vmessURI renders the v2rayN base64 JSON form, the only VMess link there is.
+func (p *ProxyParams) vmessURI(name string) string {
+	security := p.Security
+	if security == "none" {
+		security = ""
+	}
+
+	doc := map[string]string{
+		"v":    "2",
+		"ps":   name,
+		"add":  p.Address,
+		"port": strconv.Itoa(p.Port),
+		"id":   p.UUID,
+		"aid":  strconv.Itoa(p.AlterID),
+		"scy":  p.Cipher,
+		"net":  p.Network,
+		"type": p.HeaderType,
+		"host": p.Host,
+		"path": p.Path,
+		"tls":  security,
+		"sni":  p.SNI,
+		"alpn": p.ALPN,
+		"fp":   p.Fingerprint,
+	}
+	if p.Insecure {
+		doc["allowInsecure"] = "1"
+	}
+
+	data, _ := json.Marshal(doc)
+	return "vmess://" + base64.StdEncoding.EncodeToString(data)
+}
@@ -0,0 +1,153 @@
+package xkeen
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+// Defaults for the usage warnings, used when config.yaml leaves them at zero.
+const (
+	DefaultQuotaWarnPercent = 90
+	DefaultExpiryWarnDays   = 3
+)
+
+// parseUsage reads the account headers panel-style providers (Marzban,
+// 3x-ui, Remnawave…) attach to a subscription:
+//
+//	subscription-userinfo: upload=1; download=2; total=3; expire=1700000000
+//	profile-update-interval: 12
+//	profile-title: base64:0JzQvtC5
+//
+// nil means the provider sent none of them.
+func parseUsage(h http.Header) *models.SubscriptionUsage {
+	info := h.Get("Subscription-Userinfo")
+	interval := strings.TrimSpace(h.Get("Profile-Update-Interval"))
+	title := strings.TrimSpace(h.Get("Profile-Title"))
+	if info == "" && interval == "" && title == "" {
+		return nil
+	}
+
+	usage := &models.SubscriptionUsage{Title: decodeTitle(title)}
+
+	for _, field := range strings.Split(info, ";") {
+		key, value, ok := strings.Cut(strings.TrimSpace(field), "=")
+		if !ok {
+			continue
+		}
+		// Some panels send floats ("total=1.073741824e+11")
+		n, err := strconv.ParseFloat(strings.TrimSpace(value), 64)
+		if err != nil || n < 0 {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(key)) {
+		case "upload":
+			usage.Upload = int64(n)
+		case "download":
+			usage.Download = int64(n)
+		case "total":
+			usage.Total = int64(n)
+		case "expire":
+			if n > 0 {
+				usage.Expire = time.Unix(int64(n), 0).UTC()
+			}
+		}
+	}
+
+	// The interval is in hours
+	if hours, err := strconv.ParseFloat(interval, 64); err == nil && hours > 0 {
+		usage.UpdateInterval = int(hours * 3600)
+	}
+
+	return usage
+}
+
+// decodeTitle unwraps the "base64:" form providers use to fit non-ASCII names
+// into a header.
+func decodeTitle(title string) string {
+	encoded, ok := strings.CutPrefix(title, "base64:")
+	if !ok {
+		return title
+	}
+	decoded, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return title
+	}
+	return string(decoded)
+}
+
+// UsageWarnings says what about a subscription's account needs the owner's
+// attention: traffic nearly used up, or the subscription about to expire.
+// Zero thresholds take the defaults.
+func UsageWarnings(usage *models.SubscriptionUsage, quotaPercent, expiryDays int, now time.Time) []string {
+	if usage == nil {
+		return nil
+	}
+	if quotaPercent <= 0 {
+		quotaPercent = DefaultQuotaWarnPercent
+	}
+	if expiryDays <= 0 {
+		expiryDays = DefaultExpiryWarnDays
+	}
+
+	var warnings []string
+
+	if usage.Total > 0 {
+		used := usage.Upload + usage.Download
+		switch percent := used * 100 / usage.Total; {
+		case used >= usage.Total:
+			warnings = append(warnings, "трафик исчерпан")
+		case percent >= int64(quotaPercent):
+			warnings = append(warnings, fmt.Sprintf("израсходовано %d%% трафика, осталось %s", percent, formatBytes(usage.Total-used)))
+		}
+	}
+
+	if !usage.Expire.IsZero() {
+		left := usage.Expire.Sub(now)
+		switch {
+		case left <= 0:
+			warnings = append(warnings, "срок подписки истёк")
+		case left <= time.Duration(expiryDays)*24*time.Hour:
+			warnings = append(warnings, fmt.Sprintf("подписка истекает %s", usage.Expire.Local().Format("02.01.2006 15:04")))
+		}
+	}
+
+	return warnings
+}
+
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d Б", n)
+	}
+	value := float64(n)
+	for _, suffix := range []string{"КБ", "МБ", "ГБ"} {
+		value /= unit
+		if value < unit {
+			return fmt.Sprintf("%.1f %s", value, suffix)
+		}
+	}
+	return fmt.Sprintf("%.1f ТБ", value/unit)
+}
+
+// UsageStatus lists the account state of every enabled subscription whose
+// provider reports one.
+func (sm *SubscriptionManager) UsageStatus(quotaPercent, expiryDays int, now time.Time) []models.SubscriptionStatus {
+	var out []models.SubscriptionStatus
+	for _, sub := range sm.Subscriptions() {
+		if !sub.Enabled || sub.Usage == nil {
+			continue
+		}
+		out = append(out, models.SubscriptionStatus{
+			Name:     sub.Name,
+			Usage:    *sub.Usage,
+			Warnings: UsageWarnings(sub.Usage, quotaPercent, expiryDays, now),
+		})
+	}
+	return out
+}
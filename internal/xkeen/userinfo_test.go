@@ -0,0 +1,53 @@
+package xkeen
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"xkeen-panel/internal/models"
+)
+
+func TestParseUsage(t *testing.T) {
+	if parseUsage(http.Header{}) != nil {
+		t.Error("no headers must give no usage")
+	}
+
+	h := http.Header{}
+	h.Set("Subscription-Userinfo", "upload=1; download=2.5e+3;total=0; expire=0; junk")
+	usage := parseUsage(h)
+	if usage == nil || usage.Upload != 1 || usage.Download != 2500 || usage.Total != 0 || !usage.Expire.IsZero() {
+		t.Errorf("usage = %+v", usage)
+	}
+}
+
+func TestUsageWarnings(t *testing.T) {
+	now := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name  string
+		usage models.SubscriptionUsage
+		want  []string
+	}{
+		{"unlimited", models.SubscriptionUsage{Download: 1 << 40}, nil},
+		{"plenty left", models.SubscriptionUsage{Download: 50, Total: 100, Expire: now.Add(30 * 24 * time.Hour)}, nil},
+		{"quota", models.SubscriptionUsage{Upload: 10, Download: 85, Total: 100}, []string{"израсходовано 95%"}},
+		{"exhausted", models.SubscriptionUsage{Download: 120, Total: 100}, []string{"трафик исчерпан"}},
+		{"expiring", models.SubscriptionUsage{Expire: now.Add(24 * time.Hour)}, []string{"подписка истекает"}},
+		{"expired", models.SubscriptionUsage{Expire: now.Add(-time.Hour)}, []string{"срок подписки истёк"}},
+	}
+
+	for _, c := range cases {
+		got := UsageWarnings(&c.usage, 0, 0, now)
+		if len(got) != len(c.want) {
+			t.Errorf("%s: warnings = %v, want %v", c.name, got, c.want)
+			continue
+		}
+		for i := range got {
+			if !strings.Contains(got[i], c.want[i]) {
+				t.Errorf("%s: warning %q, want %q", c.name, got[i], c.want[i])
+			}
+		}
+	}
+}
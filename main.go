@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"io/fs"
@@ -9,6 +10,7 @@ import (
 	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 	"xkeen-panel/internal/auth"
@@ -40,6 +42,26 @@ func main() {
 
 	// Subscription manager
 	subManager := xkeen.NewSubscriptionManager(cfg.DataDir)
+	subManager.SetHistorySize(cfg.SubscriptionHistory)
+	subManager.SetRefreshGuard(cfg.SubscriptionMaxRemovedPercent, cfg.SubscriptionMinServers)
+	if err := xkeen.ValidateStrategy(cfg.PoolStrategy); err != nil {
+		log.Printf("Предупреждение: pool_strategy: %v — пул остаётся на leastPing", err)
+		cfg.PoolStrategy = ""
+	}
+	if err := xkeen.ValidatePinPolicy(cfg.PoolPin); err != nil {
+		log.Printf("Предупреждение: pool_pin: %v — закрепление без плановой смены", err)
+		cfg.PoolPin.RotateAt = ""
+	}
+	if _, err := xkeen.NamedPoolsFromConfig(cfg); err != nil {
+		log.Printf("Предупреждение: %v — именованные пулы не обновляются", err)
+	}
+	if err := subManager.SetDuplicatePolicy(cfg.DuplicateMode, cfg.DuplicateRules); err != nil {
+		log.Printf("Предупреждение: %v — дубликаты не скрываются", err)
+	}
+	subManager.LatencyHistory().SetRetention(cfg.LatencyHistorySize,
+		time.Duration(cfg.LatencyHistoryDays)*24*time.Hour,
+		time.Duration(cfg.LatencyHistoryFlushMinutes)*time.Minute)
+	subManager.LatencyHistory().SetProbeKind(cfg.LatencyProbe)
 	if err := subManager.Load(); err != nil {
 		log.Printf("Предупреждение: ошибка загрузки подписки: %v", err)
 	}
@@ -63,7 +85,7 @@ func main() {
 
 	// An install from before the api block was fixed cannot pin a pool node until
 	// the file is migrated, and a pool in sync never reaches the refresh path
-	if migrated, err := xkeen.EnsureAPIConfig(poolStore.Get(), cfg.XrayAPIAddr); err != nil {
+	if migrated, err := xkeen.EnsureAPIConfig(rt, poolStore.Get(), cfg.XrayAPIAddr, cfg.XrayMetricsAddr); err != nil {
 		log.Printf("Не удалось обновить api-блок Xray: %v", err)
 	} else if migrated {
 		log.Printf("api-блок Xray приведён к текущей форме — перезапускаю ядро")
@@ -110,6 +132,19 @@ func main() {
 		})
 	}
 
+	// A refresh held back by the guard waits for the owner: tell the UI
+	xkeen.OnQuarantine = func(name string, q models.Quarantine) {
+		eventBus.Publish(sse.Event{
+			Type: "subscription_quarantine",
+			Data: map[string]interface{}{
+				"name":         name,
+				"reason":       q.Reason,
+				"server_count": len(q.Servers),
+				"time":         q.Time,
+			},
+		})
+	}
+
 	// Context for graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -117,10 +152,20 @@ func main() {
 	// Run the watchdog
 	go watchdog.Start(ctx)
 
-	// Periodic subscription refresh
-	if cfg.SubscriptionRefreshInterval > 0 {
-		go runSubscriptionRefresh(ctx, cfg, subManager, watchdog, detector, poolStore, geoMatcher, eventBus)
-	}
+	// Background latency sweeps
+	sweeper := monitor.NewSweeper(cfg, subManager, detector)
+	sweeper.SetEventBus(eventBus)
+	sweeper.SetLogger(watchdog.Log)
+	go sweeper.Start(ctx)
+
+	// The core's own view of the pool nodes, pushed when it changes
+	observatoryWatcher := monitor.NewObservatoryWatcher(cfg, subManager, detector)
+	observatoryWatcher.SetEventBus(eventBus)
+	go observatoryWatcher.Start(ctx)
+
+	// Periodic subscription refresh. Runs even with the global interval off: a
+	// subscription may carry an interval of its own.
+	go runSubscriptionRefresh(ctx, cfg, subManager, watchdog, detector, poolStore, geoMatcher, eventBus)
 
 	// Frontend assets
 	var frontendFS fs.FS
@@ -142,7 +187,11 @@ func main() {
 	sigChan := make(chan os.Signal, 1)
 	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
 
+	// main waits for the goroutine: Shutdown makes ListenAndServe return at
+	// once, and exiting then would cut the history flush short
+	stopped := make(chan struct{})
 	go func() {
+		defer close(stopped)
 		<-sigChan
 		log.Println("Получен сигнал завершения, останавливаем сервер...")
 		cancel()
@@ -153,22 +202,32 @@ func main() {
 		if err := httpServer.Shutdown(shutdownCtx); err != nil {
 			log.Printf("Ошибка при остановке сервера: %v", err)
 		}
+		if err := subManager.LatencyHistory().Flush(); err != nil {
+			log.Printf("История задержек не сохранена: %v", err)
+		}
 	}()
 
 	log.Printf("XKeen Panel v2 запущена на порту %d (xkeen=%s, outbounds=%s)", cfg.Port, cfg.XKeenPath, cfg.OutboundsFile)
 	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatalf("Ошибка сервера: %v", err)
 	}
+	<-stopped
 
 	log.Println("Сервер остановлен")
 }
 
-// runSubscriptionRefresh refreshes the subscription on a timer. The core is
-// restarted only when the active server was actually replaced (it vanished from
-// the subscription) — a refresh must not drop a working connection.
+// subscriptionTick is how often the refresh loop looks for a subscription whose
+// interval has passed. Intervals are per subscription, so the loop cannot just
+// sleep for one of them.
+const subscriptionTick = time.Minute
+
+// runSubscriptionRefresh refreshes the subscriptions on a timer, each on its
+// own interval. The core is restarted only when the active server was actually
+// replaced (it vanished from the catalogue) — a refresh must not drop a working
+// connection.
 func runSubscriptionRefresh(ctx context.Context, cfg *models.Config, sm *xkeen.SubscriptionManager, wd *monitor.Watchdog, det *xkeen.Detector, pool *xkeen.PoolStore, matcher *geoip.Matcher, bus *sse.EventBus) {
-	interval := time.Duration(cfg.SubscriptionRefreshInterval) * time.Second
-	ticker := time.NewTicker(interval)
+	fallback := time.Duration(cfg.SubscriptionRefreshInterval) * time.Second
+	ticker := time.NewTicker(subscriptionTick)
 	defer ticker.Stop()
 
 	for {
@@ -176,24 +235,49 @@ func runSubscriptionRefresh(ctx context.Context, cfg *models.Config, sm *xkeen.S
 		case <-ctx.Done():
 			return
 		case <-ticker.C:
+			due := sm.DueSubscriptions(fallback, cfg.SubscriptionProviderInterval, time.Now())
+			if len(due) == 0 {
+				continue
+			}
+
 			prevURI := ""
 			if a := sm.GetActiveServer(); a != nil {
 				prevURI = a.RawURI
 			}
 
-			var err error
-			for attempt := 0; attempt < 2; attempt++ {
-				if _, err = sm.Refresh(); err == nil {
-					break
+			refreshed := 0
+			for _, name := range due {
+				var changed bool
+				var err error
+				for attempt := 0; attempt < 2; attempt++ {
+					if changed, err = sm.RefreshIfChanged(name); err == nil {
+						break
+					}
+					// Held for approval: asking again gets the same list
+					var quarantined *xkeen.QuarantineError
+					if errors.As(err, &quarantined) {
+						break
+					}
+					select {
+					case <-ctx.Done():
+						return
+					case <-time.After(30 * time.Second):
+					}
 				}
-				select {
-				case <-ctx.Done():
-					return
-				case <-time.After(30 * time.Second):
+				// An exhausted quota often comes as an empty subscription, so
+				// the warning matters most when the refresh failed
+				logUsageWarnings(cfg, sm, wd, name)
+				if err != nil {
+					wd.Log("[AUTO-UPDATE] Подписка %s не обновилась: %v", name, err)
+					continue
+				}
+				// 304 from the provider: the same servers, nothing to sync
+				if changed {
+					refreshed++
 				}
 			}
-			if err != nil {
-				wd.Log("[AUTO-UPDATE] Подписка не обновилась: %v", err)
+			bus.Publish(sse.Event{Type: "status", Data: wd.GetStatus()})
+			if refreshed == 0 {
 				continue
 			}
 
@@ -205,6 +289,16 @@ func runSubscriptionRefresh(ctx context.Context, cfg *models.Config, sm *xkeen.S
 
 			rt := det.Runtime()
 
+			// New servers get their exit found before the pool and the geo
+			// filter judge them
+			if cfg.ExitDiscovery {
+				if found, err := sm.DiscoverMissingExits(xkeen.ExitDiscoveryFromConfig(cfg, rt, matcher)); err != nil {
+					wd.Log("[AUTO-UPDATE] Выход новых серверов не определён: %v", err)
+				} else if found > 0 {
+					wd.Log("[AUTO-UPDATE] Определён выход %d сервер(ов)", found)
+				}
+			}
+
 			// A pool is generated from subscription URIs, so a rotated server
 			// leaves it pointing at an endpoint that no longer answers. Sync on
 			// every refresh, not only when the active server changed.
@@ -216,7 +310,7 @@ func runSubscriptionRefresh(ctx context.Context, cfg *models.Config, sm *xkeen.S
 				}
 
 				res, err := xkeen.RefreshPool(rt, cfg.OutboundsFile, cfg.XrayAPIAddr, sm.GetServers(), state,
-					xkeen.PoolSelectionFromConfig(cfg, matcher))
+					xkeen.PoolSelectionFromConfig(cfg, matcher, sm))
 				switch {
 				case err != nil:
 					wd.Log("[AUTO-UPDATE] Пул не синхронизирован: %v", err)
@@ -224,6 +318,17 @@ func runSubscriptionRefresh(ctx context.Context, cfg *models.Config, sm *xkeen.S
 					det.InvalidateTopology()
 					wd.Log("[AUTO-UPDATE] Пул обновлён: +%d, -%d, заменено %d%s", len(res.Added), len(res.Removed), len(res.Replaced), liveSuffix(res))
 				}
+
+				for _, sync := range xkeen.RefreshNamedPools(rt, cfg, matcher, sm, pool) {
+					switch {
+					case sync.Error != "":
+						wd.Log("[AUTO-UPDATE] Пул %s не синхронизирован: %s", sync.Pool, sync.Error)
+					case sync.Result.Changed:
+						det.InvalidateTopology()
+						wd.Log("[AUTO-UPDATE] Пул %s обновлён: +%d, -%d, заменено %d%s", sync.Pool,
+							len(sync.Result.Added), len(sync.Result.Removed), len(sync.Result.Replaced), liveSuffix(sync.Result))
+					}
+				}
 			} else if active != nil && newURI != prevURI {
 				// Single-outbound mode: the active server left the subscription.
 				// Do not blindly restart onto servers[0] — it may sit in an
@@ -239,7 +344,20 @@ func runSubscriptionRefresh(ctx context.Context, cfg *models.Config, sm *xkeen.S
 			}
 
 			bus.Publish(sse.Event{Type: "subscription", Data: map[string]bool{"updated": true}})
-			wd.Log("[AUTO-UPDATE] Подписка обновлена (%d серверов)", len(sm.GetServers()))
+			wd.Log("[AUTO-UPDATE] Подписки обновлены: %s (%d серверов)", strings.Join(due, ", "), len(sm.GetServers()))
+		}
+	}
+}
+
+// logUsageWarnings puts a subscription's quota and expiry warnings in the panel
+// log, where they reach the UI over SSE.
+func logUsageWarnings(cfg *models.Config, sm *xkeen.SubscriptionManager, wd *monitor.Watchdog, name string) {
+	for _, st := range sm.UsageStatus(cfg.SubscriptionQuotaWarnPercent, cfg.SubscriptionExpiryWarnDays, time.Now()) {
+		if st.Name != name {
+			continue
+		}
+		for _, warning := range st.Warnings {
+			wd.Log("[SUBSCRIPTION] %s: %s", name, warning)
 		}
 	}
 }
@@ -280,7 +398,31 @@ func loadConfig(path string) (*models.Config, error) {
 		BlacklistTTLSec:    300,
 		WatchdogAutoStart:  true,
 
-		SubscriptionRefreshInterval: 1800,
+		LatencyProbe:          xkeen.ProbeModeTCP,
+		LatencyProbeURL:       "https://www.gstatic.com/generate_204",
+		LatencyProbeTimeoutMs: 5000,
+
+		LatencySweepMaxLoad: 1.0,
+
+		LatencyHistorySize:         xkeen.DefaultLatencyHistorySize,
+		LatencyHistoryDays:         7,
+		LatencyHistoryFlushMinutes: 15,
+
+		SpeedTestURL:        xkeen.DefaultSpeedTestURL,
+		SpeedTestMaxMB:      25,
+		SpeedTestMaxSeconds: 15,
+
+		UDPCheckDNS: xkeen.DefaultUDPCheckDNS,
+
+		DuplicateMode: xkeen.DuplicatesKeep,
+
+		ExitTraceURL: xkeen.DefaultExitTraceURL,
+
+		SubscriptionRefreshInterval:   1800,
+		SubscriptionQuotaWarnPercent:  xkeen.DefaultQuotaWarnPercent,
+		SubscriptionExpiryWarnDays:    xkeen.DefaultExpiryWarnDays,
+		SubscriptionHistory:           xkeen.DefaultHistorySize,
+		SubscriptionMaxRemovedPercent: xkeen.DefaultMaxRemovedPercent,
 
 		PoolMaxNodes:             xkeen.DefaultPoolMaxNodes,
 		HealthCheckURLs:          monitor.DefaultHealthURLs,